@@ -0,0 +1,103 @@
+package imagesync
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// adaptiveDecreaseInterval is the minimum time between two decreases, the
+// copies in flight when a registry starts throttling fail together and
+// halve the limit only once.
+const adaptiveDecreaseInterval = 10 * time.Second
+
+// adaptiveLimit bounds the tags copied at once with an AIMD controller for
+// --adaptive-concurrency: it starts at the configured parallelism, halves
+// the limit when a copy is throttled with 429 or 503 and raises it by one
+// after a limit's worth of copies without throttling. A nil adaptiveLimit
+// doesn't limit anything.
+type adaptiveLimit struct {
+	max int
+
+	mu        sync.Mutex
+	limit     int
+	inFlight  int
+	successes int
+	decreased time.Time
+	// changed is closed and replaced whenever a slot may have become free.
+	changed chan struct{}
+}
+
+func newAdaptiveLimit(enabled bool, max int) *adaptiveLimit {
+	if !enabled {
+		return nil
+	}
+	return &adaptiveLimit{max: max, limit: max, changed: make(chan struct{})}
+}
+
+// acquire waits until fewer tags than the limit are copied, the returned
+// function releases the slot.
+func (a *adaptiveLimit) acquire(ctx context.Context) (func(), error) {
+	if a == nil {
+		return func() {}, nil
+	}
+	for {
+		a.mu.Lock()
+		if a.inFlight < a.limit {
+			a.inFlight++
+			a.mu.Unlock()
+			var once sync.Once
+			return func() {
+				once.Do(func() {
+					a.mu.Lock()
+					a.inFlight--
+					a.notify()
+					a.mu.Unlock()
+				})
+			}, nil
+		}
+		changed := a.changed
+		a.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// observe adjusts the limit with the outcome of a copy attempt.
+func (a *adaptiveLimit) observe(err error) {
+	if a == nil || (err != nil && !isThrottled(err)) {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err != nil {
+		a.successes = 0
+		if a.limit == 1 || time.Since(a.decreased) < adaptiveDecreaseInterval {
+			return
+		}
+		a.limit = max(a.limit/2, 1)
+		a.decreased = time.Now()
+		logrus.Infof("Lowering the concurrency to %d tags, registry is throttling: %s", a.limit, err)
+		return
+	}
+	if a.limit == a.max {
+		return
+	}
+	if a.successes++; a.successes >= a.limit {
+		a.successes = 0
+		a.limit++
+		logrus.Infof("Raising the concurrency to %d tags", a.limit)
+		a.notify()
+	}
+}
+
+// notify wakes up the copies waiting for a slot, a.mu has to be held.
+func (a *adaptiveLimit) notify() {
+	close(a.changed)
+	a.changed = make(chan struct{})
+}
@@ -0,0 +1,202 @@
+package imagesync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/image"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/samber/lo"
+	"github.com/sirupsen/logrus"
+)
+
+// ageFilter selects tags by the creation time of their image, the zero value
+// selects all tags.
+type ageFilter struct {
+	MinAge    time.Duration
+	MaxAge    time.Duration
+	NewerThan time.Time
+}
+
+func parseAgeFilter(minAge, maxAge, newerThan string) (ageFilter, error) {
+	var (
+		f   ageFilter
+		err error
+	)
+	if f.MinAge, err = parseAge("min-age", minAge); err != nil {
+		return ageFilter{}, err
+	}
+	if f.MaxAge, err = parseAge("max-age", maxAge); err != nil {
+		return ageFilter{}, err
+	}
+	if f.NewerThan, err = parseDate("newer-than", newerThan); err != nil {
+		return ageFilter{}, err
+	}
+	return f, nil
+}
+
+// parseAge parses a duration like 12h or a number of days like 90d.
+func parseAge(name, value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err == nil && n >= 0 {
+			return time.Duration(n) * 24 * time.Hour, nil
+		}
+	} else if d, err := time.ParseDuration(value); err == nil && d >= 0 {
+		return d, nil
+	}
+	return 0, fmt.Errorf("invalid %s %q, expected a duration like 12h or 90d", name, value)
+}
+
+// parseDate parses a date like 2024-01-01 or an RFC 3339 time.
+func parseDate(name, value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.DateOnly, value); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid %s %q, expected a date like 2024-01-01", name, value)
+}
+
+func (f ageFilter) enabled() bool {
+	return f.MinAge > 0 || f.MaxAge > 0 || !f.NewerThan.IsZero()
+}
+
+func (f ageFilter) matches(created, now time.Time) bool {
+	age := now.Sub(created)
+	if f.MinAge > 0 && age < f.MinAge {
+		return false
+	}
+	if f.MaxAge > 0 && age > f.MaxAge {
+		return false
+	}
+	return f.NewerThan.IsZero() || created.After(f.NewerThan)
+}
+
+// filterAge returns the tags whose image was created within the age limits.
+// Tags whose creation time can't be read aren't copied.
+func (r *syncRun) filterAge(ctx context.Context, srcRepository types.ImageReference, tags []string) []string {
+	now := time.Now()
+	selected := r.selectConcurrently(tags, func(tag string) bool {
+		created, err := r.imageCreated(ctx, srcRepository, tag)
+		if err != nil {
+			logrus.Warnf("skipping tag %s, failed reading its creation time: %s", tag, err)
+			return false
+		}
+		if !r.job.Age.matches(created, now) {
+			logrus.Debugf("skipping tag %s created at %s", tag, created.Format(time.RFC3339))
+			return false
+		}
+		return true
+	})
+	logrus.Infof("%d of %d tags were created within the age limits", len(selected), len(tags))
+	return selected
+}
+
+// selectConcurrently returns the tags for which keep returns true, in their
+// order. keep runs for MaxConcurrentTags tags at a time.
+func (r *syncRun) selectConcurrently(tags []string, keep func(tag string) bool) []string {
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		kept = map[string]bool{}
+	)
+	ch := make(chan string)
+	for i := 0; i < max(min(r.job.MaxConcurrentTags, len(tags)), 1); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for tag := range ch {
+				if !keep(tag) {
+					continue
+				}
+				mu.Lock()
+				kept[tag] = true
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, tag := range tags {
+		ch <- tag
+	}
+	close(ch)
+	wg.Wait()
+
+	return lo.Filter(tags, func(tag string, _ int) bool { return kept[tag] })
+}
+
+// imageCreated returns the org.opencontainers.image.created annotation of a
+// tag, or the creation time of its image config. The first instance of a
+// manifest list, after --platforms, stands for the list.
+func (r *syncRun) imageCreated(ctx context.Context, srcRepository types.ImageReference, tag string) (time.Time, error) {
+	srcRef, err := docker.ParseReference(fmt.Sprintf("//%s:%s", srcRepository.DockerReference().Name(), tag))
+	if err != nil {
+		return time.Time{}, err
+	}
+	src, err := r.job.Platforms.wrap(srcRef).NewImageSource(ctx, r.opts.SourceCtx)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer src.Close()
+
+	data, mimeType, err := src.GetManifest(ctx, nil)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if created, ok := createdAnnotation(data, mimeType); ok {
+		return created, nil
+	}
+	var instance *digest.Digest
+	if manifest.MIMETypeIsMultiImage(mimeType) {
+		list, err := manifest.ListFromBlob(data, mimeType)
+		if err != nil {
+			return time.Time{}, err
+		}
+		instances := list.Instances()
+		if len(instances) == 0 {
+			return time.Time{}, errors.New("the manifest list is empty")
+		}
+		instance = &instances[0]
+	}
+
+	img, err := image.FromUnparsedImage(ctx, r.opts.SourceCtx, image.UnparsedInstance(src, instance))
+	if err != nil {
+		return time.Time{}, err
+	}
+	if data, mimeType, err = img.Manifest(ctx); err == nil {
+		if created, ok := createdAnnotation(data, mimeType); ok {
+			return created, nil
+		}
+	}
+	info, err := img.Inspect(ctx)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if info.Created == nil || info.Created.IsZero() {
+		return time.Time{}, errors.New("the image has no creation time")
+	}
+	return *info.Created, nil
+}
+
+// createdAnnotation returns the creation time annotation of an OCI manifest
+// or index.
+func createdAnnotation(data []byte, mimeType string) (time.Time, bool) {
+	created, err := time.Parse(time.RFC3339, manifestAnnotations(data, mimeType)[imgspecv1.AnnotationCreated])
+	return created, err == nil
+}
@@ -0,0 +1,161 @@
+package imagesync
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
+)
+
+// annotator adds the annotations of --add-annotation to the top-level
+// manifests of the copied images, a nil annotator copies them unchanged.
+type annotator struct {
+	// annotations are the values by key, with the ${source}, ${digest} and
+	// ${date} placeholders expanded per image.
+	annotations map[string]string
+}
+
+func newAnnotator(opts Options) (*annotator, error) {
+	if len(opts.AddAnnotations) == 0 {
+		return nil, nil
+	}
+	if opts.PreserveDigests {
+		return nil, errors.New("--add-annotation can't be used with --preserve-digests")
+	}
+	a := &annotator{annotations: map[string]string{}}
+	for _, v := range opts.AddAnnotations {
+		key, value, ok := strings.Cut(v, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid --add-annotation %q, expected key=value", v)
+		}
+		a.annotations[key] = value
+	}
+	return a, nil
+}
+
+// wrap returns ref with the annotations added to its top-level manifest if
+// it is an OCI manifest or index. source names the image for ${source},
+// sourceDigest returns the digest for ${digest} once the manifest was read.
+func (a *annotator) wrap(ref types.ImageReference, source string, sourceDigest func() digest.Digest) types.ImageReference {
+	if a == nil {
+		return ref
+	}
+	return &annotatedReference{ImageReference: ref, annotator: a, source: source, sourceDigest: sourceDigest}
+}
+
+// expand returns the annotations for an image.
+func (a *annotator) expand(source string, sourceDigest digest.Digest, now time.Time) map[string]string {
+	values := map[string]string{
+		"source": source,
+		"digest": sourceDigest.String(),
+		"date":   now.UTC().Format(time.RFC3339),
+	}
+	annotations := make(map[string]string, len(a.annotations))
+	for key, value := range a.annotations {
+		annotations[key] = os.Expand(value, func(name string) string { return values[name] })
+	}
+	return annotations
+}
+
+type annotatedReference struct {
+	types.ImageReference
+	annotator    *annotator
+	source       string
+	sourceDigest func() digest.Digest
+}
+
+func (r *annotatedReference) NewImageSource(ctx context.Context, sys *types.SystemContext) (types.ImageSource, error) {
+	src, err := r.ImageReference.NewImageSource(ctx, sys)
+	if err != nil {
+		return nil, err
+	}
+	return &annotatedSource{ImageSource: src, ref: r}, nil
+}
+
+type annotatedSource struct {
+	types.ImageSource
+	ref *annotatedReference
+
+	// the date of an image stays the same when the copy reads its manifest
+	// again, and a Docker manifest is warned about once
+	once sync.Once
+	now  time.Time
+}
+
+func (s *annotatedSource) Reference() types.ImageReference {
+	return s.ref
+}
+
+func (s *annotatedSource) GetManifest(ctx context.Context, instanceDigest *digest.Digest) ([]byte, string, error) {
+	manifestBlob, mimeType, err := s.ImageSource.GetManifest(ctx, instanceDigest)
+	if err != nil || instanceDigest != nil {
+		return manifestBlob, mimeType, err
+	}
+	s.once.Do(func() {
+		s.now = time.Now()
+		if !annotatable(mimeType) {
+			logrus.Warnf("not annotating %s, its %s manifest has no annotations", refName(s.ref), mimeType)
+		}
+	})
+	if !annotatable(mimeType) {
+		return manifestBlob, mimeType, nil
+	}
+	annotated, err := addAnnotations(manifestBlob, s.ref.annotator.expand(s.ref.source, s.ref.sourceDigest(), s.now))
+	if err != nil {
+		return nil, "", fmt.Errorf("annotating %s: %w", refName(s.ref), err)
+	}
+	return annotated, mimeType, nil
+}
+
+// GetSignatures drops the signatures of an annotated manifest, they don't
+// match it anymore.
+func (s *annotatedSource) GetSignatures(ctx context.Context, instanceDigest *digest.Digest) ([][]byte, error) {
+	if instanceDigest == nil {
+		_, mimeType, err := s.ImageSource.GetManifest(ctx, nil)
+		if err != nil {
+			return nil, err
+		}
+		if annotatable(mimeType) {
+			return nil, nil
+		}
+	}
+	return s.ImageSource.GetSignatures(ctx, instanceDigest)
+}
+
+// annotatable reports whether manifests of mimeType have annotations, only
+// OCI manifests and indexes do.
+func annotatable(mimeType string) bool {
+	return mimeType == imgspecv1.MediaTypeImageManifest || mimeType == imgspecv1.MediaTypeImageIndex
+}
+
+// addAnnotations sets annotations in an OCI manifest or index, all other
+// fields are kept.
+func addAnnotations(manifestBlob []byte, annotations map[string]string) ([]byte, error) {
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(manifestBlob, &doc); err != nil {
+		return nil, fmt.Errorf("parsing manifest: %w", err)
+	}
+	merged := map[string]string{}
+	if raw, ok := doc["annotations"]; ok {
+		if err := json.Unmarshal(raw, &merged); err != nil {
+			return nil, fmt.Errorf("parsing manifest annotations: %w", err)
+		}
+	}
+	maps.Copy(merged, annotations)
+	raw, err := json.Marshal(merged)
+	if err != nil {
+		return nil, err
+	}
+	doc["annotations"] = raw
+	return json.Marshal(doc)
+}
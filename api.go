@@ -0,0 +1,231 @@
+package imagesync
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// syncRequest is the body of POST /syncs. Its keys are named like the
+// command line flags, unset keys default to the flags of serve.
+type syncRequest struct {
+	Src             string   `json:"src"`
+	Dest            string   `json:"dest"`
+	Tags            []string `json:"tags"`
+	TagsPattern     *string  `json:"tags-pattern"`
+	SkipTagsPattern *string  `json:"skip-tags-pattern"`
+	SkipTags        []string `json:"skip-tags"`
+	Semver          *string  `json:"semver"`
+	KeepLatestN     *int     `json:"keep-latest-n"`
+	Platforms       *string  `json:"platforms"`
+	Overwrite       *bool    `json:"overwrite"`
+	CompareDigests  *bool    `json:"compare-digests"`
+	DryRun          *bool    `json:"dry-run"`
+}
+
+// apply replaces the jobs of opts by the single job of the request. Only
+// registry sources and destinations are accepted.
+func (req syncRequest) apply(opts *Options) error {
+	if req.Src == "" || req.Dest == "" {
+		return errors.New("src and dest are required")
+	}
+	// local transports would read and write files of the server host with
+	// its registry credentials
+	src, err := detectSource(req.Src, opts.SrcFormat, opts.LegacySourceDetection)
+	if err != nil {
+		return err
+	}
+	if src.kind != sourceRegistry {
+		return fmt.Errorf("src %q is not a registry reference", req.Src)
+	}
+	dests, err := detectDestinations(req.Dest, opts.DestType)
+	if err != nil {
+		return err
+	}
+	for _, dest := range dests {
+		if dest.kind != destinationRegistry {
+			return fmt.Errorf("dest %q is not a registry reference", dest.value)
+		}
+	}
+	opts.Source, opts.Destination = req.Src, req.Dest
+	opts.Config, opts.SkopeoSyncConfig, opts.ImagesFile, opts.SrcNamespace, opts.DestNamespace = "", "", "", "", ""
+	if req.Tags != nil {
+		opts.Tags = req.Tags
+	}
+	if req.SkipTags != nil {
+		opts.SkipTags = req.SkipTags
+	}
+	setIfNotNil(&opts.TagsPattern, req.TagsPattern)
+	setIfNotNil(&opts.SkipTagsPattern, req.SkipTagsPattern)
+	setIfNotNil(&opts.Semver, req.Semver)
+	setIfNotNil(&opts.KeepLatestN, req.KeepLatestN)
+	setIfNotNil(&opts.Platforms, req.Platforms)
+	setIfNotNil(&opts.Overwrite, req.Overwrite)
+	setIfNotNil(&opts.CompareDigests, req.CompareDigests)
+	setIfNotNil(&opts.DryRun, req.DryRun)
+	// pruning isn't offered to the API
+	opts.Prune = false
+	return nil
+}
+
+// runView is the JSON document of a run, its tags are only listed by
+// GET /syncs/{id}.
+type runView struct {
+	ID      string    `json:"id"`
+	Trigger string    `json:"trigger"`
+	Status  runStatus `json:"status"`
+	// Source, Destination and Config are the parameters of the run, a
+	// webhook sync has the pushed repository and tags instead.
+	Source      string       `json:"source,omitempty"`
+	Destination string       `json:"destination,omitempty"`
+	Config      string       `json:"config,omitempty"`
+	PushedTags  []string     `json:"pushedTags,omitempty"`
+	QueuedAt    time.Time    `json:"queuedAt"`
+	StartedAt   *time.Time   `json:"startedAt,omitempty"`
+	FinishedAt  *time.Time   `json:"finishedAt,omitempty"`
+	Totals      ResultTotals `json:"totals"`
+	Tags        []TagResult  `json:"tags,omitempty"`
+	Error       string       `json:"error,omitempty"`
+}
+
+// registerAPI adds the REST API to mux, every request needs the
+// --api-token as bearer token.
+func (s *syncServer) registerAPI(mux *http.ServeMux) {
+	mux.HandleFunc("POST /syncs", s.authorizeAPI(s.createSync))
+	mux.HandleFunc("GET /syncs/{id}", s.authorizeAPI(s.getSync))
+	mux.HandleFunc("GET /history", s.authorizeAPI(s.listRuns))
+}
+
+func (s *syncServer) authorizeAPI(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.apiToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeAPIError(w, http.StatusUnauthorized, "invalid api token")
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// createSync queues the sync of the request body.
+func (s *syncServer) createSync(w http.ResponseWriter, r *http.Request) {
+	var req syncRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxWebhookSize))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "parsing sync request: "+err.Error())
+		return
+	}
+	opts, err := syncOptions(s.c)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err = req.apply(&opts); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	// invalid filters fail the request instead of the run
+	if _, err = jobFromOptions(opts); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	run := s.newRun("api", opts)
+	if !s.enqueue(run) {
+		writeAPIError(w, http.StatusServiceUnavailable, "too many pending syncs")
+		return
+	}
+	w.Header().Set("Location", "/syncs/"+run.id)
+	writeAPIJSON(w, http.StatusAccepted, s.view(run, false))
+}
+
+// getSync returns a run with the tags it synced so far.
+func (s *syncServer) getSync(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	i := slices.IndexFunc(s.runs, func(run *serverRun) bool { return run.id == r.PathValue("id") })
+	var run *serverRun
+	if i >= 0 {
+		run = s.runs[i]
+	}
+	s.mu.Unlock()
+	if run == nil {
+		writeAPIError(w, http.StatusNotFound, "no such sync")
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, s.view(run, true))
+}
+
+// listRuns returns the recent runs, the newest first. ?limit= bounds their
+// number.
+func (s *syncServer) listRuns(w http.ResponseWriter, r *http.Request) {
+	limit := maxServerRuns
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			writeAPIError(w, http.StatusBadRequest, "limit has to be a positive number")
+			return
+		}
+		limit = n
+	}
+	s.mu.Lock()
+	runs := slices.Clone(s.runs)
+	s.mu.Unlock()
+	slices.Reverse(runs)
+	views := make([]runView, 0, min(limit, len(runs)))
+	for _, run := range runs[:min(limit, len(runs))] {
+		views = append(views, s.view(run, false))
+	}
+	writeAPIJSON(w, http.StatusOK, map[string][]runView{"runs": views})
+}
+
+func (s *syncServer) view(run *serverRun, withTags bool) runView {
+	tags, totals := run.result.progress()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v := runView{
+		ID:          run.id,
+		Trigger:     run.trigger,
+		Status:      run.status,
+		Source:      run.opts.Source,
+		Destination: run.opts.Destination,
+		Config:      run.opts.Config,
+		PushedTags:  run.opts.PushedTags,
+		QueuedAt:    run.queuedAt,
+		Totals:      totals,
+	}
+	if run.opts.PushedRepository != "" {
+		v.Source, v.Destination, v.Config = run.opts.PushedRepository, "", ""
+	}
+	if started := run.startedAt; !started.IsZero() {
+		v.StartedAt = &started
+	}
+	if finished := run.finishedAt; !finished.IsZero() {
+		v.FinishedAt = &finished
+	}
+	if withTags {
+		v.Tags = tags
+	}
+	if run.err != nil {
+		v.Error = run.err.Error()
+	}
+	return v
+}
+
+func writeAPIJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, msg string) {
+	writeAPIJSON(w, status, map[string]string{"error": msg})
+}
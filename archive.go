@@ -0,0 +1,321 @@
+package imagesync
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	dockerarchive "github.com/containers/image/v5/docker/archive"
+	"github.com/containers/image/v5/docker/reference"
+	ociarchive "github.com/containers/image/v5/oci/archive"
+	ocilayout "github.com/containers/image/v5/oci/layout"
+	"github.com/containers/image/v5/types"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/samber/lo"
+	"github.com/sirupsen/logrus"
+)
+
+// archiveSnapshot stages the tags of a repository synced into an oci-archive
+// in an OCI layout next to the archive. The archive is replaced by the
+// layout, an index with a ref name per tag, once all tags are copied.
+type archiveSnapshot struct {
+	path string
+	dir  string
+}
+
+func newArchiveSnapshot(path string) (*archiveSnapshot, error) {
+	dir, err := os.MkdirTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return nil, fmt.Errorf("creating the staging layout of %s: %w", path, err)
+	}
+	return &archiveSnapshot{path: path, dir: dir}, nil
+}
+
+// destination returns the staging layout as repository destination.
+func (s *archiveSnapshot) destination() destination {
+	return destination{kind: destinationOCILayout, value: s.dir, archive: s.path}
+}
+
+// write replaces the archive with the staged tags. A snapshot missing tags
+// which failed isn't written.
+func (s *archiveSnapshot) write(failed int64) error {
+	if failed > 0 {
+		return fmt.Errorf("%d tags failed, %s is unchanged", failed, s.path)
+	}
+	if _, err := os.Stat(filepath.Join(s.dir, imgspecv1.ImageIndexFile)); errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("no tag was copied, %s is unchanged", s.path)
+	}
+	return packTar(s.dir, s.path, nil)
+}
+
+func (s *archiveSnapshot) remove() {
+	_ = os.RemoveAll(s.dir)
+}
+
+// archiveTagReference is a tag of an OCI layout which is staged for or
+// extracted from an oci-archive, named like the tag of the archive in logs
+// and results.
+type archiveTagReference struct {
+	types.ImageReference
+	archive string
+	tag     string
+}
+
+func (r *archiveTagReference) Transport() types.ImageTransport {
+	return ociarchive.Transport
+}
+
+func (r *archiveTagReference) StringWithinTransport() string {
+	return r.archive + ":" + r.tag
+}
+
+// archiveImage is a tagged image of a multi-image archive.
+type archiveImage struct {
+	tag string
+	ref types.ImageReference
+}
+
+// importArchive copies every tagged image of an oci-archive or docker-archive
+// source holding several images, or of an archive of a glob or directory
+// source, to the tag of the same name in the repository destinations. It
+// reports false for other sources, which are copied as a single image.
+func (r *syncRun) importArchive(ctx context.Context, src source, dests []destination) (bool, error) {
+	if src.kind != sourceOCIArchive && src.kind != sourceDockerArchive {
+		return false, nil
+	}
+	// a path:reference source names a single image
+	if info, err := os.Stat(src.value); err != nil || info.IsDir() {
+		return false, nil
+	}
+	for _, dest := range dests {
+		if dest.hasTag() || dest.holdsSingleImage() {
+			return false, nil
+		}
+	}
+	images, closeArchive, err := openArchive(r.opts.SourceCtx, src)
+	if err != nil {
+		return false, err
+	}
+	defer closeArchive()
+	if len(images) == 0 && r.job.ArchiveTags {
+		return true, fmt.Errorf("%s has no tagged image", src.value)
+	}
+	if len(images) < 2 && !r.job.ArchiveTags {
+		return false, nil
+	}
+
+	total := len(images)
+	tags, err := r.job.selectTags(lo.Map(images, func(img archiveImage, _ int) string { return img.tag }))
+	if err != nil {
+		return true, err
+	}
+	if err = r.job.TagRewrite.check(tags); err != nil {
+		return true, err
+	}
+	selected := lo.SliceToMap(tags, func(tag string) (string, bool) { return tag, true })
+	images = lo.Filter(images, func(img archiveImage, _ int) bool { return selected[img.tag] })
+
+	// the tags of each destination which are kept without --overwrite
+	present := make([]map[string]bool, len(dests))
+	for i, dest := range dests {
+		if dest.kind == destinationDir {
+			if err = os.MkdirAll(dest.value, 0o755); err != nil {
+				return true, fmt.Errorf("creating dir destination: %w", err)
+			}
+		}
+		destRepository, err := dest.reference()
+		if err != nil {
+			return true, err
+		}
+		if destTags, err := dest.tags(ctx, r.opts.DestinationCtx, destRepository); err == nil && !r.job.Overwrite {
+			present[i] = lo.SliceToMap(destTags, func(tag string) (string, bool) { return tag, true })
+		}
+	}
+
+	logrus.Infof("Importing %d of %d tagged images of %s", len(images), total, src.value)
+	r.progress.plan(len(images))
+	for _, img := range images {
+		if ctx.Err() != nil {
+			return true, ctx.Err()
+		}
+		tag := r.job.TagRewrite.rewrite(img.tag)
+		var destRefs []types.ImageReference
+		for i, dest := range dests {
+			destRef, err := dest.tagReference(tag)
+			if err != nil {
+				logrus.Warnf("failed parsing dest ref: %s", err)
+				continue
+			}
+			if present[i][tag] {
+				r.addTag(TagResult{Source: refName(img.ref), Destination: refName(destRef), Status: TagSkipped})
+				continue
+			}
+			destRefs = append(destRefs, destRef)
+		}
+		if len(destRefs) == 0 {
+			continue
+		}
+		if err := r.copyTag(ctx, destRefs, img.ref); err != nil {
+			if isQuotaExceeded(err) {
+				return true, err
+			}
+			logrus.Warnf("failed copying image: %s", err)
+		}
+	}
+	return true, nil
+}
+
+// openArchive lists the tagged images of the archive source, close releases
+// the archive. An oci-archive is extracted once instead of for every image.
+func openArchive(sys *types.SystemContext, src source) ([]archiveImage, func(), error) {
+	if src.kind == sourceOCIArchive {
+		return ociArchiveImages(src.value)
+	}
+	return dockerArchiveImages(sys, src.value)
+}
+
+func ociArchiveImages(path string) ([]archiveImage, func(), error) {
+	dir, err := os.MkdirTemp("", "imagesync-archive-")
+	if err != nil {
+		return nil, nil, err
+	}
+	remove := func() { _ = os.RemoveAll(dir) }
+	if err = extractTar(path, dir); err != nil {
+		remove()
+		return nil, nil, fmt.Errorf("extracting oci-archive %s: %w", path, err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, imgspecv1.ImageIndexFile))
+	var index imgspecv1.Index
+	if err == nil {
+		err = json.Unmarshal(data, &index)
+	}
+	if err != nil {
+		remove()
+		return nil, nil, fmt.Errorf("reading index of oci-archive %s: %w", path, err)
+	}
+	var images []archiveImage
+	for _, m := range index.Manifests {
+		name := m.Annotations[imgspecv1.AnnotationRefName]
+		tag, ok := refNameTag(name)
+		if !ok {
+			logrus.Warnf("skipping image %s of %s without tag", m.Digest, path)
+			continue
+		}
+		ref, err := ocilayout.NewReference(dir, name)
+		if err != nil {
+			remove()
+			return nil, nil, err
+		}
+		images = append(images, archiveImage{tag: tag, ref: &archiveTagReference{ImageReference: ref, archive: path, tag: name}})
+	}
+	return lo.UniqBy(images, func(img archiveImage) string { return img.tag }), remove, nil
+}
+
+func dockerArchiveImages(sys *types.SystemContext, path string) ([]archiveImage, func(), error) {
+	reader, err := dockerarchive.NewReader(sys, path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading docker-archive %s: %w", path, err)
+	}
+	refs, err := reader.List()
+	if err != nil {
+		_ = reader.Close()
+		return nil, nil, fmt.Errorf("reading docker-archive %s: %w", path, err)
+	}
+	var images []archiveImage
+	for i, imageRefs := range refs {
+		for _, ref := range imageRefs {
+			tagged, ok := ref.DockerReference().(reference.NamedTagged)
+			if !ok {
+				logrus.Warnf("skipping image %d of %s without tag", i+1, path)
+				continue
+			}
+			images = append(images, archiveImage{tag: tagged.Tag(), ref: ref})
+		}
+	}
+	return lo.UniqBy(images, func(img archiveImage) string { return img.tag }), func() { _ = reader.Close() }, nil
+}
+
+// refNameTag returns the tag of the ref name of an OCI image, either a tag
+// or an image reference like docker.io/library/alpine:3.
+func refNameTag(name string) (string, bool) {
+	if i := strings.LastIndex(name, ":"); i >= 0 && !strings.Contains(name[i+1:], "/") {
+		name = name[i+1:]
+	}
+	return name, validTag.MatchString(name)
+}
+
+// archiveFiles returns the archives of a glob source like ./exports/*.tar or
+// of a directory source without OCI layout, the .tar, .tar.gz and .tgz files
+// in it. It reports false for other sources.
+func archiveFiles(src string) ([]string, bool, error) {
+	var files []string
+	switch {
+	case strings.ContainsAny(src, "*?["):
+		matches, err := filepath.Glob(src)
+		if err != nil {
+			return nil, true, fmt.Errorf("invalid source pattern %q: %w", src, err)
+		}
+		for _, match := range matches {
+			if info, err := os.Stat(match); err == nil && info.Mode().IsRegular() {
+				files = append(files, match)
+			}
+		}
+	case isPathLike(src) && isArchiveDir(src):
+		entries, err := os.ReadDir(src)
+		if err != nil {
+			return nil, true, fmt.Errorf("reading source directory: %w", err)
+		}
+		for _, entry := range entries {
+			name := entry.Name()
+			if entry.Type().IsRegular() && !strings.HasPrefix(name, ".") && (strings.HasSuffix(name, ".tar") || strings.HasSuffix(name, ".tar.gz") || strings.HasSuffix(name, ".tgz")) {
+				files = append(files, filepath.Join(src, name))
+			}
+		}
+	default:
+		return nil, false, nil
+	}
+	if len(files) == 0 {
+		return nil, true, fmt.Errorf("no archive matches %s", src)
+	}
+	return files, true, nil
+}
+
+// isArchiveDir reports whether path is a directory, but no OCI layout.
+func isArchiveDir(path string) bool {
+	info, err := os.Stat(path)
+	if err != nil || !info.IsDir() {
+		return false
+	}
+	_, err = os.Stat(filepath.Join(path, imgspecv1.ImageLayoutFile))
+	return errors.Is(err, os.ErrNotExist)
+}
+
+// archiveJobs returns a job for every archive file, copying its images to
+// their tags in the repository destinations of defaults.
+func archiveJobs(defaults syncJob, files []string) ([]syncJob, error) {
+	dests, err := detectDestinations(defaults.Destination, defaults.DestType)
+	if err != nil {
+		return nil, err
+	}
+	for _, dest := range dests {
+		if dest.hasTag() || dest.holdsSingleImage() {
+			return nil, fmt.Errorf("the images of archives are copied to their own tags, the %s destination %s can't have a tag or hold a single image: %w", dest.typeName(), dest.value, ErrUnsupportedDestination)
+		}
+	}
+	jobs := make([]syncJob, 0, len(files))
+	for _, file := range files {
+		abs, err := filepath.Abs(file)
+		if err != nil {
+			return nil, fmt.Errorf("resolving source path: %w", err)
+		}
+		job := defaults
+		job.Source, job.ArchiveTags = abs, true
+		jobs = append(jobs, job)
+	}
+	logrus.Infof("Syncing %d archives", len(jobs))
+	return jobs, nil
+}
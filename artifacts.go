@@ -0,0 +1,128 @@
+package imagesync
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/types"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
+)
+
+// imageConfigTypes are the config media types of container images, the
+// manifests with other config media types are artifacts like Helm charts.
+var imageConfigTypes = []string{imgspecv1.MediaTypeImageConfig, manifest.DockerV2Schema2ConfigMediaType}
+
+// artifactType returns the artifact type of a manifest like the OCI
+// referrers API: its artifactType, otherwise the media type of its config.
+// Indexes without artifactType and Docker manifests are images and have
+// the type of their image config.
+func artifactType(manifestBlob []byte, mimeType string) string {
+	var m struct {
+		ArtifactType string `json:"artifactType"`
+		Config       struct {
+			MediaType string `json:"mediaType"`
+		} `json:"config"`
+	}
+	switch manifest.NormalizedMIMEType(mimeType) {
+	case imgspecv1.MediaTypeImageManifest:
+		if err := json.Unmarshal(manifestBlob, &m); err == nil && m.ArtifactType != "" {
+			return m.ArtifactType
+		}
+		if m.Config.MediaType != "" {
+			return m.Config.MediaType
+		}
+		return imgspecv1.MediaTypeImageConfig
+	case imgspecv1.MediaTypeImageIndex:
+		if err := json.Unmarshal(manifestBlob, &m); err == nil && m.ArtifactType != "" {
+			return m.ArtifactType
+		}
+		return imgspecv1.MediaTypeImageConfig
+	default:
+		return manifest.DockerV2Schema2ConfigMediaType
+	}
+}
+
+// isArtifactType reports whether t isn't the type of a container image.
+func isArtifactType(t string) bool {
+	return !slices.Contains(imageConfigTypes, t)
+}
+
+// isNonImageArtifact reports whether a copy failed because it converted or
+// inspected an artifact like an image.
+func isNonImageArtifact(err error) bool {
+	var artifactErr manifest.NonImageArtifactError
+	return errors.As(err, &artifactErr)
+}
+
+// wantsArtifact reports whether the artifact type t is selected by
+// --artifact-types and --skip-artifact-types.
+func (r *syncRun) wantsArtifact(t string) bool {
+	if len(r.options.ArtifactTypes) > 0 && !slices.Contains(r.options.ArtifactTypes, t) {
+		return false
+	}
+	return !slices.Contains(r.options.SkipArtifactTypes, t)
+}
+
+// selectArtifact reads the source manifest for --artifact-types and
+// --skip-artifact-types and records srcRef as skipped for destRefs if its
+// artifact type isn't selected. Manifests which can't be read are copied,
+// the copy reports the error.
+func (r *syncRun) selectArtifact(ctx context.Context, destRefs []types.ImageReference, srcRef types.ImageReference) bool {
+	if len(r.options.ArtifactTypes) == 0 && len(r.options.SkipArtifactTypes) == 0 {
+		return true
+	}
+	t, err := r.sourceArtifactType(ctx, srcRef)
+	if err != nil {
+		logrus.Debugf("failed reading the artifact type of %s: %s", refName(srcRef), err)
+		return true
+	}
+	if r.wantsArtifact(t) {
+		return true
+	}
+	reason := fmt.Sprintf("its artifact type %s isn't selected", t)
+	logrus.Infof("Skipping %s, %s", refName(srcRef), reason)
+	for _, destRef := range destRefs {
+		r.addTag(TagResult{Source: refName(srcRef), Destination: refName(destRef), Status: TagSkipped, Reason: reason})
+	}
+	return false
+}
+
+func (r *syncRun) sourceArtifactType(ctx context.Context, srcRef types.ImageReference) (string, error) {
+	src, err := r.limits.src.wrap(srcRef).NewImageSource(ctx, r.opts.SourceCtx)
+	if err != nil {
+		return "", fmt.Errorf("opening source image: %w", err)
+	}
+	defer src.Close()
+	manifestBlob, mimeType, err := src.GetManifest(ctx, nil)
+	if err != nil {
+		return "", fmt.Errorf("reading source manifest: %w", err)
+	}
+	return artifactType(manifestBlob, mimeType), nil
+}
+
+// transferArtifact copies the artifact srcRef to each of destRefs byte for
+// byte, artifacts can't be converted or filtered by platform like images.
+func (r *syncRun) transferArtifact(ctx context.Context, destRefs []types.ImageReference, srcRef types.ImageReference) (transferred, error) {
+	var t transferred
+	for _, destRef := range destRefs {
+		var copied transferred
+		err := withRetry(ctx, r.options.MaxRetries, r.options.RetryDelay, refName(srcRef), func() error {
+			var err error
+			copied, _, err = r.transferRaw(ctx, destRef, srcRef)
+			r.adaptive.observe(err)
+			return err
+		})
+		if err != nil {
+			return transferred{}, fmt.Errorf("copying artifact to %s: %w", refName(destRef), err)
+		}
+		t.manifest, t.sourceDigest = copied.manifest, copied.sourceDigest
+		t.bytes += copied.bytes
+		t.duration += copied.duration
+	}
+	return t, nil
+}
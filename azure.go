@@ -0,0 +1,202 @@
+package imagesync
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/types"
+	"github.com/sirupsen/logrus"
+)
+
+// acrHostPattern matches the registries of Azure Container Registry, e.g.
+// myregistry.azurecr.io.
+var acrHostPattern = regexp.MustCompile(`^[a-z0-9]+\.azurecr\.(?:io|cn|us)$`)
+
+// acrUsername is the user name of ACR refresh tokens.
+const acrUsername = "00000000-0000-0000-0000-000000000000"
+
+// acrTokenRefresh is how long before it expires a refresh token is
+// replaced.
+const acrTokenRefresh = 10 * time.Minute
+
+// acrRegistry returns the ACR host of a registry reference.
+func acrRegistry(ref string) (string, bool) {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return "", false
+	}
+	host := reference.Domain(named)
+	return host, acrHostPattern.MatchString(host)
+}
+
+// acrSession logs in to the ACR registries of a sync by exchanging the
+// Microsoft Entra token of the managed identity, service principal or az
+// CLI for ACR refresh tokens. Without Azure credentials the auth files are
+// used.
+type acrSession struct {
+	once       sync.Once
+	credential azcore.TokenCredential
+
+	mu     sync.Mutex
+	tokens map[string]acrToken
+	// failed is set once getting an Entra token failed.
+	failed bool
+}
+
+type acrToken struct {
+	auth    *types.DockerAuthConfig
+	expires time.Time
+}
+
+func newACRSession() *acrSession {
+	return &acrSession{tokens: map[string]acrToken{}}
+}
+
+// auth returns the credentials of the registry host, nil without Azure
+// credentials.
+func (a *acrSession) auth(ctx context.Context, host string) (*types.DockerAuthConfig, error) {
+	a.once.Do(func() {
+		credential, err := azidentity.NewDefaultAzureCredential(nil)
+		if err != nil {
+			logrus.Warnf("no Azure credentials, using the auth files: %s", err)
+			return
+		}
+		a.credential = credential
+	})
+	if a.credential == nil {
+		return nil, nil
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if token, ok := a.tokens[host]; ok && time.Until(token.expires) > acrTokenRefresh {
+		return token.auth, nil
+	}
+	if a.failed {
+		return nil, nil
+	}
+	entra, err := a.credential.GetToken(ctx, policy.TokenRequestOptions{Scopes: []string{"https://containerregistry.azure.net/.default"}})
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		logrus.Warnf("no Azure credentials, using the auth files: %s", err)
+		a.failed = true
+		return nil, nil
+	}
+	refresh, err := exchangeACRToken(ctx, host, entra.Token)
+	if err != nil {
+		return nil, fmt.Errorf("logging in to %s: %w", host, err)
+	}
+	token := acrToken{auth: &types.DockerAuthConfig{Username: acrUsername, Password: refresh}, expires: jwtExpiry(refresh, entra.ExpiresOn)}
+	a.tokens[host] = token
+	return token.auth, nil
+}
+
+// exchangeACRToken exchanges an Entra access token for a refresh token of
+// the registry.
+func exchangeACRToken(ctx context.Context, host, accessToken string) (string, error) {
+	form := url.Values{
+		"grant_type":   {"access_token"},
+		"service":      {host},
+		"access_token": {accessToken},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://"+host+"/oauth2/exchange", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("token exchange failed with status %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	var body struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("decoding token exchange: %w", err)
+	}
+	if body.RefreshToken == "" {
+		return "", fmt.Errorf("token exchange returned no refresh token")
+	}
+	return body.RefreshToken, nil
+}
+
+// jwtExpiry returns the exp claim of a JWT, fallback if it has none. The
+// token isn't verified, the registry does that.
+func jwtExpiry(token string, fallback time.Time) time.Time {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return fallback
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return fallback
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err = json.Unmarshal(payload, &claims); err != nil || claims.Exp == 0 {
+		return fallback
+	}
+	return time.Unix(claims.Exp, 0)
+}
+
+// prepareACR logs in to the ACR registries of the job. Credentials of the
+// job or its credential helpers take precedence, the destination token is
+// only used if all registry destinations are on the same ACR registry.
+func (r *syncRun) prepareACR(ctx context.Context, src source, dests []destination) error {
+	if r.acr == nil {
+		return nil
+	}
+	if host, ok := acrRegistry(src.value); ok && src.kind == sourceRegistry && r.opts.SourceCtx.DockerAuthConfig == nil {
+		auth, err := r.acr.auth(ctx, host)
+		if err != nil {
+			return err
+		}
+		r.opts.SourceCtx.DockerAuthConfig = auth
+	}
+
+	hosts := map[string]bool{}
+	var acrHost string
+	for _, dest := range dests {
+		if dest.kind != destinationRegistry {
+			continue
+		}
+		host, ok := acrRegistry(dest.value)
+		hosts[host] = true
+		if ok {
+			acrHost = host
+		}
+	}
+	switch {
+	case acrHost == "" || r.opts.DestinationCtx.DockerAuthConfig != nil:
+	case len(hosts) == 1:
+		auth, err := r.acr.auth(ctx, acrHost)
+		if err != nil {
+			return err
+		}
+		r.opts.DestinationCtx.DockerAuthConfig = auth
+	default:
+		logrus.Warnf("the destinations of %s are on several registries, using the auth files for Azure Container Registry", r.job.Source)
+	}
+	return nil
+}
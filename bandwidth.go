@@ -0,0 +1,139 @@
+package imagesync
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containers/image/v5/types"
+	"github.com/docker/go-units"
+)
+
+// maxThrottledRead caps a single read of a throttled blob, so large reads
+// don't cause long pauses followed by bursts.
+const maxThrottledRead = 32 * 1024
+
+// bandwidthLimiter paces reads to a number of bytes per second, a nil
+// limiter doesn't limit anything. It is safe for concurrent use, all readers
+// share the bandwidth.
+type bandwidthLimiter struct {
+	bytesPerSecond float64
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+// parseBandwidth parses a rate like 50MB/s or 10MiB, the /s suffix is
+// optional. An empty value is unlimited.
+func parseBandwidth(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	size, err := units.FromHumanSize(strings.TrimSuffix(strings.TrimSpace(value), "/s"))
+	if err != nil || size <= 0 {
+		return 0, fmt.Errorf("invalid bandwidth %q, expected e.g. 50MB/s", value)
+	}
+	return size, nil
+}
+
+func newBandwidthLimiter(bytesPerSecond int64) *bandwidthLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &bandwidthLimiter{bytesPerSecond: float64(bytesPerSecond)}
+}
+
+// wait blocks until n more bytes may be transferred.
+func (l *bandwidthLimiter) wait(ctx context.Context, n int) error {
+	if l == nil || n <= 0 {
+		return nil
+	}
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(float64(n) / l.bytesPerSecond * float64(time.Second)))
+	l.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// throttle returns ref with the blobs of its image sources read no faster
+// than the limiters allow. Throttling the source also throttles the upload,
+// images are streamed from the source to the destination.
+func throttle(ref types.ImageReference, limiters ...*bandwidthLimiter) types.ImageReference {
+	var active []*bandwidthLimiter
+	for _, l := range limiters {
+		if l != nil {
+			active = append(active, l)
+		}
+	}
+	if len(active) == 0 {
+		return ref
+	}
+	return &throttledReference{ImageReference: ref, limiters: active}
+}
+
+type throttledReference struct {
+	types.ImageReference
+	limiters []*bandwidthLimiter
+}
+
+func (r *throttledReference) NewImageSource(ctx context.Context, sys *types.SystemContext) (types.ImageSource, error) {
+	src, err := r.ImageReference.NewImageSource(ctx, sys)
+	if err != nil {
+		return nil, err
+	}
+	return &throttledSource{ImageSource: src, ref: r}, nil
+}
+
+type throttledSource struct {
+	types.ImageSource
+	ref *throttledReference
+}
+
+func (s *throttledSource) Reference() types.ImageReference {
+	return s.ref
+}
+
+func (s *throttledSource) GetBlob(ctx context.Context, info types.BlobInfo, cache types.BlobInfoCache) (io.ReadCloser, int64, error) {
+	rc, size, err := s.ImageSource.GetBlob(ctx, info, cache)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &throttledReadCloser{ReadCloser: rc, ctx: ctx, limiters: s.ref.limiters}, size, nil
+}
+
+type throttledReadCloser struct {
+	io.ReadCloser
+	ctx      context.Context
+	limiters []*bandwidthLimiter
+}
+
+func (r *throttledReadCloser) Read(p []byte) (int, error) {
+	if len(p) > maxThrottledRead {
+		p = p[:maxThrottledRead]
+	}
+	n, err := r.ReadCloser.Read(p)
+	for _, l := range r.limiters {
+		if werr := l.wait(r.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,615 @@
+package imagesync
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/pkg/compression"
+	"github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	bundleVersion      = 1
+	bundleIndexFile    = "bundle.json"
+	bundleChecksumFile = "SHA256SUMS"
+	// bundleRepositories holds a directory per repository with a dir: image
+	// per tag, which keeps the manifests and their digests unchanged.
+	bundleRepositories = "repositories"
+)
+
+// bundleIndex is the bundle.json of a bundle.
+type bundleIndex struct {
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"createdAt"`
+	// Incremental bundles leave out the images and blobs of an inventory.
+	Incremental bool          `json:"incremental,omitempty"`
+	Images      []bundleImage `json:"images"`
+}
+
+type bundleImage struct {
+	// Repository is the path of the source repository without registry, the
+	// image is imported to the same path below the destination.
+	Repository string `json:"repository"`
+	Source     string `json:"source"`
+	Tag        string `json:"tag"`
+	Digest     string `json:"digest"`
+}
+
+// bundleExport collects the images of an export in a work directory next
+// to the bundle until they are packed.
+type bundleExport struct {
+	path string
+	dir  string
+	// sources maps the repositories of the bundle to their source.
+	sources map[string]string
+	// inventory is the air-gapped registry of an incremental bundle, known
+	// are its blobs by repository.
+	inventory *bundleInventory
+	known     map[string]map[digest.Digest]bool
+}
+
+// newBundleExport points the jobs to a directory per source repository in
+// the work directory of the bundle.
+func newBundleExport(options Options, jobs []syncJob) (*bundleExport, error) {
+	if options.Destination != "" || options.DestNamespace != "" {
+		return nil, errors.New("export stores the images by their source repository, --dest and --dest-namespace can't be used")
+	}
+	if _, err := bundleCompression(options.ExportBundle); err != nil {
+		return nil, err
+	}
+	path, err := filepath.Abs(options.ExportBundle)
+	if err != nil {
+		return nil, fmt.Errorf("resolving bundle path: %w", err)
+	}
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".imagesync-export-")
+	if err != nil {
+		return nil, fmt.Errorf("creating export directory: %w", err)
+	}
+	b := &bundleExport{path: path, dir: dir, sources: map[string]string{}}
+	if options.BundleInventory != "" {
+		if b.inventory, err = loadInventory(options.BundleInventory, false); err != nil {
+			b.remove()
+			return nil, err
+		}
+		b.known = b.inventory.blobs()
+	}
+	for i := range jobs {
+		if err = b.add(&jobs[i], options.LegacySourceDetection); err != nil {
+			b.remove()
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+func (b *bundleExport) add(job *syncJob, legacy bool) error {
+	src, err := detectSource(job.Source, job.SrcFormat, legacy)
+	if err != nil {
+		return err
+	}
+	named, err := reference.ParseNormalizedNamed(src.value)
+	if err != nil || src.kind != sourceRegistry {
+		return fmt.Errorf("can't export %s, only registry sources can be exported", job.Source)
+	}
+	if _, ok := named.(reference.Digested); ok {
+		return fmt.Errorf("can't export %s, images are exported by tag", job.Source)
+	}
+	repo := reference.Path(named)
+	if other, ok := b.sources[repo]; ok && other != named.Name() {
+		return fmt.Errorf("%s and %s are both exported as %s", other, named.Name(), repo)
+	}
+	b.sources[repo] = named.Name()
+
+	dir := b.repositoryDir(repo)
+	if err = os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("creating export directory: %w", err)
+	}
+	job.Destination = "dir:" + dir
+	if tagged, ok := named.(reference.Tagged); ok {
+		job.Destination = "dir:" + filepath.Join(dir, tagged.Tag())
+	}
+	job.DestType = ""
+	return nil
+}
+
+func (b *bundleExport) repositoryDir(repo string) string {
+	return filepath.Join(b.dir, bundleRepositories, filepath.FromSlash(repo))
+}
+
+// write packs the exported images with their index and checksums into the
+// bundle. Images with the digest of the inventory are left out.
+func (b *bundleExport) write() error {
+	index := bundleIndex{Version: bundleVersion, CreatedAt: time.Now().UTC(), Incremental: b.inventory != nil}
+	unchanged := 0
+	for _, repo := range slices.Sorted(maps.Keys(b.sources)) {
+		tags, err := dirTags(b.repositoryDir(repo))
+		if err != nil {
+			return err
+		}
+		for _, tag := range tags {
+			data, err := os.ReadFile(filepath.Join(b.repositoryDir(repo), tag, "manifest.json"))
+			if err != nil {
+				return fmt.Errorf("reading exported manifest: %w", err)
+			}
+			dgst, err := manifest.Digest(data)
+			if err != nil {
+				return err
+			}
+			if dgst.String() == b.inventory.tagDigest(repo, tag) {
+				if err = os.RemoveAll(filepath.Join(b.repositoryDir(repo), tag)); err != nil {
+					return fmt.Errorf("removing unchanged image: %w", err)
+				}
+				unchanged++
+				continue
+			}
+			index.Images = append(index.Images, bundleImage{Repository: repo, Source: b.sources[repo], Tag: tag, Digest: dgst.String()})
+		}
+	}
+	if unchanged > 0 {
+		logrus.Infof("Left out %d images which are unchanged in the inventory", unchanged)
+	}
+	if len(index.Images) == 0 && unchanged > 0 {
+		return errors.New("no image changed since the inventory")
+	}
+	if len(index.Images) == 0 {
+		return errors.New("no image was exported")
+	}
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.WriteFile(filepath.Join(b.dir, bundleIndexFile), append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("writing bundle index: %w", err)
+	}
+	if err = writeChecksums(b.dir); err != nil {
+		return err
+	}
+	if err = packBundle(b.dir, b.path); err != nil {
+		return err
+	}
+	logrus.WithFields(logrus.Fields{"bundle": b.path, "images": len(index.Images)}).Info("Wrote bundle")
+	return nil
+}
+
+func (b *bundleExport) remove() {
+	if b == nil {
+		return
+	}
+	if err := os.RemoveAll(b.dir); err != nil {
+		logrus.Warnf("failed removing %s: %s", b.dir, err)
+	}
+}
+
+// bundleCompression returns the compression of a bundle from its file
+// extension, nil for a plain tar.
+func bundleCompression(path string) (*compression.Algorithm, error) {
+	switch {
+	case strings.HasSuffix(path, ".tar.zst"), strings.HasSuffix(path, ".tzst"):
+		return &compression.Zstd, nil
+	case strings.HasSuffix(path, ".tar.gz"), strings.HasSuffix(path, ".tgz"):
+		return &compression.Gzip, nil
+	case strings.HasSuffix(path, ".tar"):
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unsupported bundle %s, expected a .tar, .tar.gz or .tar.zst file", path)
+	}
+}
+
+// writeChecksums writes the sha256sum compatible checksums of all files
+// below dir. Blobs were verified against their digest while copying, their
+// name is their checksum.
+func writeChecksums(dir string) error {
+	var lines []string
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.Type().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		sum, ok := blobChecksum(rel)
+		if !ok {
+			if sum, err = fileChecksum(path); err != nil {
+				return err
+			}
+		}
+		lines = append(lines, sum+"  "+rel+"\n")
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("writing bundle checksums: %w", err)
+	}
+	slices.Sort(lines)
+	return os.WriteFile(filepath.Join(dir, bundleChecksumFile), []byte(strings.Join(lines, "")), 0o644)
+}
+
+// blobChecksum returns the checksum of a dir: image blob, which is named by
+// its sha256 digest.
+func blobChecksum(rel string) (string, bool) {
+	sum := rel[strings.LastIndex(rel, "/")+1:]
+	if _, err := hex.DecodeString(sum); err != nil || len(sum) != sha256.Size*2 {
+		return "", false
+	}
+	return sum, true
+}
+
+func fileChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// packBundle writes the files below dir as tar archive to path, compressed
+// as the extension of path says.
+func packBundle(dir, path string) error {
+	algo, err := bundleCompression(path)
+	if err != nil {
+		return err
+	}
+	return packTar(dir, path, algo)
+}
+
+// packTar replaces path with a tar archive of the files below dir,
+// compressed with algo unless it is nil. Blobs shared by several
+// repositories are stored once, the other copies are hard links.
+func packTar(dir, path string, algo *compression.Algorithm) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("creating %s: %w", path, err)
+	}
+	defer os.Remove(f.Name())
+
+	buf := bufio.NewWriterSize(f, 1<<20)
+	var w io.Writer = buf
+	var compressor io.WriteCloser
+	if algo != nil {
+		if compressor, err = compression.CompressStream(buf, *algo, nil); err != nil {
+			_ = f.Close()
+			return fmt.Errorf("creating %s: %w", path, err)
+		}
+		w = compressor
+	}
+	tw := tar.NewWriter(w)
+	blobs := map[string]string{}
+	err = filepath.WalkDir(dir, func(file string, entry fs.DirEntry, err error) error {
+		if err != nil || file == dir {
+			return err
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name, hdr.Uname, hdr.Gname, hdr.Uid, hdr.Gid = rel, "", "", 0, 0
+		if entry.IsDir() {
+			hdr.Name += "/"
+		}
+		if sum, ok := blobChecksum(rel); ok {
+			if first, ok := blobs[sum]; ok {
+				hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeLink, first, 0
+				return tw.WriteHeader(hdr)
+			}
+			blobs[sum] = rel
+		}
+		if err = tw.WriteHeader(hdr); err != nil || !entry.Type().IsRegular() {
+			return err
+		}
+		src, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		_, err = io.Copy(tw, src)
+		return err
+	})
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil && compressor != nil {
+		err = compressor.Close()
+	}
+	if err == nil {
+		err = buf.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("writing %s: %w", path, err)
+	}
+	if err = os.Chmod(f.Name(), 0o644); err != nil {
+		return fmt.Errorf("writing %s: %w", path, err)
+	}
+	if err = os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("replacing %s: %w", path, err)
+	}
+	return nil
+}
+
+// bundleImport is an extracted bundle.
+type bundleImport struct {
+	dir   string
+	index bundleIndex
+	// jobs copy the images of the index in the same order.
+	jobs []syncJob
+}
+
+// openBundle extracts and verifies --import-bundle, it returns a job for
+// every image of the bundle copying it below each destination.
+func openBundle(options Options) (*bundleImport, []syncJob, error) {
+	if options.Source != "" || options.Config != "" || options.SkopeoSyncConfig != "" || options.SrcNamespace != "" || options.ImagesFile != "" {
+		return nil, nil, errors.New("import reads the images from the bundle, --src, --config, --skopeo-sync-config, --src-namespace and --images-file can't be used")
+	}
+	if options.Destination == "" {
+		return nil, nil, errors.New("--dest is required with import")
+	}
+	defaults, err := jobFromOptions(options)
+	if err != nil {
+		return nil, nil, err
+	}
+	dir, err := os.MkdirTemp("", "imagesync-import-")
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating import directory: %w", err)
+	}
+	b := &bundleImport{dir: dir}
+	if err = b.open(options.ImportBundle); err != nil {
+		b.remove()
+		return nil, nil, err
+	}
+
+	for _, img := range b.index.Images {
+		job := defaults
+		job.Source = "dir:" + b.imageDir(img)
+		job.Destination = destinationsBelow(options.Destination, img.Repository+":"+img.Tag)
+		b.jobs = append(b.jobs, job)
+	}
+	logrus.Infof("Importing %d images of bundle %s created at %s", len(b.jobs), options.ImportBundle, b.index.CreatedAt.Format(time.RFC3339))
+	return b, slices.Clone(b.jobs), nil
+}
+
+func (b *bundleImport) imageDir(img bundleImage) string {
+	return filepath.Join(b.dir, bundleRepositories, filepath.FromSlash(img.Repository), img.Tag)
+}
+
+// checkBlobs verifies that the destinations have the blobs an incremental
+// bundle left out.
+func (b *bundleImport) checkBlobs(ctx context.Context, options Options) error {
+	if b == nil || !b.index.Incremental {
+		return nil
+	}
+	for i, img := range b.index.Images {
+		missing, err := missingBlobs(b.imageDir(img))
+		if err != nil {
+			return fmt.Errorf("reading %s:%s of bundle: %w", img.Repository, img.Tag, err)
+		}
+		if len(missing) == 0 {
+			continue
+		}
+		if err = checkDestinationBlobs(ctx, options, b.jobs[i], missing); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeInventory adds the imported images to the inventory at path.
+func (b *bundleImport) writeInventory(path string) error {
+	if b == nil || path == "" {
+		return nil
+	}
+	inv, err := loadInventory(path, true)
+	if err != nil {
+		return err
+	}
+	for _, img := range b.index.Images {
+		blobs, err := dirImageBlobs(b.imageDir(img))
+		if err != nil {
+			return fmt.Errorf("reading %s:%s of bundle: %w", img.Repository, img.Tag, err)
+		}
+		inv.add(img.Repository, img.Tag, img.Digest, blobs)
+	}
+	if err = inv.write(path); err != nil {
+		return fmt.Errorf("writing inventory: %w", err)
+	}
+	return nil
+}
+
+func (b *bundleImport) open(path string) error {
+	if err := b.extract(path); err != nil {
+		return err
+	}
+	if err := verifyChecksums(b.dir); err != nil {
+		return fmt.Errorf("verifying bundle %s: %w", path, err)
+	}
+	data, err := os.ReadFile(filepath.Join(b.dir, bundleIndexFile))
+	if err == nil {
+		err = json.Unmarshal(data, &b.index)
+	}
+	if err != nil {
+		return fmt.Errorf("reading bundle index: %w", err)
+	}
+	if b.index.Version != bundleVersion {
+		return fmt.Errorf("unsupported bundle version %d", b.index.Version)
+	}
+	for _, img := range b.index.Images {
+		if !filepath.IsLocal(img.Repository) || !filepath.IsLocal(img.Tag) {
+			return fmt.Errorf("invalid image %s:%s in bundle index", img.Repository, img.Tag)
+		}
+	}
+	return nil
+}
+
+// extract unpacks the bundle at path, compressed bundles are detected by
+// their content.
+func (b *bundleImport) extract(path string) error {
+	if err := extractTar(path, b.dir); err != nil {
+		return fmt.Errorf("extracting bundle: %w", err)
+	}
+	return nil
+}
+
+// extractTar unpacks the tar archive at path into dir, a compressed archive
+// is detected by its content.
+func extractTar(path, dir string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r, _, err := compression.AutoDecompress(bufio.NewReaderSize(f, 1<<20))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !filepath.IsLocal(hdr.Name) {
+			return fmt.Errorf("invalid path %q", hdr.Name)
+		}
+		target := filepath.Join(dir, filepath.FromSlash(hdr.Name))
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, 0o755)
+		case tar.TypeReg:
+			err = extractFile(tr, target)
+		case tar.TypeLink:
+			if !filepath.IsLocal(hdr.Linkname) {
+				return fmt.Errorf("invalid link %q", hdr.Linkname)
+			}
+			if err = os.MkdirAll(filepath.Dir(target), 0o755); err == nil {
+				err = os.Link(filepath.Join(dir, filepath.FromSlash(hdr.Linkname)), target)
+			}
+		default:
+			return fmt.Errorf("unsupported entry %s", hdr.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func extractFile(r io.Reader, path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, r); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// verifyChecksums checks every file below dir against the checksum file,
+// files without checksum are rejected. Hard links of a verified blob aren't
+// read again.
+func verifyChecksums(dir string) error {
+	data, err := os.ReadFile(filepath.Join(dir, bundleChecksumFile))
+	if err != nil {
+		return fmt.Errorf("reading checksums: %w", err)
+	}
+	sums := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		sum, rel, ok := strings.Cut(line, "  ")
+		if !ok {
+			return fmt.Errorf("invalid checksum line %q", line)
+		}
+		sums[rel] = sum
+	}
+	verified := map[string]fs.FileInfo{}
+	err = filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.Type().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == bundleChecksumFile {
+			return nil
+		}
+		want, ok := sums[rel]
+		if !ok {
+			return fmt.Errorf("%s has no checksum", rel)
+		}
+		delete(sums, rel)
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if prev, ok := verified[want]; ok && os.SameFile(prev, info) {
+			return nil
+		}
+		got, err := fileChecksum(path)
+		if err != nil {
+			return err
+		}
+		if got != want {
+			return fmt.Errorf("checksum of %s is %s, expected %s", rel, got, want)
+		}
+		verified[want] = info
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for rel := range sums {
+		return fmt.Errorf("%s is missing", rel)
+	}
+	return nil
+}
+
+func (b *bundleImport) remove() {
+	if b == nil {
+		return
+	}
+	if err := os.RemoveAll(b.dir); err != nil {
+		logrus.Warnf("failed removing %s: %s", b.dir, err)
+	}
+}
@@ -0,0 +1,391 @@
+package imagesync
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/containers/image/v5/pkg/docker/config"
+	"github.com/containers/image/v5/types"
+	"github.com/sirupsen/logrus"
+)
+
+// catalogPageSize is the number of repositories requested per catalog page.
+const catalogPageSize = 1000
+
+var (
+	linkNextPattern  = regexp.MustCompile(`<([^>]+)>\s*;\s*rel="?next"?`)
+	authParamPattern = regexp.MustCompile(`(\w+)="([^"]*)"`)
+)
+
+// namespace is a registry and a repository path prefix, e.g.
+// registry.example.com/team/.
+type namespace struct {
+	host   string
+	prefix string
+}
+
+func parseNamespace(value string) (namespace, error) {
+	host, path, _ := strings.Cut(strings.TrimPrefix(value, "docker://"), "/")
+	if host == "" {
+		return namespace{}, fmt.Errorf("invalid namespace %q, expected registry/path/", value)
+	}
+	path = strings.Trim(path, "/")
+	if path != "" {
+		path += "/"
+	}
+	return namespace{host: host, prefix: path}, nil
+}
+
+func (n namespace) String() string {
+	return n.host + "/" + n.prefix
+}
+
+// namespaceJobs returns a repository sync job for every repository of the
+// --src-namespace matching --repos-pattern, copied to the same path below
+// each --dest-namespace.
+func namespaceJobs(ctx context.Context, options Options, defaults syncJob) ([]syncJob, error) {
+	if options.Source != "" || options.Destination != "" || options.Config != "" || options.SkopeoSyncConfig != "" || options.ImagesFile != "" {
+		return nil, errors.New("--src-namespace can't be used together with --src, --dest, --config, --skopeo-sync-config or --images-file")
+	}
+	if options.DestNamespace == "" && options.ExportBundle == "" && len(defaults.RepoRewrite) == 0 {
+		return nil, errors.New("--dest-namespace or --repo-rewrite is required with --src-namespace")
+	}
+	src, err := parseNamespace(options.SrcNamespace)
+	if err != nil {
+		return nil, err
+	}
+	var pattern *regexp.Regexp
+	if options.ReposPattern != "" {
+		if pattern, err = regexp.Compile(options.ReposPattern); err != nil {
+			return nil, fmt.Errorf("%q is not valid regexp", options.ReposPattern)
+		}
+	}
+
+	sys := newSystemContext(options, "src", options.SrcStrictTLS, options.SrcPlainHTTP)
+	repos, err := listRepositories(ctx, sys, src, options.SrcPlainHTTP)
+	if err != nil {
+		return nil, fmt.Errorf("listing repositories of %s: %w", src, err)
+	}
+
+	var jobs []syncJob
+	for _, repo := range repos {
+		name, ok := strings.CutPrefix(repo, src.prefix)
+		if !ok || name == "" || (pattern != nil && !pattern.MatchString(name)) {
+			continue
+		}
+		job := defaults
+		job.Source = src.host + "/" + repo
+		job.Destination = defaults.RepoRewrite.destinationOf(job.Source, options.DestNamespace, name)
+		if job.Destination == "" && options.ExportBundle == "" {
+			return nil, fmt.Errorf("no --repo-rewrite matches %s and --dest-namespace isn't set", job.Source)
+		}
+		jobs = append(jobs, job)
+	}
+	if len(jobs) == 0 {
+		return nil, fmt.Errorf("no repository of %s matches", src)
+	}
+	logrus.Infof("Syncing %d repositories of %s", len(jobs), src)
+	return jobs, nil
+}
+
+// destinationsBelow returns the comma separated destinations of repository
+// name below each of the comma separated prefixes.
+func destinationsBelow(prefixes, name string) string {
+	var dests []string
+	for _, prefix := range strings.Split(prefixes, ",") {
+		if prefix = strings.TrimSpace(prefix); prefix != "" {
+			dests = append(dests, strings.TrimSuffix(prefix, "/")+"/"+name)
+		}
+	}
+	return strings.Join(dests, ",")
+}
+
+// listRepositories lists the repositories below the namespace. Docker Hub
+// and Quay have no catalog, their organization APIs are used instead. The
+// catalog of other registries is read over http:// with plainHTTP.
+func listRepositories(ctx context.Context, sys *types.SystemContext, ns namespace, plainHTTP bool) ([]string, error) {
+	switch ns.host {
+	case "docker.io", "index.docker.io", "registry-1.docker.io":
+		return dockerHubRepositories(ctx, sys, ns)
+	case "quay.io":
+		return quayRepositories(ctx, sys, ns)
+	default:
+		return catalogRepositories(ctx, sys, ns.host, plainHTTP)
+	}
+}
+
+// catalogRepositories reads all pages of the /v2/_catalog API of host.
+func catalogRepositories(ctx context.Context, sys *types.SystemContext, host string, plainHTTP bool) ([]string, error) {
+	client := &registryClient{host: host, sys: sys, http: registryHTTPClient(sys), plainHTTP: plainHTTP}
+	next := fmt.Sprintf("/v2/_catalog?n=%d", catalogPageSize)
+	var repos []string
+	for next != "" {
+		resp, err := client.get(ctx, next, "registry:catalog:*")
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Repositories []string `json:"repositories"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("parsing catalog: %w", err)
+		}
+		repos = append(repos, page.Repositories...)
+		next = nextLink(resp)
+	}
+	return repos, nil
+}
+
+// nextLink returns the path of the next page of a paginated registry
+// response, empty on the last page.
+func nextLink(resp *http.Response) string {
+	m := linkNextPattern.FindStringSubmatch(resp.Header.Get("Link"))
+	if m == nil {
+		return ""
+	}
+	if u, err := url.Parse(m[1]); err == nil && u.IsAbs() {
+		return u.RequestURI()
+	}
+	return m[1]
+}
+
+// dockerHubRepositories lists the repositories of a Docker Hub namespace,
+// private repositories are included if credentials for docker.io exist.
+func dockerHubRepositories(ctx context.Context, sys *types.SystemContext, ns namespace) ([]string, error) {
+	org := strings.TrimSuffix(ns.prefix, "/")
+	if org == "" || strings.Contains(org, "/") {
+		return nil, fmt.Errorf("a Docker Hub namespace must be a single organization, got %q", ns.prefix)
+	}
+	client := registryHTTPClient(sys)
+	token := ""
+	if auth, err := config.GetCredentials(sys, "docker.io"); err == nil && auth.Username != "" {
+		if token, err = dockerHubLogin(ctx, client, auth.Username, auth.Password); err != nil {
+			logrus.Warnf("failed logging in to Docker Hub, listing public repositories only: %s", err)
+		}
+	}
+
+	next := fmt.Sprintf("https://hub.docker.com/v2/namespaces/%s/repositories?page_size=100", url.PathEscape(org))
+	var repos []string
+	for next != "" {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, next, nil)
+		if err != nil {
+			return nil, err
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		var page struct {
+			Next    string `json:"next"`
+			Results []struct {
+				Name string `json:"name"`
+			} `json:"results"`
+		}
+		if err = getJSON(client, req, &page); err != nil {
+			return nil, err
+		}
+		for _, result := range page.Results {
+			repos = append(repos, org+"/"+result.Name)
+		}
+		next = page.Next
+	}
+	return repos, nil
+}
+
+func dockerHubLogin(ctx context.Context, client *http.Client, username, password string) (string, error) {
+	body, err := json.Marshal(map[string]string{"username": username, "password": password})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://hub.docker.com/v2/users/login", strings.NewReader(string(body)))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	var login struct {
+		Token string `json:"token"`
+	}
+	if err = getJSON(client, req, &login); err != nil {
+		return "", err
+	}
+	return login.Token, nil
+}
+
+// quayRepositories lists the public repositories of a Quay organization.
+func quayRepositories(ctx context.Context, sys *types.SystemContext, ns namespace) ([]string, error) {
+	org := strings.TrimSuffix(ns.prefix, "/")
+	if org == "" || strings.Contains(org, "/") {
+		return nil, fmt.Errorf("a Quay namespace must be a single organization, got %q", ns.prefix)
+	}
+	client := registryHTTPClient(sys)
+	var (
+		repos    []string
+		nextPage string
+	)
+	for {
+		query := url.Values{"namespace": {org}, "public": {"true"}}
+		if nextPage != "" {
+			query.Set("next_page", nextPage)
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://quay.io/api/v1/repository?"+query.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Repositories []struct {
+				Name string `json:"name"`
+			} `json:"repositories"`
+			NextPage string `json:"next_page"`
+		}
+		if err = getJSON(client, req, &page); err != nil {
+			return nil, err
+		}
+		for _, repo := range page.Repositories {
+			repos = append(repos, org+"/"+repo.Name)
+		}
+		if page.NextPage == "" {
+			return repos, nil
+		}
+		nextPage = page.NextPage
+	}
+}
+
+func getJSON(client *http.Client, req *http.Request, v any) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s: unexpected status %s", req.Method, req.URL, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// registryClient sends requests to the distribution API of a registry,
+// answering bearer token challenges with the credentials of sys.
+type registryClient struct {
+	host  string
+	sys   *types.SystemContext
+	http  *http.Client
+	token string
+	// plainHTTP sends all requests over http://.
+	plainHTTP bool
+	// accept is the Accept header of the requests, e.g. the manifest
+	// media types.
+	accept string
+}
+
+// get requests path, a relative next link of a previous response, with the
+// token scope needed for it.
+func (c *registryClient) get(ctx context.Context, path, scope string) (*http.Response, error) {
+	return c.request(ctx, http.MethodGet, path, scope)
+}
+
+// request sends a method request of path, a successful response is
+// returned. Registries without strict TLS are tried over plain http if https
+// fails.
+func (c *registryClient) request(ctx context.Context, method, path, scope string) (*http.Response, error) {
+	if c.plainHTTP {
+		return c.do(ctx, method, "http", path, scope)
+	}
+	resp, err := c.do(ctx, method, "https", path, scope)
+	if err != nil && c.sys != nil && c.sys.DockerInsecureSkipTLSVerify == types.OptionalBoolTrue {
+		logrus.Debugf("https request to %s failed, trying http: %s", c.host, err)
+		resp, err = c.do(ctx, method, "http", path, scope)
+	}
+	return resp, err
+}
+
+func (c *registryClient) do(ctx context.Context, method, scheme, path, scope string) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, method, scheme+"://"+c.host+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		if c.accept != "" {
+			req.Header.Set("Accept", c.accept)
+		}
+		if c.token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		} else if auth, err := config.GetCredentials(c.sys, c.host); err == nil && auth.Username != "" {
+			req.SetBasicAuth(auth.Username, auth.Password)
+		}
+		resp, err := c.http.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			return resp, nil
+		}
+		challenge := resp.Header.Get("WWW-Authenticate")
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized || attempt > 0 || !strings.HasPrefix(strings.ToLower(challenge), "bearer ") {
+			return nil, &registryStatusError{method: method, path: path, status: resp.Status, code: resp.StatusCode}
+		}
+		if c.token, err = c.fetchToken(ctx, challenge, scope); err != nil {
+			return nil, fmt.Errorf("getting registry token: %w", err)
+		}
+	}
+}
+
+// registryStatusError is an unexpected status of a registry API response.
+type registryStatusError struct {
+	method string
+	path   string
+	status string
+	code   int
+}
+
+func (e *registryStatusError) Error() string {
+	return fmt.Sprintf("%s %s: unexpected status %s", e.method, e.path, e.status)
+}
+
+// fetchToken requests a token for scope, space separated scopes, from the
+// realm of a bearer challenge.
+func (c *registryClient) fetchToken(ctx context.Context, challenge, scope string) (string, error) {
+	params := map[string]string{}
+	for _, m := range authParamPattern.FindAllStringSubmatch(challenge, -1) {
+		params[strings.ToLower(m[1])] = m[2]
+	}
+	realm, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return "", fmt.Errorf("invalid bearer challenge %q", challenge)
+	}
+	query := realm.Query()
+	if service := params["service"]; service != "" {
+		query.Set("service", service)
+	}
+	for _, s := range strings.Fields(scope) {
+		query.Add("scope", s)
+	}
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if auth, err := config.GetCredentials(c.sys, c.host); err == nil && auth.Username != "" {
+		req.SetBasicAuth(auth.Username, auth.Password)
+	}
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err = getJSON(c.http, req, &token); err != nil {
+		return "", err
+	}
+	if token.Token != "" {
+		return token.Token, nil
+	}
+	return token.AccessToken, nil
+}
@@ -0,0 +1,106 @@
+package imagesync
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// checkpointVersion is the version of the --state-file format.
+const checkpointVersion = 1
+
+// checkpointEntry is a destination tag completed by an interrupted sync.
+type checkpointEntry struct {
+	Source   string    `json:"source,omitempty"`
+	Digest   string    `json:"digest,omitempty"`
+	CopiedAt time.Time `json:"copiedAt"`
+}
+
+type checkpointFile struct {
+	Version int                        `json:"version"`
+	Tags    map[string]checkpointEntry `json:"tags"`
+}
+
+// checkpoint records the completed copies of a sync in the state file, so a
+// restarted sync skips them. The file is removed once a sync finishes
+// without failures, a nil checkpoint doesn't record anything.
+type checkpoint struct {
+	path string
+
+	mu   sync.Mutex
+	file checkpointFile
+}
+
+// loadCheckpoint returns nil if no state file is requested and an empty
+// checkpoint if the state file doesn't exist yet.
+func loadCheckpoint(path string) (*checkpoint, error) {
+	if path == "" {
+		return nil, nil
+	}
+	c := &checkpoint{path: path, file: checkpointFile{Version: checkpointVersion, Tags: map[string]checkpointEntry{}}}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading state file: %w", err)
+	}
+	var file checkpointFile
+	if err = json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("parsing state file %s: %w", path, err)
+	}
+	if file.Version != checkpointVersion {
+		return nil, fmt.Errorf("state file %s has unsupported version %d", path, file.Version)
+	}
+	if file.Tags != nil {
+		c.file.Tags = file.Tags
+	}
+	if len(c.file.Tags) > 0 {
+		logrus.Infof("Resuming sync, %d tags were completed according to %s", len(c.file.Tags), path)
+	}
+	return c, nil
+}
+
+// done reports whether the copy to dest was completed by an earlier run.
+func (c *checkpoint) done(dest string) bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.file.Tags[dest]
+	return ok
+}
+
+// record adds a completed copy and writes the state file.
+func (c *checkpoint) record(tag TagResult) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.file.Tags[tag.Destination] = checkpointEntry{Source: tag.Source, Digest: tag.Digest, CopiedAt: time.Now().UTC()}
+	data, err := json.MarshalIndent(c.file, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(c.path, data)
+	}
+	if err != nil {
+		logrus.Warnf("failed writing state file: %s", err)
+	}
+}
+
+// remove deletes the state file after a completed sync.
+func (c *checkpoint) remove() error {
+	if c == nil {
+		return nil
+	}
+	if err := os.Remove(c.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("removing state file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package imagesync
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+// TestCheckpointResume interrupts a sync by a failing tag and checks that the
+// next run only copies the tags the first one didn't.
+func TestCheckpointResume(t *testing.T) {
+	var failing atomic.Bool
+	failing.Store(true)
+	src := newTestRegistry(t, func(next http.Handler) http.Handler {
+		fail := failTag("2", http.StatusNotFound)(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if failing.Load() {
+				fail.ServeHTTP(w, r)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+	dest := newTestRegistry(t, nil)
+	failing.Store(false)
+	pushTestImage(t, src, "app", "1", 1)
+	pushTestImage(t, src, "app", "2", 1)
+	failing.Store(true)
+
+	state := filepath.Join(t.TempDir(), "sync.state")
+	opts := testOptions(src+"/app", dest+"/app")
+	// without the checkpoint existing tags would be copied again
+	opts.Overwrite = true
+	opts.KeepGoing = true
+	opts.StateFile = state
+
+	result, err := (&Syncer{}).Sync(context.Background(), opts)
+	if !errors.Is(err, ErrPartialFailure) {
+		t.Fatalf("first Sync() = %v, want ErrPartialFailure", err)
+	}
+	if totals := result.totals(); totals.Copied != 1 || totals.Failed != 1 {
+		t.Fatalf("first run copied %d and failed %d tags, want 1 each", totals.Copied, totals.Failed)
+	}
+	c, err := loadCheckpoint(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.done(dest+"/app:1") || c.done(dest+"/app:2") {
+		t.Errorf("state file tags = %v, want only %s/app:1", c.file.Tags, dest)
+	}
+
+	failing.Store(false)
+	result, err = (&Syncer{}).Sync(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("second Sync() = %v", err)
+	}
+	if totals := result.totals(); totals.Copied != 1 || totals.Skipped != 1 {
+		t.Errorf("second run copied %d and skipped %d tags, want 1 each", totals.Copied, totals.Skipped)
+	}
+	if _, err = os.Stat(state); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("state file of the completed sync wasn't removed: %v", err)
+	}
+}
+
+func TestCheckpointVersion(t *testing.T) {
+	state := filepath.Join(t.TempDir(), "sync.state")
+	if err := os.WriteFile(state, []byte(`{"version": 2, "tags": {}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadCheckpoint(state); err == nil {
+		t.Error("loadCheckpoint() of version 2 = nil, want an error")
+	}
+}
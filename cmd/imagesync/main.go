@@ -1,15 +1,20 @@
 package main
 
 import (
-	"log"
 	"os"
 
+	"github.com/containers/storage/pkg/reexec"
+	"github.com/sirupsen/logrus"
 	"github.com/trim21/imagesync"
 )
 
 func main() {
+	// containers-storage extracts layers in a re-executed child process
+	if reexec.Init() {
+		return
+	}
 	if err := imagesync.Execute(); err != nil {
-		log.Fatal(err)
-		os.Exit(1)
+		logrus.Error(err)
+		os.Exit(imagesync.ExitCode(err))
 	}
 }
@@ -0,0 +1,374 @@
+package imagesync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/containers/image/v5/types"
+	"gopkg.in/yaml.v3"
+)
+
+// syncJob is a single source to destination pair with its tag selection.
+type syncJob struct {
+	Source            string
+	SrcFormat         string
+	FallbackSources   []fallbackSource
+	Destination       string
+	DestType          string
+	SrcStrictTLS      bool
+	DestStrictTLS     bool
+	SrcPlainHTTP      bool
+	DestPlainHTTP     bool
+	TagsPattern       string
+	SkipTagsPattern   string
+	SkipTags          []string
+	Tags              []string
+	TagRewrite        tagRewriter
+	Retag             retagRules
+	Semver            string
+	KeepLatestN       int
+	Age               ageFilter
+	Metadata          metadataFilter
+	Overwrite         bool
+	CompareDigests    bool
+	Prune             bool
+	MaxConcurrentTags int
+	Platforms         platformFilter
+	IncludeReferrers  bool
+	// SrcCredentials and SrcCertDir override the source registry login and
+	// certificates of the options.
+	SrcCredentials *types.DockerAuthConfig
+	SrcCertDir     string
+	// DestCredentials override the destination registry login.
+	DestCredentials *types.DockerAuthConfig
+	// CredentialHelpers log in to the registries without credentials of
+	// the job.
+	CredentialHelpers credentialHelpers
+	// RepoRewrite names the destinations of the jobs computed from their
+	// source.
+	RepoRewrite repoRewriter
+	// ArchiveTags copies the images of an archive of a glob or directory
+	// source to their own tags, even if the archive holds a single image.
+	ArchiveTags bool
+	// Retention is the retention policy of a config file repository, nil
+	// keeps all destination tags.
+	Retention *retentionPolicy
+}
+
+// configFile is the format of the --config file. The keys of a repository
+// are named like the command line flags, missing keys default to the flags.
+type configFile struct {
+	Repositories []configRepository `yaml:"repositories"`
+}
+
+type configRepository struct {
+	Src               string           `yaml:"src"`
+	SrcFormat         *string          `yaml:"src-format"`
+	FallbackSrc       []string         `yaml:"fallback-src"`
+	Dest              string           `yaml:"dest"`
+	DestType          *string          `yaml:"dest-type"`
+	SrcStrictTLS      *bool            `yaml:"src-strict-tls"`
+	DestStrictTLS     *bool            `yaml:"dest-strict-tls"`
+	SrcPlainHTTP      *bool            `yaml:"src-plain-http"`
+	DestPlainHTTP     *bool            `yaml:"dest-plain-http"`
+	TagsPattern       *string          `yaml:"tags-pattern"`
+	SkipTagsPattern   *string          `yaml:"skip-tags-pattern"`
+	SkipTags          []string         `yaml:"skip-tags"`
+	Tags              []string         `yaml:"tags"`
+	TagRewrite        []string         `yaml:"tag-rewrite"`
+	Retag             []string         `yaml:"retag"`
+	Semver            *string          `yaml:"semver"`
+	KeepLatestN       *int             `yaml:"keep-latest-n"`
+	MinAge            *string          `yaml:"min-age"`
+	MaxAge            *string          `yaml:"max-age"`
+	NewerThan         *string          `yaml:"newer-than"`
+	FilterAnnotation  []string         `yaml:"filter-annotation"`
+	FilterLabel       []string         `yaml:"filter-label"`
+	Overwrite         *overwriteValue  `yaml:"overwrite"`
+	CompareDigests    *bool            `yaml:"compare-digests"`
+	Prune             *bool            `yaml:"prune"`
+	MaxConcurrentTags *int             `yaml:"max-concurrent-tags"`
+	Platforms         *string          `yaml:"platforms"`
+	AllPlatforms      *bool            `yaml:"all-platforms"`
+	IncludeReferrers  *bool            `yaml:"include-referrers"`
+	Retention         *configRetention `yaml:"retention"`
+	CredentialHelper  []string         `yaml:"credential-helper"`
+}
+
+// syncJobs returns the jobs of the config file, the jobs of the repositories
+// of --src-namespace, or the single job described by the options.
+func syncJobs(ctx context.Context, options Options) ([]syncJob, error) {
+	defaults, err := jobFromOptions(options)
+	if err != nil {
+		return nil, err
+	}
+	if options.SrcNamespace != "" {
+		return namespaceJobs(ctx, options, defaults)
+	}
+	if options.ImagesFile != "" {
+		return imagesFileJobs(options, defaults)
+	}
+	if len(options.Manifests) > 0 {
+		return manifestJobs(options, defaults)
+	}
+	if options.SkopeoSyncConfig != "" {
+		return skopeoJobs(options, defaults)
+	}
+	if files, ok, err := archiveFiles(options.Source); ok || err != nil {
+		if err != nil {
+			return nil, err
+		}
+		return archiveJobs(defaults, files)
+	}
+	if options.Config == "" {
+		if defaults.Destination == "" && options.ExportBundle == "" {
+			return nil, errors.New("--dest is required unless --config is given")
+		}
+		return []syncJob{defaults}, nil
+	}
+
+	if options.Source != "" || options.Destination != "" {
+		return nil, errors.New("--src and --dest can't be used together with --config")
+	}
+	return loadConfig(options.Config, defaults, options.ExportBundle == "")
+}
+
+func jobFromOptions(options Options) (syncJob, error) {
+	platforms, err := parsePlatforms(options.Platforms)
+	if err != nil {
+		return syncJob{}, err
+	}
+	tagRewrite, err := parseTagRewrites(options.TagRewrite)
+	if err != nil {
+		return syncJob{}, err
+	}
+	retag, err := parseRetags(options.Retag)
+	if err != nil {
+		return syncJob{}, err
+	}
+	age, err := parseAgeFilter(options.MinAge, options.MaxAge, options.NewerThan)
+	if err != nil {
+		return syncJob{}, err
+	}
+	metadata, err := parseMetadataFilter(options.FilterAnnotations, options.FilterLabels)
+	if err != nil {
+		return syncJob{}, err
+	}
+	helpers, err := parseCredentialHelpers(options.CredentialHelpers)
+	if err != nil {
+		return syncJob{}, err
+	}
+	repoRewrite, err := parseRepoRewrites(options.RepoRewrite)
+	if err != nil {
+		return syncJob{}, err
+	}
+	fallbacks, err := parseFallbackSources(options.FallbackSources)
+	if err != nil {
+		return syncJob{}, err
+	}
+	return syncJob{
+		Source:            options.Source,
+		SrcFormat:         options.SrcFormat,
+		FallbackSources:   fallbacks,
+		Destination:       options.Destination,
+		DestType:          options.DestType,
+		SrcStrictTLS:      options.SrcStrictTLS,
+		DestStrictTLS:     options.DestStrictTLS,
+		SrcPlainHTTP:      options.SrcPlainHTTP,
+		DestPlainHTTP:     options.DestPlainHTTP,
+		TagsPattern:       options.TagsPattern,
+		SkipTagsPattern:   options.SkipTagsPattern,
+		SkipTags:          options.SkipTags,
+		Tags:              options.Tags,
+		TagRewrite:        tagRewrite,
+		Retag:             retag,
+		Semver:            options.Semver,
+		KeepLatestN:       options.KeepLatestN,
+		Age:               age,
+		Metadata:          metadata,
+		Overwrite:         options.Overwrite,
+		CompareDigests:    options.CompareDigests,
+		Prune:             options.Prune,
+		MaxConcurrentTags: options.MaxConcurrentTags,
+		Platforms:         platforms,
+		IncludeReferrers:  options.IncludeReferrers,
+		CredentialHelpers: helpers,
+		RepoRewrite:       repoRewrite,
+	}, nil
+}
+
+// loadConfig reads the jobs of the config file, an export ignores the
+// destinations and doesn't need them.
+func loadConfig(path string, defaults syncJob, needDest bool) ([]syncJob, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config: %w", err)
+	}
+	defer f.Close()
+
+	var cfg configFile
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err = dec.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("parsing config %s: %w", path, err)
+	}
+	if len(cfg.Repositories) == 0 {
+		return nil, fmt.Errorf("config %s has no repositories", path)
+	}
+
+	jobs := make([]syncJob, 0, len(cfg.Repositories))
+	for i, repo := range cfg.Repositories {
+		if repo.Src == "" || (repo.Dest == "" && needDest) {
+			return nil, fmt.Errorf("config %s: repository %d needs src and dest", path, i+1)
+		}
+		job := defaults
+		job.Source = repo.Src
+		job.Destination = repo.Dest
+		if job.FallbackSources, err = parseFallbackSources(repo.FallbackSrc); err != nil {
+			return nil, fmt.Errorf("config %s: repository %d: %w", path, i+1, err)
+		}
+		setIfNotNil(&job.SrcFormat, repo.SrcFormat)
+		setIfNotNil(&job.DestType, repo.DestType)
+		setIfNotNil(&job.SrcStrictTLS, repo.SrcStrictTLS)
+		setIfNotNil(&job.DestStrictTLS, repo.DestStrictTLS)
+		setIfNotNil(&job.SrcPlainHTTP, repo.SrcPlainHTTP)
+		setIfNotNil(&job.DestPlainHTTP, repo.DestPlainHTTP)
+		setIfNotNil(&job.TagsPattern, repo.TagsPattern)
+		setIfNotNil(&job.SkipTagsPattern, repo.SkipTagsPattern)
+		setIfNotNil(&job.Semver, repo.Semver)
+		setIfNotNil(&job.KeepLatestN, repo.KeepLatestN)
+		if err = repo.setAge(&job.Age); err != nil {
+			return nil, fmt.Errorf("config %s: repository %d: %w", path, i+1, err)
+		}
+		if repo.FilterAnnotation != nil {
+			if job.Metadata.Annotations, err = parseMetadataConditions("filter-annotation", repo.FilterAnnotation); err != nil {
+				return nil, fmt.Errorf("config %s: repository %d: %w", path, i+1, err)
+			}
+		}
+		if repo.FilterLabel != nil {
+			if job.Metadata.Labels, err = parseMetadataConditions("filter-label", repo.FilterLabel); err != nil {
+				return nil, fmt.Errorf("config %s: repository %d: %w", path, i+1, err)
+			}
+		}
+		if repo.Overwrite != nil {
+			job.Overwrite = repo.Overwrite.all
+			job.CompareDigests = job.CompareDigests || repo.Overwrite.changed
+		}
+		setIfNotNil(&job.CompareDigests, repo.CompareDigests)
+		setIfNotNil(&job.Prune, repo.Prune)
+		setIfNotNil(&job.MaxConcurrentTags, repo.MaxConcurrentTags)
+		setIfNotNil(&job.IncludeReferrers, repo.IncludeReferrers)
+		if repo.SkipTags != nil {
+			job.SkipTags = repo.SkipTags
+		}
+		if repo.Tags != nil {
+			job.Tags = repo.Tags
+		}
+		if repo.TagRewrite != nil {
+			if job.TagRewrite, err = parseTagRewrites(repo.TagRewrite); err != nil {
+				return nil, fmt.Errorf("config %s: repository %d: %w", path, i+1, err)
+			}
+		}
+		if repo.Retag != nil {
+			if job.Retag, err = parseRetags(repo.Retag); err != nil {
+				return nil, fmt.Errorf("config %s: repository %d: %w", path, i+1, err)
+			}
+		}
+		if repo.CredentialHelper != nil {
+			if job.CredentialHelpers, err = parseCredentialHelpers(repo.CredentialHelper); err != nil {
+				return nil, fmt.Errorf("config %s: repository %d: %w", path, i+1, err)
+			}
+		}
+		if repo.Platforms != nil && repo.AllPlatforms != nil {
+			return nil, fmt.Errorf("config %s: repository %d can't set both platforms and all-platforms", path, i+1)
+		}
+		if repo.Platforms != nil {
+			if job.Platforms, err = parsePlatforms(*repo.Platforms); err != nil {
+				return nil, fmt.Errorf("config %s: repository %d: %w", path, i+1, err)
+			}
+		}
+		if repo.AllPlatforms != nil && *repo.AllPlatforms {
+			job.Platforms = nil
+		}
+		if repo.Retention != nil {
+			if job.Retention, err = parseRetention(*repo.Retention); err != nil {
+				return nil, fmt.Errorf("config %s: repository %d: %w", path, i+1, err)
+			}
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+// setAge overrides the age limits set by the repository.
+func (repo configRepository) setAge(age *ageFilter) error {
+	var err error
+	if repo.MinAge != nil {
+		if age.MinAge, err = parseAge("min-age", *repo.MinAge); err != nil {
+			return err
+		}
+	}
+	if repo.MaxAge != nil {
+		if age.MaxAge, err = parseAge("max-age", *repo.MaxAge); err != nil {
+			return err
+		}
+	}
+	if repo.NewerThan != nil {
+		if age.NewerThan, err = parseDate("newer-than", *repo.NewerThan); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func setIfNotNil[T any](dst *T, v *T) {
+	if v != nil {
+		*dst = *v
+	}
+}
+
+// overwriteValue is --overwrite and the overwrite key of the config file,
+// true, false or changed. changed only copies the existing tags whose digest
+// differs, like --compare-digests.
+type overwriteValue struct {
+	all, changed bool
+}
+
+func (v *overwriteValue) Set(value string) error {
+	if value == "changed" {
+		v.all, v.changed = false, true
+		return nil
+	}
+	all, err := strconv.ParseBool(value)
+	if err != nil {
+		return errors.New("expected true, false or changed")
+	}
+	v.all, v.changed = all, false
+	return nil
+}
+
+func (v *overwriteValue) String() string {
+	if v.changed {
+		return "changed"
+	}
+	return strconv.FormatBool(v.all)
+}
+
+// IsBoolFlag lets --overwrite be given without value.
+func (v *overwriteValue) IsBoolFlag() bool {
+	return true
+}
+
+func (v *overwriteValue) UnmarshalYAML(node *yaml.Node) error {
+	if node.Tag == "!!bool" {
+		return node.Decode(&v.all)
+	}
+	if node.Value != "changed" {
+		return fmt.Errorf("line %d: invalid overwrite %q, expected true, false or changed", node.Line, node.Value)
+	}
+	v.changed = true
+	return nil
+}
@@ -0,0 +1,152 @@
+package imagesync
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/types"
+	"github.com/docker/docker-credential-helpers/client"
+	"github.com/docker/docker-credential-helpers/credentials"
+	"github.com/sirupsen/logrus"
+)
+
+// credentialHelpers are the docker credential helpers of --credential-helper
+// by registry, fallback is used for the other registries.
+type credentialHelpers struct {
+	registries map[string]string
+	fallback   string
+}
+
+// parseCredentialHelpers parses values like ecr-login or
+// ghcr.io=osxkeychain. A helper is the docker-credential-<helper> program.
+func parseCredentialHelpers(values []string) (credentialHelpers, error) {
+	var h credentialHelpers
+	for _, v := range values {
+		registry, helper, ok := strings.Cut(v, "=")
+		if !ok {
+			registry, helper = "", v
+		}
+		if helper == "" || strings.ContainsAny(helper, `/\`) {
+			return credentialHelpers{}, fmt.Errorf("invalid --credential-helper %q, expected [registry=]helper", v)
+		}
+		if registry == "" {
+			h.fallback = helper
+			continue
+		}
+		if h.registries == nil {
+			h.registries = map[string]string{}
+		}
+		h.registries[registry] = helper
+	}
+	return h, nil
+}
+
+func (h credentialHelpers) enabled() bool {
+	return h.fallback != "" || len(h.registries) > 0
+}
+
+// helper returns the helper of a registry, empty if there is none.
+func (h credentialHelpers) helper(registry string) string {
+	if helper, ok := h.registries[registry]; ok {
+		return helper
+	}
+	return h.fallback
+}
+
+// credentialStore runs the credential helpers, their credentials are
+// cached for the sync.
+type credentialStore struct {
+	mu    sync.Mutex
+	cache map[string]*types.DockerAuthConfig
+}
+
+func newCredentialStore() *credentialStore {
+	return &credentialStore{cache: map[string]*types.DockerAuthConfig{}}
+}
+
+// get returns the credentials helper stores for registry, nil if it has
+// none.
+func (s *credentialStore) get(helper, registry string) (*types.DockerAuthConfig, error) {
+	key := helper + "\x00" + registry
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if auth, ok := s.cache[key]; ok {
+		return auth, nil
+	}
+	program := helper
+	if !strings.HasPrefix(program, "docker-credential-") {
+		program = "docker-credential-" + program
+	}
+	serverURL := registry
+	if registry == "docker.io" {
+		// docker stores Docker Hub credentials by its v1 URL
+		serverURL = "https://index.docker.io/v1/"
+	}
+	creds, err := client.Get(client.NewShellProgramFunc(program), serverURL)
+	var auth *types.DockerAuthConfig
+	switch {
+	case credentials.IsErrCredentialsNotFound(err):
+		logrus.Debugf("%s has no credentials for %s", program, registry)
+	case err != nil:
+		return nil, fmt.Errorf("getting credentials for %s from %s: %w", registry, program, err)
+	case creds.Username == "<token>":
+		auth = &types.DockerAuthConfig{IdentityToken: creds.Secret}
+	default:
+		auth = &types.DockerAuthConfig{Username: creds.Username, Password: creds.Secret}
+	}
+	s.cache[key] = auth
+	return auth, nil
+}
+
+// prepareCredentialHelpers logs in to the registries of the job with the
+// credential helpers. Credentials of the job take precedence, the
+// destination credentials are only set if all registry destinations are on
+// the same registry.
+func (r *syncRun) prepareCredentialHelpers(src source, dests []destination) error {
+	if !r.job.CredentialHelpers.enabled() {
+		return nil
+	}
+	if registry := registryOf(src.value); src.kind == sourceRegistry && registry != "" && r.opts.SourceCtx.DockerAuthConfig == nil {
+		if helper := r.job.CredentialHelpers.helper(registry); helper != "" {
+			auth, err := r.credentials.get(helper, registry)
+			if err != nil {
+				return err
+			}
+			r.opts.SourceCtx.DockerAuthConfig = auth
+		}
+	}
+
+	registries := map[string]bool{}
+	for _, dest := range dests {
+		if dest.kind == destinationRegistry {
+			registries[registryOf(dest.value)] = true
+		}
+	}
+	for registry := range registries {
+		helper := r.job.CredentialHelpers.helper(registry)
+		switch {
+		case helper == "" || registry == "":
+		case len(registries) > 1:
+			logrus.Warnf("the destinations of %s are on several registries, using the auth files instead of %s", r.job.Source, helper)
+		default:
+			auth, err := r.credentials.get(helper, registry)
+			if err != nil {
+				return err
+			}
+			r.opts.DestinationCtx.DockerAuthConfig = auth
+		}
+	}
+	return nil
+}
+
+// registryOf returns the registry of a registry reference, empty if it
+// doesn't parse.
+func registryOf(ref string) string {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return ""
+	}
+	return reference.Domain(named)
+}
@@ -0,0 +1,196 @@
+package imagesync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"text/tabwriter"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/samber/lo"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+// tagDeletion is a tag the delete command selected, with its outcome.
+type tagDeletion struct {
+	Tag    string `json:"tag"`
+	Status string `json:"status"`
+	Digest string `json:"digest,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+const (
+	deletionDeleted = "deleted"
+	deletionPlanned = "planned"
+	deletionKept    = "kept"
+	deletionFailed  = "failed"
+)
+
+// deleteTags is the action of the delete command. It deletes the tags of the
+// --dest registry repository which the tag filters and --older-than select,
+// in dry-run mode they are only listed. Like --prune, a tag whose manifest
+// is shared with a tag that isn't selected is kept, registries delete the
+// manifest with all its tags.
+func deleteTags(c *cli.Context) error {
+	if err := setupLogging(c); err != nil {
+		return err
+	}
+	output := c.String("output")
+	if output != "text" && output != "json" {
+		return fmt.Errorf("unsupported output %q", output)
+	}
+	if c.NArg() > 0 {
+		return fmt.Errorf("delete takes no arguments, the repository is --dest")
+	}
+
+	opts := optionsFromFlags(c).withDefaults()
+	if c.IsSet("older-than") {
+		opts.MinAge = c.String("older-than")
+	}
+	if opts.TagsPattern == "" && len(opts.Tags) == 0 && opts.Semver == "" && opts.MinAge == "" && opts.MaxAge == "" && opts.NewerThan == "" {
+		return errors.New("delete needs --tags-pattern, --tag, --semver or --older-than, it doesn't delete all tags of a repository")
+	}
+	if opts.KeepLatestN > 0 {
+		return errors.New("--keep-latest selects tags to copy, it can't be used with delete")
+	}
+	dest, err := detectDestination(opts.Destination, opts.DestType)
+	if err != nil {
+		return err
+	}
+	if dest.kind != destinationRegistry || dest.hasTag() {
+		return fmt.Errorf("%s is not a registry repository", opts.Destination)
+	}
+	destRepo, err := dest.reference()
+	if err != nil {
+		return err
+	}
+
+	jobs := make([]syncJob, 1)
+	if jobs[0], err = jobFromOptions(opts); err != nil {
+		return err
+	}
+	if err = (&Syncer{}).setCredentials(c.Context, opts, jobs); err != nil {
+		return err
+	}
+	removeAuthFiles, err := kubernetesAuthFiles(c.Context, &opts)
+	if err != nil {
+		return err
+	}
+	defer removeAuthFiles()
+	run := newSyncRun(opts, jobs[0], &syncState{result: newResult(opts)})
+	// the age filter reads the creation times of the destination images
+	run.opts.SourceCtx = run.opts.DestinationCtx
+
+	ctx := c.Context
+	destTags, err := dest.tags(ctx, run.opts.DestinationCtx, destRepo)
+	if err != nil {
+		return fmt.Errorf("getting destination tags: %w", err)
+	}
+	// signatures and attestations go with the images they refer to
+	destTags = slices.DeleteFunc(destTags, referrerTagPattern.MatchString)
+	tags := destTags
+	if len(run.job.Tags) > 0 {
+		tags = lo.Intersect(run.job.Tags, destTags)
+	}
+	if tags, err = run.job.selectTags(tags); err != nil {
+		return err
+	}
+	if run.job.Age.enabled() && len(tags) > 0 {
+		tags = run.filterAge(ctx, destRepo, tags)
+	}
+
+	// a failure of all tags is counted below
+	deletions, _ := run.deleteTags(ctx, dest, tags, subtract(destTags, tags))
+	if err = writeDeletions(os.Stdout, output, deletions); err != nil {
+		return err
+	}
+	counts := lo.CountValuesBy(deletions, func(d tagDeletion) string { return d.Status })
+	if counts[deletionFailed] > 0 {
+		return fmt.Errorf("failed deleting %d of %d tags of %s", counts[deletionFailed], len(tags), destRepo.DockerReference().Name())
+	}
+	if opts.DryRun {
+		logrus.Infof("Would delete %d of %d tags of %s", counts[deletionPlanned], len(destTags), destRepo.DockerReference().Name())
+	} else {
+		logrus.Infof("Deleted %d of %d tags of %s", counts[deletionDeleted], len(destTags), destRepo.DockerReference().Name())
+	}
+	return nil
+}
+
+// deleteTags deletes tags of dest whose manifest none of the kept tags
+// shares. If the digest of a kept tag can't be read, every tag fails with
+// the returned error.
+func (r *syncRun) deleteTags(ctx context.Context, dest destination, tags, kept []string) ([]tagDeletion, error) {
+	keptDigests, err := r.keptDigests(ctx, dest, kept)
+	if err != nil {
+		logrus.Warnf("Not deleting tags, %s", err)
+		return lo.Map(tags, func(tag string, _ int) tagDeletion {
+			return tagDeletion{Tag: tag, Status: deletionFailed, Error: err.Error()}
+		}), err
+	}
+	digests := r.destDigests(ctx, dest, tags)
+
+	deletions := make([]tagDeletion, 0, len(tags))
+	deleted := map[digest.Digest]bool{}
+	for _, tag := range tags {
+		d := tagDeletion{Tag: tag}
+		dgst, ok := digests[tag]
+		ref, err := dest.tagReference(tag)
+		switch {
+		case err != nil:
+			d.Status, d.Error = deletionFailed, err.Error()
+		case !ok:
+			d.Status, d.Error = deletionFailed, "its digest couldn't be read"
+		case keptDigests[dgst] != "":
+			d.Status, d.Error = deletionKept, fmt.Sprintf("its manifest is shared with tag %s", keptDigests[dgst])
+		case r.options.DryRun:
+			d.Status = deletionPlanned
+		case deleted[dgst]:
+			// already gone together with another tag of the same manifest
+			d.Status = deletionDeleted
+		default:
+			if err = ref.DeleteImage(ctx, r.opts.DestinationCtx); err != nil {
+				d.Status, d.Error = deletionFailed, err.Error()
+			} else {
+				d.Status = deletionDeleted
+				deleted[dgst] = true
+			}
+		}
+		if ok {
+			d.Digest = dgst.String()
+		}
+		fields := logrus.Fields{"tag": tag, "digest": d.Digest}
+		switch d.Status {
+		case deletionDeleted:
+			logrus.WithFields(fields).Info("Deleted tag")
+		case deletionPlanned:
+			logrus.WithFields(fields).Info("Would delete tag")
+		default:
+			logrus.WithFields(fields).Warnf("Not deleting tag, %s", d.Error)
+		}
+		deletions = append(deletions, d)
+	}
+	return deletions, nil
+}
+
+func writeDeletions(w io.Writer, output string, deletions []tagDeletion) error {
+	if output == "json" {
+		return writeIndentedJSON(w, deletions)
+	}
+	if len(deletions) == 0 {
+		return nil
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TAG\tSTATUS\tDIGEST")
+	for _, d := range deletions {
+		detail := d.Digest
+		if d.Error != "" {
+			detail = d.Error
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", d.Tag, d.Status, detail)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,340 @@
+package imagesync
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containers/image/v5/directory"
+	"github.com/containers/image/v5/docker"
+	dockerarchive "github.com/containers/image/v5/docker/archive"
+	"github.com/containers/image/v5/docker/daemon"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/manifest"
+	ociarchive "github.com/containers/image/v5/oci/archive"
+	ocilayout "github.com/containers/image/v5/oci/layout"
+	"github.com/containers/image/v5/storage"
+	"github.com/containers/image/v5/types"
+	dockerclient "github.com/docker/docker/client"
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var ErrUnsupportedDestination = errors.New("unsupported destination")
+
+type destinationKind int
+
+const (
+	destinationRegistry destinationKind = iota
+	destinationOCILayout
+	destinationOCIArchive
+	destinationDockerArchive
+	destinationDockerDaemon
+	destinationContainersStorage
+	destinationDir
+)
+
+// destination is a detected destination reference, value has the transport
+// prefix stripped and local paths are absolute.
+type destination struct {
+	kind  destinationKind
+	value string
+	// archive is the oci-archive an OCI layout is staged for.
+	archive string
+}
+
+var destinationTypes = []struct {
+	name   string
+	prefix string
+	kind   destinationKind
+}{
+	{"registry", "docker://", destinationRegistry},
+	{"oci", "oci:", destinationOCILayout},
+	{"oci-archive", "oci-archive:", destinationOCIArchive},
+	{"docker-archive", "docker-archive:", destinationDockerArchive},
+	{"docker-daemon", "docker-daemon:", destinationDockerDaemon},
+	{"containers-storage", "containers-storage:", destinationContainersStorage},
+	{"dir", "dir:", destinationDir},
+}
+
+// detectDestination decides the transport of dest like detectSource does,
+// an explicit transport prefix or destType wins. Without both absolute and
+// ./ or ../ prefixed paths are OCI layouts, or oci-archives if they end with
+// .tar, all other values are registry references.
+func detectDestination(dest, destType string) (destination, error) {
+	var d destination
+	found := false
+	for _, t := range destinationTypes {
+		if value, ok := strings.CutPrefix(dest, t.prefix); ok {
+			d, found = destination{kind: t.kind, value: value}, true
+			break
+		}
+	}
+
+	if destType != "" {
+		kind, ok := destinationKindOf(destType)
+		if !ok {
+			return destination{}, fmt.Errorf("unsupported destination type %q: %w", destType, ErrUnsupportedDestination)
+		}
+		if found && d.kind != kind {
+			return destination{}, fmt.Errorf("destination %q doesn't match --dest-type %s", dest, destType)
+		}
+		if !found {
+			d = destination{kind: kind, value: dest}
+		}
+	} else if !found {
+		d = destination{kind: destinationRegistry, value: dest}
+		if isPathLike(dest) {
+			d.kind = destinationOCILayout
+			if path, _, _ := strings.Cut(dest, ":"); strings.EqualFold(filepath.Ext(path), ".tar") {
+				d.kind = destinationOCIArchive
+			}
+		}
+	}
+
+	if d.kind != destinationRegistry && isPathLike(d.value) {
+		abs, err := filepath.Abs(d.value)
+		if err != nil {
+			return destination{}, fmt.Errorf("resolving destination path: %w", err)
+		}
+		d.value = abs
+	}
+	return d, nil
+}
+
+// detectDestinations detects the comma separated destinations of value.
+func detectDestinations(value, destType string) ([]destination, error) {
+	var dests []destination
+	seen := map[string]bool{}
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" || seen[part] {
+			continue
+		}
+		seen[part] = true
+		dest, err := detectDestination(part, destType)
+		if err != nil {
+			return nil, err
+		}
+		dests = append(dests, dest)
+	}
+	if len(dests) == 0 {
+		return nil, errors.New("no destination given")
+	}
+	return dests, nil
+}
+
+func destinationKindOf(name string) (destinationKind, bool) {
+	for _, t := range destinationTypes {
+		if t.name == name {
+			return t.kind, true
+		}
+	}
+	return 0, false
+}
+
+func (d destination) isArchive() bool {
+	return d.kind == destinationOCIArchive || d.kind == destinationDockerArchive
+}
+
+// holdsSingleImage reports whether the destination stores a single image,
+// archives and local image stores can't be the destination of a repository.
+func (d destination) holdsSingleImage() bool {
+	return d.isArchive() || d.isLocalStore()
+}
+
+// isLocalStore reports whether the destination is the image store of the
+// docker daemon or of podman.
+func (d destination) isLocalStore() bool {
+	return d.kind == destinationDockerDaemon || d.kind == destinationContainersStorage
+}
+
+// singlePlatform reports whether the destination can't store manifest lists,
+// containers-storage only keeps the image of the host platform.
+func (d destination) singlePlatform() bool {
+	return d.kind == destinationDockerArchive || d.isLocalStore()
+}
+
+func (d destination) typeName() string {
+	for _, t := range destinationTypes {
+		if t.kind == d.kind {
+			return t.name
+		}
+	}
+	return "unknown"
+}
+
+// reference returns the reference of the destination itself, either a
+// single image or a repository.
+func (d destination) reference() (types.ImageReference, error) {
+	var (
+		ref types.ImageReference
+		err error
+	)
+	switch d.kind {
+	case destinationOCILayout:
+		ref, err = ocilayout.ParseReference(d.value)
+	case destinationOCIArchive:
+		ref, err = ociarchive.ParseReference(d.value)
+	case destinationDockerArchive:
+		ref, err = dockerarchive.ParseReference(d.value)
+	case destinationDockerDaemon:
+		// like registry destinations the tag defaults to latest
+		var named reference.Named
+		if named, err = reference.ParseNormalizedNamed(d.value); err == nil {
+			ref, err = daemon.NewReference("", reference.TagNameOnly(named))
+		}
+	case destinationContainersStorage:
+		ref, err = storage.Transport.ParseReference(d.value)
+	case destinationDir:
+		ref, err = directory.NewReference(d.value)
+	default:
+		ref, err = docker.ParseReference("//" + d.value)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing destination ref: %w", err)
+	}
+	return ref, nil
+}
+
+// hasTag reports whether the destination names a single image. A dir
+// destination is a path without tag.
+func (d destination) hasTag() bool {
+	switch {
+	case d.kind == destinationRegistry || d.isLocalStore():
+		return hasTag(d.value)
+	case d.kind == destinationDir:
+		return false
+	}
+	return strings.Contains(d.value, ":")
+}
+
+// repository returns the repository of a destination naming the single
+// image ref.
+func (d destination) repository(ref types.ImageReference) destination {
+	switch d.kind {
+	case destinationRegistry, destinationDockerDaemon, destinationContainersStorage:
+		d.value = ref.DockerReference().Name()
+	case destinationOCILayout:
+		if i := strings.LastIndex(d.value, ":"); i >= 0 {
+			d.value = d.value[:i]
+		}
+	}
+	return d
+}
+
+// tagReference returns the reference of tag in a repository destination,
+// archives hold a single image and can't be the destination of a repository.
+func (d destination) tagReference(tag string) (types.ImageReference, error) {
+	switch d.kind {
+	case destinationRegistry:
+		return docker.ParseReference(fmt.Sprintf("//%s:%s", d.value, tag))
+	case destinationOCILayout:
+		ref, err := ocilayout.NewReference(d.value, tag)
+		if err != nil || d.archive == "" {
+			return ref, err
+		}
+		return &archiveTagReference{ImageReference: ref, archive: d.archive, tag: tag}, nil
+	case destinationDockerDaemon:
+		return daemon.ParseReference(fmt.Sprintf("%s:%s", d.value, tag))
+	case destinationContainersStorage:
+		return storage.Transport.ParseReference(fmt.Sprintf("%s:%s", d.value, tag))
+	case destinationDir:
+		// a directory per tag
+		return directory.NewReference(filepath.Join(d.value, tag))
+	default:
+		return nil, fmt.Errorf("syncing a repository into an archive needs a single source tag: %w", ErrUnsupportedDestination)
+	}
+}
+
+// tags lists the tags of a repository destination, a missing OCI layout has
+// no tags.
+func (d destination) tags(ctx context.Context, sys *types.SystemContext, repository types.ImageReference) ([]string, error) {
+	switch d.kind {
+	case destinationRegistry:
+		return docker.GetRepositoryTags(ctx, sys, repository)
+	case destinationDir:
+		return dirTags(d.value)
+	}
+
+	data, err := os.ReadFile(filepath.Join(d.value, imgspecv1.ImageIndexFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading oci layout index: %w", err)
+	}
+	var index imgspecv1.Index
+	if err = json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("parsing oci layout index: %w", err)
+	}
+	var tags []string
+	for _, m := range index.Manifests {
+		if name := m.Annotations[imgspecv1.AnnotationRefName]; name != "" {
+			tags = append(tags, name)
+		}
+	}
+	return tags, nil
+}
+
+// dirTags lists the tag directories of a repository dir destination, a
+// missing directory has no tags.
+func dirTags(path string) ([]string, error) {
+	entries, err := os.ReadDir(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading dir destination: %w", err)
+	}
+	var tags []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(path, entry.Name(), "manifest.json")); err == nil {
+			tags = append(tags, entry.Name())
+		}
+	}
+	return tags, nil
+}
+
+// referenceDigest returns the digest of the manifest of ref, registries are
+// asked with a HEAD request, all others read the manifest.
+func referenceDigest(ctx context.Context, sys *types.SystemContext, ref types.ImageReference) (digest.Digest, error) {
+	if ref.Transport().Name() == docker.Transport.Name() {
+		return docker.GetDigest(ctx, sys, ref)
+	}
+	src, err := ref.NewImageSource(ctx, sys)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	manifestBlob, _, err := src.GetManifest(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	return manifest.Digest(manifestBlob)
+}
+
+// pingDaemon checks the docker daemon is reachable, the docker-daemon
+// destination otherwise fails with a closed pipe hiding the cause.
+func pingDaemon(ctx context.Context, sys *types.SystemContext) error {
+	host := dockerclient.DefaultDockerHost
+	if sys != nil && sys.DockerDaemonHost != "" {
+		host = sys.DockerDaemonHost
+	}
+	client, err := dockerclient.NewClientWithOpts(dockerclient.WithHost(host), dockerclient.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf("connecting to the docker daemon: %w", err)
+	}
+	defer client.Close()
+	if _, err = client.Ping(ctx); err != nil {
+		return fmt.Errorf("connecting to the docker daemon: %w", err)
+	}
+	return nil
+}
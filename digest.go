@@ -0,0 +1,150 @@
+package imagesync
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+)
+
+// changedTags returns the tags whose manifest digest differs between source
+// and destination. Tags whose digest can't be read are considered changed.
+func (r *syncRun) changedTags(ctx context.Context, dest destination, srcRepository types.ImageReference, tags []string) []string {
+	var changed []string
+	for _, c := range r.compareTags(ctx, dest, srcRepository, tags) {
+		if c.err != nil {
+			logrus.Debugf("failed comparing digests of tag %s, copying it: %s", c.tag, c.err)
+		}
+		if c.err != nil || c.source != c.destination {
+			changed = append(changed, c.tag)
+		}
+	}
+	return changed
+}
+
+// tagComparison is the manifest digest of a tag in the source and in the
+// destination, err is set if either can't be read.
+type tagComparison struct {
+	tag         string
+	source      digest.Digest
+	destination digest.Digest
+	err         error
+}
+
+// compareTags reads the digests of the tags in the source and the
+// destination, the comparisons are in the order of tags.
+func (r *syncRun) compareTags(ctx context.Context, dest destination, srcRepository types.ImageReference, tags []string) []tagComparison {
+	var wg sync.WaitGroup
+	comparisons := make([]tagComparison, len(tags))
+	ch := make(chan int)
+	for i := 0; i < max(min(r.job.MaxConcurrentTags, len(tags)), 1); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range ch {
+				comparisons[i] = r.compareTag(ctx, dest, srcRepository, tags[i])
+			}
+		}()
+	}
+	for i := range tags {
+		ch <- i
+	}
+	close(ch)
+	wg.Wait()
+	return comparisons
+}
+
+func (r *syncRun) compareTag(ctx context.Context, dest destination, srcRepository types.ImageReference, tag string) tagComparison {
+	c := tagComparison{tag: tag}
+	srcTagRef, err := docker.ParseReference(fmt.Sprintf("//%s:%s", srcRepository.DockerReference().Name(), tag))
+	if err != nil {
+		c.err = err
+		return c
+	}
+	destTagRef, err := dest.tagReference(r.job.TagRewrite.rewrite(tag))
+	if err != nil {
+		c.err = err
+		return c
+	}
+
+	if c.source, err = r.sourceDigest(ctx, srcTagRef); err != nil {
+		c.err = fmt.Errorf("getting source digest: %w", err)
+		return c
+	}
+	if c.destination, err = referenceDigest(ctx, r.opts.DestinationCtx, destTagRef); err != nil {
+		c.err = fmt.Errorf("getting destination digest: %w", err)
+	}
+	return c
+}
+
+// sourceDigest returns the digest of the manifest which would be copied, with
+// --platforms that is the digest of the reduced manifest list.
+func (r *syncRun) sourceDigest(ctx context.Context, srcRef types.ImageReference) (digest.Digest, error) {
+	if r.job.Platforms == nil {
+		return docker.GetDigest(ctx, r.opts.SourceCtx, srcRef)
+	}
+	src, err := r.job.Platforms.wrap(srcRef).NewImageSource(ctx, r.opts.SourceCtx)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	manifestBlob, _, err := src.GetManifest(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	return manifest.Digest(manifestBlob)
+}
+
+// singleImageRefs returns the destination references of the single image
+// srcRef. Destinations without a tag get --dest-tag, or the digest of a source
+// referenced by digest, which is then copied unchanged. Destinations which
+// already have that digest are skipped unless --overwrite is given.
+func (r *syncRun) singleImageRefs(ctx context.Context, dests []destination, destRefs []types.ImageReference, srcRef types.ImageReference) ([]types.ImageReference, error) {
+	digested, byDigest := srcRef.DockerReference().(reference.Canonical)
+	refs := make([]types.ImageReference, 0, len(destRefs))
+	for i, dest := range dests {
+		destRef := destRefs[i]
+		switch {
+		case r.options.DestTag != "" && dest.hasTag():
+			return nil, fmt.Errorf("--dest-tag can't be used with the tagged destination %s", dest.value)
+		case r.options.DestTag != "":
+			ref, err := dest.repository(destRef).tagReference(r.options.DestTag)
+			if err != nil {
+				return nil, fmt.Errorf("parsing dest ref: %w", err)
+			}
+			destRef = ref
+		case byDigest && dest.kind == destinationRegistry && !dest.hasTag():
+			ref, err := docker.ParseReference(fmt.Sprintf("//%s@%s", destRef.DockerReference().Name(), digested.Digest()))
+			if err != nil {
+				return nil, fmt.Errorf("parsing dest ref: %w", err)
+			}
+			// a changed manifest can't be stored by the source digest
+			if r.manifestType != "" {
+				return nil, fmt.Errorf("--format can't convert %s, it is stored by its digest in %s", refName(srcRef), dest.value)
+			}
+			if r.annotator != nil {
+				return nil, fmt.Errorf("--add-annotation can't annotate %s, it is stored by its digest in %s", refName(srcRef), dest.value)
+			}
+			r.opts.PreserveDigests = true
+			if !r.job.Overwrite {
+				if dgst, err := referenceDigest(ctx, r.opts.DestinationCtx, ref); err == nil && dgst == digested.Digest() {
+					logrus.Infof("Skipping %s, the destination has the digest", refName(ref))
+					r.addTag(TagResult{Source: refName(srcRef), Destination: refName(ref), Status: TagSkipped, Digest: dgst.String()})
+					if !r.options.DryRun {
+						r.digests.record(srcRef, ref, dgst)
+					}
+					continue
+				}
+			}
+			destRef = ref
+		}
+		refs = append(refs, destRef)
+	}
+	return refs, nil
+}
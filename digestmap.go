@@ -0,0 +1,101 @@
+package imagesync
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// digestPin pins a source image to its registry destination by digest, in
+// the format of the images of a kustomization and of a Flux Kustomization.
+type digestPin struct {
+	Name    string `yaml:"name"`
+	NewName string `yaml:"newName"`
+	Digest  string `yaml:"digest"`
+}
+
+// digestMap collects the digests of the synced tags of a run for the
+// --digest-map-file, all digestMap methods are no-ops on a nil receiver.
+type digestMap struct {
+	path string
+
+	mu   sync.Mutex
+	pins map[[2]string]digestPin
+}
+
+func newDigestMap(path string) *digestMap {
+	if path == "" {
+		return nil
+	}
+	return &digestMap{path: path, pins: map[[2]string]digestPin{}}
+}
+
+// record pins srcRef to the digest of destRef. Only registry destinations
+// are pinned, other destinations have no repository to pull from.
+func (m *digestMap) record(srcRef, destRef types.ImageReference, dgst digest.Digest) {
+	if m == nil || destRef.Transport().Name() != docker.Transport.Name() {
+		return
+	}
+	// images are referenced by their familiar name in manifests, which the
+	// kustomize image names have to match
+	name := refName(srcRef)
+	if named := srcRef.DockerReference(); named != nil {
+		name = reference.FamiliarString(named)
+	}
+	pin := digestPin{Name: name, NewName: destRef.DockerReference().Name(), Digest: dgst.String()}
+	m.mu.Lock()
+	m.pins[[2]string{pin.Name, pin.NewName}] = pin
+	m.mu.Unlock()
+}
+
+// recordExisting pins a source tag whose destination tag already exists,
+// its digest is requested from the destination.
+func (m *digestMap) recordExisting(ctx context.Context, srcRef, destRef types.ImageReference, sys *types.SystemContext) {
+	if m == nil || destRef.Transport().Name() != docker.Transport.Name() {
+		return
+	}
+	dgst, err := referenceDigest(ctx, sys, destRef)
+	if err != nil {
+		logrus.Warnf("failed getting digest of %s for the digest map: %s", refName(destRef), err)
+		return
+	}
+	m.record(srcRef, destRef, dgst)
+}
+
+// write replaces the digest map file with the pins of the run as the images
+// list of a kustomization, sorted by source.
+func (m *digestMap) write() error {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	pins := make([]digestPin, 0, len(m.pins))
+	for _, pin := range m.pins {
+		pins = append(pins, pin)
+	}
+	sort.Slice(pins, func(i, j int) bool {
+		if pins[i].Name != pins[j].Name {
+			return pins[i].Name < pins[j].Name
+		}
+		return pins[i].NewName < pins[j].NewName
+	})
+	var b bytes.Buffer
+	enc := yaml.NewEncoder(&b)
+	enc.SetIndent(2)
+	if err := enc.Encode(struct {
+		Images []digestPin `yaml:"images"`
+	}{pins}); err != nil {
+		return fmt.Errorf("encoding digest map: %w", err)
+	}
+	return writeFileAtomic(m.path, b.Bytes())
+}
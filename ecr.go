@@ -0,0 +1,219 @@
+package imagesync
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	ecrtypes "github.com/aws/aws-sdk-go-v2/service/ecr/types"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/types"
+	"github.com/sirupsen/logrus"
+)
+
+// ecrHostPattern matches the private registries of Amazon ECR, e.g.
+// 123456789012.dkr.ecr.eu-west-1.amazonaws.com.
+var ecrHostPattern = regexp.MustCompile(`^(\d{12})\.dkr\.ecr(?:-fips)?\.([a-z0-9-]+)\.amazonaws\.com(?:\.cn)?$`)
+
+type ecrRegistry struct {
+	host    string
+	account string
+	region  string
+}
+
+// parseECRRegistry returns the ECR registry of a registry reference.
+func parseECRRegistry(ref string) (ecrRegistry, bool) {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return ecrRegistry{}, false
+	}
+	host := reference.Domain(named)
+	m := ecrHostPattern.FindStringSubmatch(host)
+	if m == nil {
+		return ecrRegistry{}, false
+	}
+	return ecrRegistry{host: host, account: m[1], region: m[2]}, true
+}
+
+// ecrSession logs in to the ECR registries of a sync with the AWS
+// credentials of the environment, a profile or the instance role, and
+// creates missing destination repositories. Without AWS credentials the
+// auth files are used.
+type ecrSession struct {
+	repository *ecr.CreateRepositoryInput
+
+	mu      sync.Mutex
+	regions map[string]*ecrRegion
+	// existing are the repositories known to exist by host/path.
+	existing map[string]bool
+}
+
+// ecrRegion is the client and authorization token of a region, client is
+// nil if there are no AWS credentials.
+type ecrRegion struct {
+	client *ecr.Client
+	auth   *types.DockerAuthConfig
+}
+
+func newECRSession(options Options) (*ecrSession, error) {
+	input := &ecr.CreateRepositoryInput{
+		ImageTagMutability:         ecrtypes.ImageTagMutabilityMutable,
+		ImageScanningConfiguration: &ecrtypes.ImageScanningConfiguration{ScanOnPush: options.ECRScanOnPush},
+	}
+	if options.ECRImmutableTags {
+		input.ImageTagMutability = ecrtypes.ImageTagMutabilityImmutable
+	}
+	for _, tag := range options.ECRRepositoryTags {
+		key, value, ok := strings.Cut(tag, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid --ecr-repository-tag %q, expected key=value", tag)
+		}
+		input.Tags = append(input.Tags, ecrtypes.Tag{Key: aws.String(key), Value: aws.String(value)})
+	}
+	return &ecrSession{repository: input, regions: map[string]*ecrRegion{}, existing: map[string]bool{}}, nil
+}
+
+// region returns the client and token of a region, they are created once.
+func (e *ecrSession) region(ctx context.Context, name string) (*ecrRegion, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if r, ok := e.regions[name]; ok {
+		return r, nil
+	}
+	r := &ecrRegion{}
+	cfg, err := awsconfig.LoadDefaultConfig(ctx, awsconfig.WithRegion(name))
+	if err == nil {
+		_, err = cfg.Credentials.Retrieve(ctx)
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		logrus.Warnf("no AWS credentials for Amazon ECR in %s, using the auth files: %s", name, err)
+		e.regions[name] = r
+		return r, nil
+	}
+	client := ecr.NewFromConfig(cfg)
+	out, err := client.GetAuthorizationToken(ctx, &ecr.GetAuthorizationTokenInput{})
+	if err != nil {
+		return nil, fmt.Errorf("getting Amazon ECR token for %s: %w", name, err)
+	}
+	if len(out.AuthorizationData) == 0 || out.AuthorizationData[0].AuthorizationToken == nil {
+		return nil, fmt.Errorf("getting Amazon ECR token for %s: no token returned", name)
+	}
+	token, err := base64.StdEncoding.DecodeString(*out.AuthorizationData[0].AuthorizationToken)
+	if err != nil {
+		return nil, fmt.Errorf("decoding Amazon ECR token: %w", err)
+	}
+	user, password, ok := strings.Cut(string(token), ":")
+	if !ok {
+		return nil, errors.New("decoding Amazon ECR token: missing password")
+	}
+	r.client, r.auth = client, &types.DockerAuthConfig{Username: user, Password: password}
+	e.regions[name] = r
+	return r, nil
+}
+
+// ensureRepository creates the repository path of reg unless it exists, a
+// dry run only logs it.
+func (e *ecrSession) ensureRepository(ctx context.Context, reg ecrRegistry, path string, dryRun bool) error {
+	key := reg.host + "/" + path
+	e.mu.Lock()
+	known := e.existing[key]
+	e.mu.Unlock()
+	if known {
+		return nil
+	}
+	r, err := e.region(ctx, reg.region)
+	if err != nil || r.client == nil {
+		return err
+	}
+
+	_, err = r.client.DescribeRepositories(ctx, &ecr.DescribeRepositoriesInput{
+		RegistryId:      aws.String(reg.account),
+		RepositoryNames: []string{path},
+	})
+	var notFound *ecrtypes.RepositoryNotFoundException
+	switch {
+	case errors.As(err, &notFound) && dryRun:
+		logrus.Infof("Would create Amazon ECR repository %s", key)
+		return nil
+	case errors.As(err, &notFound):
+		input := *e.repository
+		input.RegistryId, input.RepositoryName = aws.String(reg.account), aws.String(path)
+		_, err = r.client.CreateRepository(ctx, &input)
+		var exists *ecrtypes.RepositoryAlreadyExistsException
+		if err != nil && !errors.As(err, &exists) {
+			return fmt.Errorf("creating Amazon ECR repository %s: %w", key, err)
+		}
+		logrus.Infof("Created Amazon ECR repository %s", key)
+	case err != nil:
+		return fmt.Errorf("checking Amazon ECR repository %s: %w", key, err)
+	}
+	e.mu.Lock()
+	e.existing[key] = true
+	e.mu.Unlock()
+	return nil
+}
+
+// prepareECR logs in to the ECR registries of the job and creates its
+// missing destination repositories. Credentials of the job or its
+// credential helpers take precedence, the destination token is only used if
+// all registry destinations are on the same ECR registry.
+func (r *syncRun) prepareECR(ctx context.Context, src source, dests []destination) error {
+	if r.ecr == nil {
+		return nil
+	}
+	if reg, ok := parseECRRegistry(src.value); ok && src.kind == sourceRegistry && r.opts.SourceCtx.DockerAuthConfig == nil {
+		region, err := r.ecr.region(ctx, reg.region)
+		if err != nil {
+			return err
+		}
+		r.opts.SourceCtx.DockerAuthConfig = region.auth
+	}
+
+	hosts := map[string]bool{}
+	var registries []ecrRegistry
+	var paths []string
+	for _, dest := range dests {
+		if dest.kind != destinationRegistry {
+			continue
+		}
+		named, err := reference.ParseNormalizedNamed(dest.value)
+		if err != nil {
+			continue
+		}
+		hosts[reference.Domain(named)] = true
+		if reg, ok := parseECRRegistry(dest.value); ok {
+			registries = append(registries, reg)
+			paths = append(paths, reference.Path(named))
+		}
+	}
+	if len(registries) == 0 {
+		return nil
+	}
+	switch {
+	case r.opts.DestinationCtx.DockerAuthConfig != nil:
+	case len(hosts) == 1:
+		region, err := r.ecr.region(ctx, registries[0].region)
+		if err != nil {
+			return err
+		}
+		r.opts.DestinationCtx.DockerAuthConfig = region.auth
+	default:
+		logrus.Warnf("the destinations of %s are on several registries, using the auth files for Amazon ECR", r.job.Source)
+	}
+	for i, reg := range registries {
+		if err := r.ecr.ensureRepository(ctx, reg, paths[i], r.options.DryRun); err != nil {
+			return err
+		}
+	}
+	return nil
+}
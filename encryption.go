@@ -0,0 +1,66 @@
+package imagesync
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/containers/image/v5/copy"
+	"github.com/containers/image/v5/manifest"
+	encconfig "github.com/containers/ocicrypt/config"
+	"github.com/containers/ocicrypt/helpers"
+)
+
+// encryption encrypts the layers of the copied images for the recipients
+// of --encryption-key and decrypts encrypted source layers with the keys of
+// --decryption-key, a nil encryption copies layers as they are.
+type encryption struct {
+	encrypt *encconfig.EncryptConfig
+	decrypt *encconfig.DecryptConfig
+}
+
+// newEncryption parses the recipients and keys of opts in the format of
+// skopeo and podman, e.g. jwe:pubkey.pem for a recipient and
+// privkey.pem:password for a key.
+func newEncryption(opts Options, manifestType string) (*encryption, error) {
+	if opts.EncryptLayers != (len(opts.EncryptionKeys) > 0) {
+		return nil, errors.New("--encrypt-layers and --encryption-key have to be used together")
+	}
+	if !opts.EncryptLayers && len(opts.DecryptionKeys) == 0 {
+		return nil, nil
+	}
+	e := &encryption{}
+	if opts.EncryptLayers {
+		if opts.PreserveDigests {
+			return nil, errors.New("--encrypt-layers can't be used with --preserve-digests")
+		}
+		if manifestType != "" && !manifest.MIMETypeSupportsEncryption(manifestType) {
+			return nil, errors.New("encrypted layers need OCI manifests, --format v2s2 can't be used with --encrypt-layers")
+		}
+		cc, err := helpers.CreateCryptoConfig(opts.EncryptionKeys, nil)
+		if err != nil {
+			return nil, fmt.Errorf("--encryption-key: %w", err)
+		}
+		e.encrypt = cc.EncryptConfig
+	}
+	if len(opts.DecryptionKeys) > 0 {
+		cc, err := helpers.CreateDecryptCryptoConfig(opts.DecryptionKeys, nil)
+		if err != nil {
+			return nil, fmt.Errorf("--decryption-key: %w", err)
+		}
+		e.decrypt = cc.DecryptConfig
+	}
+	return e, nil
+}
+
+// apply makes opts encrypt all layers of the copied images and decrypt the
+// encrypted layers of the sources.
+func (e *encryption) apply(opts *copy.Options) {
+	if e == nil {
+		return
+	}
+	if e.encrypt != nil {
+		opts.OciEncryptConfig = e.encrypt
+		opts.OciEncryptLayers = &[]int{}
+	}
+	opts.OciDecryptConfig = e.decrypt
+}
@@ -0,0 +1,210 @@
+package imagesync
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"text/tabwriter"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/pkg/blobinfocache/none"
+	"github.com/containers/image/v5/types"
+	"github.com/docker/go-units"
+	"github.com/opencontainers/go-digest"
+	"github.com/samber/lo"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+// tagEstimate is a tag a sync would copy, the output of the estimate
+// command. Bytes is the size of its config and layers, TransferBytes the size
+// of those the destination lacks and no earlier tag transfers.
+type tagEstimate struct {
+	Tag           string `json:"tag"`
+	Bytes         int64  `json:"bytes"`
+	TransferBytes int64  `json:"transferBytes"`
+	Error         string `json:"error,omitempty"`
+}
+
+// estimate sums the blobs of the tags to copy, each blob is counted once.
+type estimate struct {
+	Tags             []tagEstimate `json:"tags"`
+	Blobs            int           `json:"blobs"`
+	ExistingBlobs    int           `json:"existingBlobs"`
+	Bytes            int64         `json:"bytes"`
+	ExistingBytes    int64         `json:"existingBytes"`
+	TransferBytes    int64         `json:"transferBytes"`
+	UnreadableImages int           `json:"unreadableImages,omitempty"`
+}
+
+// estimateSync is the action of the estimate command. It lists the tags a
+// sync of the source repository to the destination repository would copy
+// and sums the sizes their manifests report, without the blobs the
+// destination already has. Only the selected platforms are counted.
+func estimateSync(c *cli.Context) error {
+	in, err := newInspection(c, 2)
+	if err != nil {
+		return err
+	}
+	defer in.close()
+	ctx := c.Context
+	srcTags, err := in.sourceTags(ctx)
+	if err != nil {
+		return err
+	}
+	dest, destTags, err := in.destination(ctx)
+	if err != nil {
+		return err
+	}
+	job := in.run.job
+	if err = job.TagRewrite.check(srcTags); err != nil {
+		return err
+	}
+	tags := srcTags
+	if !job.Overwrite {
+		tags = slices.DeleteFunc(slices.Clone(srcTags), func(tag string) bool {
+			return slices.Contains(destTags, job.TagRewrite.rewrite(tag))
+		})
+		if existing := subtract(srcTags, tags); job.CompareDigests && len(existing) > 0 {
+			tags = append(tags, in.run.changedTags(ctx, dest, in.srcRepo, existing)...)
+		}
+	}
+	logrus.Infof("Estimating %d of %d tags", len(tags), len(srcTags))
+
+	est := estimate{Tags: []tagEstimate{}}
+	tagBlobs := make([][]types.BlobInfo, len(tags))
+	for i, tag := range tags {
+		est.Tags = append(est.Tags, tagEstimate{Tag: tag})
+		srcRef, err := docker.ParseReference(fmt.Sprintf("//%s:%s", in.srcRepo.DockerReference().Name(), tag))
+		if err == nil {
+			tagBlobs[i], err = imageBlobs(ctx, job.Platforms.wrap(srcRef), in.run.opts.SourceCtx)
+		}
+		if err != nil {
+			logrus.Warnf("failed reading the manifests of %s: %s", tag, err)
+			est.Tags[i].Error = err.Error()
+			est.UnreadableImages++
+		}
+	}
+
+	blobs := lo.UniqBy(lo.Flatten(tagBlobs), func(blob types.BlobInfo) digest.Digest { return blob.Digest })
+	existing, err := destinationBlobs(ctx, dest, in.run.opts.DestinationCtx, blobs)
+	if err != nil {
+		return err
+	}
+	counted := map[digest.Digest]bool{}
+	for i, blobs := range tagBlobs {
+		for _, blob := range blobs {
+			est.Tags[i].Bytes += blob.Size
+			if counted[blob.Digest] {
+				continue
+			}
+			counted[blob.Digest] = true
+			est.Blobs++
+			est.Bytes += blob.Size
+			if existing[blob.Digest] {
+				est.ExistingBlobs++
+				est.ExistingBytes += blob.Size
+				continue
+			}
+			est.Tags[i].TransferBytes += blob.Size
+			est.TransferBytes += blob.Size
+		}
+	}
+	return in.writeEstimate(os.Stdout, est)
+}
+
+// imageBlobs returns the config and layers of the manifests of ref, for
+// manifest lists those of all instances. Sizes which the manifests don't
+// report count as 0.
+func imageBlobs(ctx context.Context, ref types.ImageReference, sys *types.SystemContext) ([]types.BlobInfo, error) {
+	src, err := ref.NewImageSource(ctx, sys)
+	if err != nil {
+		return nil, fmt.Errorf("opening image: %w", err)
+	}
+	defer src.Close()
+
+	manifestBlob, mimeType, err := src.GetManifest(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("reading manifest: %w", err)
+	}
+	instances := []*digest.Digest{nil}
+	if manifest.MIMETypeIsMultiImage(mimeType) {
+		list, err := manifest.ListFromBlob(manifestBlob, mimeType)
+		if err != nil {
+			return nil, fmt.Errorf("parsing manifest list: %w", err)
+		}
+		instances = lo.Map(list.Instances(), func(instance digest.Digest, _ int) *digest.Digest { return &instance })
+	}
+	var blobs []types.BlobInfo
+	for _, instance := range instances {
+		if instance != nil {
+			if manifestBlob, mimeType, err = src.GetManifest(ctx, instance); err != nil {
+				return nil, fmt.Errorf("reading manifest %s: %w", instance, err)
+			}
+		}
+		instanceBlobs, err := manifestBlobs(manifestBlob, mimeType)
+		if err != nil {
+			return nil, err
+		}
+		blobs = append(blobs, instanceBlobs...)
+	}
+	return lo.Map(blobs, func(blob types.BlobInfo, _ int) types.BlobInfo {
+		blob.Size = max(blob.Size, 0)
+		return blob
+	}), nil
+}
+
+// destinationBlobs returns which of blobs the repository of dest has. A
+// destination which can't be opened, e.g. a missing directory, has none.
+func destinationBlobs(ctx context.Context, dest destination, sys *types.SystemContext, blobs []types.BlobInfo) (map[digest.Digest]bool, error) {
+	existing := map[digest.Digest]bool{}
+	if len(blobs) == 0 {
+		return existing, nil
+	}
+	ref, err := dest.reference()
+	if err != nil {
+		return nil, err
+	}
+	imageDest, err := ref.NewImageDestination(ctx, sys)
+	if err != nil {
+		logrus.Warnf("failed opening %s, counting all blobs: %s", refName(ref), err)
+		return existing, nil
+	}
+	defer imageDest.Close()
+	for _, blob := range blobs {
+		reused, _, err := imageDest.TryReusingBlob(ctx, blob, none.NoCache, false)
+		if err != nil {
+			return nil, fmt.Errorf("checking blob %s in %s: %w", blob.Digest, refName(ref), err)
+		}
+		existing[blob.Digest] = reused
+	}
+	return existing, nil
+}
+
+func (in *inspection) writeEstimate(w io.Writer, est estimate) error {
+	if in.output == "json" {
+		return writeIndentedJSON(w, est)
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TAG\tSIZE\tTRANSFER")
+	for _, t := range est.Tags {
+		if t.Error != "" {
+			fmt.Fprintf(tw, "%s\t-\t%s\n", t.Tag, t.Error)
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", t.Tag, units.HumanSize(float64(t.Bytes)), units.HumanSize(float64(t.TransferBytes)))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "\n%d tags, %d blobs of %s, %d blobs of %s already in the destination\n",
+		len(est.Tags), est.Blobs, units.HumanSize(float64(est.Bytes)), est.ExistingBlobs, units.HumanSize(float64(est.ExistingBytes)))
+	fmt.Fprintf(w, "Transfer: %s\n", units.HumanSize(float64(est.TransferBytes)))
+	if est.UnreadableImages > 0 {
+		fmt.Fprintf(w, "%d tags couldn't be read and aren't counted\n", est.UnreadableImages)
+	}
+	return nil
+}
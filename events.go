@@ -0,0 +1,144 @@
+package imagesync
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/containers/image/v5/types"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+// The events of --progress-format json.
+const (
+	eventTagStarted = "tagStarted"
+	eventBlobCopied = "blobCopied"
+	eventTagDone    = "tagDone"
+	eventTagFailed  = "tagFailed"
+)
+
+// progressEvent is a single JSON line of --progress-format json.
+type progressEvent struct {
+	Time   time.Time `json:"time"`
+	Event  string    `json:"event"`
+	Source string    `json:"source"`
+	// Destinations are the destinations of a started tag.
+	Destinations []string `json:"destinations,omitempty"`
+	Destination  string   `json:"destination,omitempty"`
+	// Digest is the digest of a copied blob or of the manifest of a done
+	// tag.
+	Digest       string `json:"digest,omitempty"`
+	SourceDigest string `json:"sourceDigest,omitempty"`
+	// Bytes is the size of a copied blob or the copied bytes of a done tag.
+	Bytes       int64 `json:"bytes,omitempty"`
+	ReusedBytes int64 `json:"reusedBytes,omitempty"`
+	// Reused is set for blobs which already existed in the destination.
+	Reused          bool    `json:"reused,omitempty"`
+	DurationSeconds float64 `json:"durationSeconds,omitempty"`
+	Error           string  `json:"error,omitempty"`
+}
+
+// progressEvents writes the progress events of all syncs of the process, a
+// nil progressEvents writes nothing.
+type progressEvents struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+	// failed is set once writing failed, e.g. because the reader of the
+	// pipe went away. The sync goes on without events.
+	failed bool
+}
+
+// startProgressEvents opens the --progress-file for --progress-format json
+// and returns a function closing it, without --progress-file the events are
+// written to stderr. Opening a named pipe blocks until it has a reader.
+func startProgressEvents(c *cli.Context) (*progressEvents, func(), error) {
+	switch format := c.String("progress-format"); format {
+	case "text":
+		if c.IsSet("progress-file") {
+			return nil, nil, errors.New("--progress-file requires --progress-format json")
+		}
+		return nil, func() {}, nil
+	case "json":
+	default:
+		return nil, nil, fmt.Errorf("unsupported progress format %q", format)
+	}
+	path := c.String("progress-file")
+	if path == "" {
+		return &progressEvents{enc: json.NewEncoder(os.Stderr)}, func() {}, nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, nil, fmt.Errorf("opening progress file: %w", err)
+	}
+	return &progressEvents{enc: json.NewEncoder(f)}, func() { f.Close() }, nil
+}
+
+func (e *progressEvents) write(event progressEvent) {
+	if e == nil {
+		return
+	}
+	event.Time = time.Now().UTC()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.failed {
+		return
+	}
+	if err := e.enc.Encode(event); err != nil {
+		e.failed = true
+		logrus.Warnf("failed writing progress events, no further events are written: %s", err)
+	}
+}
+
+// startTag writes the tagStarted event of copying src to dests and returns
+// the function writing the blobCopied events of the copy's progress.
+func (e *progressEvents) startTag(src string, dests []string) func(types.ProgressProperties) {
+	if e == nil {
+		return func(types.ProgressProperties) {}
+	}
+	e.write(progressEvent{Event: eventTagStarted, Source: src, Destinations: dests})
+	return func(p types.ProgressProperties) {
+		switch p.Event {
+		case types.ProgressEventDone:
+			e.write(progressEvent{Event: eventBlobCopied, Source: src, Digest: p.Artifact.Digest.String(), Bytes: int64(p.Offset)})
+		case types.ProgressEventSkipped:
+			e.write(progressEvent{Event: eventBlobCopied, Source: src, Digest: p.Artifact.Digest.String(), Bytes: max(p.Artifact.Size, 0), Reused: true})
+		}
+	}
+}
+
+// recordTag writes the tagDone or tagFailed event of a copied tag.
+func (e *progressEvents) recordTag(tag TagResult) {
+	event := progressEvent{
+		Source:          tag.Source,
+		Destination:     tag.Destination,
+		Digest:          tag.Digest,
+		SourceDigest:    tag.SourceDigest,
+		Bytes:           tag.Bytes,
+		ReusedBytes:     tag.ReusedBytes,
+		DurationSeconds: tag.DurationSeconds,
+		Error:           tag.Error,
+	}
+	switch tag.Status {
+	case TagCopied:
+		event.Event = eventTagDone
+	case TagFailed:
+		event.Event = eventTagFailed
+	default:
+		return
+	}
+	e.write(event)
+}
+
+// observeAll returns a function passing the progress of a copy to each of
+// observers.
+func observeAll(observers ...func(types.ProgressProperties)) func(types.ProgressProperties) {
+	return func(p types.ProgressProperties) {
+		for _, observe := range observers {
+			observe(p)
+		}
+	}
+}
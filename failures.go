@@ -0,0 +1,84 @@
+package imagesync
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"text/tabwriter"
+)
+
+var (
+	// ErrPartialFailure is returned by --keep-going runs in which some tags failed.
+	ErrPartialFailure = errors.New("some tags failed")
+	// ErrOutOfSync is returned by --check runs which found tags missing in
+	// the destination.
+	ErrOutOfSync = errors.New("destination is out of sync")
+)
+
+const (
+	// ExitCodeFailure is the exit code of a failed run.
+	ExitCodeFailure = 1
+	// ExitCodePartialFailure is the exit code of a --keep-going run in
+	// which some tags failed while the others were synced.
+	ExitCodePartialFailure = 2
+	// ExitCodeOutOfSync is the exit code of a --check run which found tags
+	// that would be copied.
+	ExitCodeOutOfSync = 3
+	// ExitCodeLocked is the exit code of a run which found the --lock-file
+	// held by another run.
+	ExitCodeLocked = 4
+)
+
+// ExitCode returns the process exit code for the error returned by Execute.
+func ExitCode(err error) int {
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, ErrPartialFailure):
+		return ExitCodePartialFailure
+	case errors.Is(err, ErrOutOfSync):
+		return ExitCodeOutOfSync
+	case errors.Is(err, ErrLocked):
+		return ExitCodeLocked
+	default:
+		return ExitCodeFailure
+	}
+}
+
+// classifyFailure returns the failure class of the error of a failed tag.
+func classifyFailure(err error) FailureClass {
+	switch {
+	case isQuotaExceeded(err):
+		return FailureQuotaExceeded
+	case isTransient(err):
+		return FailureTransient
+	default:
+		return ""
+	}
+}
+
+// writeFailureSummary prints a table of the failed tags of result.
+func writeFailureSummary(w io.Writer, result *Result) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "\nFailed tags (%d of %d):\n", result.Totals.Failed, len(result.Tags))
+	fmt.Fprintln(tw, "SOURCE\tDESTINATION\tERROR")
+	for _, tag := range result.Tags {
+		if tag.Status == TagFailed {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", tag.Source, tag.Destination, tag.Error)
+		}
+	}
+	return tw.Flush()
+}
+
+// writeMissingSummary prints a table of the tags a --check run found missing.
+func writeMissingSummary(w io.Writer, result *Result) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "\nMissing tags (%d):\n", result.Totals.Planned)
+	fmt.Fprintln(tw, "SOURCE\tDESTINATION\tDIGEST")
+	for _, tag := range result.Tags {
+		if tag.Status == TagPlanned {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", tag.Source, tag.Destination, tag.Digest)
+		}
+	}
+	return tw.Flush()
+}
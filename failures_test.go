@@ -0,0 +1,48 @@
+package imagesync
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestFailedTagsExitCode(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		keepGoing bool
+		want      int
+	}{
+		{"fails", false, ExitCodeFailure},
+		{"keep-going", true, ExitCodePartialFailure},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			src := newTestRegistry(t, failTag("broken", http.StatusNotFound))
+			dest := newTestRegistry(t, nil)
+			pushTestImage(t, src, "app", "good", 1)
+			pushTestImage(t, src, "app", "broken", 1)
+
+			opts := testOptions(src+"/app", dest+"/app")
+			opts.KeepGoing = tt.keepGoing
+			result, err := (&Syncer{}).Sync(context.Background(), opts)
+			if got := ExitCode(err); got != tt.want {
+				t.Errorf("ExitCode(%v) = %d, want %d", err, got, tt.want)
+			}
+			if errors.Is(err, ErrPartialFailure) != tt.keepGoing {
+				t.Errorf("error %v wraps ErrPartialFailure: %t, want %t", err, !tt.keepGoing, tt.keepGoing)
+			}
+			if totals := result.totals(); totals.Failed != 1 || totals.Copied != 1 {
+				t.Errorf("failed %d and copied %d tags, want 1 each", totals.Failed, totals.Copied)
+			}
+		})
+	}
+}
+
+func TestSyncedTagsExitCode(t *testing.T) {
+	src := newTestRegistry(t, nil)
+	dest := newTestRegistry(t, nil)
+	pushTestImage(t, src, "app", "1", 1)
+	if _, err := (&Syncer{}).Sync(context.Background(), testOptions(src+"/app", dest+"/app")); ExitCode(err) != 0 {
+		t.Errorf("Sync() = %v, want nil", err)
+	}
+}
@@ -0,0 +1,103 @@
+package imagesync
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/types"
+	"github.com/sirupsen/logrus"
+)
+
+// fallbackSource is a registry source tried when the source of a job fails,
+// either a registry hosting the same repository or another repository.
+type fallbackSource struct {
+	registry   string
+	repository string
+}
+
+// parseFallbackSources parses the sources after the first --src, registries
+// like mirror.gcr.io or repositories like mirror.gcr.io/library/nginx.
+func parseFallbackSources(values []string) ([]fallbackSource, error) {
+	fallbacks := make([]fallbackSource, 0, len(values))
+	for _, v := range values {
+		v = strings.TrimPrefix(v, "docker://")
+		if !strings.Contains(v, "/") && (strings.ContainsAny(v, ".:") || v == "localhost") {
+			fallbacks = append(fallbacks, fallbackSource{registry: v})
+			continue
+		}
+		named, err := reference.ParseNormalizedNamed(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid fallback source %q: %w", v, err)
+		}
+		if !reference.IsNameOnly(named) {
+			return nil, fmt.Errorf("fallback source %q can't have a tag or digest, the tag of the source is used", v)
+		}
+		fallbacks = append(fallbacks, fallbackSource{repository: named.Name()})
+	}
+	return fallbacks, nil
+}
+
+// fallbackRefs returns ref in the fallback sources of the job, in order.
+// Only registry references have fallbacks.
+func (job syncJob) fallbackRefs(ref types.ImageReference) []types.ImageReference {
+	named := ref.DockerReference()
+	if len(job.FallbackSources) == 0 || named == nil || ref.Transport().Name() != docker.Transport.Name() {
+		return nil
+	}
+	refs := make([]types.ImageReference, 0, len(job.FallbackSources))
+	for _, fallback := range job.FallbackSources {
+		repository := fallback.repository
+		if repository == "" {
+			repository = fallback.registry + "/" + reference.Path(named)
+		}
+		fallbackNamed, err := reference.ParseNormalizedNamed(repository)
+		if err == nil {
+			if tagged, ok := named.(reference.Tagged); ok {
+				fallbackNamed, err = reference.WithTag(fallbackNamed, tagged.Tag())
+			} else if digested, ok := named.(reference.Digested); ok {
+				fallbackNamed, err = reference.WithDigest(fallbackNamed, digested.Digest())
+			}
+		}
+		var fallbackRef types.ImageReference
+		if err == nil {
+			fallbackRef, err = docker.NewReference(fallbackNamed)
+		}
+		if err != nil {
+			logrus.Warnf("skipping fallback source %s for %s: %s", repository, refName(ref), err)
+			continue
+		}
+		refs = append(refs, fallbackRef)
+	}
+	return refs
+}
+
+// sourceTags lists the tags of srcRepository, from the fallback sources in
+// order while the listing fails.
+func (r *syncRun) sourceTags(ctx context.Context, srcRepository types.ImageReference) ([]string, error) {
+	tags, err := docker.GetRepositoryTags(ctx, r.opts.SourceCtx, srcRepository)
+	for _, fallback := range r.job.fallbackRefs(srcRepository) {
+		if err == nil || ctx.Err() != nil {
+			break
+		}
+		logrus.Warnf("listing the tags of %s failed, listing %s instead: %s", srcRepository.DockerReference().Name(), fallback.DockerReference().Name(), err)
+		tags, err = docker.GetRepositoryTags(ctx, r.opts.SourceCtx, fallback)
+	}
+	return tags, err
+}
+
+// transferWithFallback copies srcRef to destRefs, from the fallback sources
+// in order while the copy fails after its retries.
+func (r *syncRun) transferWithFallback(ctx context.Context, destRefs []types.ImageReference, srcRef types.ImageReference) (transferred, error) {
+	t, err := r.transfer(ctx, destRefs, srcRef)
+	for _, fallback := range r.job.fallbackRefs(srcRef) {
+		if err == nil || ctx.Err() != nil {
+			break
+		}
+		logrus.Warnf("copying %s failed, copying %s instead: %s", refName(srcRef), refName(fallback), err)
+		t, err = r.transfer(ctx, destRefs, fallback)
+	}
+	return t, err
+}
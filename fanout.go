@@ -0,0 +1,252 @@
+package imagesync
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+)
+
+// newFanoutReference returns a reference whose image destination writes to
+// all refs at once. Every blob is read from the source a single time and
+// streamed to the destinations which don't have it yet.
+func newFanoutReference(refs []types.ImageReference) types.ImageReference {
+	if len(refs) == 1 {
+		return refs[0]
+	}
+	return &fanoutReference{ImageReference: refs[0], refs: refs}
+}
+
+// fanoutReference behaves like its first reference except for the image
+// destination.
+type fanoutReference struct {
+	types.ImageReference
+	refs []types.ImageReference
+}
+
+func (r *fanoutReference) NewImageDestination(ctx context.Context, sys *types.SystemContext) (types.ImageDestination, error) {
+	dests := make([]types.ImageDestination, 0, len(r.refs))
+	for _, ref := range r.refs {
+		dest, err := ref.NewImageDestination(ctx, sys)
+		if err != nil {
+			for _, d := range dests {
+				_ = d.Close()
+			}
+			return nil, err
+		}
+		dests = append(dests, dest)
+	}
+	return &fanoutDestination{ref: r, dests: dests, present: map[digest.Digest][]bool{}}, nil
+}
+
+type fanoutDestination struct {
+	ref   *fanoutReference
+	dests []types.ImageDestination
+
+	mu sync.Mutex
+	// present records the destinations which already have a blob, so
+	// PutBlob only uploads it to the others.
+	present map[digest.Digest][]bool
+}
+
+func (d *fanoutDestination) Reference() types.ImageReference {
+	return d.ref
+}
+
+func (d *fanoutDestination) Close() error {
+	var errs []error
+	for _, dest := range d.dests {
+		errs = append(errs, dest.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// SupportedManifestMIMETypes returns the types supported by all destinations,
+// nil means every type is supported.
+func (d *fanoutDestination) SupportedManifestMIMETypes() []string {
+	var supported []string
+	for _, dest := range d.dests {
+		mimeTypes := dest.SupportedManifestMIMETypes()
+		if mimeTypes == nil {
+			continue
+		}
+		if supported == nil {
+			supported = mimeTypes
+			continue
+		}
+		var both []string
+		for _, t := range supported {
+			for _, other := range mimeTypes {
+				if t == other {
+					both = append(both, t)
+					break
+				}
+			}
+		}
+		supported = both
+	}
+	return supported
+}
+
+func (d *fanoutDestination) SupportsSignatures(ctx context.Context) error {
+	for _, dest := range d.dests {
+		if err := dest.SupportsSignatures(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *fanoutDestination) DesiredLayerCompression() types.LayerCompression {
+	compression := d.dests[0].DesiredLayerCompression()
+	for _, dest := range d.dests[1:] {
+		if dest.DesiredLayerCompression() != compression {
+			return types.PreserveOriginal
+		}
+	}
+	return compression
+}
+
+func (d *fanoutDestination) AcceptsForeignLayerURLs() bool {
+	for _, dest := range d.dests {
+		if !dest.AcceptsForeignLayerURLs() {
+			return false
+		}
+	}
+	return true
+}
+
+func (d *fanoutDestination) MustMatchRuntimeOS() bool {
+	for _, dest := range d.dests {
+		if dest.MustMatchRuntimeOS() {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *fanoutDestination) IgnoresEmbeddedDockerReference() bool {
+	for _, dest := range d.dests {
+		if !dest.IgnoresEmbeddedDockerReference() {
+			return false
+		}
+	}
+	return true
+}
+
+func (d *fanoutDestination) HasThreadSafePutBlob() bool {
+	for _, dest := range d.dests {
+		if !dest.HasThreadSafePutBlob() {
+			return false
+		}
+	}
+	return true
+}
+
+// TryReusingBlob only reports a blob as reused if all destinations have it,
+// substitutes aren't allowed so all destinations store the same blob.
+func (d *fanoutDestination) TryReusingBlob(ctx context.Context, info types.BlobInfo, cache types.BlobInfoCache, _ bool) (bool, types.BlobInfo, error) {
+	present := make([]bool, len(d.dests))
+	all := true
+	var reusedInfo types.BlobInfo
+	for i, dest := range d.dests {
+		reused, blobInfo, err := dest.TryReusingBlob(ctx, info, cache, false)
+		if err != nil {
+			return false, types.BlobInfo{}, err
+		}
+		present[i] = reused
+		if reused && reusedInfo.Digest == "" {
+			reusedInfo = blobInfo
+		}
+		all = all && reused
+	}
+	if all {
+		return true, reusedInfo, nil
+	}
+	d.mu.Lock()
+	d.present[info.Digest] = present
+	d.mu.Unlock()
+	return false, types.BlobInfo{}, nil
+}
+
+// PutBlob streams the blob to all destinations which don't have it yet.
+func (d *fanoutDestination) PutBlob(ctx context.Context, stream io.Reader, inputInfo types.BlobInfo, cache types.BlobInfoCache, isConfig bool) (types.BlobInfo, error) {
+	d.mu.Lock()
+	present := d.present[inputInfo.Digest]
+	d.mu.Unlock()
+
+	var (
+		wg      sync.WaitGroup
+		writers []io.Writer
+		pipes   []*io.PipeWriter
+		infos   = make([]types.BlobInfo, len(d.dests))
+		errs    = make([]error, len(d.dests))
+	)
+	for i, dest := range d.dests {
+		if present != nil && present[i] {
+			continue
+		}
+		pr, pw := io.Pipe()
+		writers = append(writers, pw)
+		pipes = append(pipes, pw)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			infos[i], errs[i] = dest.PutBlob(ctx, pr, inputInfo, cache, isConfig)
+			// destinations return early if they have the blob, keep reading
+			// so the other destinations get the whole stream
+			if errs[i] == nil {
+				_, _ = io.Copy(io.Discard, pr)
+			}
+			_ = pr.CloseWithError(errs[i])
+		}()
+	}
+
+	_, err := io.Copy(io.MultiWriter(writers...), stream)
+	for _, pw := range pipes {
+		_ = pw.CloseWithError(err)
+	}
+	wg.Wait()
+	if err != nil {
+		return types.BlobInfo{}, err
+	}
+	for i, err := range errs {
+		if err != nil {
+			return types.BlobInfo{}, err
+		}
+		if infos[i].Digest != "" {
+			return infos[i], nil
+		}
+	}
+	return inputInfo, nil
+}
+
+func (d *fanoutDestination) PutManifest(ctx context.Context, manifest []byte, instanceDigest *digest.Digest) error {
+	for _, dest := range d.dests {
+		if err := dest.PutManifest(ctx, manifest, instanceDigest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *fanoutDestination) PutSignatures(ctx context.Context, signatures [][]byte, instanceDigest *digest.Digest) error {
+	for _, dest := range d.dests {
+		if err := dest.PutSignatures(ctx, signatures, instanceDigest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *fanoutDestination) Commit(ctx context.Context, unparsedToplevel types.UnparsedImage) error {
+	for _, dest := range d.dests {
+		if err := dest.Commit(ctx, unparsedToplevel); err != nil {
+			return err
+		}
+	}
+	return nil
+}
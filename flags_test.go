@@ -0,0 +1,78 @@
+package imagesync
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/urfave/cli/v2"
+)
+
+// parseOptions returns the Options of the command line args.
+func parseOptions(t *testing.T, args ...string) Options {
+	t.Helper()
+	app := newApp()
+	var opts Options
+	app.Action = func(c *cli.Context) error {
+		opts = optionsFromFlags(c)
+		return nil
+	}
+	if err := app.Run(append([]string{"imagesync"}, args...)); err != nil {
+		t.Fatal(err)
+	}
+	return opts
+}
+
+// TestListFlags checks that every list flag takes comma separated values
+// as well as repeated flags.
+func TestListFlags(t *testing.T) {
+	for _, tt := range []struct {
+		flag  string
+		value func(Options) []string
+	}{
+		{"tag", func(o Options) []string { return o.Tags }},
+		{"mount-from", func(o Options) []string { return o.MountFrom }},
+		{"referrer-types", func(o Options) []string { return o.ReferrerTypes }},
+		{"artifact-types", func(o Options) []string { return o.ArtifactTypes }},
+		{"skip-artifact-types", func(o Options) []string { return o.SkipArtifactTypes }},
+		{"max-concurrent-per-registry", func(o Options) []string { return o.MaxConcurrentPerRegistry }},
+	} {
+		t.Run(tt.flag, func(t *testing.T) {
+			want := []string{"a", "b", "c"}
+			if got := tt.value(parseOptions(t, "--"+tt.flag, "a,b", "--"+tt.flag, "c")); !slices.Equal(got, want) {
+				t.Errorf("--%s a,b --%s c = %q, want %q", tt.flag, tt.flag, got, want)
+			}
+		})
+	}
+}
+
+// TestMaxConcurrentPerRegistryList checks the documented mix of a limit for
+// all registries and one for a registry.
+func TestMaxConcurrentPerRegistryList(t *testing.T) {
+	opts := parseOptions(t, "--max-concurrent-per-registry", "4,ghcr.io=2")
+	opts.MaxConcurrentTags = 8
+	slots, err := newTagSlots(opts, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := slots.registries.max; got != 4 {
+		t.Errorf("limit for all registries = %d, want 4", got)
+	}
+	if got := slots.registries.overrides; len(got) != 1 || got["ghcr.io"] != 2 {
+		t.Errorf("registry limits = %v, want ghcr.io=2", got)
+	}
+}
+
+func TestDestinationList(t *testing.T) {
+	if got, want := parseOptions(t, "--dest", "a,b", "--dest", "c").Destination, "a,b,c"; got != want {
+		t.Errorf("Destination = %q, want %q", got, want)
+	}
+}
+
+// TestTagRewriteCommas checks that the commas of a --tag-rewrite rule aren't
+// split.
+func TestTagRewriteCommas(t *testing.T) {
+	rule := `s/^v([0-9]{1,3})$/release-$1/`
+	if got := parseOptions(t, "--tag-rewrite", rule).TagRewrite; !slices.Equal(got, []string{rule}) {
+		t.Errorf("TagRewrite = %q, want %q", got, rule)
+	}
+}
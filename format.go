@@ -0,0 +1,58 @@
+package imagesync
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/pkg/compression"
+	compressiontypes "github.com/containers/image/v5/pkg/compression/types"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// parseFormat returns the manifest type of --format, manifest lists are
+// converted to the matching list type by containers/image. Empty keeps the
+// format of the source.
+func parseFormat(format string) (string, error) {
+	switch format {
+	case "":
+		return "", nil
+	case "oci":
+		return imgspecv1.MediaTypeImageManifest, nil
+	case "v2s2":
+		return manifest.DockerV2Schema2MediaType, nil
+	default:
+		return "", fmt.Errorf("unsupported format %q, expected oci or v2s2", format)
+	}
+}
+
+// parseCompression returns the layer compression of --compression and
+// --compression-level, nil keeps the compression of the source. A level of
+// 0 is the default level of the algorithm.
+func parseCompression(name string, level int) (*compression.Algorithm, *int, error) {
+	if name == "" {
+		if level != 0 {
+			return nil, nil, errors.New("--compression-level requires --compression")
+		}
+		return nil, nil, nil
+	}
+	maxLevel := 22
+	switch name {
+	case compressiontypes.GzipAlgorithmName:
+		maxLevel = 9
+	case compressiontypes.ZstdAlgorithmName, compressiontypes.ZstdChunkedAlgorithmName:
+	default:
+		return nil, nil, fmt.Errorf("unsupported --compression %q, expected gzip, zstd or zstd:chunked", name)
+	}
+	algo, err := compression.AlgorithmByName(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if level == 0 {
+		return &algo, nil, nil
+	}
+	if level < 1 || level > maxLevel {
+		return nil, nil, fmt.Errorf("%s compression levels range from 1 to %d, got %d", name, maxLevel, level)
+	}
+	return &algo, &level, nil
+}
@@ -0,0 +1,144 @@
+package imagesync
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/containers/image/v5/copy"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/types"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// googleHostPattern matches Container Registry and Artifact Registry, e.g.
+// eu.gcr.io and europe-west1-docker.pkg.dev.
+var googleHostPattern = regexp.MustCompile(`^(?:(?:[a-z0-9-]+\.)?gcr\.io|[a-z0-9-]+-docker\.pkg\.dev)$`)
+
+// googleTokenRefresh is how long before it expires a token is replaced, a
+// copy started with it has that long to authenticate its requests.
+const googleTokenRefresh = 10 * time.Minute
+
+// isGoogleRegistry reports whether the registry of ref is run by Google.
+func isGoogleRegistry(ref string) bool {
+	named, err := reference.ParseNormalizedNamed(ref)
+	return err == nil && googleHostPattern.MatchString(reference.Domain(named))
+}
+
+// googleSession logs in to the Google registries of a sync with the
+// service-account JSON of --google-credentials or the Application Default
+// Credentials. Without credentials the auth files are used.
+type googleSession struct {
+	credentialsFile string
+
+	once   sync.Once
+	tokens oauth2.TokenSource
+	err    error
+}
+
+func newGoogleSession(options Options) (*googleSession, error) {
+	if options.GoogleCredentials != "" {
+		if _, err := os.Stat(options.GoogleCredentials); err != nil {
+			return nil, fmt.Errorf("--google-credentials: %w", err)
+		}
+	}
+	return &googleSession{credentialsFile: options.GoogleCredentials}, nil
+}
+
+// init finds the credentials once, a missing ADC only warns. The token
+// source outlives the sync, it refreshes without a request context.
+func (g *googleSession) init() error {
+	g.once.Do(func() {
+		params := google.CredentialsParams{
+			Scopes:            []string{"https://www.googleapis.com/auth/cloud-platform"},
+			EarlyTokenRefresh: googleTokenRefresh,
+		}
+		var (
+			creds *google.Credentials
+			err   error
+		)
+		if g.credentialsFile != "" {
+			var data []byte
+			if data, err = os.ReadFile(g.credentialsFile); err == nil {
+				creds, err = google.CredentialsFromJSONWithParams(context.Background(), data, params)
+			}
+			if err != nil {
+				g.err = fmt.Errorf("--google-credentials: %w", err)
+				return
+			}
+		} else if creds, err = google.FindDefaultCredentialsWithParams(context.Background(), params); err != nil {
+			logrus.Warnf("no Google credentials, using the auth files: %s", err)
+			return
+		}
+		g.tokens = creds.TokenSource
+	})
+	return g.err
+}
+
+// auth returns a valid token as registry credentials, nil without Google
+// credentials. Tokens are refreshed when they are about to expire.
+func (g *googleSession) auth() (*types.DockerAuthConfig, error) {
+	if err := g.init(); err != nil || g.tokens == nil {
+		return nil, err
+	}
+	token, err := g.tokens.Token()
+	if err != nil {
+		return nil, fmt.Errorf("getting Google access token: %w", err)
+	}
+	return &types.DockerAuthConfig{Username: "oauth2accesstoken", Password: token.AccessToken}, nil
+}
+
+// prepareGoogle logs in to the Google registries of the job. Credentials of
+// the job or its credential helpers take precedence, the destination token
+// is only used if all registry destinations are on Google registries.
+func (r *syncRun) prepareGoogle(src source, dests []destination) error {
+	if r.google == nil {
+		return nil
+	}
+	r.googleSrc = src.kind == sourceRegistry && r.opts.SourceCtx.DockerAuthConfig == nil && isGoogleRegistry(src.value)
+	var registries, googles int
+	for _, dest := range dests {
+		if dest.kind == destinationRegistry {
+			registries++
+			if isGoogleRegistry(dest.value) {
+				googles++
+			}
+		}
+	}
+	if r.opts.DestinationCtx.DockerAuthConfig != nil {
+		googles = 0
+	}
+	if googles > 0 && googles < registries {
+		logrus.Warnf("the destinations of %s are on several registries, using the auth files for Google registries", r.job.Source)
+	}
+	r.googleDest = googles > 0 && googles == registries
+	return r.refreshGoogle(&r.opts)
+}
+
+// refreshGoogle replaces the Google tokens of opts by valid ones, the
+// system contexts are copied as other tags may use them concurrently.
+func (r *syncRun) refreshGoogle(opts *copy.Options) error {
+	if !r.googleSrc && !r.googleDest {
+		return nil
+	}
+	auth, err := r.google.auth()
+	if err != nil || auth == nil {
+		return err
+	}
+	if r.googleSrc {
+		sys := *opts.SourceCtx
+		sys.DockerAuthConfig = auth
+		opts.SourceCtx = &sys
+	}
+	if r.googleDest {
+		sys := *opts.DestinationCtx
+		sys.DockerAuthConfig = auth
+		opts.DestinationCtx = &sys
+	}
+	return nil
+}
@@ -0,0 +1,258 @@
+package imagesync
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/pkg/docker/config"
+	"github.com/containers/image/v5/types"
+	"github.com/sirupsen/logrus"
+)
+
+// harborSession is the --harbor integration: projects missing in Harbor
+// destinations are created and their retention rules are logged. Other
+// registries are left alone.
+type harborSession struct {
+	public bool
+
+	mu sync.Mutex
+	// hosts records per registry whether it is Harbor.
+	hosts map[string]bool
+	// projects are the projects known to exist by host/project.
+	projects map[string]bool
+}
+
+func newHarborSession(options Options) *harborSession {
+	if !options.Harbor {
+		return nil
+	}
+	return &harborSession{public: options.HarborPublicProjects, hosts: map[string]bool{}, projects: map[string]bool{}}
+}
+
+// harborAPI is a client of the Harbor API of a registry.
+type harborAPI struct {
+	host   string
+	client *http.Client
+	auth   *types.DockerAuthConfig
+}
+
+func newHarborAPI(host string, sys *types.SystemContext) *harborAPI {
+	api := &harborAPI{host: host, client: registryHTTPClient(sys)}
+	if auth, err := config.GetCredentials(sys, host); err == nil && auth.Username != "" {
+		api.auth = &auth
+	}
+	return api
+}
+
+// do sends a request to path, a non-nil body is sent as JSON. A response
+// with status other than the expected ones fails.
+func (h *harborAPI) do(ctx context.Context, method, path string, body any, out any, expected ...int) (int, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, "https://"+h.host+"/api/v2.0"+path, reader)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if h.auth != nil {
+		req.SetBasicAuth(h.auth.Username, h.auth.Password)
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if !slices.Contains(expected, resp.StatusCode) {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return resp.StatusCode, fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if out != nil && resp.StatusCode == http.StatusOK {
+		if err = json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return resp.StatusCode, fmt.Errorf("decoding %s: %w", path, err)
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+// isHarbor reports whether the registry serves the Harbor API, it is only
+// checked once per registry.
+func (s *harborSession) isHarbor(ctx context.Context, api *harborAPI) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if harbor, ok := s.hosts[api.host]; ok {
+		return harbor
+	}
+	var info struct {
+		HarborVersion string `json:"harbor_version"`
+	}
+	_, err := api.do(ctx, http.MethodGet, "/systeminfo", nil, &info, http.StatusOK)
+	harbor := err == nil
+	if harbor {
+		logrus.Debugf("%s is Harbor %s", api.host, info.HarborVersion)
+	} else {
+		logrus.Debugf("%s isn't Harbor, skipping the Harbor integration: %s", api.host, err)
+	}
+	s.hosts[api.host] = harbor
+	return harbor
+}
+
+// harborProject is the part of a Harbor project the integration reads.
+type harborProject struct {
+	Metadata struct {
+		RetentionID string `json:"retention_id"`
+	} `json:"metadata"`
+}
+
+// ensureProject creates the project of the destination repository unless it
+// exists and logs its retention rules, a dry run only logs the creation.
+func (s *harborSession) ensureProject(ctx context.Context, dest string, sys *types.SystemContext, dryRun bool) error {
+	named, err := reference.ParseNormalizedNamed(dest)
+	if err != nil {
+		return nil
+	}
+	host := reference.Domain(named)
+	project, _, _ := strings.Cut(reference.Path(named), "/")
+	key := host + "/" + project
+	s.mu.Lock()
+	known := s.projects[key]
+	s.mu.Unlock()
+	api := newHarborAPI(host, sys)
+	if known || !s.isHarbor(ctx, api) {
+		return nil
+	}
+
+	var p harborProject
+	path := "/projects/" + url.PathEscape(project)
+	status, err := api.do(ctx, http.MethodGet, path, nil, &p, http.StatusOK, http.StatusNotFound, http.StatusForbidden)
+	if err != nil {
+		return fmt.Errorf("checking Harbor project %s: %w", key, err)
+	}
+	switch {
+	case status == http.StatusForbidden:
+		// robot accounts can push without reading the project
+		logrus.Debugf("no access to Harbor project %s, assuming it exists", key)
+	case status == http.StatusNotFound && dryRun:
+		logrus.Infof("Would create Harbor project %s", key)
+		return nil
+	case status == http.StatusNotFound:
+		create := map[string]any{
+			"project_name": project,
+			"metadata":     map[string]string{"public": strconv.FormatBool(s.public)},
+		}
+		if _, err = api.do(ctx, http.MethodPost, "/projects", create, nil, http.StatusCreated, http.StatusConflict); err != nil {
+			return fmt.Errorf("creating Harbor project %s: %w", key, err)
+		}
+		logrus.Infof("Created Harbor project %s", key)
+	default:
+		s.warnRetention(ctx, api, key, p.Metadata.RetentionID)
+	}
+	s.mu.Lock()
+	s.projects[key] = true
+	s.mu.Unlock()
+	return nil
+}
+
+// harborRetention is a tag retention policy of a project.
+type harborRetention struct {
+	Rules []struct {
+		Disabled       bool                        `json:"disabled"`
+		Action         string                      `json:"action"`
+		Template       string                      `json:"template"`
+		Params         map[string]any              `json:"params"`
+		TagSelectors   []harborSelector            `json:"tag_selectors"`
+		ScopeSelectors map[string][]harborSelector `json:"scope_selectors"`
+	} `json:"rules"`
+	Trigger struct {
+		Kind     string         `json:"kind"`
+		Settings map[string]any `json:"settings"`
+	} `json:"trigger"`
+}
+
+type harborSelector struct {
+	Decoration string `json:"decoration"`
+	Pattern    string `json:"pattern"`
+}
+
+func (h harborSelector) String() string {
+	return h.Decoration + " " + h.Pattern
+}
+
+// warnRetention logs the enabled retention rules of a project, Harbor
+// deletes the pushed tags which none of them retains.
+func (s *harborSession) warnRetention(ctx context.Context, api *harborAPI, project, id string) {
+	if id == "" {
+		return
+	}
+	var retention harborRetention
+	if _, err := api.do(ctx, http.MethodGet, "/retentions/"+url.PathEscape(id), nil, &retention, http.StatusOK); err != nil {
+		logrus.Debugf("failed reading the retention policy of Harbor project %s: %s", project, err)
+		return
+	}
+	var rules []string
+	for _, rule := range retention.Rules {
+		if rule.Disabled {
+			continue
+		}
+		desc := rule.Action + " " + rule.Template
+		params := make([]string, 0, len(rule.Params))
+		for k, v := range rule.Params {
+			params = append(params, fmt.Sprintf("%s=%v", k, v))
+		}
+		slices.Sort(params)
+		if len(params) > 0 {
+			desc += " (" + strings.Join(params, ", ") + ")"
+		}
+		for _, sel := range rule.ScopeSelectors["repository"] {
+			desc += ", repositories " + sel.String()
+		}
+		for _, sel := range rule.TagSelectors {
+			desc += ", tags " + sel.String()
+		}
+		rules = append(rules, desc)
+	}
+	if len(rules) == 0 {
+		return
+	}
+	schedule := retention.Trigger.Kind
+	if cron, ok := retention.Trigger.Settings["cron"].(string); ok && cron != "" {
+		schedule += " " + cron
+	}
+	logrus.Warnf("Harbor project %s has a tag retention policy (%s), tags it doesn't retain are deleted: %s",
+		project, schedule, strings.Join(rules, "; "))
+}
+
+// prepareHarbor creates the missing Harbor projects of the registry
+// destinations of the job.
+func (r *syncRun) prepareHarbor(ctx context.Context, dests []destination) error {
+	if r.harbor == nil {
+		return nil
+	}
+	for _, dest := range dests {
+		if dest.kind != destinationRegistry {
+			continue
+		}
+		if err := r.harbor.ensureProject(ctx, dest.value, r.opts.DestinationCtx, r.options.DryRun); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+package imagesync
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	// the sqlite driver is linked for the blob info cache already
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/urfave/cli/v2"
+)
+
+const historySchema = `
+CREATE TABLE IF NOT EXISTS runs (
+	id INTEGER PRIMARY KEY,
+	started_at TEXT NOT NULL,
+	finished_at TEXT NOT NULL,
+	source TEXT NOT NULL,
+	destination TEXT NOT NULL,
+	config TEXT NOT NULL,
+	dry_run INTEGER NOT NULL,
+	copied INTEGER NOT NULL,
+	skipped INTEGER NOT NULL,
+	failed INTEGER NOT NULL,
+	bytes INTEGER NOT NULL,
+	error TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS tags (
+	run_id INTEGER NOT NULL REFERENCES runs (id),
+	source TEXT NOT NULL,
+	destination TEXT NOT NULL,
+	status TEXT NOT NULL,
+	digest TEXT NOT NULL,
+	source_digest TEXT NOT NULL,
+	bytes INTEGER NOT NULL,
+	duration_seconds REAL NOT NULL,
+	error TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS tags_destination ON tags (destination);
+CREATE INDEX IF NOT EXISTS tags_source ON tags (source);
+`
+
+// historyDB is the --state-db, a SQLite database recording every run and
+// the outcome of its tags.
+type historyDB struct {
+	db *sql.DB
+}
+
+// openHistory opens or creates the database at path, nil without a path.
+func openHistory(path string) (*historyDB, error) {
+	if path == "" {
+		return nil, nil
+	}
+	// several processes may record runs at once
+	db, err := sql.Open("sqlite3", path+"?_busy_timeout=10000")
+	if err != nil {
+		return nil, fmt.Errorf("opening state db: %w", err)
+	}
+	if _, err = db.Exec(historySchema); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("creating state db %s: %w", path, err)
+	}
+	return &historyDB{db: db}, nil
+}
+
+func (h *historyDB) close() {
+	if h != nil {
+		_ = h.db.Close()
+	}
+}
+
+// record adds the finished run of result.
+func (h *historyDB) record(result *Result) error {
+	if h == nil {
+		return nil
+	}
+	tx, err := h.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	p := result.Parameters
+	res, err := tx.Exec(`INSERT INTO runs (started_at, finished_at, source, destination, config, dry_run, copied, skipped, failed, bytes, error)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		result.StartedAt.Format(time.RFC3339Nano), result.FinishedAt.Format(time.RFC3339Nano),
+		p.Source, p.Destination, p.Config, p.DryRun,
+		result.Totals.Copied, result.Totals.Skipped, result.Totals.Failed, result.Totals.Bytes, result.Error)
+	if err != nil {
+		return err
+	}
+	runID, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	for _, tag := range result.Tags {
+		if _, err = tx.Exec(`INSERT INTO tags (run_id, source, destination, status, digest, source_digest, bytes, duration_seconds, error)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			runID, tag.Source, tag.Destination, tag.Status, tag.Digest, tag.SourceDigest, tag.Bytes, tag.DurationSeconds, tag.Error); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// historyEntry is a tag of a recorded run.
+type historyEntry struct {
+	RunID      int64  `json:"runId"`
+	FinishedAt string `json:"finishedAt"`
+	DryRun     bool   `json:"dryRun,omitempty"`
+	TagResult
+}
+
+// query returns the recorded tags, the newest first. image matches the
+// source or destination by repository or repository:tag, dgst the source
+// or destination digest, status the outcome. Empty values match all.
+func (h *historyDB) query(image, dgst, status string, limit int) ([]historyEntry, error) {
+	var (
+		where []string
+		args  []any
+	)
+	if image != "" {
+		where = append(where, `(t.source = ? OR t.destination = ? OR substr(t.source, 1, length(?)) = ? OR substr(t.destination, 1, length(?)) = ?)`)
+		prefix := image + ":"
+		args = append(args, image, image, prefix, prefix, prefix, prefix)
+	}
+	if dgst != "" {
+		where = append(where, `(t.digest = ? OR t.source_digest = ?)`)
+		args = append(args, dgst, dgst)
+	}
+	if status != "" {
+		where = append(where, `t.status = ?`)
+		args = append(args, status)
+	}
+	q := `SELECT r.id, r.finished_at, r.dry_run, t.source, t.destination, t.status, t.digest, t.source_digest, t.bytes, t.duration_seconds, t.error
+		FROM tags t JOIN runs r ON r.id = t.run_id`
+	if len(where) > 0 {
+		q += " WHERE " + strings.Join(where, " AND ")
+	}
+	q += " ORDER BY r.id DESC, t.destination LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := h.db.Query(q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := []historyEntry{}
+	for rows.Next() {
+		var e historyEntry
+		if err = rows.Scan(&e.RunID, &e.FinishedAt, &e.DryRun, &e.Source, &e.Destination, &e.Status,
+			&e.Digest, &e.SourceDigest, &e.Bytes, &e.DurationSeconds, &e.Error); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// showHistory is the action of the history command.
+func showHistory(c *cli.Context) error {
+	path := c.String("state-db")
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("opening state db: %w", err)
+	}
+	if c.Int("limit") < 1 {
+		return errors.New("--limit must be positive")
+	}
+	output := c.String("output")
+	if output != "text" && output != "json" {
+		return fmt.Errorf("unsupported output %q", output)
+	}
+	h, err := openHistory(path)
+	if err != nil {
+		return err
+	}
+	defer h.close()
+	entries, err := h.query(c.String("image"), c.String("digest"), c.String("status"), c.Int("limit"))
+	if err != nil {
+		return fmt.Errorf("querying state db: %w", err)
+	}
+	if output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(entries)
+	}
+	return writeHistory(os.Stdout, entries)
+}
+
+func writeHistory(w io.Writer, entries []historyEntry) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tRUN\tSTATUS\tSOURCE\tDESTINATION\tSOURCE DIGEST\tDIGEST")
+	for _, e := range entries {
+		status := string(e.Status)
+		if e.DryRun {
+			status += " (dry run)"
+		}
+		finished := e.FinishedAt
+		if t, err := time.Parse(time.RFC3339Nano, finished); err == nil {
+			finished = t.Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\t%s\t%s\n", finished, e.RunID, status, e.Source, e.Destination, e.SourceDigest, e.Digest)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,113 @@
+package imagesync
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/containers/image/v5/types"
+	"github.com/samber/lo"
+	"github.com/sirupsen/logrus"
+)
+
+// hooks are the shell commands run before and after every copied tag and
+// after the run, described by IMAGESYNC_ environment variables. A nil hooks
+// runs nothing.
+type hooks struct {
+	preTag  string
+	postTag string
+	postRun string
+}
+
+func newHooks(opts Options) *hooks {
+	if opts.PreTagHook == "" && opts.PostTagHook == "" && opts.PostRunHook == "" {
+		return nil
+	}
+	return &hooks{preTag: opts.PreTagHook, postTag: opts.PostTagHook, postRun: opts.PostRunHook}
+}
+
+// runPreTag runs the pre-tag hook before srcRef is copied to destRefs, a
+// failing hook fails the tag.
+func (h *hooks) runPreTag(ctx context.Context, srcRef types.ImageReference, destRefs []types.ImageReference) error {
+	if h == nil || h.preTag == "" {
+		return nil
+	}
+	err := runHook(ctx, h.preTag, []string{
+		"IMAGESYNC_SOURCE=" + refName(srcRef),
+		"IMAGESYNC_DESTINATIONS=" + strings.Join(lo.Map(destRefs, func(ref types.ImageReference, _ int) string { return refName(ref) }), " "),
+	})
+	if err != nil {
+		return fmt.Errorf("pre-tag hook: %w", err)
+	}
+	return nil
+}
+
+// runPostTag runs the post-tag hook for the outcome of copying a tag to a
+// destination. The copy is done, a failing hook is only logged.
+func (h *hooks) runPostTag(ctx context.Context, tag TagResult) {
+	if h == nil || h.postTag == "" {
+		return
+	}
+	err := runHook(ctx, h.postTag, []string{
+		"IMAGESYNC_SOURCE=" + tag.Source,
+		"IMAGESYNC_DESTINATION=" + tag.Destination,
+		"IMAGESYNC_STATUS=" + string(tag.Status),
+		"IMAGESYNC_DIGEST=" + tag.Digest,
+		"IMAGESYNC_SOURCE_DIGEST=" + tag.SourceDigest,
+		"IMAGESYNC_BYTES=" + strconv.FormatInt(tag.Bytes, 10),
+		"IMAGESYNC_ERROR=" + tag.Error,
+	})
+	if err != nil {
+		logrus.Warnf("post-tag hook of %s failed: %s", tag.Destination, err)
+	}
+}
+
+// runPostRun runs the post-run hook with the totals of the finished run,
+// which returned err. A failing hook is only logged.
+func (h *hooks) runPostRun(ctx context.Context, result *Result, err error) {
+	if h == nil || h.postRun == "" {
+		return
+	}
+	t := result.totals()
+	status, errText := "succeeded", ""
+	if err != nil || t.Failed > 0 {
+		status = "failed"
+	}
+	if err != nil {
+		errText = err.Error()
+	}
+	// a sync cancelled by its timeout still runs the hook
+	if herr := runHook(context.WithoutCancel(ctx), h.postRun, []string{
+		"IMAGESYNC_STATUS=" + status,
+		"IMAGESYNC_COPIED=" + strconv.Itoa(t.Copied),
+		"IMAGESYNC_FAILED=" + strconv.Itoa(t.Failed),
+		"IMAGESYNC_SKIPPED=" + strconv.Itoa(t.Skipped),
+		"IMAGESYNC_BYTES=" + strconv.FormatInt(t.Bytes, 10),
+		"IMAGESYNC_DURATION_SECONDS=" + strconv.FormatFloat(result.durationSeconds(), 'f', 1, 64),
+		"IMAGESYNC_ERROR=" + errText,
+	}); herr != nil {
+		logrus.Warnf("post-run hook failed: %s", herr)
+	}
+}
+
+// runHook runs command with sh and the environment of the process plus env.
+// The output of the command is logged at debug level.
+func runHook(ctx context.Context, command string, env []string) error {
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Env = append(os.Environ(), env...)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	err := cmd.Run()
+	if out := strings.TrimSpace(output.String()); out != "" {
+		logrus.Debugf("hook output: %s", out)
+		if err != nil {
+			return fmt.Errorf("%w: %s", err, out)
+		}
+	}
+	return err
+}
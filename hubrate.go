@@ -0,0 +1,187 @@
+package imagesync
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/pkg/docker/config"
+	"github.com/containers/image/v5/types"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	hubRegistry = "registry-1.docker.io"
+	hubTokenURL = "https://auth.docker.io/token"
+	hubService  = "registry.docker.io"
+	// hubMinPause bounds a pause from below, the estimate of the time a
+	// pull takes to return to the window is rough.
+	hubMinPause = 30 * time.Second
+)
+
+// hubPacer keeps the pulls from Docker Hub below its rate limit. Before a
+// copy the remaining pulls are read from the ratelimit-* headers of a HEAD
+// request, which doesn't count as a pull; copies pause while no more than
+// buffer pulls are left.
+type hubPacer struct {
+	buffer int
+
+	// mu serializes the checks, a pause holds back all copies.
+	mu sync.Mutex
+	// unlimited is set once Docker Hub returned no rate limit headers.
+	unlimited bool
+	tokens    map[string]hubToken
+}
+
+type hubToken struct {
+	token   string
+	expires time.Time
+}
+
+// hubRateLimit is the state of the rate limit window of a pull.
+type hubRateLimit struct {
+	limit, remaining int
+	window           time.Duration
+}
+
+func newHubPacer(buffer int) *hubPacer {
+	if buffer < 0 {
+		return nil
+	}
+	return &hubPacer{buffer: buffer, tokens: map[string]hubToken{}}
+}
+
+// wait pauses until pulling ref stays within the rate limit. Refs of other
+// registries and failed checks don't wait.
+func (p *hubPacer) wait(ctx context.Context, ref types.ImageReference, sys *types.SystemContext) error {
+	if p == nil || ref.Transport().Name() != docker.Transport.Name() {
+		return nil
+	}
+	named := ref.DockerReference()
+	if named == nil || reference.Domain(named) != "docker.io" {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for !p.unlimited {
+		limit, err := p.check(ctx, named, sys)
+		if err != nil {
+			logrus.Debugf("failed reading the Docker Hub rate limit: %s", err)
+			return nil
+		}
+		if limit == nil {
+			logrus.Debug("Docker Hub returned no rate limit, not pacing pulls")
+			p.unlimited = true
+			return nil
+		}
+		if limit.remaining > p.buffer {
+			return nil
+		}
+		pause := min(max(time.Duration(p.buffer-limit.remaining+1)*limit.window/time.Duration(max(limit.limit, 1)), hubMinPause), limit.window)
+		logrus.Warnf("%d of %d Docker Hub pulls left in the %s window, pausing for %s", limit.remaining, limit.limit, limit.window, pause)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(pause):
+		}
+	}
+	return nil
+}
+
+// check reads the rate limit of pulling named, nil if there is none.
+func (p *hubPacer) check(ctx context.Context, named reference.Named, sys *types.SystemContext) (*hubRateLimit, error) {
+	repo := reference.Path(named)
+	token, err := p.token(ctx, repo, sys)
+	if err != nil {
+		return nil, err
+	}
+	ref := "latest"
+	if digested, ok := named.(reference.Digested); ok {
+		ref = digested.Digest().String()
+	} else if tagged, ok := named.(reference.Tagged); ok {
+		ref = tagged.Tag()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, "https://"+hubRegistry+"/v2/"+repo+"/manifests/"+ref, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Accept", strings.Join(manifest.DefaultRequestedManifestMIMETypes, ", "))
+	resp, err := registryHTTPClient(sys).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	limit, window, okLimit := parseRateLimitHeader(resp.Header.Get("ratelimit-limit"))
+	remaining, _, okRemaining := parseRateLimitHeader(resp.Header.Get("ratelimit-remaining"))
+	if !okLimit || !okRemaining {
+		if resp.StatusCode == http.StatusTooManyRequests {
+			return &hubRateLimit{window: hubMinPause}, nil
+		}
+		return nil, nil
+	}
+	return &hubRateLimit{limit: limit, remaining: remaining, window: window}, nil
+}
+
+// parseRateLimitHeader parses a value like "100;w=21600" into the count
+// and the window.
+func parseRateLimitHeader(value string) (int, time.Duration, bool) {
+	count, params, _ := strings.Cut(value, ";")
+	n, err := strconv.Atoi(strings.TrimSpace(count))
+	if err != nil {
+		return 0, 0, false
+	}
+	window := 6 * time.Hour
+	for _, param := range strings.Split(params, ";") {
+		if w, ok := strings.CutPrefix(strings.TrimSpace(param), "w="); ok {
+			if seconds, err := strconv.Atoi(w); err == nil && seconds > 0 {
+				window = time.Duration(seconds) * time.Second
+			}
+		}
+	}
+	return n, window, true
+}
+
+// token returns a pull token of repo, authenticated with the Docker Hub
+// credentials of sys if there are any.
+func (p *hubPacer) token(ctx context.Context, repo string, sys *types.SystemContext) (string, error) {
+	if t, ok := p.tokens[repo]; ok && time.Now().Before(t.expires) {
+		return t.token, nil
+	}
+	q := url.Values{"service": {hubService}, "scope": {"repository:" + repo + ":pull"}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, hubTokenURL+"?"+q.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	if auth, err := config.GetCredentials(sys, "docker.io"); err == nil && auth.Username != "" {
+		req.SetBasicAuth(auth.Username, auth.Password)
+	}
+	resp, err := registryHTTPClient(sys).Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("getting Docker Hub token: %s", resp.Status)
+	}
+	var body struct {
+		Token     string `json:"token"`
+		ExpiresIn int    `json:"expires_in"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("decoding Docker Hub token: %w", err)
+	}
+	// the token is replaced a minute before it expires
+	expiresIn := time.Duration(max(body.ExpiresIn, 60)-60) * time.Second
+	p.tokens[repo] = hubToken{token: body.Token, expires: time.Now().Add(expiresIn)}
+	return body.Token, nil
+}
@@ -0,0 +1,123 @@
+package imagesync
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/containers/image/v5/docker/reference"
+)
+
+// imagesFileJobs returns a single image job for every line of the
+// --images-file, - reads stdin. A line is a source image with a tag or
+// digest and optionally its destination, without destination the image is
+// copied to its repository path below each --dest: docker.io/library/alpine:3
+// goes to <dest>/library/alpine:3. A destination without tag gets the tag of
+// the source. Empty lines and lines starting with # are ignored.
+func imagesFileJobs(options Options, defaults syncJob) ([]syncJob, error) {
+	if options.Source != "" || options.Config != "" || options.SkopeoSyncConfig != "" {
+		return nil, errors.New("--images-file can't be used together with --src, --config or --skopeo-sync-config")
+	}
+	path := options.ImagesFile
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading images file: %w", err)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	base := singleImageDefaults(defaults)
+	var jobs []syncJob
+	dests := map[string]int{}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("images file %s: line %d: expected a source and an optional destination", path, line)
+		}
+		dest := ""
+		if len(fields) == 2 {
+			dest = fields[1]
+		}
+		job, err := singleImageJob(options, base, fields[0], dest)
+		if err != nil {
+			return nil, fmt.Errorf("images file %s: line %d: %w", path, line, err)
+		}
+		if other, ok := dests[job.Destination]; ok && job.Destination != "" {
+			return nil, fmt.Errorf("images file %s: lines %d and %d are both copied to %s", path, other, line, job.Destination)
+		}
+		dests[job.Destination] = line
+		jobs = append(jobs, job)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading images file: %w", err)
+	}
+	if len(jobs) == 0 {
+		return nil, fmt.Errorf("images file %s has no images", path)
+	}
+	return jobs, nil
+}
+
+// singleImageDefaults returns defaults for jobs naming their image, the
+// tag filters and pruning don't apply to them.
+func singleImageDefaults(defaults syncJob) syncJob {
+	defaults.TagsPattern, defaults.SkipTagsPattern, defaults.Semver, defaults.Tags, defaults.SkipTags = "", "", "", nil, nil
+	defaults.KeepLatestN, defaults.Age, defaults.Prune = 0, ageFilter{}, false
+	return defaults
+}
+
+// singleImageJob returns the job copying the image src to dest, an empty
+// dest copies it to its --repo-rewrite or its repository path below each
+// --dest.
+func singleImageJob(options Options, base syncJob, src, dest string) (syncJob, error) {
+	src = strings.TrimPrefix(src, "docker://")
+	named, err := reference.ParseNormalizedNamed(src)
+	if err != nil {
+		return syncJob{}, err
+	}
+	if !hasTag(src) {
+		return syncJob{}, fmt.Errorf("%s needs a tag or digest", src)
+	}
+	job := base
+	job.Source = src
+	rewritten, ok := base.RepoRewrite.rewrite(named.Name())
+	switch {
+	case dest != "":
+		job.Destination = withSourceTag(strings.TrimPrefix(dest, "docker://"), named)
+	case ok:
+		job.Destination = withSourceTag(rewritten, named)
+	case options.Destination == "" && options.ExportBundle == "":
+		return syncJob{}, fmt.Errorf("%s has no destination, no --repo-rewrite matches and --dest isn't set", src)
+	default:
+		job.Destination = destinationsBelow(options.Destination, withSourceTag(reference.Path(named), named))
+	}
+	return job, nil
+}
+
+// withSourceTag appends the tag of src to each of the comma separated
+// registry destinations without tag or digest. A source digest isn't
+// appended, the image is stored by its digest then.
+func withSourceTag(dests string, src reference.Named) string {
+	tagged, ok := src.(reference.Tagged)
+	if !ok {
+		return dests
+	}
+	parts := strings.Split(dests, ",")
+	for i, dest := range parts {
+		dest = strings.TrimSpace(dest)
+		// other transports than registries are left alone
+		if _, err := reference.ParseNormalizedNamed(dest); err == nil && !hasTag(dest) {
+			parts[i] = dest + ":" + tagged.Tag()
+		}
+	}
+	return strings.Join(parts, ",")
+}
@@ -6,19 +6,29 @@ import (
 	"fmt"
 	"os"
 	"regexp"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/containers/image/v5/copy"
+	"github.com/containers/image/v5/directory"
 	"github.com/containers/image/v5/docker"
 	dockerarchive "github.com/containers/image/v5/docker/archive"
+	"github.com/containers/image/v5/docker/daemon"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/manifest"
 	ociarchive "github.com/containers/image/v5/oci/archive"
 	ocilayout "github.com/containers/image/v5/oci/layout"
-	"github.com/containers/image/v5/signature"
+	"github.com/containers/image/v5/pkg/compression"
+	"github.com/containers/image/v5/storage"
 	"github.com/containers/image/v5/types"
 	"github.com/samber/lo"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var Version string
@@ -26,31 +36,183 @@ var Version string
 var ErrInvalidTag = errors.New("invalid tag")
 
 func Execute() error {
+	return newApp().Run(os.Args)
+}
+
+// newApp returns the imagesync command line application.
+func newApp() *cli.App {
 	app := cli.NewApp()
 	app.Name = "imagesync"
 	app.Usage = "Sync container images in registries."
 	app.Version = Version
+	// --tag-rewrite rules may contain commas, the list flags are split by
+	// listFlag instead
+	app.DisableSliceFlagSeparator = true
 
 	app.Flags = []cli.Flag{
-		&cli.StringFlag{
+		&cli.StringSliceFlag{
 			Name:    "src",
-			Usage:   "Reference for the source container image/repository.",
+			Usage:   "Reference for the source container image/repository. Repeat it to fall back to other registries, e.g. -s docker.io/library/nginx -s mirror.gcr.io, when a tag can't be listed or copied.",
 			Aliases: []string{"s"},
 		},
+		&cli.StringFlag{
+			Name:  "src-format",
+			Usage: "Source transport: registry, oci, oci-archive, docker-archive, docker-daemon, containers-storage or dir. Detected from src and the content of archives by default.",
+		},
+		&cli.BoolFlag{
+			Name:  "legacy-source-detection",
+			Usage: "Treat every source which exists as a local file or directory as local path, deprecated.",
+		},
+		&cli.StringFlag{
+			Name:  "src-namespace",
+			Usage: "Sync every repository below this registry path, e.g. registry.example.com/team/, instead of --src.",
+		},
+		&cli.StringFlag{
+			Name:  "repos-pattern",
+			Usage: "Regex pattern the repository path below --src-namespace has to match.",
+		},
 		&cli.BoolFlag{
 			Name:  "src-strict-tls",
 			Usage: "Enable strict TLS for connections to source container registry.",
 		},
+		&cli.BoolFlag{
+			Name:  "src-plain-http",
+			Usage: "Connect to the source container registry over plain HTTP instead of HTTPS.",
+		},
+		&cli.StringSliceFlag{
+			Name:    "dest",
+			Usage:   "Reference for the destination container repository. Repeat it or separate destinations by commas to copy to several destinations at once.",
+			Aliases: []string{"d"},
+		},
+		&cli.StringFlag{
+			Name:  "dest-type",
+			Usage: "Destination transport: registry, oci, oci-archive, docker-archive, docker-daemon, containers-storage or dir. Detected from dest by default.",
+		},
+		&cli.StringFlag{
+			Name:  "skopeo-sync-config",
+			Usage: "Sync the images of a skopeo sync YAML file to the --dest registry path.",
+		},
+		&cli.StringFlag{
+			Name:  "images-file",
+			Usage: "File with a source image and an optional destination per line, - for stdin. Images without destination are copied below --dest.",
+		},
 		&cli.StringFlag{
-			Name:     "dest",
-			Usage:    "Reference for the destination container repository.",
-			Aliases:  []string{"d"},
-			Required: true,
+			Name:  "dest-namespace",
+			Usage: "Registry path the repositories of --src-namespace are synced below, comma separated for several destinations.",
+		},
+		&cli.StringSliceFlag{
+			Name:  "repo-rewrite",
+			Usage: "Copy the source repositories matching a pattern=replacement rule to the replacement instead of below the destination, e.g. 'docker.io/library/(.*)=mirror.internal/dockerhub/$1'. Can be repeated, the first matching rule wins.",
+		},
+		&cli.StringFlag{
+			Name:    "config",
+			Usage:   "YAML file with the repositories to sync, replaces --src and --dest.",
+			Aliases: []string{"c"},
 		},
 		&cli.BoolFlag{
 			Name:  "dest-strict-tls",
 			Usage: "Enable strict TLS for connections to destination container registry.",
 		},
+		&cli.BoolFlag{
+			Name:  "dest-plain-http",
+			Usage: "Connect to the destination container registry over plain HTTP instead of HTTPS.",
+		},
+		&cli.StringFlag{
+			Name:  "dest-tag",
+			Usage: "Tag of a single source image, e.g. one referenced by digest, in destinations without a tag.",
+		},
+		&cli.StringFlag{
+			Name:  "src-proxy",
+			Usage: "HTTP(S) or SOCKS5 proxy URL for connections to the source registry, the destination is contacted directly.",
+		},
+		&cli.StringFlag{
+			Name:  "dest-proxy",
+			Usage: "HTTP(S) or SOCKS5 proxy URL for connections to the destination registry, the source is contacted directly.",
+		},
+		&cli.StringSliceFlag{
+			Name:  "resolve",
+			Usage: "Connect to another address for a registry, as host[:port]=address[:port], e.g. registry.example.com=10.0.0.5:5000. TLS certificates are verified for the host. Can be repeated.",
+		},
+		&cli.StringFlag{
+			Name:  "authfile",
+			Usage: "Path of a Docker/Podman config.json with registry credentials, used for source and destination.",
+		},
+		&cli.StringFlag{
+			Name:  "src-authfile",
+			Usage: "Path of a config.json with credentials for the source registry, overrides --authfile.",
+		},
+		&cli.StringFlag{
+			Name:  "dest-authfile",
+			Usage: "Path of a config.json with credentials for the destination registry, overrides --authfile.",
+		},
+		&cli.StringFlag{
+			Name:  "src-cert-dir",
+			Usage: "Directory with the ca.crt, client.cert and client.key for connections to the source registry.",
+		},
+		&cli.StringFlag{
+			Name:  "dest-cert-dir",
+			Usage: "Directory with the ca.crt, client.cert and client.key for connections to the destination registry.",
+		},
+		&cli.StringFlag{
+			Name:  "registries-conf",
+			Usage: "Path of a containers registries.conf with mirrors and short-name aliases and search registries for sources without registry.",
+		},
+		&cli.StringFlag{
+			Name:  "src-creds",
+			Usage: "Credentials of the source registry, user:password or vault:<path>[#field] to read them from HashiCorp Vault.",
+		},
+		&cli.StringFlag{
+			Name:  "dest-creds",
+			Usage: "Credentials of the destination registry, user:password or vault:<path>[#field] to read them from HashiCorp Vault.",
+		},
+		&cli.StringFlag{
+			Name:  "vault-role-id",
+			Usage: "Log in to Vault with this AppRole role id instead of $VAULT_TOKEN or ~/.vault-token.",
+		},
+		&cli.StringFlag{
+			Name:  "vault-secret-id-file",
+			Usage: "File with the AppRole secret id of --vault-role-id.",
+		},
+		&cli.StringSliceFlag{
+			Name:  "credential-helper",
+			Usage: "Get the registry credentials from the docker-credential-<helper> program, e.g. ecr-login, osxkeychain or pass. registry=helper only uses it for one registry, can be repeated.",
+		},
+		&cli.StringSliceFlag{
+			Name:  "ecr-repository-tag",
+			Usage: "Tag key=value of the Amazon ECR repositories created for missing destination repositories, can be repeated.",
+		},
+		&cli.BoolFlag{
+			Name:  "ecr-immutable-tags",
+			Usage: "Create missing Amazon ECR repositories with immutable tags.",
+		},
+		&cli.BoolFlag{
+			Name:  "ecr-scan-on-push",
+			Usage: "Create missing Amazon ECR repositories with scan on push.",
+		},
+		&cli.StringFlag{
+			Name:  "google-credentials",
+			Usage: "Service-account JSON file for gcr.io and pkg.dev registries. (default: the Application Default Credentials)",
+		},
+		&cli.StringFlag{
+			Name:  "docker-socket",
+			Usage: "Socket path or host URL of the docker daemon used by docker-daemon: sources and destinations. (default: $DOCKER_HOST or /var/run/docker.sock)",
+		},
+		&cli.StringFlag{
+			Name:  "storage-root",
+			Usage: "Graph root of containers-storage: sources and destinations. (default: the graphroot of storage.conf)",
+		},
+		&cli.StringFlag{
+			Name:  "storage-runroot",
+			Usage: "Run root of containers-storage: sources and destinations. (default: the runroot of storage.conf)",
+		},
+		&cli.StringFlag{
+			Name:  "blob-cache-dir",
+			Usage: "Directory of the blob info cache remembering the blobs known to exist in registries across runs. (default: the containers/image cache)",
+		},
+		&cli.StringSliceFlag{
+			Name:  "mount-from",
+			Usage: "Mount the blobs a destination lacks from these repositories of its registry instead of uploading them, e.g. base/alpine or registry.internal/base/alpine. Can be repeated or separated by commas.",
+		},
 		&cli.StringFlag{
 			Name:  "tags-pattern",
 			Usage: "Regex pattern to select tags for syncing.",
@@ -59,155 +221,1330 @@ func Execute() error {
 			Name:  "skip-tags-pattern",
 			Usage: "Regex pattern to exclude tags.",
 		},
+		&cli.StringSliceFlag{
+			Name:    "tag",
+			Aliases: []string{"tags"},
+			Usage:   "Copy exactly these tags of the source repository without listing its tags, repeatable or comma separated.",
+		},
 		&cli.StringFlag{
 			Name:  "skip-tags",
 			Usage: "Comma separated list of tags to be skipped.",
 		},
-		&cli.BoolFlag{
+		&cli.StringSliceFlag{
+			Name:  "tag-rewrite",
+			Usage: "Rename destination tags with a sed style s/pattern/replacement/[g] rule, e.g. 's/^release-(.*)$/v$1/'. Can be repeated, the rules are applied in order.",
+		},
+		&cli.StringSliceFlag{
+			Name:  "retag",
+			Usage: "After syncing a repository point a destination tag at the highest version among the destination tags, e.g. 'latest=highest-semver' or 'stable=highest-semver:<2.0'. The source tag of that name isn't copied. Can be repeated.",
+		},
+		&cli.StringFlag{
+			Name:  "semver",
+			Usage: "Only sync tags which are semantic versions matching this constraint e.g. \">=1.20.0 <2.0.0\".",
+		},
+		&cli.IntFlag{
+			Name:  "keep-latest-n",
+			Usage: "Only sync the newest n tags which are semantic versions.",
+		},
+		&cli.StringFlag{
+			Name:  "min-age",
+			Usage: "Only sync tags whose image was created at least this long ago, e.g. 12h or 7d.",
+		},
+		&cli.StringFlag{
+			Name:  "max-age",
+			Usage: "Only sync tags whose image was created within this duration, e.g. 90d.",
+		},
+		&cli.StringFlag{
+			Name:  "newer-than",
+			Usage: "Only sync tags whose image was created after this date, e.g. 2024-01-01.",
+		},
+		&cli.StringSliceFlag{
+			Name:  "filter-annotation",
+			Usage: "Only sync tags whose manifest has this annotation, key=value or just key, e.g. org.opencontainers.image.vendor=acme. Can be repeated, all of them have to match.",
+		},
+		&cli.StringSliceFlag{
+			Name:  "filter-label",
+			Usage: "Only sync tags whose image config has this label, key=value or just key, e.g. release=stable. Can be repeated, all of them have to match.",
+		},
+		&cli.GenericFlag{
 			Name:  "overwrite",
-			Usage: "Use this to copy/override all the tags.",
+			Usage: "Use this to copy/override all the tags, --overwrite=changed only copies existing tags whose manifest digest differs.",
+			Value: &overwriteValue{},
+		},
+		&cli.StringFlag{
+			Name:  "report-file",
+			Usage: "Write the result of the run, the document of --output json, to this JSON file.",
+		},
+		&cli.StringFlag{
+			Name:  "pre-tag-hook",
+			Usage: "Run this shell command before copying every tag, with IMAGESYNC_SOURCE and IMAGESYNC_DESTINATIONS set. A failing command fails the tag.",
+		},
+		&cli.StringFlag{
+			Name:  "post-tag-hook",
+			Usage: "Run this shell command after copying every tag to a destination, with IMAGESYNC_SOURCE, IMAGESYNC_DESTINATION, IMAGESYNC_STATUS, IMAGESYNC_DIGEST, IMAGESYNC_SOURCE_DIGEST, IMAGESYNC_BYTES and IMAGESYNC_ERROR set.",
+		},
+		&cli.StringFlag{
+			Name:  "post-run-hook",
+			Usage: "Run this shell command when the run finishes, with IMAGESYNC_STATUS, IMAGESYNC_COPIED, IMAGESYNC_FAILED, IMAGESYNC_SKIPPED, IMAGESYNC_BYTES, IMAGESYNC_DURATION_SECONDS and IMAGESYNC_ERROR set.",
+		},
+		&cli.StringSliceFlag{
+			Name:  "notify-webhook",
+			Usage: "POST the summary and the failed tags of the run as JSON to this URL when it finishes. Can be repeated.",
+		},
+		&cli.StringSliceFlag{
+			Name:  "notify-slack",
+			Usage: "Post the message of the run to this Slack incoming webhook URL when it finishes. Can be repeated.",
+		},
+		&cli.StringFlag{
+			Name:  "notify-template",
+			Usage: "Go template of the notification message, e.g. '{{.Status}}: {{.Summary.Failed}} failed', it replaces the webhook body as well.",
+		},
+		&cli.StringFlag{
+			Name:  "notify-on",
+			Usage: "When to notify, always or failure.",
+			Value: "always",
+		},
+		&cli.StringFlag{
+			Name:  "log-level",
+			Usage: "Log level, one of debug, info, warn or error.",
+			Value: "info",
+		},
+		&cli.StringFlag{
+			Name:  "log-format",
+			Usage: "Log format, text or json.",
+			Value: "text",
+		},
+		&cli.BoolFlag{
+			Name:    "quiet",
+			Aliases: []string{"q"},
+			Usage:   "Don't print the progress of the copies, logs are still written.",
+		},
+		&cli.BoolFlag{
+			Name:  "no-progress",
+			Usage: "Don't draw progress bars on a terminal, print the output of the copies like without a terminal.",
+		},
+		&cli.StringFlag{
+			Name:  "progress-format",
+			Usage: "Progress format, text or json. json writes a JSON line for every started, failed and done tag and copied blob instead of the progress output.",
+			Value: "text",
+		},
+		&cli.StringFlag{
+			Name:  "progress-file",
+			Usage: "Write the json progress events to this file or named pipe instead of stderr.",
+		},
+		&cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "List, filter and compare tags like a real run and print the tags which would be copied without copying them.",
+		},
+		&cli.BoolFlag{
+			Name:  "check",
+			Usage: "Compare like --dry-run and exit with code 3 if the destination misses any tag, nothing is copied.",
+		},
+		&cli.BoolFlag{
+			Name:  "compare-digests",
+			Usage: "Also copy tags which exist in the destination if their manifest digest differs from the source.",
+		},
+		&cli.BoolFlag{
+			Name:  "prune",
+			Usage: "After syncing delete destination tags which don't exist in the source repository, requires --confirm-prune.",
+		},
+		&cli.BoolFlag{
+			Name:  "confirm-prune",
+			Usage: "Confirm deleting the tags selected by --prune, without it they are only listed.",
 		},
 		&cli.IntFlag{
 			Name:  "max-concurrent-tags",
 			Usage: "Maximum number of tags to be synced/copied in parallel.",
 			Value: 1,
 		},
+		&cli.IntFlag{
+			Name:  "max-concurrent-repos",
+			Usage: "Maximum number of repositories of a config file or namespace synced in parallel, sharing a budget of max-concurrent-tags x max-concurrent-repos tags.",
+			Value: 1,
+		},
+		&cli.IntFlag{
+			Name:  "max-parallel-blobs",
+			Usage: "Maximum number of layers of a single image downloaded and uploaded in parallel.",
+			Value: 6,
+		},
+		&cli.StringFlag{
+			Name:  "platforms",
+			Usage: "Only copy these platforms of multi-arch images, comma separated os/arch[/variant] e.g. linux/amd64,linux/arm64.",
+		},
+		&cli.BoolFlag{
+			Name:  "all-platforms",
+			Usage: "Copy all platforms of multi-arch images, this is the default.",
+			Value: true,
+		},
+		&cli.StringFlag{
+			Name:  "format",
+			Usage: "Convert the manifests to oci or v2s2 (Docker schema 2), e.g. for registries rejecting OCI images. The digests change.",
+		},
+		&cli.StringFlag{
+			Name:  "compression",
+			Usage: "Recompress the layers with gzip, zstd or zstd:chunked. zstd converts Docker manifests to OCI, the digests change.",
+		},
+		&cli.IntFlag{
+			Name:  "compression-level",
+			Usage: "Level of --compression, 1 to 9 for gzip and 1 to 22 for zstd, 0 is the default level of the algorithm.",
+		},
+		&cli.BoolFlag{
+			Name:  "preserve-digests",
+			Usage: "Fail instead of converting or recompressing manifests, the destination digests always equal the source digests.",
+		},
+		&cli.BoolFlag{
+			Name:  "encrypt-layers",
+			Usage: "Encrypt all layers of the copied images for the recipients of --encryption-key, the manifests are converted to OCI.",
+		},
+		&cli.StringSliceFlag{
+			Name:  "encryption-key",
+			Usage: "Recipient of --encrypt-layers as protocol:file, e.g. jwe:pubkey.pem, pkcs7:cert.pem or pgp:user@example.com.",
+		},
+		&cli.StringSliceFlag{
+			Name:  "decryption-key",
+			Usage: "Private key decrypting the encrypted layers of the sources, as file or file:password.",
+		},
+		&cli.StringSliceFlag{
+			Name:  "add-annotation",
+			Usage: "Add this key=value annotation to the OCI manifests of the copied images, ${source}, ${digest} and ${date} are replaced by the source image, its digest and the copy time. Can be repeated.",
+		},
+		&cli.BoolFlag{
+			Name:  "include-referrers",
+			Usage: "Also copy the cosign signature, attestation and SBOM tags and the OCI referrers of copied images.",
+		},
+		&cli.StringSliceFlag{
+			Name:  "referrer-types",
+			Usage: "Only copy the referrers of the OCI referrers API with these artifact types, e.g. application/vnd.dev.sigstore.bundle.v0.3+json. Repeatable or comma separated. (default: all)",
+		},
+		&cli.StringSliceFlag{
+			Name:  "artifact-types",
+			Usage: "Only copy the tags of these artifact types, e.g. application/vnd.cncf.helm.config.v1+json. Images have the type application/vnd.oci.image.config.v1+json or application/vnd.docker.container.image.v1+json. Repeatable or comma separated. (default: all)",
+		},
+		&cli.StringSliceFlag{
+			Name:  "skip-artifact-types",
+			Usage: "Skip the tags of these artifact types, repeatable or comma separated.",
+		},
+		&cli.StringFlag{
+			Name:  "max-image-size",
+			Usage: "Skip the images larger than this by the sizes of their manifests, e.g. 5GB, counting the selected platforms. (default: unlimited)",
+		},
+		&cli.StringFlag{
+			Name:  "max-layer-size",
+			Usage: "Skip the images with a layer larger than this, e.g. 2GB. (default: unlimited)",
+		},
+		&cli.BoolFlag{
+			Name:  "keep-going",
+			Usage: "Continue after failing tags, print a summary of the failures and exit with code 2.",
+		},
+		&cli.IntFlag{
+			Name:  "max-retries",
+			Usage: "Retry copying a tag this many times on transient registry errors (429, 5xx, network).",
+		},
+		&cli.DurationFlag{
+			Name:  "retry-delay",
+			Usage: "Initial delay between retries, doubled on every retry.",
+			Value: time.Second,
+		},
+		&cli.DurationFlag{
+			Name:  "timeout",
+			Usage: "Abort the sync after this duration, in watch mode every sync. (default: no timeout)",
+		},
+		&cli.DurationFlag{
+			Name:  "tag-timeout",
+			Usage: "Fail a single image copy, including its retries, after this duration. (default: no timeout)",
+		},
+		&cli.StringFlag{
+			Name:  "lock-file",
+			Usage: "Hold a lock on this file while running and exit with code 4 if another run holds it, e.g. /var/run/imagesync.lock.",
+		},
+		&cli.BoolFlag{
+			Name:  "wait-for-lock",
+			Usage: "Wait for the run holding the --lock-file to finish instead of exiting.",
+		},
+		&cli.DurationFlag{
+			Name:  "lock-timeout",
+			Usage: "Exit after waiting this long for the --lock-file. (default: no timeout)",
+		},
+		&cli.StringFlag{
+			Name:  "output",
+			Usage: "Output format, text or json. With json logs go to stderr and a single result document is printed to stdout.",
+			Value: "text",
+		},
+		&cli.BoolFlag{
+			Name:  "watch",
+			Usage: "Keep running and re-sync every --interval until SIGINT or SIGTERM.",
+		},
+		&cli.DurationFlag{
+			Name:  "interval",
+			Usage: "Time between the end of a sync and the next one with --watch.",
+			Value: 15 * time.Minute,
+		},
+		&cli.BoolFlag{
+			Name:  "verify-after-copy",
+			Usage: "Read the manifest of every copied image back from the destination registry and fail the tag if its digest or media type differs.",
+		},
+		&cli.Float64Flag{
+			Name:  "verify-layers",
+			Usage: "Fraction of the layers of an image --verify-after-copy downloads from the destination and checks against their digests, 0 to 1.",
+		},
+		&cli.StringFlag{
+			Name:  "verify-policy",
+			Usage: "Only copy source images satisfying this containers-policy.json signature policy.",
+		},
+		&cli.StringFlag{
+			Name:  "verify-cosign-pubkey",
+			Usage: "Only copy source images with a cosign signature of this public key.",
+		},
+		&cli.StringFlag{
+			Name:  "sign-cosign-key",
+			Usage: "Sign every copied image with this cosign private key, the passphrase is read from COSIGN_PASSWORD.",
+		},
+		&cli.StringFlag{
+			Name:  "sign-cosign-identity",
+			Usage: "Sign keyless with a Fulcio certificate for the OIDC identity token in this file.",
+		},
+		&cli.StringFlag{
+			Name:  "sign-fulcio-url",
+			Usage: "Fulcio instance for keyless signing.",
+			Value: defaultFulcioURL,
+		},
+		&cli.StringFlag{
+			Name:  "sign-rekor-url",
+			Usage: "Upload signatures to this Rekor transparency log, keyless signatures default to " + defaultRekorURL + ".",
+		},
+		&cli.StringFlag{
+			Name:  "sign-by",
+			Usage: "Sign every copied image with a simple signing signature of the GPG key with this fingerprint, stored where registries.d configures it.",
+		},
+		&cli.StringFlag{
+			Name:  "sign-passphrase-file",
+			Usage: "Read the passphrase of the --sign-by key from this file.",
+		},
+		&cli.StringFlag{
+			Name:  "notation-key",
+			Usage: "Sign every copied image with a Notary v2 signature of this key of the notation CLI, pushed as referrer of the image.",
+		},
+		&cli.BoolFlag{
+			Name:  "scan-before-push",
+			Usage: "Scan every source image for vulnerabilities with --scanner and skip the images exceeding --severity-threshold.",
+		},
+		&cli.StringFlag{
+			Name:  "scanner",
+			Usage: "Vulnerability scanner of --scan-before-push, trivy or grype.",
+			Value: "trivy",
+		},
+		&cli.StringFlag{
+			Name:  "severity-threshold",
+			Usage: "Skip images with vulnerabilities of this severity or higher, low, medium, high or critical.",
+			Value: "critical",
+		},
+		&cli.StringFlag{
+			Name:  "metrics-addr",
+			Usage: "Serve Prometheus metrics on this address at /metrics e.g. :9090, most useful with --watch.",
+		},
+		&cli.StringFlag{
+			Name:  "otel-endpoint",
+			Usage: "Export OpenTelemetry traces of the syncs, tag listings, copies and blobs to this OTLP/HTTP collector URL e.g. http://localhost:4318.",
+		},
+		&cli.StringFlag{
+			Name:  "quota-action",
+			Usage: "Check the storage quota of Harbor destinations before syncing and act if the sync would exceed it, warn or fail. Other registries aren't checked.",
+		},
+		&cli.BoolFlag{
+			Name:  "harbor",
+			Usage: "Create projects missing in Harbor destinations, warn about their tag retention rules and check their quota (default --quota-action warn).",
+		},
+		&cli.BoolFlag{
+			Name:  "harbor-public-projects",
+			Usage: "Create the missing Harbor projects as public projects.",
+		},
+		&cli.IntFlag{
+			Name:  "max-connections-per-registry",
+			Usage: "Maximum number of concurrent requests to a registry, applied separately to source and destination. (default: unlimited)",
+		},
+		&cli.StringSliceFlag{
+			Name:  "max-concurrent-per-registry",
+			Usage: "Maximum number of tags copied in parallel from each source registry, a limit for all or registry=limit e.g. 4,ghcr.io=2. Applies in addition to --max-concurrent-tags. (default: unlimited)",
+		},
+		&cli.BoolFlag{
+			Name:  "adaptive-concurrency",
+			Usage: "Start with --max-concurrent-tags and halve the tags copied in parallel when a registry responds with 429 or 503, raising it again while it doesn't.",
+		},
+		&cli.StringFlag{
+			Name:  "max-bandwidth",
+			Usage: "Limit the blob transfer of all copies together, e.g. 50MB/s. (default: unlimited)",
+		},
+		&cli.StringFlag{
+			Name:  "max-bandwidth-per-tag",
+			Usage: "Limit the blob transfer of every single image copy, e.g. 10MB/s. (default: unlimited)",
+		},
+		&cli.IntFlag{
+			Name:  "hub-rate-limit-buffer",
+			Usage: "Pause copies from Docker Hub while no more than this many pulls are left in its rate limit window, negative disables pacing.",
+			Value: 10,
+		},
+		&cli.StringFlag{
+			Name:  "pprof-addr",
+			Usage: "Serve net/http/pprof on this address (e.g. 127.0.0.1:6060) while syncing.",
+		},
+		&cli.StringFlag{
+			Name:  "cpuprofile",
+			Usage: "Write a CPU profile to this file.",
+		},
+		&cli.StringFlag{
+			Name:  "memprofile",
+			Usage: "Write a heap profile to this file at exit.",
+		},
+		&cli.StringFlag{
+			Name:  "state-file",
+			Usage: "Record completed copies in this file, a restarted sync skips them even with --overwrite. Removed once a sync finishes without failures.",
+		},
+		&cli.StringFlag{
+			Name:  "state-db",
+			Usage: "SQLite database every run and the digests and outcome of its tags are recorded in, see imagesync history.",
+		},
+		&cli.StringFlag{
+			Name:  "index-file",
+			Usage: "Merge tag, digest, creation time, labels and platforms of copied images into this index file.",
+		},
+		&cli.StringFlag{
+			Name:  "index-format",
+			Usage: "Format of the index file, json or csv. Detected from the file extension by default.",
+		},
+		&cli.BoolFlag{
+			Name:  "index-existing",
+			Usage: "Also index tags which are skipped because they already exist in the destination.",
+		},
+		&cli.Int64Flag{
+			Name:  "index-max-size",
+			Usage: "Rotate the index file to <index-file>.1 once it would grow beyond this many bytes.",
+		},
+		&cli.StringFlag{
+			Name:  "digest-map-file",
+			Usage: "Write the destination repository and digest of every synced source tag to this YAML file, as the images of a kustomization.",
+		},
+	}
+
+	app.Action = func(c *cli.Context) error {
+		stopProfiling := startProfiling(c)
+		defer stopProfiling()
+
+		return DetectAndCopyImage(c)
+	}
+
+	// the commands take all sync flags, e.g. --config or --platforms for an
+	// export and --dest-creds for an import
+	app.Commands = []*cli.Command{
+		{
+			Name:      "sync",
+			Usage:     "Sync the images of the sources to the destinations, the same as imagesync without command.",
+			UsageText: "imagesync sync --src library/alpine --dest registry.internal/library/alpine",
+			Flags:     slices.Clone(app.Flags),
+			Action:    app.Action,
+		},
+		{
+			Name:      "list-tags",
+			Usage:     "Print the tags of a source repository which the tag filters select.",
+			UsageText: "imagesync list-tags --semver '>=3.18' library/alpine",
+			ArgsUsage: "<repository>",
+			Flags:     slices.Clone(app.Flags),
+			Action:    listTags,
+		},
+		{
+			Name:      "diff",
+			Usage:     "Show the tags missing in the destination, with other digests or only in the destination.",
+			UsageText: "imagesync diff --tags-pattern '^3' library/alpine registry.internal/library/alpine",
+			ArgsUsage: "<source repository> <destination repository>",
+			Flags:     slices.Clone(app.Flags),
+			Action:    diffTags,
+		},
+		{
+			Name:      "verify",
+			Usage:     "Compare the digests of the tags both repositories have.",
+			UsageText: "imagesync verify library/alpine registry.internal/library/alpine",
+			ArgsUsage: "<source repository> <destination repository>",
+			Flags:     slices.Clone(app.Flags),
+			Action:    verifyTags,
+		},
+		{
+			Name:      "estimate",
+			Usage:     "Print the tags a sync would copy and the bytes it would transfer, without the blobs the destination has.",
+			UsageText: "imagesync estimate --platforms linux/amd64 library/alpine registry.internal/library/alpine",
+			ArgsUsage: "<source repository> <destination repository>",
+			Flags:     slices.Clone(app.Flags),
+			Action:    estimateSync,
+		},
+		{
+			Name:      "delete",
+			Usage:     "Delete the tags of a destination registry repository which the tag filters select, --dry-run only lists them.",
+			UsageText: "imagesync delete --dest registry.internal/org/app --tags-pattern '^pr-' --older-than 30d --dry-run",
+			Flags: append(slices.Clone(app.Flags), &cli.StringFlag{
+				Name:  "older-than",
+				Usage: "Only delete tags whose image was created longer ago than this, e.g. 30d or 12h, the same as --min-age.",
+			}),
+			Action: deleteTags,
+		},
+		{
+			Name:      "merge",
+			Usage:     "Copy single-platform images to the repository of --dest and push an OCI image index of them as --dest.",
+			UsageText: "imagesync merge --dest registry.internal/org/app:1.0 registry.internal/org/app:1.0-amd64 registry.internal/org/app:1.0-arm64",
+			ArgsUsage: "<source image>...",
+			Flags:     slices.Clone(app.Flags),
+			Action:    mergeImages,
+		},
+		{
+			Name:      "export",
+			Usage:     "Pack the images of the sources into a bundle for an air-gapped registry.",
+			UsageText: "imagesync export --config sync.yaml --bundle images.tar.zst",
+			Flags: append(slices.Clone(app.Flags), &cli.StringFlag{
+				Name:     "bundle",
+				Usage:    "Bundle to write, a .tar, .tar.gz or .tar.zst file.",
+				Required: true,
+			}, &cli.StringFlag{
+				Name:  "inventory",
+				Usage: "Inventory written by import, the images and layers the air-gapped registry has are left out of the bundle.",
+			}),
+			Action: app.Action,
+		},
+		{
+			Name:      "import",
+			Usage:     "Copy the images of a bundle below the destination.",
+			UsageText: "imagesync import --bundle images.tar.zst --dest registry.internal",
+			Flags: append(slices.Clone(app.Flags), &cli.StringFlag{
+				Name:     "bundle",
+				Usage:    "Bundle written by export.",
+				Required: true,
+			}, &cli.StringFlag{
+				Name:  "inventory",
+				Usage: "Inventory of the destination to add the imported images to, created if missing.",
+			}),
+			Action: app.Action,
+		},
+		{
+			Name:      "from-manifests",
+			Usage:     "Copy the images of Kubernetes manifests, kustomizations and Helm charts below the destination.",
+			UsageText: "imagesync from-manifests --dest mirror.example.com/k8s ./deploy/",
+			ArgsUsage: "<path>...",
+			Flags:     slices.Clone(app.Flags),
+			Action: func(c *cli.Context) error {
+				if c.NArg() == 0 {
+					return errors.New("from-manifests needs a file or directory, - for stdin")
+				}
+				return app.Action(c)
+			},
+		},
+		{
+			Name:      "serve",
+			Usage:     "Sync the pushed tags of registry webhooks from Harbor, Docker Hub or Quay and serve a REST API to trigger syncs.",
+			UsageText: "imagesync serve --listen :8080 --config sync.yaml",
+			Flags: append(slices.Clone(app.Flags), &cli.StringFlag{
+				Name:  "listen",
+				Usage: "Address to serve the webhooks on at /webhook.",
+				Value: ":8080",
+			}, &cli.StringFlag{
+				Name:    "webhook-token",
+				Usage:   "Secret webhooks have to send as ?token= or in the Authorization header.",
+				EnvVars: []string{"IMAGESYNC_WEBHOOK_TOKEN"},
+			}, &cli.StringFlag{
+				Name:    "api-token",
+				Usage:   "Bearer token of the REST API at /syncs and /history, which is only served with it.",
+				EnvVars: []string{"IMAGESYNC_API_TOKEN"},
+			}),
+			Action: app.Action,
+		},
+		{
+			Name:      "operator",
+			Usage:     "Sync the ImageSync resources of a Kubernetes cluster and write their outcome into their status.",
+			UsageText: "imagesync operator --namespace imagesync",
+			Flags: append(slices.Clone(app.Flags), &cli.StringFlag{
+				Name:    "namespace",
+				Usage:   "Only sync the ImageSync resources of this namespace, all namespaces if empty.",
+				EnvVars: []string{"IMAGESYNC_NAMESPACE"},
+			}, &cli.DurationFlag{
+				Name:  "resync-interval",
+				Usage: "Time between listing the ImageSync resources, resources without interval are synced every --interval.",
+				Value: 30 * time.Second,
+			}),
+			Action: app.Action,
+		},
+		{
+			Name:      "history",
+			Usage:     "Show the tags recorded in a --state-db, the newest first.",
+			UsageText: "imagesync history --state-db /var/lib/imagesync.db --image registry.internal/library/alpine:3",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:     "state-db",
+					Usage:    "Database written by --state-db.",
+					Required: true,
+				},
+				&cli.StringFlag{
+					Name:  "image",
+					Usage: "Only show this source or destination repository or repository:tag.",
+				},
+				&cli.StringFlag{
+					Name:  "digest",
+					Usage: "Only show tags with this source or destination digest.",
+				},
+				&cli.StringFlag{
+					Name:  "status",
+					Usage: "Only show tags with this outcome: copied, skipped, failed, planned or pruned.",
+				},
+				&cli.IntFlag{
+					Name:  "limit",
+					Usage: "Maximum number of tags to show.",
+					Value: 50,
+				},
+				&cli.StringFlag{
+					Name:  "output",
+					Usage: "Output format: text or json.",
+					Value: "text",
+				},
+			},
+			Action: showHistory,
+		},
+	}
+	return app
+}
+
+// DetectAndCopyImage will try to detect the source type and will
+// copy the image. Detection is based on following rules if:
+//
+//   - src has an oci:, oci-archive:, docker-archive:, docker-daemon:,
+//     containers-storage:, dir: or docker:// prefix use that transport.
+//   - src is an absolute or ./ prefixed directory assume it is an OCI layout.
+//   - src is an absolute or ./ prefixed file detect for oci-archive or docker-archive.
+//   - src is an image with a tag copy single image to dest.
+//   - none of the above then it is an entire repository sync
+//     to sync the repositories.
+//
+// With --output json logs are written to stderr and the Result is printed to stdout.
+// With --watch the sync is repeated every --interval until SIGINT or SIGTERM.
+func DetectAndCopyImage(c *cli.Context) error {
+	if err := setupLogging(c); err != nil {
+		return err
+	}
+	output := c.String("output")
+	if output != "text" && output != "json" {
+		return fmt.Errorf("unsupported output %q", output)
+	}
+	if output == "json" {
+		logrus.SetOutput(os.Stderr)
+	}
+
+	if c.IsSet("platforms") && c.IsSet("all-platforms") {
+		return errors.New("--platforms and --all-platforms can't be used together")
+	}
+
+	reexecForStorage(optionsFromFlags(c))
+
+	unlock, err := acquireLock(c)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	syncer := &Syncer{}
+	var stopMetrics func()
+	syncer.metrics, stopMetrics = startMetrics(c)
+	defer stopMetrics()
+	var closeEvents func()
+	if syncer.events, closeEvents, err = startProgressEvents(c); err != nil {
+		return err
+	}
+	defer closeEvents()
+	stopTracing, err := startTracing(c)
+	if err != nil {
+		return err
+	}
+	defer stopTracing()
+
+	if c.Command != nil && c.Command.Name == "serve" {
+		return serveSyncs(c, syncer)
+	}
+	if c.Command != nil && c.Command.Name == "operator" {
+		return operateSyncs(c, syncer)
+	}
+	if c.Bool("watch") {
+		return watchImages(c, syncer)
+	}
+	return syncOnce(context.Background(), c, syncer)
+}
+
+// syncOnce syncs all jobs a single time and prints the result.
+func syncOnce(ctx context.Context, c *cli.Context, syncer *Syncer) error {
+	opts, err := syncOptions(c)
+	if err != nil {
+		return err
+	}
+	// bars aren't drawn by serve and operator, their syncs may overlap
+	opts.ProgressBars = opts.ReportWriter != nil && !c.Bool("no-progress") && isTerminal(opts.ReportWriter)
+	return syncAndReport(ctx, c, syncer, opts)
+}
+
+// syncOptions returns the Options of a sync started by the command line.
+func syncOptions(c *cli.Context) (Options, error) {
+	opts := optionsFromFlags(c)
+	if path := c.String("sign-cosign-identity"); path != "" {
+		token, err := os.ReadFile(path)
+		if err != nil {
+			return Options{}, fmt.Errorf("reading identity token: %w", err)
+		}
+		opts.SignCosignIdentityToken = strings.TrimSpace(string(token))
+	}
+	// the json result and the json progress events replace the progress
+	// output
+	if c.String("output") != "json" && c.String("progress-format") != "json" && !c.Bool("quiet") {
+		opts.ReportWriter = os.Stdout
 	}
+	return opts, nil
+}
+
+// syncAndReport runs the sync of opts and prints the result.
+func syncAndReport(ctx context.Context, c *cli.Context, syncer *Syncer, opts Options) error {
+	result, err := syncer.Sync(ctx, opts)
+	return reportResult(c, opts, result, err)
+}
 
-	app.Action = cli.ActionFunc(DetectAndCopyImage)
+// reportResult prints the result of a sync which returned err.
+func reportResult(c *cli.Context, opts Options, result *Result, err error) error {
 
-	if err := app.Run(os.Args); err != nil {
+	switch {
+	case errors.Is(err, ErrPartialFailure) && jsonLogs():
+		logTags(result, TagFailed, "Tag failed")
+	case errors.Is(err, ErrPartialFailure):
+		if werr := writeFailureSummary(logrus.StandardLogger().Out, result); werr != nil {
+			logrus.Warnf("failed writing failure summary: %s", werr)
+		}
+	}
+	switch {
+	case errors.Is(err, ErrOutOfSync) && jsonLogs():
+		logTags(result, TagPlanned, "Tag missing")
+	case errors.Is(err, ErrOutOfSync):
+		if werr := writeMissingSummary(logrus.StandardLogger().Out, result); werr != nil {
+			logrus.Warnf("failed writing missing tags: %s", werr)
+		}
+	}
+	if werr := writeSummary(logrus.StandardLogger().Out, result); werr != nil {
+		logrus.Warnf("failed writing summary: %s", werr)
+	}
+	if path := c.String("report-file"); path != "" {
+		if werr := writeReportFile(path, result); werr != nil && err == nil {
+			err = fmt.Errorf("writing report file: %w", werr)
+		}
+	}
+	if c.String("output") == "json" {
+		if werr := result.WriteJSON(os.Stdout); werr != nil && err == nil {
+			err = fmt.Errorf("writing result: %w", werr)
+		}
+	}
+	if err != nil {
 		return err
 	}
+
+	if opts.Check {
+		logrus.Info("Check completed, the destination is in sync.")
+		return nil
+	}
+	if opts.DryRun {
+		logrus.Info("Dry run completed, nothing was copied.")
+		return nil
+	}
+	logrus.Info("Image(s) sync completed.")
 	return nil
 }
 
-// DetectAndCopyImage will try to detect the source type and will
-// copy the image. Detection is based on following rules if:
-//
-//   - src is a directory assume it is an OCI layout.
-//   - src is file detect for oci-archive or docker-archive.
-//   - src is an image with a tag copy single image to dest.
-//   - none of the above then it is an entire repository sync
-//     to sync the repositories.
-func DetectAndCopyImage(c *cli.Context) error {
-	dest := c.String("dest")
-	destRef, err := docker.ParseReference(fmt.Sprintf("//%s", dest))
-	if err != nil {
-		return fmt.Errorf("parsing destination ref: %w", err)
+// optionsFromFlags returns the Options described by the command line flags.
+// listFlag returns the values of the slice flag name, repeated or comma
+// separated.
+func listFlag(c *cli.Context, name string) []string {
+	var values []string
+	for _, v := range c.StringSlice(name) {
+		values = append(values, lo.Compact(strings.Split(v, ","))...)
+	}
+	return values
+}
+
+func optionsFromFlags(c *cli.Context) Options {
+	var skipTags []string
+	if v := c.String("skip-tags"); v != "" {
+		skipTags = strings.Split(v, ",")
+	}
+	overwrite, ok := c.Generic("overwrite").(*overwriteValue)
+	if !ok {
+		overwrite = &overwriteValue{}
+	}
+	srcs := c.StringSlice("src")
+	return Options{
+		Source:                    lo.FirstOrEmpty(srcs),
+		SrcFormat:                 c.String("src-format"),
+		FallbackSources:           lo.Drop(srcs, 1),
+		Destination:               strings.Join(listFlag(c, "dest"), ","),
+		DestType:                  c.String("dest-type"),
+		DestTag:                   c.String("dest-tag"),
+		Config:                    c.String("config"),
+		LegacySourceDetection:     c.Bool("legacy-source-detection"),
+		SkopeoSyncConfig:          c.String("skopeo-sync-config"),
+		ImagesFile:                c.String("images-file"),
+		Manifests:                 commandArgs(c, "from-manifests"),
+		SrcNamespace:              c.String("src-namespace"),
+		DestNamespace:             c.String("dest-namespace"),
+		ReposPattern:              c.String("repos-pattern"),
+		RepoRewrite:               c.StringSlice("repo-rewrite"),
+		SrcStrictTLS:              c.Bool("src-strict-tls"),
+		SrcPlainHTTP:              c.Bool("src-plain-http"),
+		SrcProxy:                  c.String("src-proxy"),
+		DestProxy:                 c.String("dest-proxy"),
+		Resolve:                   c.StringSlice("resolve"),
+		DestStrictTLS:             c.Bool("dest-strict-tls"),
+		DestPlainHTTP:             c.Bool("dest-plain-http"),
+		AuthFile:                  c.String("authfile"),
+		SrcAuthFile:               c.String("src-authfile"),
+		DestAuthFile:              c.String("dest-authfile"),
+		SrcCertDir:                c.String("src-cert-dir"),
+		DestCertDir:               c.String("dest-cert-dir"),
+		RegistriesConf:            c.String("registries-conf"),
+		ECRRepositoryTags:         c.StringSlice("ecr-repository-tag"),
+		ECRImmutableTags:          c.Bool("ecr-immutable-tags"),
+		ECRScanOnPush:             c.Bool("ecr-scan-on-push"),
+		GoogleCredentials:         c.String("google-credentials"),
+		CredentialHelpers:         c.StringSlice("credential-helper"),
+		SrcCreds:                  c.String("src-creds"),
+		DestCreds:                 c.String("dest-creds"),
+		VaultRoleID:               c.String("vault-role-id"),
+		VaultSecretIDFile:         c.String("vault-secret-id-file"),
+		DockerSocket:              c.String("docker-socket"),
+		StorageRoot:               c.String("storage-root"),
+		StorageRunRoot:            c.String("storage-runroot"),
+		BlobCacheDir:              c.String("blob-cache-dir"),
+		MountFrom:                 listFlag(c, "mount-from"),
+		TagsPattern:               c.String("tags-pattern"),
+		SkipTagsPattern:           c.String("skip-tags-pattern"),
+		SkipTags:                  skipTags,
+		Tags:                      listFlag(c, "tag"),
+		TagRewrite:                c.StringSlice("tag-rewrite"),
+		Retag:                     c.StringSlice("retag"),
+		Semver:                    c.String("semver"),
+		KeepLatestN:               c.Int("keep-latest-n"),
+		MinAge:                    c.String("min-age"),
+		MaxAge:                    c.String("max-age"),
+		NewerThan:                 c.String("newer-than"),
+		FilterAnnotations:         c.StringSlice("filter-annotation"),
+		FilterLabels:              c.StringSlice("filter-label"),
+		Platforms:                 c.String("platforms"),
+		IncludeReferrers:          c.Bool("include-referrers"),
+		ReferrerTypes:             listFlag(c, "referrer-types"),
+		ArtifactTypes:             listFlag(c, "artifact-types"),
+		SkipArtifactTypes:         listFlag(c, "skip-artifact-types"),
+		MaxImageSize:              c.String("max-image-size"),
+		MaxLayerSize:              c.String("max-layer-size"),
+		Format:                    c.String("format"),
+		PreserveDigests:           c.Bool("preserve-digests"),
+		Compression:               c.String("compression"),
+		CompressionLevel:          c.Int("compression-level"),
+		EncryptLayers:             c.Bool("encrypt-layers"),
+		EncryptionKeys:            c.StringSlice("encryption-key"),
+		DecryptionKeys:            c.StringSlice("decryption-key"),
+		AddAnnotations:            c.StringSlice("add-annotation"),
+		Overwrite:                 overwrite.all,
+		CompareDigests:            c.Bool("compare-digests") || overwrite.changed,
+		Prune:                     c.Bool("prune"),
+		ConfirmPrune:              c.Bool("confirm-prune"),
+		DryRun:                    c.Bool("dry-run"),
+		Check:                     c.Bool("check"),
+		MaxConcurrentTags:         c.Int("max-concurrent-tags"),
+		MaxConcurrentRepos:        c.Int("max-concurrent-repos"),
+		MaxParallelBlobs:          c.Int("max-parallel-blobs"),
+		Timeout:                   c.Duration("timeout"),
+		TagTimeout:                c.Duration("tag-timeout"),
+		KeepGoing:                 c.Bool("keep-going"),
+		MaxRetries:                c.Int("max-retries"),
+		RetryDelay:                c.Duration("retry-delay"),
+		QuotaAction:               c.String("quota-action"),
+		Harbor:                    c.Bool("harbor"),
+		HarborPublicProjects:      c.Bool("harbor-public-projects"),
+		MaxConnectionsPerRegistry: c.Int("max-connections-per-registry"),
+		MaxConcurrentPerRegistry:  listFlag(c, "max-concurrent-per-registry"),
+		AdaptiveConcurrency:       c.Bool("adaptive-concurrency"),
+		MaxBandwidth:              c.String("max-bandwidth"),
+		MaxBandwidthPerTag:        c.String("max-bandwidth-per-tag"),
+		HubRateLimitBuffer:        c.Int("hub-rate-limit-buffer"),
+		VerifyAfterCopy:           c.Bool("verify-after-copy"),
+		VerifyLayers:              c.Float64("verify-layers"),
+		VerifyPolicy:              c.String("verify-policy"),
+		VerifyCosignPubkey:        c.String("verify-cosign-pubkey"),
+		SignCosignKey:             c.String("sign-cosign-key"),
+		SignCosignPassphrase:      os.Getenv("COSIGN_PASSWORD"),
+		SignFulcioURL:             c.String("sign-fulcio-url"),
+		SignRekorURL:              c.String("sign-rekor-url"),
+		SignBy:                    c.String("sign-by"),
+		SignPassphraseFile:        c.String("sign-passphrase-file"),
+		NotationKey:               c.String("notation-key"),
+		ScanBeforePush:            c.Bool("scan-before-push"),
+		Scanner:                   c.String("scanner"),
+		SeverityThreshold:         c.String("severity-threshold"),
+		StateFile:                 c.String("state-file"),
+		StateDB:                   c.String("state-db"),
+		IndexFile:                 c.String("index-file"),
+		IndexFormat:               c.String("index-format"),
+		IndexExisting:             c.Bool("index-existing"),
+		IndexMaxSize:              c.Int64("index-max-size"),
+		DigestMapFile:             c.String("digest-map-file"),
+		PreTagHook:                c.String("pre-tag-hook"),
+		PostTagHook:               c.String("post-tag-hook"),
+		PostRunHook:               c.String("post-run-hook"),
+		NotifyWebhooks:            c.StringSlice("notify-webhook"),
+		NotifySlack:               c.StringSlice("notify-slack"),
+		NotifyTemplate:            c.String("notify-template"),
+		NotifyOn:                  c.String("notify-on"),
+		ExportBundle:              commandBundle(c, "export"),
+		ImportBundle:              commandBundle(c, "import"),
+		BundleInventory:           c.String("inventory"),
+	}
+}
+
+// commandBundle returns --bundle if c is the context of command.
+func commandBundle(c *cli.Context, command string) string {
+	if c.Command == nil || c.Command.Name != command {
+		return ""
+	}
+	return c.String("bundle")
+}
+
+// commandArgs returns the arguments if c is the context of command.
+func commandArgs(c *cli.Context, command string) []string {
+	if c.Command == nil || c.Command.Name != command {
+		return nil
 	}
+	return c.Args().Slice()
+}
+
+// syncState is shared by all jobs of a sync.
+type syncState struct {
+	limits    connLimits
+	bandwidth *bandwidthLimiter
+	// bandwidthPerTag is the rate of the limiter created for every copy.
+	bandwidthPerTag int64
+	// maxImageSize and maxLayerSize skip larger images, 0 is unlimited.
+	maxImageSize int64
+	maxLayerSize int64
+	index        *tagIndex
+	digests      *digestMap
+	hooks        *hooks
+	checkpoint   *checkpoint
+	result       *Result
+	metrics      *syncMetrics
+	signing      *signing
+	notation     *notationSigner
+	scan         *scanGate
+	verification *verification
+	export       *bundleExport
+	// manifestType is the manifest type of --format.
+	manifestType string
+	// compression and compressionLevel recompress the layers, nil keeps
+	// the compression of the source.
+	compression      *compression.Algorithm
+	compressionLevel *int
+	encryption       *encryption
+	annotator        *annotator
+	mounter          *blobMounter
+	ecr              *ecrSession
+	google           *googleSession
+	acr              *acrSession
+	harbor           *harborSession
+	hub              *hubPacer
+	credentials      *credentialStore
+	tagSlots         *tagSlots
+	adaptive         *adaptiveLimit
+	progress         *progressBars
+	events           *progressEvents
+}
+
+// syncRun is the state of syncing a single job.
+type syncRun struct {
+	*syncState
+	options   Options
+	job       syncJob
+	opts      copy.Options
+	referrers *referrers
+	// failed counts the failed tags of the job.
+	failed atomic.Int64
+	// googleSrc and googleDest are set if the side is logged in with the
+	// refreshed tokens of google.
+	googleSrc  bool
+	googleDest bool
+}
 
+func newSyncRun(options Options, job syncJob, state *syncState) *syncRun {
 	// setup copy options
 	opts := copy.Options{
-		ReportWriter:       os.Stdout,
-		ImageListSelection: copy.CopyAllImages,
+		ReportWriter:          options.ReportWriter,
+		ImageListSelection:    copy.CopyAllImages,
+		ForceManifestMIMEType: state.manifestType,
+		PreserveDigests:       options.PreserveDigests,
+		MaxParallelDownloads:  uint(max(options.MaxParallelBlobs, 0)),
+	}
+	// the bars replace the output of the copies
+	if state.progress != nil {
+		opts.ReportWriter = nil
+	}
+	opts.SourceCtx = newSystemContext(options, "src", job.SrcStrictTLS, job.SrcPlainHTTP)
+	opts.DestinationCtx = newSystemContext(options, "dest", job.DestStrictTLS, job.DestPlainHTTP)
+	if state.compression != nil {
+		// blobs of other compressions in the destination aren't reused
+		opts.DestinationCtx.CompressionFormat = state.compression
+		opts.DestinationCtx.CompressionLevel = state.compressionLevel
+		opts.ForceCompressionFormat = true
+	}
+	if job.SrcCredentials != nil {
+		opts.SourceCtx.DockerAuthConfig = job.SrcCredentials
 	}
-	if !c.Bool("dest-strict-tls") {
-		opts.DestinationCtx = &types.SystemContext{DockerInsecureSkipTLSVerify: types.NewOptionalBool(true)}
+	if job.DestCredentials != nil {
+		opts.DestinationCtx.DockerAuthConfig = job.DestCredentials
 	}
-	if !c.Bool("src-strict-tls") {
-		opts.SourceCtx = &types.SystemContext{DockerInsecureSkipTLSVerify: types.NewOptionalBool(true)}
+	if job.SrcCertDir != "" {
+		opts.SourceCtx.DockerCertPath = job.SrcCertDir
 	}
+	state.verification.apply(&opts)
+	state.encryption.apply(&opts)
+	state.signing.apply(&opts)
 
-	ctx := context.Background()
-	src := c.String("src")
-	if info, err := os.Stat(src); err == nil {
-		// copy oci layout
-		if info.IsDir() {
-			srcRef, err := ocilayout.ParseReference(src)
-			if err != nil {
-				return fmt.Errorf("parsing source oci ref: %w", err)
-			}
-			if err = copyImage(ctx, destRef, srcRef, &opts); err != nil {
-				return fmt.Errorf("copy oci layout: %w", err)
+	return &syncRun{syncState: state, options: options, job: job, opts: opts}
+}
+
+func (r *syncRun) copyImages(ctx context.Context) error {
+	dests, err := detectDestinations(r.job.Destination, r.job.DestType)
+	if err != nil {
+		return err
+	}
+	destRefs := make([]types.ImageReference, 0, len(dests))
+	for _, dest := range dests {
+		destRef, err := dest.reference()
+		if err != nil {
+			return err
+		}
+		destRefs = append(destRefs, destRef)
+		if (r.signing != nil || r.notation != nil) && dest.kind != destinationRegistry {
+			return fmt.Errorf("signing needs a registry destination: %w", ErrUnsupportedDestination)
+		}
+		if dest.kind == destinationDockerDaemon {
+			if err = pingDaemon(ctx, r.opts.DestinationCtx); err != nil {
+				return err
 			}
-			logrus.Info("Image(s) sync completed.")
-			return nil
 		}
+		if r.job.Prune && dest.kind == destinationDir {
+			return fmt.Errorf("tags can't be pruned in a dir destination: %w", ErrUnsupportedDestination)
+		}
+		if r.options.PreserveDigests && dest.singlePlatform() {
+			return fmt.Errorf("a %s destination doesn't store the source manifest, digests can't be preserved: %w", dest.typeName(), ErrUnsupportedDestination)
+		}
+		if r.job.IncludeReferrers && dest.holdsSingleImage() {
+			return fmt.Errorf("referrers can't be stored in a %s destination: %w", dest.typeName(), ErrUnsupportedDestination)
+		}
+	}
+	if r.options.PreserveDigests && len(r.job.Platforms) > 0 {
+		return errors.New("--platforms can't be used with --preserve-digests, the reduced manifest list has another digest")
+	}
+	// converted manifests never have the digest of the source
+	if r.job.CompareDigests && (r.manifestType != "" || r.compression != nil || r.annotator != nil) {
+		return errors.New("--compare-digests can't be used with --format, --compression or --add-annotation, converted manifests have other digests")
+	}
+	// copied signature tags would replace the signatures created by this run
+	if r.job.IncludeReferrers && r.signing.sigstore() {
+		return errors.New("--include-referrers can't be used together with --sign-cosign-key or --sign-cosign-identity")
+	}
+	if err = r.checkFanout(dests); err != nil {
+		return err
+	}
+	if dest := dests[0]; dest.singlePlatform() {
+		// docker archives and the daemon can't store manifest lists, copy a
+		// single platform
+		if len(r.job.Platforms) > 1 {
+			return fmt.Errorf("a %s destination holds a single platform, got %d platforms: %w", dest.typeName(), len(r.job.Platforms), ErrUnsupportedDestination)
+		}
+		r.opts.ImageListSelection = copy.CopySystemImage
+		if len(r.job.Platforms) == 1 {
+			p := r.job.Platforms[0]
+			r.opts.SourceCtx.OSChoice, r.opts.SourceCtx.ArchitectureChoice, r.opts.SourceCtx.VariantChoice = p.OS, p.Architecture, p.Variant
+		}
+	}
 
-		// try copying oci archive with docker archive as fallback
-		srcRef, _ := ociarchive.ParseReference(src)
-		if err = copyImage(ctx, destRef, srcRef, &opts); err != nil {
-			srcRef, err = dockerarchive.ParseReference(src)
-			if err != nil {
-				return fmt.Errorf("parsing source docker-archive ref: %w", err)
-			}
-			if err = copyImage(ctx, destRef, srcRef, &opts); err != nil {
-				return fmt.Errorf("copy docker-archive layout: %w", err)
-			}
+	if r.options.LegacySourceDetection {
+		logrus.Warn("--legacy-source-detection is deprecated and will be removed in the next release")
+	}
+	src, err := detectSource(r.job.Source, r.job.SrcFormat, r.options.LegacySourceDetection)
+	if err != nil {
+		return err
+	}
+	if src.kind == sourceRegistry {
+		if src.value, err = r.resolveShortName(ctx, src.value); err != nil {
+			return err
 		}
-	} else {
+	}
+	if r.scan != nil && src.kind != sourceRegistry {
+		return errors.New("--scan-before-push needs a registry source")
+	}
+	if len(r.job.FallbackSources) > 0 && src.kind != sourceRegistry {
+		return errors.New("fallback sources need a registry source")
+	}
+	if err = r.prepareCredentialHelpers(src, dests); err != nil {
+		return err
+	}
+	if err = r.prepareECR(ctx, src, dests); err != nil {
+		return err
+	}
+	if err = r.prepareGoogle(src, dests); err != nil {
+		return err
+	}
+	if err = r.prepareACR(ctx, src, dests); err != nil {
+		return err
+	}
+	if err = r.prepareHarbor(ctx, dests); err != nil {
+		return err
+	}
+
+	if imported, err := r.importArchive(ctx, src, dests); imported || err != nil {
+		return err
+	}
+
+	switch src.kind {
+	case sourceOCILayout:
+		srcRef, err := ocilayout.ParseReference(src.value)
+		if err != nil {
+			return fmt.Errorf("parsing source oci ref: %w", err)
+		}
+		if err = r.copyTag(ctx, destRefs, srcRef); err != nil {
+			return fmt.Errorf("copy oci layout: %w", err)
+		}
+	case sourceOCIArchive:
+		srcRef, err := ociarchive.ParseReference(src.value)
+		if err != nil {
+			return fmt.Errorf("parsing source oci-archive ref: %w", err)
+		}
+		if err = r.copyTag(ctx, destRefs, srcRef); err != nil {
+			return fmt.Errorf("copy oci-archive: %w", err)
+		}
+	case sourceDockerArchive:
+		srcRef, err := dockerarchive.ParseReference(src.value)
+		if err != nil {
+			return fmt.Errorf("parsing source docker-archive ref: %w", err)
+		}
+		if err = r.copyTag(ctx, destRefs, srcRef); err != nil {
+			return fmt.Errorf("copy docker-archive layout: %w", err)
+		}
+	case sourceDockerDaemon:
+		srcRef, err := daemon.ParseReference(src.value)
+		if err != nil {
+			return fmt.Errorf("parsing source docker-daemon ref: %w", err)
+		}
+		if err = r.copyTag(ctx, destRefs, srcRef); err != nil {
+			return fmt.Errorf("copy docker-daemon image: %w", err)
+		}
+	case sourceDir:
+		srcRef, err := directory.NewReference(src.value)
+		if err != nil {
+			return fmt.Errorf("parsing source dir ref: %w", err)
+		}
+		if err = r.copyTag(ctx, destRefs, srcRef); err != nil {
+			return fmt.Errorf("copy dir image: %w", err)
+		}
+	case sourceContainersStorage:
+		srcRef, err := storage.Transport.ParseReference(src.value)
+		if err != nil {
+			return fmt.Errorf("parsing source containers-storage ref: %w", err)
+		}
+		if err = r.copyTag(ctx, destRefs, srcRef); err != nil {
+			return fmt.Errorf("copy containers-storage image: %w", err)
+		}
+	default:
 		// copy single tag sync entire repository
-		srcRef, err := docker.ParseReference(fmt.Sprintf("//%s", src))
+		srcRef, err := docker.ParseReference(fmt.Sprintf("//%s", src.value))
 		if err != nil {
 			return fmt.Errorf("parsing source docker ref: %w", err)
 		}
-		if hasTag(src, srcRef) {
-			if err = copyImage(ctx, destRef, srcRef, &opts); err != nil {
+		if hasTag(src.value) {
+			if len(r.job.Tags) > 0 {
+				return errors.New("--tag needs a repository source without tag")
+			}
+			if r.job.IncludeReferrers {
+				r.referrers = &referrers{
+					dests:   lo.Map(dests, func(dest destination, i int) destination { return dest.repository(destRefs[i]) }),
+					srcRepo: srcRef.DockerReference().Name(),
+					srcTags: sync.OnceValues(func() ([]string, error) {
+						return r.sourceTags(ctx, srcRef)
+					}),
+				}
+			}
+			if destRefs, err = r.singleImageRefs(ctx, dests, destRefs, srcRef); err != nil {
+				return err
+			}
+			if len(destRefs) == 0 {
+				return nil
+			}
+			for _, destRef := range destRefs {
+				if err := checkDestinationQuota(ctx, r.options.QuotaAction, destRef, r.opts.DestinationCtx, r.opts.SourceCtx, []types.ImageReference{r.job.Platforms.wrap(srcRef)}, r.job.DestPlainHTTP); err != nil {
+					return err
+				}
+			}
+			if err = r.copyTag(ctx, destRefs, srcRef); err != nil {
 				return fmt.Errorf("copy tag: %w", err)
 			}
 		} else {
-			if hasTag(dest, destRef) {
-				return fmt.Errorf("tag shouldn't be provided in dest: %w", ErrInvalidTag)
+			if r.options.DestTag != "" {
+				return errors.New("--dest-tag needs a single source image")
+			}
+			var snapshot *archiveSnapshot
+			for i, dest := range dests {
+				if dest.hasTag() {
+					return fmt.Errorf("tag shouldn't be provided in dest: %w", ErrInvalidTag)
+				}
+				// an oci-archive is the only destination, see checkFanout
+				if dest.kind == destinationOCIArchive {
+					if snapshot, err = newArchiveSnapshot(dest.value); err != nil {
+						return err
+					}
+					defer snapshot.remove()
+					dests[i] = snapshot.destination()
+					if destRefs[i], err = dests[i].reference(); err != nil {
+						return err
+					}
+					continue
+				}
+				if dest.holdsSingleImage() {
+					return fmt.Errorf("syncing a repository into a %s destination needs a single source tag: %w", dest.typeName(), ErrUnsupportedDestination)
+				}
+				// the tag directories are resolved below it
+				if dest.kind == destinationDir {
+					if err = os.MkdirAll(dest.value, 0o755); err != nil {
+						return fmt.Errorf("creating dir destination: %w", err)
+					}
+				}
 			}
-			if err = copyRepository(ctx, c, destRef, srcRef, opts); err != nil {
+			if err = r.copyRepository(ctx, dests, destRefs, srcRef); err != nil {
 				return fmt.Errorf("copy repository: %w", err)
 			}
+			if snapshot != nil && !r.options.DryRun {
+				if err = snapshot.write(r.failed.Load()); err != nil {
+					return fmt.Errorf("writing oci-archive: %w", err)
+				}
+			}
 		}
 	}
 
-	logrus.Info("Image(s) sync completed.")
 	return nil
 }
 
-func copyRepository(ctx context.Context, cliCtx *cli.Context, destRepository, srcRepository types.ImageReference, opts copy.Options) error {
-	srcTags, err := docker.GetRepositoryTags(ctx, opts.SourceCtx, srcRepository)
-	if err != nil {
-		return fmt.Errorf("getting source tags: %w", err)
-	}
-
+// selectTags returns the tags of a source repository which the tag filters
+// of the job select.
+func (job syncJob) selectTags(tags []string) ([]string, error) {
 	// skip tags
-	shouldSkip := cliCtx.String("skip-tags")
-	if shouldSkip != "" {
-		srcTags = subtract(srcTags, strings.Split(shouldSkip, ","))
+	if len(job.SkipTags) > 0 {
+		tags = subtract(tags, job.SkipTags)
 	}
 
 	// match tags
-	if pattern := cliCtx.String("tags-pattern"); pattern != "" {
+	if pattern := job.TagsPattern; pattern != "" {
 		re, err := regexp.Compile(pattern)
 		if err != nil {
-			return fmt.Errorf("%q is not valid regexp", pattern)
+			return nil, fmt.Errorf("%q is not valid regexp", pattern)
 		}
 
-		srcTags = lo.Filter(srcTags, func(item string, index int) bool { return re.MatchString(item) })
+		tags = lo.Filter(tags, func(item string, index int) bool { return re.MatchString(item) })
 	}
 
 	// exclude tags
-	if pattern := cliCtx.String("skip-tags-pattern"); pattern != "" {
+	if pattern := job.SkipTagsPattern; pattern != "" {
 		re, err := regexp.Compile(pattern)
 		if err != nil {
-			return fmt.Errorf("%q is not valid regexp", pattern)
+			return nil, fmt.Errorf("%q is not valid regexp", pattern)
 		}
-		srcTags = lo.Filter(srcTags, func(item string, index int) bool { return !re.MatchString(item) })
+		tags = lo.Filter(tags, func(item string, index int) bool { return !re.MatchString(item) })
 	}
 
-	var tags []string
-	destTags, err := docker.GetRepositoryTags(ctx, opts.DestinationCtx, destRepository)
-	if cliCtx.Bool("overwrite") || err != nil {
-		tags = srcTags
-	} else {
-		tags = subtract(srcTags, destTags)
+	// select versions
+	if job.Semver != "" || job.KeepLatestN > 0 {
+		return filterSemver(tags, job.Semver, job.KeepLatestN)
+	}
+	return tags, nil
+}
+
+func (r *syncRun) copyRepository(ctx context.Context, dests []destination, destRepositories []types.ImageReference, srcRepository types.ImageReference) error {
+	job := r.job
+	// named tags are copied without listing the source, unless the listing
+	// is needed to find referrers or to prune
+	var (
+		allSrcTags []string
+		err        error
+	)
+	srcTags := job.Tags
+	if srcTags == nil || job.IncludeReferrers || job.Prune {
+		listCtx, span := tracer.Start(ctx, "list tags", trace.WithAttributes(attribute.String("imagesync.repository", refName(srcRepository))))
+		allSrcTags, err = r.sourceTags(listCtx, srcRepository)
+		span.SetAttributes(attribute.Int("imagesync.tags", len(allSrcTags)))
+		endSpan(span, err)
+		if err != nil {
+			return fmt.Errorf("getting source tags: %w", err)
+		}
+	}
+	if srcTags == nil {
+		srcTags = allSrcTags
+	}
+
+	// referrer tags are copied together with the image they refer to
+	if job.IncludeReferrers {
+		r.referrers = &referrers{
+			dests:   dests,
+			srcRepo: srcRepository.DockerReference().Name(),
+			srcTags: func() ([]string, error) { return allSrcTags, nil },
+		}
+		srcTags = lo.Reject(srcTags, func(tag string, _ int) bool { return referrerTagPattern.MatchString(tag) })
+	}
+
+	if srcTags, err = job.selectTags(srcTags); err != nil {
+		return err
+	}
+	if err = job.TagRewrite.check(srcTags); err != nil {
+		return err
+	}
+	// --retag owns the floating tags of the destination
+	srcTags = lo.Reject(srcTags, func(tag string, _ int) bool { return job.Retag.has(job.TagRewrite.rewrite(tag)) })
+
+	// the destinations each tag has to be copied to
+	targets := map[string][]int{}
+	for i, dest := range dests {
+		pending, err := r.pendingTags(ctx, dest, destRepositories[i], srcRepository, srcTags)
+		if err != nil {
+			return err
+		}
+		for _, tag := range pending {
+			targets[tag] = append(targets[tag], i)
+		}
+	}
+	tags := lo.Filter(srcTags, func(tag string, _ int) bool { return len(targets[tag]) > 0 })
+	// reading the creation times and labels is expensive, tags which are
+	// synced already aren't checked
+	if job.Age.enabled() && len(tags) > 0 {
+		tags = r.filterAge(ctx, srcRepository, tags)
+	}
+	if job.Metadata.enabled() && len(tags) > 0 {
+		tags = r.filterMetadata(ctx, srcRepository, tags)
 	}
 
 	if len(tags) == 0 {
 		logrus.Info("Image in repositories are already synced")
-		os.Exit(0)
+		return r.prune(ctx, dests, destRepositories, allSrcTags)
 	}
 
-	logrus.Infof("Starting image sync with total-tags=%d tags=%v source=%s destination=%s", len(tags), tags, srcRepository.DockerReference().Name(), destRepository.DockerReference().Name())
+	destNames := lo.Map(destRepositories, func(ref types.ImageReference, _ int) string { return refName(ref) })
+	logrus.WithFields(logrus.Fields{
+		"totalTags":   len(tags),
+		"source":      srcRepository.DockerReference().Name(),
+		"destination": strings.Join(destNames, ","),
+	}).Info("Starting image sync")
+	r.progress.plan(len(tags))
+	logrus.Debugf("Tags to sync: %v", tags)
 
 	// limit the go routines to avoid 429 on registries
-	maxConcurrentTags := cliCtx.Int("max-concurrent-tags")
+	maxConcurrentTags := job.MaxConcurrentTags
 	numberOfConcurrentTags := maxConcurrentTags
 	if len(tags) < maxConcurrentTags {
 		numberOfConcurrentTags = len(tags)
@@ -215,8 +1552,10 @@ func copyRepository(ctx context.Context, cliCtx *cli.Context, destRepository, sr
 
 	// sync repository by copying each tag. Errors are ignored on purpose
 	// and only warning are shown via ReportWriter for failing tags.
+	// Once the destination quota is exceeded no further tags are dispatched.
+	var quotaExceeded atomic.Bool
 	var wg sync.WaitGroup
-	ch := make(chan string, len(tags))
+	ch := make(chan string)
 	wg.Add(numberOfConcurrentTags)
 	for i := 0; i < numberOfConcurrentTags; i++ {
 		go func() {
@@ -226,50 +1565,399 @@ func copyRepository(ctx context.Context, cliCtx *cli.Context, destRepository, sr
 					wg.Done()
 					return
 				}
-				destTagRef, err := docker.ParseReference(fmt.Sprintf("//%s:%s", cliCtx.String("dest"), tag))
-				if err != nil {
-					logrus.Warnf("failed parsing dest ref: %s", err)
+				destTagRefs := make([]types.ImageReference, 0, len(targets[tag]))
+				for _, i := range targets[tag] {
+					destTagRef, err := dests[i].tagReference(job.TagRewrite.rewrite(tag))
+					if err != nil {
+						logrus.Warnf("failed parsing dest ref: %s", err)
+						continue
+					}
+					destTagRefs = append(destTagRefs, destTagRef)
 				}
-				srcTagRef, err := docker.ParseReference(fmt.Sprintf("//%s:%s", cliCtx.String("src"), tag))
+				if len(destTagRefs) == 0 {
+					continue
+				}
+				srcTagRef, err := docker.ParseReference(fmt.Sprintf("//%s:%s", srcRepository.DockerReference().Name(), tag))
 				if err != nil {
 					logrus.Warnf("failed parsing src ref: %s", err)
+					continue
 				}
-				if err = copyImage(ctx, destTagRef, srcTagRef, &opts); err != nil {
+				if err = r.copyTag(ctx, destTagRefs, srcTagRef); err != nil {
+					if isQuotaExceeded(err) {
+						quotaExceeded.Store(true)
+					}
 					logrus.Warnf("failed copying image: %s", err)
 				}
 			}
 		}()
 	}
+	dispatched := 0
 	for _, tag := range tags {
+		if quotaExceeded.Load() || ctx.Err() != nil {
+			break
+		}
 		ch <- tag
+		dispatched++
 	}
 	close(ch)
 	wg.Wait()
-	return nil
+
+	if quotaExceeded.Load() {
+		return fmt.Errorf("stopped after dispatching %d of %d tags: %w", dispatched, len(tags), ErrQuotaExceeded)
+	}
+	if ctx.Err() != nil {
+		return fmt.Errorf("stopped after dispatching %d of %d tags: %w", dispatched, len(tags), ctx.Err())
+	}
+	return r.prune(ctx, dests, destRepositories, allSrcTags)
+}
+
+// pendingTags returns the tags of srcTags which have to be copied to dest and
+// records the others as skipped. The quota of dest is checked for them.
+func (r *syncRun) pendingTags(ctx context.Context, dest destination, destRepository, srcRepository types.ImageReference, srcTags []string) ([]string, error) {
+	job := r.job
+	opts := r.opts
+	var tags []string
+	destTags, err := dest.tags(ctx, opts.DestinationCtx, destRepository)
+	if job.Overwrite || err != nil {
+		tags = srcTags
+	} else {
+		present := lo.SliceToMap(destTags, func(tag string) (string, bool) { return tag, true })
+		tags = lo.Reject(srcTags, func(tag string, _ int) bool { return present[job.TagRewrite.rewrite(tag)] })
+		existing := subtract(srcTags, tags)
+		if job.CompareDigests && len(existing) > 0 {
+			changed := r.changedTags(ctx, dest, srcRepository, existing)
+			logrus.Infof("%d of %d existing tags have a different digest in the destination", len(changed), len(existing))
+			tags = append(tags, changed...)
+			existing = subtract(existing, changed)
+		}
+		for _, tag := range existing {
+			destTagRef, err := dest.tagReference(job.TagRewrite.rewrite(tag))
+			if err != nil {
+				logrus.Warnf("failed parsing dest ref: %s", err)
+				continue
+			}
+			r.addTag(TagResult{
+				Source:      fmt.Sprintf("%s:%s", srcRepository.DockerReference().Name(), tag),
+				Destination: refName(destTagRef),
+				Status:      TagSkipped,
+			})
+			if r.digests != nil && !r.options.DryRun {
+				if srcTagRef, err := docker.ParseReference(fmt.Sprintf("//%s:%s", srcRepository.DockerReference().Name(), tag)); err == nil {
+					r.digests.recordExisting(ctx, srcTagRef, destTagRef, opts.DestinationCtx)
+				}
+			}
+			if r.index == nil || !r.index.existing {
+				continue
+			}
+			r.index.recordExisting(ctx, destTagRef, opts.DestinationCtx)
+		}
+	}
+
+	if action := r.options.QuotaAction; action != "" && len(tags) > 0 {
+		srcTagRefs := make([]types.ImageReference, 0, len(tags))
+		for _, tag := range tags {
+			srcTagRef, err := docker.ParseReference(fmt.Sprintf("//%s:%s", srcRepository.DockerReference().Name(), tag))
+			if err != nil {
+				return nil, fmt.Errorf("parsing src ref: %w", err)
+			}
+			srcTagRefs = append(srcTagRefs, job.Platforms.wrap(srcTagRef))
+		}
+		if err := checkDestinationQuota(ctx, action, destRepository, opts.DestinationCtx, opts.SourceCtx, srcTagRefs, job.DestPlainHTTP); err != nil {
+			return nil, err
+		}
+	}
+	return tags, nil
+}
+
+// prune deletes the stale tags of all destinations with --prune, points the
+// --retag tags and applies the retention policy of the repository.
+func (r *syncRun) prune(ctx context.Context, dests []destination, destRepositories []types.ImageReference, srcTags []string) error {
+	if !r.job.Prune && len(r.job.Retag) == 0 && r.job.Retention == nil {
+		return nil
+	}
+	// the token of the job start may have expired while copying
+	if err := r.refreshGoogle(&r.opts); err != nil {
+		return err
+	}
+	// the floating tags of --retag aren't stale
+	srcTags = append(r.job.TagRewrite.rewriteAll(srcTags), r.job.Retag.tags()...)
+	var errs []error
+	for i, dest := range dests {
+		if r.job.Prune {
+			if err := r.pruneTags(ctx, dest, destRepositories[i], srcTags); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		if len(r.job.Retag) > 0 {
+			if err := r.retag(ctx, dest, destRepositories[i]); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		if r.job.Retention != nil {
+			if err := r.applyRetention(ctx, dest, destRepositories[i]); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
 }
 
-func copyImage(ctx context.Context, destRef, srcRef types.ImageReference, opts *copy.Options) error {
-	policyContext, err := signature.NewPolicyContext(&signature.Policy{
-		Default: []signature.PolicyRequirement{signature.NewPRInsecureAcceptAnything()},
+// copyTag copies a single image to all destRefs at once and records the
+// outcome for each destination.
+func (r *syncRun) copyTag(ctx context.Context, destRefs []types.ImageReference, srcRef types.ImageReference) error {
+	destRefs = lo.Reject(destRefs, func(destRef types.ImageReference, _ int) bool {
+		name := refName(destRef)
+		if !r.checkpoint.done(name) {
+			return false
+		}
+		logrus.Infof("Skipping %s, it was copied by an interrupted sync", name)
+		r.addTag(TagResult{Source: refName(srcRef), Destination: name, Status: TagSkipped})
+		return true
 	})
+	if len(destRefs) == 0 {
+		return nil
+	}
+	ctx, span := tracer.Start(ctx, "copy tag", trace.WithAttributes(
+		attribute.String("imagesync.source", refName(srcRef)),
+		attribute.StringSlice("imagesync.destinations", lo.Map(destRefs, func(ref types.ImageReference, _ int) string { return refName(ref) })),
+	))
+	// pausing for the Docker Hub rate limit and waiting for a slot don't
+	// count as tag timeout
+	if err := r.hub.wait(ctx, srcRef, r.opts.SourceCtx); err != nil {
+		endSpan(span, err)
+		return err
+	}
+	release, err := r.tagSlots.acquire(ctx, srcRef)
+	if err != nil {
+		endSpan(span, err)
+		return err
+	}
+	defer release()
+	releaseAdaptive, err := r.adaptive.acquire(ctx)
+	if err != nil {
+		endSpan(span, err)
+		return err
+	}
+	defer releaseAdaptive()
+	if !r.selectArtifact(ctx, destRefs, srcRef) || !r.selectSize(ctx, destRefs, srcRef) {
+		endSpan(span, nil)
+		return nil
+	}
+	tagCtx := ctx
+	if timeout := r.options.TagTimeout; timeout > 0 {
+		var cancel context.CancelFunc
+		tagCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	if ok, err := r.scanSource(tagCtx, destRefs, srcRef); !ok {
+		endSpan(span, err)
+		return err
+	}
+	var t transferred
+	if !r.options.DryRun {
+		err = r.hooks.runPreTag(tagCtx, srcRef, destRefs)
+	}
+	if err == nil {
+		t, err = r.transferWithFallback(tagCtx, destRefs, srcRef)
+	}
+	if err == nil {
+		err = r.verifyCopies(tagCtx, destRefs, t.manifest)
+	}
+	if err == nil {
+		err = r.signCopies(tagCtx, destRefs, t.manifest)
+	}
+	if err != nil && ctx.Err() == nil && errors.Is(tagCtx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("copy exceeded the tag timeout of %s: %w", r.options.TagTimeout, err)
+	}
+	span.SetAttributes(attribute.Int64("imagesync.bytes", t.bytes), attribute.Int64("imagesync.reused_bytes", t.reusedBytes))
+	endSpan(span, err)
+	r.recordCopies(ctx, destRefs, srcRef, t, err)
+	if err == nil {
+		r.copyReferrers(tagCtx, t)
+	}
+	return err
+}
+
+// transfer copies srcRef to destRefs. In dry-run mode nothing is copied and
+// the source manifest is returned instead.
+func (r *syncRun) transfer(ctx context.Context, destRefs []types.ImageReference, srcRef types.ImageReference) (transferred, error) {
+	started := time.Now()
+	artifactRef := srcRef
+	srcRef, sourceDigest := recordSourceDigest(ctx, r.opts.SourceCtx, srcRef, r.limits.src)
+	srcRef = r.annotator.wrap(r.job.Platforms.wrap(srcRef), refName(srcRef), sourceDigest)
+	srcRef = throttle(srcRef, r.bandwidth, newBandwidthLimiter(r.bandwidthPerTag))
+
+	if !r.options.DryRun {
+		opts := r.opts
+		if err := r.refreshGoogle(&opts); err != nil {
+			return transferred{}, err
+		}
+		bar := r.progress.startTag(refName(srcRef))
+		defer bar.done()
+		events := r.events.startTag(refName(srcRef), lo.Map(destRefs, func(ref types.ImageReference, _ int) string { return refName(ref) }))
+		progress, copiedBytes := countBytes(observeAll(bar.observe, events))
+		opts.Progress = progress
+		opts.ProgressInterval = time.Second
+
+		destRefs := lo.Map(destRefs, func(ref types.ImageReference, _ int) types.ImageReference {
+			return r.export.wrap(r.mounter.wrap(ref, r.job.DestPlainHTTP))
+		})
+		var manifestBlob []byte
+		err := withRetry(ctx, r.options.MaxRetries, r.options.RetryDelay, refName(srcRef), func() error {
+			var err error
+			manifestBlob, err = copyImage(ctx, destRefs, srcRef, &opts, r.limits, r.verification)
+			r.adaptive.observe(err)
+			return err
+		})
+		copied, reused := copiedBytes()
+		// artifacts are rejected by the conversions of the copy
+		if isNonImageArtifact(err) {
+			logrus.Debugf("copying %s unchanged, it isn't an image: %s", refName(artifactRef), err)
+			return r.transferArtifact(ctx, destRefs, artifactRef)
+		}
+		if err == nil && r.options.PreserveDigests {
+			err = checkPreservedDigest(manifestBlob, sourceDigest())
+		}
+		return transferred{
+			manifest:     manifestBlob,
+			sourceDigest: sourceDigest(),
+			bytes:        copied,
+			reusedBytes:  reused,
+			duration:     time.Since(started),
+		}, err
+	}
+
+	src, err := srcRef.NewImageSource(ctx, r.opts.SourceCtx)
+	if err != nil {
+		return transferred{}, fmt.Errorf("opening source image: %w", err)
+	}
+	defer src.Close()
+	manifestBlob, _, err := src.GetManifest(ctx, nil)
+	if err != nil {
+		return transferred{}, fmt.Errorf("reading source manifest: %w", err)
+	}
+	return transferred{manifest: manifestBlob, sourceDigest: sourceDigest(), duration: time.Since(started)}, nil
+}
+
+func (r *syncRun) recordCopies(ctx context.Context, destRefs []types.ImageReference, srcRef types.ImageReference, t transferred, err error) {
+	for _, destRef := range destRefs {
+		r.recordCopy(ctx, destRef, srcRef, t, err)
+	}
+}
+
+func (r *syncRun) recordCopy(ctx context.Context, destRef, srcRef types.ImageReference, t transferred, err error) {
+	tag := TagResult{
+		Source:          refName(srcRef),
+		Destination:     refName(destRef),
+		Status:          TagCopied,
+		SourceDigest:    t.sourceDigest.String(),
+		Bytes:           t.bytes,
+		ReusedBytes:     t.reusedBytes,
+		DurationSeconds: t.duration.Seconds(),
+	}
+	if !r.options.DryRun {
+		r.metrics.recordCopy(destRef, srcRef, t, err)
+	}
+	if err != nil {
+		tag.Status = TagFailed
+		tag.Error = err.Error()
+		tag.FailureClass = classifyFailure(err)
+		r.addTag(tag)
+		if !r.options.DryRun {
+			r.hooks.runPostTag(ctx, tag)
+		}
+		return
+	}
+
+	if dgst, err := manifest.Digest(t.manifest); err == nil {
+		tag.Digest = dgst.String()
+	}
+	if r.options.DryRun {
+		tag.Status = TagPlanned
+		logrus.WithFields(tagFields(tag)).Info("Would copy image")
+	} else {
+		logrus.WithFields(tagFields(tag)).Info("Copied image")
+		r.index.recordCopied(ctx, destRef, r.opts.DestinationCtx, t.manifest, r.job.DestPlainHTTP)
+		if dgst, err := manifest.Digest(t.manifest); err == nil {
+			r.digests.record(srcRef, destRef, dgst)
+		}
+		r.checkpoint.record(tag)
+	}
+	r.addTag(tag)
+	if !r.options.DryRun {
+		r.hooks.runPostTag(ctx, tag)
+	}
+}
+
+func (r *syncRun) addTag(tag TagResult) {
+	r.result.addTag(tag)
+	r.metrics.recordTag(tag.Status)
+	r.events.recordTag(tag)
+	if tag.Status == TagFailed {
+		r.failed.Add(1)
+	}
+}
+
+// copyImage copies srcRef to all destRefs and returns the manifest written to
+// the destinations.
+func copyImage(ctx context.Context, destRefs []types.ImageReference, srcRef types.ImageReference, opts *copy.Options, limits connLimits, verify *verification) (manifestBlob []byte, err error) {
+	ctx, span := tracer.Start(ctx, "copy image")
+	defer func() { endSpan(span, err) }()
+
+	policyContext, err := verify.newPolicyContext()
 	if err != nil {
-		return fmt.Errorf("creating policy context: %w", err)
+		return nil, fmt.Errorf("creating policy context: %w", err)
 	}
-	if _, err = copy.Image(ctx, policyContext, destRef, srcRef, opts); err != nil {
-		return fmt.Errorf("copying image: %w", err)
+	defer func() { _ = policyContext.Destroy() }()
+	destRef := newFanoutReference(lo.Map(destRefs, func(ref types.ImageReference, _ int) types.ImageReference { return limits.dest.wrap(ref) }))
+	manifestBlob, err = copy.Image(ctx, policyContext, destRef, limits.src.wrap(traceBlobs(ctx, srcRef)), opts)
+	if err != nil {
+		return nil, fmt.Errorf("copying image: %w", err)
 	}
 
+	return manifestBlob, nil
+}
+
+// checkFanout rejects what doesn't work with several destinations. The
+// fan-out destination only passes simple signing signatures.
+func (r *syncRun) checkFanout(dests []destination) error {
+	if len(dests) < 2 {
+		return nil
+	}
+	for _, dest := range dests {
+		if dest.holdsSingleImage() {
+			return fmt.Errorf("a %s destination can't be one of several destinations: %w", dest.typeName(), ErrUnsupportedDestination)
+		}
+	}
+	if r.signing.sigstore() {
+		return errors.New("sigstore signing can't be used with several destinations")
+	}
+	if r.verification != nil && r.verification.registriesDir != "" {
+		return errors.New("--verify-cosign-pubkey can't be used with several destinations")
+	}
 	return nil
 }
 
-func hasTag(ref string, imageRef types.ImageReference) bool {
-	return strings.HasSuffix(imageRef.DockerReference().String(), ref)
+// hasTag reports whether ref names a single image by tag or digest.
+func hasTag(ref string) bool {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return false
+	}
+	_, tagged := named.(reference.Tagged)
+	_, digested := named.(reference.Digested)
+	return tagged || digested
 }
 
 func subtract(ts1 []string, ts2 []string) []string {
-	var diff []string
+	exclude := make(map[string]struct{}, len(ts2))
+	for _, term := range ts2 {
+		exclude[term] = struct{}{}
+	}
+
+	diff := make([]string, 0, len(ts1))
 	for _, term := range ts1 {
-		if lo.Contains(ts2, term) {
+		if _, ok := exclude[term]; ok {
 			continue
 		}
 		diff = append(diff, term)
@@ -0,0 +1,46 @@
+package imagesync
+
+import (
+	"fmt"
+	"testing"
+)
+
+// benchmarkTags returns n tags like those of a large repository: versions
+// and commit builds of them.
+func benchmarkTags(n int) []string {
+	tags := make([]string, 0, n)
+	for i := 0; len(tags) < n; i++ {
+		tags = append(tags, fmt.Sprintf("%d.%d.%d", i/100, i/10%10, i%10))
+		if len(tags) < n {
+			tags = append(tags, fmt.Sprintf("%d.%d.%d-%07x", i/100, i/10%10, i%10, i))
+		}
+	}
+	return tags
+}
+
+func BenchmarkSubtract(b *testing.B) {
+	tags := benchmarkTags(10000)
+	// half of the tags exist in the destination
+	existing := tags[:len(tags)/2]
+	b.ResetTimer()
+	for range b.N {
+		subtract(tags, existing)
+	}
+}
+
+func BenchmarkSelectTags(b *testing.B) {
+	tags := benchmarkTags(10000)
+	job := syncJob{
+		SkipTags:        tags[:1000],
+		TagsPattern:     `^\d+\.\d+\.\d+`,
+		SkipTagsPattern: `-[0-9a-f]{7}$`,
+		Semver:          ">=10.0.0",
+		KeepLatestN:     100,
+	}
+	b.ResetTimer()
+	for range b.N {
+		if _, err := job.selectTags(tags); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,380 @@
+package imagesync
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/image"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/transports"
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+)
+
+var indexCSVHeader = []string{"tag", "digest", "created", "platforms", "labels"}
+
+// indexEntry is the metadata recorded in the index file for a destination tag.
+type indexEntry struct {
+	Tag       string            `json:"tag"`
+	Digest    string            `json:"digest"`
+	Created   *time.Time        `json:"created,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Platforms []string          `json:"platforms,omitempty"`
+}
+
+// tagIndex collects index entries of a run and merges them into the index file.
+type tagIndex struct {
+	path     string
+	format   string
+	maxSize  int64
+	existing bool
+
+	mu      sync.Mutex
+	entries map[string]indexEntry
+}
+
+// newTagIndex returns nil if no index file is requested, all tagIndex methods
+// are no-ops on a nil receiver.
+func newTagIndex(path, format string, maxSize int64, existing bool) (*tagIndex, error) {
+	if path == "" {
+		return nil, nil
+	}
+	if format == "" {
+		format = "json"
+		if strings.EqualFold(filepath.Ext(path), ".csv") {
+			format = "csv"
+		}
+	}
+	if format != "json" && format != "csv" {
+		return nil, fmt.Errorf("unsupported index format %q", format)
+	}
+	return &tagIndex{path: path, format: format, maxSize: maxSize, existing: existing, entries: map[string]indexEntry{}}, nil
+}
+
+// recordCopied adds the image copied to destRef, manifestBlob is the manifest
+// returned by the copy so only the config has to be fetched, and for manifest
+// lists the manifest of the inspected instance. plainHTTP is the
+// --dest-plain-http of the job.
+func (idx *tagIndex) recordCopied(ctx context.Context, destRef types.ImageReference, sys *types.SystemContext, manifestBlob []byte, plainHTTP bool) {
+	if idx == nil {
+		return
+	}
+	if err := idx.record(ctx, destRef, sys, manifestBlob, plainHTTP); err != nil {
+		logrus.Warnf("failed indexing %s: %s", refName(destRef), err)
+	}
+}
+
+// recordExisting adds a destination tag which was skipped because it already exists.
+func (idx *tagIndex) recordExisting(ctx context.Context, destRef types.ImageReference, sys *types.SystemContext) {
+	if idx == nil || !idx.existing {
+		return
+	}
+	if err := idx.record(ctx, destRef, sys, nil, false); err != nil {
+		logrus.Warnf("failed indexing %s: %s", refName(destRef), err)
+	}
+}
+
+func (idx *tagIndex) record(ctx context.Context, ref types.ImageReference, sys *types.SystemContext, manifestBlob []byte, plainHTTP bool) error {
+	var src types.ImageSource
+	if manifestBlob != nil && ref.Transport() == docker.Transport && ref.DockerReference() != nil {
+		// opening a docker source reads the manifest again
+		src = newRegistryBlobSource(ref, sys, manifestBlob, plainHTTP)
+	} else {
+		var err error
+		if src, err = ref.NewImageSource(ctx, sys); err != nil {
+			return fmt.Errorf("opening image: %w", err)
+		}
+		defer src.Close()
+		if manifestBlob, _, err = src.GetManifest(ctx, nil); err != nil {
+			return fmt.Errorf("reading manifest: %w", err)
+		}
+	}
+
+	dgst, err := manifest.Digest(manifestBlob)
+	if err != nil {
+		return fmt.Errorf("computing digest: %w", err)
+	}
+	entry := indexEntry{Tag: refName(ref), Digest: dgst.String()}
+
+	if mimeType := manifest.GuessMIMEType(manifestBlob); manifest.MIMETypeIsMultiImage(mimeType) {
+		list, err := manifest.ListFromBlob(manifestBlob, mimeType)
+		if err != nil {
+			return fmt.Errorf("parsing manifest list: %w", err)
+		}
+		for _, instance := range list.Instances() {
+			info, err := list.Instance(instance)
+			if err != nil {
+				return fmt.Errorf("reading manifest list instance: %w", err)
+			}
+			if p := info.ReadOnly.Platform; p != nil {
+				entry.Platforms = append(entry.Platforms, formatPlatform(p.OS, p.Architecture, p.Variant))
+			}
+		}
+	}
+
+	// for manifest lists the image matching sys is inspected
+	img, err := image.FromUnparsedImage(ctx, sys, image.UnparsedInstance(src, nil))
+	if err != nil {
+		return fmt.Errorf("opening image: %w", err)
+	}
+	info, err := img.Inspect(ctx)
+	if err != nil {
+		return fmt.Errorf("reading image config: %w", err)
+	}
+	entry.Created = info.Created
+	entry.Labels = info.Labels
+	if entry.Platforms == nil && info.Os != "" {
+		entry.Platforms = []string{formatPlatform(info.Os, info.Architecture, info.Variant)}
+	}
+
+	idx.mu.Lock()
+	idx.entries[entry.Tag] = entry
+	idx.mu.Unlock()
+	return nil
+}
+
+// registryBlobSource is the image of a registry ref whose manifest is known.
+// The config, and the instance manifests of a manifest list, are read by
+// digest from the distribution API.
+type registryBlobSource struct {
+	ref      types.ImageReference
+	repo     string
+	manifest []byte
+	client   *registryClient
+}
+
+func newRegistryBlobSource(ref types.ImageReference, sys *types.SystemContext, manifestBlob []byte, plainHTTP bool) *registryBlobSource {
+	named := ref.DockerReference()
+	host := reference.Domain(named)
+	// Docker Hub is reached through its registry host
+	if host == "docker.io" {
+		host = hubRegistry
+	}
+	client := &registryClient{
+		host:      host,
+		sys:       sys,
+		http:      registryHTTPClient(sys),
+		plainHTTP: plainHTTP,
+		accept:    strings.Join(manifest.DefaultRequestedManifestMIMETypes, ", "),
+	}
+	return &registryBlobSource{ref: ref, repo: reference.Path(named), manifest: manifestBlob, client: client}
+}
+
+func (s *registryBlobSource) Reference() types.ImageReference {
+	return s.ref
+}
+
+func (s *registryBlobSource) Close() error {
+	return nil
+}
+
+func (s *registryBlobSource) GetManifest(ctx context.Context, instanceDigest *digest.Digest) ([]byte, string, error) {
+	if instanceDigest == nil {
+		return s.manifest, manifest.GuessMIMEType(s.manifest), nil
+	}
+	resp, err := s.client.get(ctx, "/v2/"+s.repo+"/manifests/"+instanceDigest.String(), "repository:"+s.repo+":pull")
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	blob, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	if !instanceDigest.Algorithm().Available() || instanceDigest.Algorithm().FromBytes(blob) != *instanceDigest {
+		return nil, "", fmt.Errorf("manifest %s doesn't match its digest", instanceDigest)
+	}
+	return blob, manifest.NormalizedMIMEType(resp.Header.Get("Content-Type")), nil
+}
+
+// GetBlob reads a blob, the image verifies the digest of the config.
+func (s *registryBlobSource) GetBlob(ctx context.Context, info types.BlobInfo, _ types.BlobInfoCache) (io.ReadCloser, int64, error) {
+	resp, err := s.client.get(ctx, "/v2/"+s.repo+"/blobs/"+info.Digest.String(), "repository:"+s.repo+":pull")
+	if err != nil {
+		return nil, 0, err
+	}
+	return resp.Body, resp.ContentLength, nil
+}
+
+func (s *registryBlobSource) HasThreadSafeGetBlob() bool {
+	return false
+}
+
+func (s *registryBlobSource) GetSignatures(context.Context, *digest.Digest) ([][]byte, error) {
+	return nil, nil
+}
+
+func (s *registryBlobSource) LayerInfosForCopy(context.Context, *digest.Digest) ([]types.BlobInfo, error) {
+	return nil, nil
+}
+
+// write merges the recorded entries into the index file. The file is replaced
+// atomically and rotated to <path>.1 once it would grow beyond maxSize.
+func (idx *tagIndex) write() error {
+	if idx == nil {
+		return nil
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	merged, err := idx.load()
+	if err != nil {
+		return fmt.Errorf("reading index file: %w", err)
+	}
+	for tag, entry := range idx.entries {
+		merged[tag] = entry
+	}
+
+	data, err := idx.encode(merged)
+	if err != nil {
+		return err
+	}
+	if idx.maxSize > 0 && int64(len(data)) > idx.maxSize {
+		if err = os.Rename(idx.path, idx.path+".1"); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("rotating index file: %w", err)
+		}
+		if data, err = idx.encode(idx.entries); err != nil {
+			return err
+		}
+	}
+
+	return writeFileAtomic(idx.path, data)
+}
+
+func (idx *tagIndex) load() (map[string]indexEntry, error) {
+	entries := map[string]indexEntry{}
+	f, err := os.Open(idx.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if idx.format == "json" {
+		var list []indexEntry
+		if err = json.NewDecoder(f).Decode(&list); err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+		for _, entry := range list {
+			entries[entry.Tag] = entry
+		}
+		return entries, nil
+	}
+
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	for i, record := range records {
+		if i == 0 || len(record) != len(indexCSVHeader) {
+			continue
+		}
+		entry := indexEntry{Tag: record[0], Digest: record[1]}
+		if created, err := time.Parse(time.RFC3339, record[2]); err == nil {
+			entry.Created = &created
+		}
+		if record[3] != "" {
+			entry.Platforms = strings.Split(record[3], ";")
+		}
+		if record[4] != "" {
+			entry.Labels = map[string]string{}
+			for _, label := range strings.Split(record[4], ";") {
+				k, v, _ := strings.Cut(label, "=")
+				entry.Labels[k] = v
+			}
+		}
+		entries[entry.Tag] = entry
+	}
+	return entries, nil
+}
+
+func (idx *tagIndex) encode(entries map[string]indexEntry) ([]byte, error) {
+	list := make([]indexEntry, 0, len(entries))
+	for _, entry := range entries {
+		list = append(list, entry)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Tag < list[j].Tag })
+
+	if idx.format == "json" {
+		data, err := json.MarshalIndent(list, "", "  ")
+		if err != nil {
+			return nil, fmt.Errorf("encoding index: %w", err)
+		}
+		return append(data, '\n'), nil
+	}
+
+	var b strings.Builder
+	w := csv.NewWriter(&b)
+	_ = w.Write(indexCSVHeader)
+	for _, entry := range list {
+		created := ""
+		if entry.Created != nil {
+			created = entry.Created.UTC().Format(time.RFC3339)
+		}
+		labels := make([]string, 0, len(entry.Labels))
+		for k, v := range entry.Labels {
+			labels = append(labels, k+"="+v)
+		}
+		sort.Strings(labels)
+		_ = w.Write([]string{entry.Tag, entry.Digest, created, strings.Join(entry.Platforms, ";"), strings.Join(labels, ";")})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return nil, fmt.Errorf("encoding index: %w", err)
+	}
+	return []byte(b.String()), nil
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("creating temporary file: %w", err)
+	}
+	defer os.Remove(f.Name())
+
+	if err = f.Chmod(0o644); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("writing temporary file: %w", err)
+	}
+	if _, err = f.Write(data); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("writing temporary file: %w", err)
+	}
+	if err = f.Close(); err != nil {
+		return fmt.Errorf("writing temporary file: %w", err)
+	}
+	if err = os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("replacing %s: %w", path, err)
+	}
+	return nil
+}
+
+func formatPlatform(os, arch, variant string) string {
+	if variant != "" {
+		return os + "/" + arch + "/" + variant
+	}
+	return os + "/" + arch
+}
+
+// refName returns a human readable name of ref.
+func refName(ref types.ImageReference) string {
+	if named := ref.DockerReference(); named != nil {
+		return named.String()
+	}
+	return transports.ImageName(ref)
+}
@@ -0,0 +1,269 @@
+package imagesync
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"text/tabwriter"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/types"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+// tagDiff is a tag which differs between source and destination, the
+// output of the diff and verify commands.
+type tagDiff struct {
+	Tag               string `json:"tag"`
+	Status            string `json:"status"`
+	SourceDigest      string `json:"sourceDigest,omitempty"`
+	DestinationDigest string `json:"destinationDigest,omitempty"`
+	Error             string `json:"error,omitempty"`
+}
+
+const (
+	diffMissing = "missing"
+	diffChanged = "changed"
+	diffExtra   = "extra"
+	diffFailed  = "failed"
+)
+
+// inspection is the single job of a list-tags, diff or verify command with
+// the tag filters of the flags.
+type inspection struct {
+	run     *syncRun
+	srcRepo types.ImageReference
+	output  string
+	// close removes the auth files read from Kubernetes secrets.
+	close func()
+}
+
+func newInspection(c *cli.Context, args int) (*inspection, error) {
+	if err := setupLogging(c); err != nil {
+		return nil, err
+	}
+	if c.NArg() != args {
+		return nil, fmt.Errorf("expected %d arguments, got %d", args, c.NArg())
+	}
+	output := c.String("output")
+	if output != "text" && output != "json" {
+		return nil, fmt.Errorf("unsupported output %q", output)
+	}
+	if c.IsSet("platforms") && c.IsSet("all-platforms") {
+		return nil, errors.New("--platforms and --all-platforms can't be used together")
+	}
+
+	opts := optionsFromFlags(c).withDefaults()
+	opts.Source, opts.Destination = c.Args().Get(0), c.Args().Get(1)
+	src, err := detectSource(opts.Source, opts.SrcFormat, opts.LegacySourceDetection)
+	if err != nil {
+		return nil, err
+	}
+	if src.kind != sourceRegistry || hasTag(src.value) {
+		return nil, fmt.Errorf("%s is not a registry repository", opts.Source)
+	}
+	srcRepo, err := docker.ParseReference("//" + src.value)
+	if err != nil {
+		return nil, fmt.Errorf("parsing source docker ref: %w", err)
+	}
+	jobs := make([]syncJob, 1)
+	if jobs[0], err = jobFromOptions(opts); err != nil {
+		return nil, err
+	}
+	if err = (&Syncer{}).setCredentials(c.Context, opts, jobs); err != nil {
+		return nil, err
+	}
+	job := jobs[0]
+	// the actions remove the auth files read from secrets
+	removeAuthFiles, err := kubernetesAuthFiles(c.Context, &opts)
+	if err != nil {
+		return nil, err
+	}
+	state := &syncState{result: newResult(opts)}
+	return &inspection{run: newSyncRun(opts, job, state), srcRepo: srcRepo, output: output, close: removeAuthFiles}, nil
+}
+
+// sourceTags lists the source tags the filters select, without referrer
+// tags.
+func (in *inspection) sourceTags(ctx context.Context) ([]string, error) {
+	tags, err := docker.GetRepositoryTags(ctx, in.run.opts.SourceCtx, in.srcRepo)
+	if err != nil {
+		return nil, fmt.Errorf("getting source tags: %w", err)
+	}
+	tags = slices.DeleteFunc(tags, referrerTagPattern.MatchString)
+	if tags, err = in.run.job.selectTags(tags); err != nil {
+		return nil, err
+	}
+	if in.run.job.Age.enabled() && len(tags) > 0 {
+		tags = in.run.filterAge(ctx, in.srcRepo, tags)
+	}
+	return tags, nil
+}
+
+// destination returns the destination and its tags, a missing repository
+// has none.
+func (in *inspection) destination(ctx context.Context) (destination, []string, error) {
+	dest, err := detectDestination(in.run.options.Destination, in.run.options.DestType)
+	if err != nil {
+		return destination{}, nil, err
+	}
+	if dest.hasTag() || dest.holdsSingleImage() {
+		return destination{}, nil, fmt.Errorf("%s is not a repository destination", in.run.options.Destination)
+	}
+	destRef, err := dest.reference()
+	if err != nil {
+		return destination{}, nil, err
+	}
+	tags, err := dest.tags(ctx, in.run.opts.DestinationCtx, destRef)
+	if err != nil {
+		logrus.Warnf("failed listing destination tags, treating the destination as empty: %s", err)
+	}
+	return dest, slices.DeleteFunc(tags, referrerTagPattern.MatchString), nil
+}
+
+// listTags is the action of the list-tags command.
+func listTags(c *cli.Context) error {
+	in, err := newInspection(c, 1)
+	if err != nil {
+		return err
+	}
+	defer in.close()
+	tags, err := in.sourceTags(c.Context)
+	if err != nil {
+		return err
+	}
+	if in.output == "json" {
+		return writeIndentedJSON(os.Stdout, append([]string{}, tags...))
+	}
+	for _, tag := range tags {
+		fmt.Println(tag)
+	}
+	return nil
+}
+
+// diffTags is the action of the diff command. Tags missing in the
+// destination, tags with another digest and destination tags the source
+// doesn't select are listed, any of them fail with ErrOutOfSync.
+func diffTags(c *cli.Context) error {
+	in, err := newInspection(c, 2)
+	if err != nil {
+		return err
+	}
+	defer in.close()
+	srcTags, err := in.sourceTags(c.Context)
+	if err != nil {
+		return err
+	}
+	dest, destTags, err := in.destination(c.Context)
+	if err != nil {
+		return err
+	}
+	job := in.run.job
+	if err = job.TagRewrite.check(srcTags); err != nil {
+		return err
+	}
+
+	var (
+		diffs  []tagDiff
+		common []string
+		synced = map[string]bool{}
+	)
+	for _, tag := range srcTags {
+		synced[job.TagRewrite.rewrite(tag)] = true
+		if slices.Contains(destTags, job.TagRewrite.rewrite(tag)) {
+			common = append(common, tag)
+		} else {
+			diffs = append(diffs, tagDiff{Tag: tag, Status: diffMissing})
+		}
+	}
+	diffs = append(diffs, in.changed(c.Context, dest, common)...)
+	for _, tag := range destTags {
+		if !synced[tag] {
+			diffs = append(diffs, tagDiff{Tag: tag, Status: diffExtra})
+		}
+	}
+	if err = in.write(os.Stdout, diffs); err != nil {
+		return err
+	}
+	if len(diffs) > 0 {
+		return fmt.Errorf("%d tags differ: %w", len(diffs), ErrOutOfSync)
+	}
+	logrus.Infof("%d tags are in sync", len(srcTags))
+	return nil
+}
+
+// verifyTags is the action of the verify command, the digests of the tags
+// in both source and destination have to match.
+func verifyTags(c *cli.Context) error {
+	in, err := newInspection(c, 2)
+	if err != nil {
+		return err
+	}
+	defer in.close()
+	srcTags, err := in.sourceTags(c.Context)
+	if err != nil {
+		return err
+	}
+	dest, destTags, err := in.destination(c.Context)
+	if err != nil {
+		return err
+	}
+	common := slices.DeleteFunc(srcTags, func(tag string) bool {
+		return !slices.Contains(destTags, in.run.job.TagRewrite.rewrite(tag))
+	})
+	diffs := in.changed(c.Context, dest, common)
+	if err = in.write(os.Stdout, diffs); err != nil {
+		return err
+	}
+	if len(diffs) > 0 {
+		return fmt.Errorf("%d of %d common tags differ: %w", len(diffs), len(common), ErrOutOfSync)
+	}
+	logrus.Infof("Verified %d common tags, their digests match", len(common))
+	return nil
+}
+
+// changed compares the digests of tags, which both sides have.
+func (in *inspection) changed(ctx context.Context, dest destination, tags []string) []tagDiff {
+	var diffs []tagDiff
+	for _, c := range in.run.compareTags(ctx, dest, in.srcRepo, tags) {
+		d := tagDiff{Tag: c.tag, Status: diffChanged, SourceDigest: c.source.String(), DestinationDigest: c.destination.String()}
+		switch {
+		case c.err != nil:
+			d.Status, d.Error = diffFailed, c.err.Error()
+		case c.source == c.destination:
+			continue
+		}
+		diffs = append(diffs, d)
+	}
+	return diffs
+}
+
+func (in *inspection) write(w io.Writer, diffs []tagDiff) error {
+	if in.output == "json" {
+		return writeIndentedJSON(w, append([]tagDiff{}, diffs...))
+	}
+	if len(diffs) == 0 {
+		return nil
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TAG\tSTATUS\tSOURCE DIGEST\tDESTINATION DIGEST")
+	for _, d := range diffs {
+		detail := d.DestinationDigest
+		if d.Error != "" {
+			detail = d.Error
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", d.Tag, d.Status, d.SourceDigest, detail)
+	}
+	return tw.Flush()
+}
+
+func writeIndentedJSON(w io.Writer, v any) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
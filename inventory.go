@@ -0,0 +1,259 @@
+package imagesync
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/pkg/blobinfocache/none"
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+)
+
+const inventoryVersion = 1
+
+// bundleInventory is the --inventory file of an air-gapped registry. Import
+// records the images it copied, export leaves them out of the next bundle.
+type bundleInventory struct {
+	Version      int                             `json:"version"`
+	Repositories map[string]*inventoryRepository `json:"repositories"`
+}
+
+// inventoryRepository lists the tags with their digest and the blobs of a
+// repository. Blobs are only reused within a repository, a registry may not
+// let other repositories mount them.
+type inventoryRepository struct {
+	Tags  map[string]string `json:"tags"`
+	Blobs []digest.Digest   `json:"blobs"`
+}
+
+// loadInventory reads the inventory at path, a missing file is an empty
+// inventory if allowMissing is set.
+func loadInventory(path string, allowMissing bool) (*bundleInventory, error) {
+	inv := &bundleInventory{Version: inventoryVersion, Repositories: map[string]*inventoryRepository{}}
+	data, err := os.ReadFile(path)
+	if allowMissing && errors.Is(err, os.ErrNotExist) {
+		return inv, nil
+	}
+	if err == nil {
+		err = json.Unmarshal(data, inv)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading inventory: %w", err)
+	}
+	if inv.Version != inventoryVersion {
+		return nil, fmt.Errorf("unsupported inventory version %d", inv.Version)
+	}
+	if inv.Repositories == nil {
+		inv.Repositories = map[string]*inventoryRepository{}
+	}
+	return inv, nil
+}
+
+func (inv *bundleInventory) write(path string) error {
+	for _, repo := range inv.Repositories {
+		slices.Sort(repo.Blobs)
+		repo.Blobs = slices.Compact(repo.Blobs)
+	}
+	data, err := json.MarshalIndent(inv, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(data, '\n'))
+}
+
+// tagDigest returns the digest of repo:tag, "" if the inventory doesn't
+// have the tag.
+func (inv *bundleInventory) tagDigest(repo, tag string) string {
+	if inv == nil || inv.Repositories[repo] == nil {
+		return ""
+	}
+	return inv.Repositories[repo].Tags[tag]
+}
+
+// blobs returns the set of blobs of every repository.
+func (inv *bundleInventory) blobs() map[string]map[digest.Digest]bool {
+	if inv == nil {
+		return nil
+	}
+	sets := make(map[string]map[digest.Digest]bool, len(inv.Repositories))
+	for name, repo := range inv.Repositories {
+		sets[name] = make(map[digest.Digest]bool, len(repo.Blobs))
+		for _, blob := range repo.Blobs {
+			sets[name][blob] = true
+		}
+	}
+	return sets
+}
+
+// add records that the destination has the image of repo:tag with blobs.
+func (inv *bundleInventory) add(repo, tag, dgst string, blobs []types.BlobInfo) {
+	r := inv.Repositories[repo]
+	if r == nil {
+		r = &inventoryRepository{Tags: map[string]string{}}
+		inv.Repositories[repo] = r
+	}
+	r.Tags[tag] = dgst
+	for _, blob := range blobs {
+		r.Blobs = append(r.Blobs, blob.Digest)
+	}
+}
+
+// dirImageBlobs returns the configs and layers of the dir: image in dir and
+// of the instances of its manifest list. Instances left out by --platforms
+// are skipped.
+func dirImageBlobs(dir string) ([]types.BlobInfo, error) {
+	data, err := os.ReadFile(filepath.Join(dir, "manifest.json"))
+	if err != nil {
+		return nil, fmt.Errorf("reading manifest: %w", err)
+	}
+	mimeType := manifest.GuessMIMEType(data)
+	if !manifest.MIMETypeIsMultiImage(mimeType) {
+		return manifestBlobs(data, mimeType)
+	}
+	list, err := manifest.ListFromBlob(data, mimeType)
+	if err != nil {
+		return nil, fmt.Errorf("parsing manifest list: %w", err)
+	}
+	var blobs []types.BlobInfo
+	for _, instance := range list.Instances() {
+		data, err := os.ReadFile(filepath.Join(dir, instance.Encoded()+".manifest.json"))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading manifest: %w", err)
+		}
+		instanceBlobs, err := manifestBlobs(data, manifest.GuessMIMEType(data))
+		if err != nil {
+			return nil, err
+		}
+		blobs = append(blobs, instanceBlobs...)
+	}
+	return blobs, nil
+}
+
+func manifestBlobs(data []byte, mimeType string) ([]types.BlobInfo, error) {
+	m, err := manifest.FromBlob(data, mimeType)
+	if err != nil {
+		return nil, fmt.Errorf("parsing manifest: %w", err)
+	}
+	blobs := []types.BlobInfo{m.ConfigInfo()}
+	for _, layer := range m.LayerInfos() {
+		blobs = append(blobs, layer.BlobInfo)
+	}
+	return blobs, nil
+}
+
+// missingBlobs returns the blobs of the dir: image in dir which aren't
+// stored in it, an incremental bundle leaves out the blobs of the inventory.
+func missingBlobs(dir string) ([]types.BlobInfo, error) {
+	blobs, err := dirImageBlobs(dir)
+	if err != nil {
+		return nil, err
+	}
+	var missing []types.BlobInfo
+	for _, blob := range blobs {
+		if blob.Digest == "" {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(dir, blob.Digest.Encoded())); errors.Is(err, os.ErrNotExist) {
+			missing = append(missing, blob)
+		}
+	}
+	return missing, nil
+}
+
+// checkDestinationBlobs verifies that every destination of job already has
+// the blobs left out of its image, so an incremental bundle fails before
+// anything is copied if a previous bundle wasn't imported.
+func checkDestinationBlobs(ctx context.Context, options Options, job syncJob, blobs []types.BlobInfo) error {
+	dests, err := detectDestinations(job.Destination, job.DestType)
+	if err != nil {
+		return err
+	}
+	sys := newSystemContext(options, "dest", job.DestStrictTLS, job.DestPlainHTTP)
+	for _, d := range dests {
+		ref, err := d.reference()
+		if err != nil {
+			return err
+		}
+		dest, err := ref.NewImageDestination(ctx, sys)
+		if err != nil {
+			return fmt.Errorf("opening %s: %w", refName(ref), err)
+		}
+		var absent []string
+		for _, blob := range blobs {
+			reused, _, err := dest.TryReusingBlob(ctx, blob, none.NoCache, false)
+			if err != nil {
+				_ = dest.Close()
+				return fmt.Errorf("checking blob %s in %s: %w", blob.Digest, refName(ref), err)
+			}
+			if !reused {
+				absent = append(absent, blob.Digest.String())
+			}
+		}
+		_ = dest.Close()
+		if len(absent) > 0 {
+			return fmt.Errorf("%s lacks %s which the incremental bundle left out, import the previous bundles first", refName(ref), strings.Join(absent, ", "))
+		}
+	}
+	return nil
+}
+
+// wrap leaves the blobs the inventory has in the repository of ref out of
+// the export. Refs outside the bundle are returned unchanged.
+func (b *bundleExport) wrap(ref types.ImageReference) types.ImageReference {
+	if b == nil || b.known == nil {
+		return ref
+	}
+	rel, err := filepath.Rel(filepath.Join(b.dir, bundleRepositories), ref.StringWithinTransport())
+	if err != nil || !filepath.IsLocal(rel) {
+		return ref
+	}
+	blobs := b.known[filepath.ToSlash(filepath.Dir(rel))]
+	if len(blobs) == 0 {
+		return ref
+	}
+	return &incrementalReference{ImageReference: ref, blobs: blobs}
+}
+
+// incrementalReference behaves like its reference except that its image
+// destination reports the blobs of the inventory as present, they are
+// neither read from the source nor written.
+type incrementalReference struct {
+	types.ImageReference
+	blobs map[digest.Digest]bool
+}
+
+func (r *incrementalReference) NewImageDestination(ctx context.Context, sys *types.SystemContext) (types.ImageDestination, error) {
+	dest, err := r.ImageReference.NewImageDestination(ctx, sys)
+	if err != nil {
+		return nil, err
+	}
+	return &incrementalDestination{ImageDestination: dest, ref: r}, nil
+}
+
+type incrementalDestination struct {
+	types.ImageDestination
+	ref *incrementalReference
+}
+
+func (d *incrementalDestination) Reference() types.ImageReference {
+	return d.ref
+}
+
+// TryReusingBlob keeps the size of info, so the manifests and their digests
+// stay unchanged.
+func (d *incrementalDestination) TryReusingBlob(ctx context.Context, info types.BlobInfo, cache types.BlobInfoCache, canSubstitute bool) (bool, types.BlobInfo, error) {
+	if d.ref.blobs[info.Digest] {
+		return true, info, nil
+	}
+	return d.ImageDestination.TryReusingBlob(ctx, info, cache, canSubstitute)
+}
@@ -0,0 +1,176 @@
+package imagesync
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	kubernetesAuthFilePrefix = "k8s://"
+	serviceAccountDir        = "/var/run/secrets/kubernetes.io/serviceaccount"
+	dockerConfigJSONType     = "kubernetes.io/dockerconfigjson"
+)
+
+// kubernetesAuthFiles replaces the k8s://<namespace>/<secret> auth files of
+// opts by files with the .dockerconfigjson of the secrets. The secrets are
+// read with the service account of the pod. The returned function removes
+// the files.
+func kubernetesAuthFiles(ctx context.Context, opts *Options) (func(), error) {
+	var dir string
+	cleanup := func() {
+		if dir != "" {
+			_ = os.RemoveAll(dir)
+		}
+	}
+	for _, f := range []struct {
+		flag string
+		path *string
+	}{{"--authfile", &opts.AuthFile}, {"--src-authfile", &opts.SrcAuthFile}, {"--dest-authfile", &opts.DestAuthFile}} {
+		secret, ok := strings.CutPrefix(*f.path, kubernetesAuthFilePrefix)
+		if !ok {
+			continue
+		}
+		namespace, name, ok := strings.Cut(secret, "/")
+		if !ok || namespace == "" || name == "" || strings.Contains(name, "/") {
+			cleanup()
+			return nil, fmt.Errorf("%s: expected k8s://<namespace>/<secret>, got %s", f.flag, *f.path)
+		}
+		config, err := readDockerConfigSecret(ctx, namespace, name)
+		if err != nil {
+			cleanup()
+			return nil, fmt.Errorf("%s: %w", f.flag, err)
+		}
+		if dir == "" {
+			if dir, err = os.MkdirTemp("", "imagesync-auth-"); err != nil {
+				return nil, err
+			}
+		}
+		path := filepath.Join(dir, strings.TrimPrefix(f.flag, "--")+".json")
+		if err = os.WriteFile(path, config, 0o600); err != nil {
+			cleanup()
+			return nil, err
+		}
+		*f.path = path
+	}
+	return cleanup, nil
+}
+
+// readDockerConfigSecret returns the .dockerconfigjson of a secret of type
+// kubernetes.io/dockerconfigjson.
+func readDockerConfigSecret(ctx context.Context, namespace, name string) ([]byte, error) {
+	client, err := newKubernetesClient()
+	if err != nil {
+		return nil, fmt.Errorf("k8s:// auth files: %w", err)
+	}
+	var secret struct {
+		Type string `json:"type"`
+		// the values are base64, which json decodes into []byte
+		Data map[string][]byte `json:"data"`
+	}
+	path := "/api/v1/namespaces/" + url.PathEscape(namespace) + "/secrets/" + url.PathEscape(name)
+	if err = client.do(ctx, http.MethodGet, path, "", nil, &secret); err != nil {
+		return nil, fmt.Errorf("reading secret %s/%s: %w", namespace, name, err)
+	}
+	if secret.Type != dockerConfigJSONType {
+		return nil, fmt.Errorf("secret %s/%s has type %s, expected %s", namespace, name, secret.Type, dockerConfigJSONType)
+	}
+	config, ok := secret.Data[".dockerconfigjson"]
+	if !ok {
+		return nil, fmt.Errorf("secret %s/%s has no .dockerconfigjson", namespace, name)
+	}
+	return config, nil
+}
+
+// kubernetesClient calls the API server of the cluster with the service
+// account of the pod.
+type kubernetesClient struct {
+	server string
+	client *http.Client
+}
+
+// newKubernetesClient returns the client of the cluster the pod runs in.
+func newKubernetesClient() (*kubernetesClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in a Kubernetes pod")
+	}
+	ca, err := os.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, fmt.Errorf("reading service account CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("service account CA has no certificates")
+	}
+	return &kubernetesClient{
+		server: "https://" + net.JoinHostPort(host, port),
+		client: &http.Client{
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}},
+			Timeout:   30 * time.Second,
+		},
+	}, nil
+}
+
+// do sends body with contentType to path and decodes the response into out
+// unless it is nil. A failed request returns a *kubernetesError.
+func (k *kubernetesClient) do(ctx context.Context, method, path, contentType string, body, out any) error {
+	// the kubelet rotates the token, it is read for every request
+	token, err := os.ReadFile(filepath.Join(serviceAccountDir, "token"))
+	if err != nil {
+		return fmt.Errorf("reading service account token: %w", err)
+	}
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, k.server+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Accept", "application/json")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &kubernetesError{status: resp.StatusCode, msg: resp.Status + ": " + strings.TrimSpace(string(body))}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// kubernetesError is a request the API server answered with an error
+// status.
+type kubernetesError struct {
+	status int
+	msg    string
+}
+
+func (e *kubernetesError) Error() string {
+	return e.msg
+}
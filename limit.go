@@ -0,0 +1,301 @@
+package imagesync
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+)
+
+// connLimits holds the per-registry request limiters of both copy sides,
+// a nil limiter doesn't limit anything.
+type connLimits struct {
+	src  *connLimiter
+	dest *connLimiter
+}
+
+func newConnLimits(maxPerRegistry int) connLimits {
+	return connLimits{
+		src:  newConnLimiter("source connection", maxPerRegistry),
+		dest: newConnLimiter("destination connection", maxPerRegistry),
+	}
+}
+
+// connLimiter bounds the number of concurrent registry requests per registry,
+// regardless of how many tags and blobs are copied in parallel.
+type connLimiter struct {
+	side string
+	max  int
+	// overrides are the limits of single registries, a limit of zero
+	// doesn't limit the registry.
+	overrides map[string]int
+
+	mu   sync.Mutex
+	sems map[string]chan struct{}
+}
+
+func newConnLimiter(side string, max int) *connLimiter {
+	if max <= 0 {
+		return nil
+	}
+	return &connLimiter{side: side, max: max, sems: map[string]chan struct{}{}}
+}
+
+func (l *connLimiter) acquire(ctx context.Context, registry string) (func(), error) {
+	size, ok := l.overrides[registry]
+	if !ok {
+		size = l.max
+	}
+	if size <= 0 {
+		return func() {}, nil
+	}
+	l.mu.Lock()
+	sem, ok := l.sems[registry]
+	if !ok {
+		sem = make(chan struct{}, size)
+		l.sems[registry] = sem
+	}
+	l.mu.Unlock()
+
+	start := time.Now()
+	select {
+	case sem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if waited := time.Since(start); waited > time.Millisecond {
+		logrus.Debugf("waited %s for a %s slot of %s", waited, l.side, registry)
+	}
+
+	var once sync.Once
+	return func() { once.Do(func() { <-sem }) }, nil
+}
+
+// acquireFor takes a slot of the registry of ref for a request outside the
+// sources and destinations of wrap. A nil limiter and refs which aren't
+// registry references don't wait.
+func (l *connLimiter) acquireFor(ctx context.Context, ref types.ImageReference) (func(), error) {
+	if l == nil || ref.Transport().Name() != docker.Transport.Name() {
+		return func() {}, nil
+	}
+	return l.acquire(ctx, reference.Domain(ref.DockerReference()))
+}
+
+// wrap returns ref with its image sources and destinations limited by l.
+// Only registry references are limited.
+func (l *connLimiter) wrap(ref types.ImageReference) types.ImageReference {
+	if l == nil || ref.Transport().Name() != docker.Transport.Name() {
+		return ref
+	}
+	return &limitedReference{ImageReference: ref, limiter: l, registry: reference.Domain(ref.DockerReference())}
+}
+
+type limitedReference struct {
+	types.ImageReference
+	limiter  *connLimiter
+	registry string
+}
+
+func (r *limitedReference) NewImageSource(ctx context.Context, sys *types.SystemContext) (types.ImageSource, error) {
+	release, err := r.limiter.acquire(ctx, r.registry)
+	if err != nil {
+		return nil, err
+	}
+	src, err := r.ImageReference.NewImageSource(ctx, sys)
+	release()
+	if err != nil {
+		return nil, err
+	}
+	return &limitedSource{ImageSource: src, ref: r}, nil
+}
+
+func (r *limitedReference) NewImageDestination(ctx context.Context, sys *types.SystemContext) (types.ImageDestination, error) {
+	release, err := r.limiter.acquire(ctx, r.registry)
+	if err != nil {
+		return nil, err
+	}
+	dest, err := r.ImageReference.NewImageDestination(ctx, sys)
+	release()
+	if err != nil {
+		return nil, err
+	}
+	return &limitedDestination{ImageDestination: dest, ref: r}, nil
+}
+
+type limitedSource struct {
+	types.ImageSource
+	ref *limitedReference
+}
+
+func (s *limitedSource) Reference() types.ImageReference {
+	return s.ref
+}
+
+func (s *limitedSource) GetManifest(ctx context.Context, instanceDigest *digest.Digest) ([]byte, string, error) {
+	release, err := s.ref.limiter.acquire(ctx, s.ref.registry)
+	if err != nil {
+		return nil, "", err
+	}
+	defer release()
+	return s.ImageSource.GetManifest(ctx, instanceDigest)
+}
+
+// GetBlob holds its connection slot until the returned stream is closed.
+func (s *limitedSource) GetBlob(ctx context.Context, info types.BlobInfo, cache types.BlobInfoCache) (io.ReadCloser, int64, error) {
+	release, err := s.ref.limiter.acquire(ctx, s.ref.registry)
+	if err != nil {
+		return nil, 0, err
+	}
+	rc, size, err := s.ImageSource.GetBlob(ctx, info, cache)
+	if err != nil {
+		release()
+		return nil, 0, err
+	}
+	return &releasingReadCloser{ReadCloser: rc, release: release}, size, nil
+}
+
+func (s *limitedSource) GetSignatures(ctx context.Context, instanceDigest *digest.Digest) ([][]byte, error) {
+	release, err := s.ref.limiter.acquire(ctx, s.ref.registry)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return s.ImageSource.GetSignatures(ctx, instanceDigest)
+}
+
+type limitedDestination struct {
+	types.ImageDestination
+	ref *limitedReference
+}
+
+func (d *limitedDestination) Reference() types.ImageReference {
+	return d.ref
+}
+
+func (d *limitedDestination) PutBlob(ctx context.Context, stream io.Reader, inputInfo types.BlobInfo, cache types.BlobInfoCache, isConfig bool) (types.BlobInfo, error) {
+	release, err := d.ref.limiter.acquire(ctx, d.ref.registry)
+	if err != nil {
+		return types.BlobInfo{}, err
+	}
+	defer release()
+	return d.ImageDestination.PutBlob(ctx, stream, inputInfo, cache, isConfig)
+}
+
+func (d *limitedDestination) TryReusingBlob(ctx context.Context, info types.BlobInfo, cache types.BlobInfoCache, canSubstitute bool) (bool, types.BlobInfo, error) {
+	release, err := d.ref.limiter.acquire(ctx, d.ref.registry)
+	if err != nil {
+		return false, types.BlobInfo{}, err
+	}
+	defer release()
+	return d.ImageDestination.TryReusingBlob(ctx, info, cache, canSubstitute)
+}
+
+func (d *limitedDestination) PutManifest(ctx context.Context, manifest []byte, instanceDigest *digest.Digest) error {
+	release, err := d.ref.limiter.acquire(ctx, d.ref.registry)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return d.ImageDestination.PutManifest(ctx, manifest, instanceDigest)
+}
+
+func (d *limitedDestination) PutSignatures(ctx context.Context, signatures [][]byte, instanceDigest *digest.Digest) error {
+	release, err := d.ref.limiter.acquire(ctx, d.ref.registry)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return d.ImageDestination.PutSignatures(ctx, signatures, instanceDigest)
+}
+
+// tagSlots bounds the tags copied at once by concurrent jobs, in total by
+// --max-concurrent-tags (times --max-concurrent-repos for repositories) and
+// per source registry by
+// --max-concurrent-per-registry. A nil tagSlots doesn't limit anything.
+type tagSlots struct {
+	// total is nil if the jobs run one after another, each job bounds its
+	// own tags then.
+	total      chan struct{}
+	registries *connLimiter
+}
+
+// newTagSlots parses --max-concurrent-per-registry, every value is either
+// the limit of every registry or registry=limit.
+func newTagSlots(opts Options, concurrentJobs bool) (*tagSlots, error) {
+	registries := &connLimiter{side: "tag", overrides: map[string]int{}, sems: map[string]chan struct{}{}}
+	for _, value := range opts.MaxConcurrentPerRegistry {
+		registry, limit, found := strings.Cut(value, "=")
+		if !found {
+			registry, limit = "", value
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(limit))
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid --max-concurrent-per-registry %q, expected a limit or registry=limit", value)
+		}
+		if registry = strings.TrimSpace(registry); registry == "" {
+			registries.max = n
+		} else {
+			registries.overrides[registry] = n
+		}
+	}
+	slots := &tagSlots{}
+	if len(opts.MaxConcurrentPerRegistry) > 0 {
+		slots.registries = registries
+	}
+	switch {
+	case concurrentJobs:
+		slots.total = make(chan struct{}, opts.MaxConcurrentTags)
+	case opts.MaxConcurrentRepos > 1:
+		// repositories synced in parallel share the budget of their tags,
+		// a repository with more tags in parallel can't take all of it
+		slots.total = make(chan struct{}, opts.MaxConcurrentTags*opts.MaxConcurrentRepos)
+	}
+	if slots.total == nil && slots.registries == nil {
+		return nil, nil
+	}
+	return slots, nil
+}
+
+// acquire waits for a slot of the registry of srcRef and then for one of
+// the total, the returned function releases both.
+func (s *tagSlots) acquire(ctx context.Context, srcRef types.ImageReference) (func(), error) {
+	if s == nil {
+		return func() {}, nil
+	}
+	release := func() {}
+	if s.registries != nil && srcRef.Transport().Name() == docker.Transport.Name() {
+		var err error
+		if release, err = s.registries.acquire(ctx, reference.Domain(srcRef.DockerReference())); err != nil {
+			return nil, err
+		}
+	}
+	if s.total == nil {
+		return release, nil
+	}
+	select {
+	case s.total <- struct{}{}:
+	case <-ctx.Done():
+		release()
+		return nil, ctx.Err()
+	}
+	return func() { <-s.total; release() }, nil
+}
+
+type releasingReadCloser struct {
+	io.ReadCloser
+	release func()
+}
+
+func (r *releasingReadCloser) Close() error {
+	defer r.release()
+	return r.ReadCloser.Close()
+}
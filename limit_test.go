@@ -0,0 +1,182 @@
+package imagesync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/types"
+)
+
+// inFlight counts the concurrent manifest and blob requests of a registry
+// and records their peak.
+type inFlight struct {
+	mu      sync.Mutex
+	current int
+	peak    int
+}
+
+func (f *inFlight) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.URL.Path, "/manifests/") && !strings.Contains(r.URL.Path, "/blobs/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		f.mu.Lock()
+		f.current++
+		f.peak = max(f.peak, f.current)
+		f.mu.Unlock()
+		defer func() {
+			f.mu.Lock()
+			f.current--
+			f.mu.Unlock()
+		}()
+		// requests overlap if they aren't limited
+		time.Sleep(5 * time.Millisecond)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (f *inFlight) reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.peak = 0
+}
+
+func (f *inFlight) max() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.peak
+}
+
+func TestMaxConnectionsPerRegistry(t *testing.T) {
+	for _, limit := range []int{0, 2} {
+		t.Run(fmt.Sprintf("limit %d", limit), func(t *testing.T) {
+			var srcRequests, destRequests inFlight
+			src := newTestRegistry(t, srcRequests.wrap)
+			dest := newTestRegistry(t, destRequests.wrap)
+			for i := range 8 {
+				pushTestImage(t, src, "app", fmt.Sprintf("%d", i), 3)
+			}
+			// the pushes aren't counted
+			srcRequests.reset()
+
+			opts := testOptions(src+"/app", dest+"/app")
+			opts.MaxConcurrentTags = 8
+			opts.MaxConnectionsPerRegistry = limit
+			if _, err := (&Syncer{}).Sync(context.Background(), opts); err != nil {
+				t.Fatal(err)
+			}
+			for side, peak := range map[string]int{"source": srcRequests.max(), "destination": destRequests.max()} {
+				switch {
+				case limit > 0 && peak > limit:
+					t.Errorf("%d concurrent requests to the %s registry, want at most %d", peak, side, limit)
+				case limit == 0 && peak <= 2:
+					// without limit the test has to reach the limit
+					t.Errorf("%d concurrent requests to the %s registry without limit, want more than 2", peak, side)
+				}
+			}
+		})
+	}
+}
+
+// peakHolders acquires a slot of srcRef from n goroutines, holding each
+// for a moment, and returns the peak number of holders.
+func peakHolders(t *testing.T, slots *tagSlots, srcRef types.ImageReference, n int) int {
+	t.Helper()
+	var (
+		wg            sync.WaitGroup
+		mu            sync.Mutex
+		current, peak int
+	)
+	for range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release, err := slots.acquire(context.Background(), srcRef)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer release()
+			mu.Lock()
+			current++
+			peak = max(peak, current)
+			mu.Unlock()
+			time.Sleep(5 * time.Millisecond)
+			mu.Lock()
+			current--
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return peak
+}
+
+func TestTagSlots(t *testing.T) {
+	ref := func(name string) types.ImageReference {
+		r, err := docker.ParseReference("//" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	for _, tt := range []struct {
+		name   string
+		opts   Options
+		concur bool
+		srcRef string
+		want   int
+	}{
+		{"all registries", Options{MaxConcurrentPerRegistry: []string{"2"}, MaxConcurrentTags: 8}, false, "docker.io/library/alpine:3", 2},
+		{"override", Options{MaxConcurrentPerRegistry: []string{"4", "ghcr.io=1"}, MaxConcurrentTags: 8}, false, "ghcr.io/org/app:1", 1},
+		{"other registry", Options{MaxConcurrentPerRegistry: []string{"ghcr.io=1"}, MaxConcurrentTags: 8}, false, "quay.io/org/app:1", 8},
+		{"concurrent jobs share the total", Options{MaxConcurrentTags: 3}, true, "quay.io/org/app:1", 3},
+		{"repositories in parallel", Options{MaxConcurrentTags: 2, MaxConcurrentRepos: 2}, false, "quay.io/org/app:1", 4},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			slots, err := newTagSlots(tt.opts, tt.concur)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := peakHolders(t, slots, ref(tt.srcRef), 8); got != tt.want {
+				t.Errorf("%d tags held slots at once, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTagSlotsCanceled(t *testing.T) {
+	slots, err := newTagSlots(Options{MaxConcurrentPerRegistry: []string{"1"}}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srcRef, err := docker.ParseReference("//ghcr.io/org/app:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release, err := slots.acquire(context.Background(), srcRef)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err = slots.acquire(ctx, srcRef); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("acquire() of a full registry = %v, want the context error", err)
+	}
+}
+
+func TestInvalidMaxConcurrentPerRegistry(t *testing.T) {
+	for _, value := range []string{"0", "ghcr.io=", "ghcr.io=x", "-1"} {
+		if _, err := newTagSlots(Options{MaxConcurrentPerRegistry: []string{value}}, false); err == nil {
+			t.Errorf("newTagSlots(%q) = nil error, want one", value)
+		}
+	}
+}
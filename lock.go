@@ -0,0 +1,93 @@
+package imagesync
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+// ErrLocked is returned when the --lock-file is held by another run.
+var ErrLocked = errors.New("another run holds the lock")
+
+// lockPollInterval is how often --wait-for-lock tries to take the lock.
+const lockPollInterval = time.Second
+
+// acquireLock takes the --lock-file of the command line, the returned
+// function releases it. The kernel releases the lock of a run which died,
+// so a stale file doesn't block the next run.
+func acquireLock(c *cli.Context) (func(), error) {
+	path := c.String("lock-file")
+	if path == "" {
+		return func() {}, nil
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("opening lock file: %w", err)
+	}
+	var deadline time.Time
+	if timeout := c.Duration("lock-timeout"); timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	for logged := false; ; logged = true {
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, syscall.EWOULDBLOCK) {
+			f.Close()
+			return nil, fmt.Errorf("locking %s: %w", path, err)
+		}
+		holder := lockHolder(f)
+		if !c.Bool("wait-for-lock") || (!deadline.IsZero() && time.Now().After(deadline)) {
+			f.Close()
+			return nil, fmt.Errorf("%w %s: %s", ErrLocked, path, holder)
+		}
+		if !logged {
+			logrus.Infof("Waiting for %s, held by %s", path, holder)
+		}
+		time.Sleep(lockPollInterval)
+	}
+
+	// the holder is only informational, the lock is the flock
+	holder := strconv.Itoa(os.Getpid()) + " " + describeRun(c) + "\n"
+	if err = f.Truncate(0); err == nil {
+		_, err = f.WriteAt([]byte(holder), 0)
+	}
+	if err != nil {
+		logrus.Warnf("failed writing lock file: %s", err)
+	}
+	return func() {
+		_ = f.Truncate(0)
+		_ = syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+// lockHolder describes the run holding the lock of f.
+func lockHolder(f *os.File) string {
+	data := make([]byte, 1024)
+	n, _ := f.ReadAt(data, 0)
+	pid, run, _ := strings.Cut(strings.TrimSpace(string(data[:n])), " ")
+	if pid == "" {
+		return "an unknown process"
+	}
+	return fmt.Sprintf("process %s (%s)", pid, run)
+}
+
+// describeRun returns the source and destination of the command line.
+func describeRun(c *cli.Context) string {
+	if config := c.String("config"); config != "" {
+		return "config " + config
+	}
+	if images := c.String("images-file"); images != "" {
+		return "images file " + images
+	}
+	return strings.Join(c.StringSlice("src"), ", ") + " to " + strings.Join(c.StringSlice("dest"), ", ")
+}
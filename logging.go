@@ -0,0 +1,68 @@
+package imagesync
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+// setupLogging configures the standard logger from --log-level and
+// --log-format.
+func setupLogging(c *cli.Context) error {
+	level, err := logrus.ParseLevel(c.String("log-level"))
+	if err != nil {
+		return fmt.Errorf("invalid --log-level: %w", err)
+	}
+	logrus.SetLevel(level)
+
+	switch format := c.String("log-format"); format {
+	case "text":
+		logrus.SetFormatter(&logrus.TextFormatter{})
+	case "json":
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	default:
+		return fmt.Errorf("unsupported log format %q", format)
+	}
+	return nil
+}
+
+// jsonLogs reports whether every log line has to be a JSON object, so
+// summary tables are logged as single entries instead.
+func jsonLogs() bool {
+	_, ok := logrus.StandardLogger().Formatter.(*logrus.JSONFormatter)
+	return ok
+}
+
+// tagFields returns the log fields of a tag outcome.
+func tagFields(tag TagResult) logrus.Fields {
+	fields := logrus.Fields{"destination": tag.Destination, "status": tag.Status}
+	if tag.Source != "" {
+		fields["source"] = tag.Source
+	}
+	if tag.Digest != "" {
+		fields["digest"] = tag.Digest
+	}
+	if tag.Bytes > 0 {
+		fields["bytes"] = tag.Bytes
+	}
+	if tag.DurationSeconds > 0 {
+		fields["durationSeconds"] = tag.DurationSeconds
+	}
+	if tag.Error != "" {
+		fields["error"] = tag.Error
+	}
+	if tag.Reason != "" {
+		fields["reason"] = tag.Reason
+	}
+	return fields
+}
+
+// logTags logs every tag of result with status as an entry of its own.
+func logTags(result *Result, status TagStatus, msg string) {
+	for _, tag := range result.Tags {
+		if tag.Status == status {
+			logrus.WithFields(tagFields(tag)).Error(msg)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package imagesync
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// manifestImage is an image found in the manifests and the file naming it
+// first.
+type manifestImage struct {
+	ref  string
+	path string
+}
+
+// manifestJobs returns a single image job for every image referenced by the
+// Kubernetes manifests, kustomizations and Helm charts of the from-manifests
+// paths, copied to its repository path below each --dest like the images
+// of an images file.
+func manifestJobs(options Options, defaults syncJob) ([]syncJob, error) {
+	if options.Source != "" || options.Config != "" || options.SkopeoSyncConfig != "" || options.ImagesFile != "" {
+		return nil, errors.New("from-manifests can't be used together with --src, --config, --skopeo-sync-config or --images-file")
+	}
+	if options.Destination == "" && options.ExportBundle == "" && len(defaults.RepoRewrite) == 0 {
+		return nil, errors.New("--dest or --repo-rewrite is required with from-manifests")
+	}
+	images, err := scanManifests(options.Manifests)
+	if err != nil {
+		return nil, err
+	}
+	if len(images) == 0 {
+		return nil, fmt.Errorf("no images found in %s", strings.Join(options.Manifests, ", "))
+	}
+
+	base := singleImageDefaults(defaults)
+	jobs := make([]syncJob, 0, len(images))
+	dests := map[string]manifestImage{}
+	for _, image := range images {
+		job, err := singleImageJob(options, base, image.ref, "")
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", image.path, err)
+		}
+		if other, ok := dests[job.Destination]; ok {
+			return nil, fmt.Errorf("%s of %s and %s of %s are both copied to %s", other.ref, other.path, image.ref, image.path, job.Destination)
+		}
+		dests[job.Destination] = image
+		jobs = append(jobs, job)
+	}
+	logrus.Infof("Found %d images in the manifests", len(jobs))
+	return jobs, nil
+}
+
+// scanManifests returns the images of the YAML files below paths, - reads
+// stdin, e.g. the output of helm template. Images without tag are the
+// latest tag like for Kubernetes. Images replaced by the images of a
+// kustomization are left out.
+func scanManifests(paths []string) ([]manifestImage, error) {
+	var (
+		images []manifestImage
+		seen   = map[string]bool{}
+		// replaced are the names of the images replaced by kustomizations,
+		// overrides the images replacing them
+		replaced  = map[string]bool{}
+		overrides = map[string]bool{}
+	)
+	add := func(path, ref string, override bool) {
+		named, err := reference.ParseNormalizedNamed(ref)
+		if err != nil {
+			logrus.Warnf("%s: ignoring image %q: %s", path, ref, err)
+			return
+		}
+		ref = reference.TagNameOnly(named).String()
+		overrides[ref] = overrides[ref] || override
+		if !seen[ref] {
+			seen[ref] = true
+			images = append(images, manifestImage{ref: ref, path: path})
+		}
+	}
+	read := func(path string, r io.Reader) error {
+		kustomization := strings.HasPrefix(filepath.Base(path), "kustomization.")
+		dec := yaml.NewDecoder(r)
+		for {
+			var doc yaml.Node
+			err := dec.Decode(&doc)
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			if err != nil {
+				// Helm templates and other files which aren't YAML
+				logrus.Warnf("skipping %s: %s", path, err)
+				return nil
+			}
+			if len(doc.Content) == 0 {
+				continue
+			}
+			if kustomization || mappingValue(doc.Content[0], "kind") == "Kustomization" {
+				for _, image := range kustomizeImages(doc.Content[0]) {
+					replaced[image.name] = true
+					add(path, image.ref, true)
+				}
+				continue
+			}
+			findImages(doc.Content[0], func(ref string) { add(path, ref, false) })
+		}
+	}
+
+	for _, root := range paths {
+		if root == "-" {
+			if err := read("stdin", os.Stdin); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				if path != root && strings.HasPrefix(d.Name(), ".") {
+					return filepath.SkipDir
+				}
+				// the templates of a chart are read from its values
+				if _, err := os.Stat(filepath.Join(filepath.Dir(path), "Chart.yaml")); err == nil && d.Name() == "templates" {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if ext := filepath.Ext(path); ext != ".yaml" && ext != ".yml" && path != root {
+				return nil
+			}
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			return read(path, f)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("reading manifests: %w", err)
+		}
+	}
+
+	if len(replaced) == 0 {
+		return images, nil
+	}
+	kept := images[:0]
+	for _, image := range images {
+		named, _ := reference.ParseNormalizedNamed(image.ref)
+		if overrides[image.ref] || (!replaced[reference.FamiliarName(named)] && !replaced[named.Name()]) {
+			kept = append(kept, image)
+		}
+	}
+	return kept, nil
+}
+
+// findImages calls found with the image keys below node, the strings of
+// manifests and the repository, tag and digest maps of Helm values.
+func findImages(node *yaml.Node, found func(string)) {
+	switch node.Kind {
+	case yaml.SequenceNode:
+		for _, child := range node.Content {
+			findImages(child, found)
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			if key.Value != "image" {
+				findImages(value, found)
+				continue
+			}
+			switch value.Kind {
+			case yaml.ScalarNode:
+				if value.Value != "" {
+					found(value.Value)
+				}
+			case yaml.MappingNode:
+				if ref := helmImage(value); ref != "" {
+					found(ref)
+				} else {
+					findImages(value, found)
+				}
+			}
+		}
+	}
+}
+
+// helmImage returns the image of the image map of Helm values, e.g.
+// {registry: docker.io, repository: bitnami/redis, tag: 7.4}. Empty if the
+// map has no repository.
+func helmImage(node *yaml.Node) string {
+	ref := mappingValue(node, "repository")
+	if ref == "" {
+		return ""
+	}
+	if registry := mappingValue(node, "registry"); registry != "" {
+		ref = registry + "/" + ref
+	}
+	if tag := mappingValue(node, "tag"); tag != "" {
+		ref += ":" + tag
+	}
+	if dgst := mappingValue(node, "digest"); dgst != "" {
+		ref += "@" + dgst
+	}
+	return ref
+}
+
+// kustomizeImage is an entry of the images of a kustomization, it replaces
+// the images called name by ref.
+type kustomizeImage struct {
+	name, ref string
+}
+
+// kustomizeImages returns the images of a kustomization. Entries only
+// renaming an image without tag or digest are the latest tag.
+func kustomizeImages(node *yaml.Node) []kustomizeImage {
+	var images []kustomizeImage
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value != "images" || node.Content[i+1].Kind != yaml.SequenceNode {
+			continue
+		}
+		for _, entry := range node.Content[i+1].Content {
+			name := mappingValue(entry, "name")
+			if name == "" {
+				continue
+			}
+			ref := name
+			if newName := mappingValue(entry, "newName"); newName != "" {
+				ref = newName
+			}
+			if tag := mappingValue(entry, "newTag"); tag != "" {
+				ref += ":" + tag
+			}
+			if dgst := mappingValue(entry, "digest"); dgst != "" {
+				ref += "@" + dgst
+			}
+			images = append(images, kustomizeImage{name: name, ref: ref})
+		}
+	}
+	return images
+}
+
+// mappingValue returns the scalar value of key in the mapping node, empty
+// if there is none.
+func mappingValue(node *yaml.Node, key string) string {
+	if node.Kind != yaml.MappingNode {
+		return ""
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key && node.Content[i+1].Kind == yaml.ScalarNode {
+			return node.Content[i+1].Value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,194 @@
+package imagesync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/image"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/types"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+// mergeSource is a single-platform source image of the merge command, the
+// descriptor is its entry in the merged index.
+type mergeSource struct {
+	ref        types.ImageReference
+	descriptor imgspecv1.Descriptor
+}
+
+func (s mergeSource) platform() string {
+	return formatPlatform(s.descriptor.Platform.OS, s.descriptor.Platform.Architecture, s.descriptor.Platform.Variant)
+}
+
+// mergeImages is the action of the merge command. The single-platform
+// source images are copied unchanged to the repository of the tagged --dest
+// registry image, which is then pointed at an OCI image index of them.
+// Images and an index the destination already has aren't pushed again.
+func mergeImages(c *cli.Context) error {
+	if err := setupLogging(c); err != nil {
+		return err
+	}
+	if c.NArg() < 2 {
+		return errors.New("merge needs at least two source images")
+	}
+	opts := optionsFromFlags(c).withDefaults()
+	opts.Source = c.Args().First()
+	dest, err := detectDestination(opts.Destination, opts.DestType)
+	if err != nil {
+		return err
+	}
+	if dest.kind != destinationRegistry || !hasTag(dest.value) {
+		return fmt.Errorf("%s is not a tagged registry image, e.g. registry.internal/app:1.0", opts.Destination)
+	}
+	destRef, err := dest.reference()
+	if err != nil {
+		return err
+	}
+
+	jobs := make([]syncJob, 1)
+	if jobs[0], err = jobFromOptions(opts); err != nil {
+		return err
+	}
+	if err = (&Syncer{}).setCredentials(c.Context, opts, jobs); err != nil {
+		return err
+	}
+	removeAuthFiles, err := kubernetesAuthFiles(c.Context, &opts)
+	if err != nil {
+		return err
+	}
+	defer removeAuthFiles()
+	run := newSyncRun(opts, jobs[0], &syncState{result: newResult(opts)})
+	// the index refers to the images by their source digests
+	run.opts.PreserveDigests = true
+
+	ctx := c.Context
+	sources := make([]mergeSource, 0, c.NArg())
+	platforms := map[string]string{}
+	for _, value := range c.Args().Slice() {
+		src, err := run.mergeSource(ctx, value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", value, err)
+		}
+		platform := src.platform()
+		if other, ok := platforms[platform]; ok {
+			return fmt.Errorf("%s and %s are both %s images", other, value, platform)
+		}
+		platforms[platform] = value
+		sources = append(sources, src)
+	}
+
+	descriptors := make([]imgspecv1.Descriptor, 0, len(sources))
+	for _, src := range sources {
+		imageRef, err := docker.ParseReference(fmt.Sprintf("//%s@%s", destRef.DockerReference().Name(), src.descriptor.Digest))
+		if err != nil {
+			return fmt.Errorf("parsing dest ref: %w", err)
+		}
+		fields := logrus.Fields{"source": refName(src.ref), "destination": refName(imageRef), "platform": src.platform()}
+		if _, err := referenceDigest(ctx, run.opts.DestinationCtx, imageRef); err == nil && !run.job.Overwrite {
+			logrus.WithFields(fields).Info("Skipping image, the destination has it")
+		} else if run.options.DryRun {
+			logrus.WithFields(fields).Info("Would copy image")
+		} else {
+			if _, err = copyImage(ctx, []types.ImageReference{imageRef}, src.ref, &run.opts, run.limits, run.verification); err != nil {
+				return fmt.Errorf("copying %s: %w", refName(src.ref), err)
+			}
+			logrus.WithFields(fields).Info("Copied image")
+		}
+		descriptors = append(descriptors, src.descriptor)
+	}
+
+	index, err := manifest.OCI1IndexFromComponents(descriptors, nil).Serialize()
+	if err != nil {
+		return fmt.Errorf("creating index: %w", err)
+	}
+	indexDigest, err := manifest.Digest(index)
+	if err != nil {
+		return err
+	}
+	fields := logrus.Fields{"destination": refName(destRef), "digest": indexDigest, "images": len(descriptors)}
+	if current, err := referenceDigest(ctx, run.opts.DestinationCtx, destRef); err == nil && current == indexDigest {
+		logrus.WithFields(fields).Info("The destination has the index already")
+		return nil
+	}
+	if run.options.DryRun {
+		logrus.WithFields(fields).Info("Would push index")
+		return nil
+	}
+	if err = pushManifest(ctx, run.opts.DestinationCtx, destRef, index); err != nil {
+		return fmt.Errorf("pushing index to %s: %w", refName(destRef), err)
+	}
+	logrus.WithFields(fields).Info("Pushed index")
+	return nil
+}
+
+// mergeSource reads the manifest and platform of the registry image value,
+// which has to be a single image.
+func (r *syncRun) mergeSource(ctx context.Context, value string) (mergeSource, error) {
+	src, err := detectSource(value, r.job.SrcFormat, r.options.LegacySourceDetection)
+	if err != nil {
+		return mergeSource{}, err
+	}
+	if src.kind != sourceRegistry || !hasTag(src.value) {
+		return mergeSource{}, errors.New("not a registry image with tag or digest")
+	}
+	if src.value, err = r.resolveShortName(ctx, src.value); err != nil {
+		return mergeSource{}, err
+	}
+	ref, err := docker.ParseReference("//" + src.value)
+	if err != nil {
+		return mergeSource{}, fmt.Errorf("parsing source docker ref: %w", err)
+	}
+	imageSrc, err := ref.NewImageSource(ctx, r.opts.SourceCtx)
+	if err != nil {
+		return mergeSource{}, err
+	}
+	defer imageSrc.Close()
+	manifestBlob, mimeType, err := imageSrc.GetManifest(ctx, nil)
+	if err != nil {
+		return mergeSource{}, fmt.Errorf("reading manifest: %w", err)
+	}
+	if manifest.MIMETypeIsMultiImage(mimeType) {
+		return mergeSource{}, errors.New("is a manifest list, merge takes single-platform images")
+	}
+	dgst, err := manifest.Digest(manifestBlob)
+	if err != nil {
+		return mergeSource{}, err
+	}
+	img, err := image.FromUnparsedImage(ctx, r.opts.SourceCtx, image.UnparsedInstance(imageSrc, nil))
+	if err != nil {
+		return mergeSource{}, err
+	}
+	info, err := img.Inspect(ctx)
+	if err != nil {
+		return mergeSource{}, fmt.Errorf("reading image config: %w", err)
+	}
+	if info.Os == "" || info.Architecture == "" {
+		return mergeSource{}, errors.New("the image config has no platform")
+	}
+	return mergeSource{ref: ref, descriptor: imgspecv1.Descriptor{
+		MediaType: mimeType,
+		Digest:    dgst,
+		Size:      int64(len(manifestBlob)),
+		Platform:  &imgspecv1.Platform{OS: info.Os, Architecture: info.Architecture, Variant: info.Variant},
+	}}, nil
+}
+
+// pushManifest pushes manifestBlob, whose blobs and instances the
+// repository of ref has, as ref.
+func pushManifest(ctx context.Context, sys *types.SystemContext, ref types.ImageReference, manifestBlob []byte) error {
+	dest, err := ref.NewImageDestination(ctx, sys)
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+	if err = dest.PutManifest(ctx, manifestBlob, nil); err != nil {
+		return err
+	}
+	// a registry doesn't read the image of the commit
+	return dest.Commit(ctx, nil)
+}
@@ -0,0 +1,179 @@
+package imagesync
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"strings"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/image"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
+)
+
+// metadataFilter selects tags by the annotations of their manifest and the
+// labels of their image config, the zero value selects all tags. All of the
+// conditions have to match.
+type metadataFilter struct {
+	Annotations []metadataCondition
+	Labels      []metadataCondition
+}
+
+// metadataCondition requires the key to be set, to value unless any.
+type metadataCondition struct {
+	key, value string
+	any        bool
+}
+
+// parseMetadataFilter parses the key=value or key conditions of
+// --filter-annotation and --filter-label.
+func parseMetadataFilter(annotations, labels []string) (metadataFilter, error) {
+	var (
+		f   metadataFilter
+		err error
+	)
+	if f.Annotations, err = parseMetadataConditions("filter-annotation", annotations); err != nil {
+		return metadataFilter{}, err
+	}
+	if f.Labels, err = parseMetadataConditions("filter-label", labels); err != nil {
+		return metadataFilter{}, err
+	}
+	return f, nil
+}
+
+func parseMetadataConditions(name string, values []string) ([]metadataCondition, error) {
+	conditions := make([]metadataCondition, 0, len(values))
+	for _, v := range values {
+		key, value, ok := strings.Cut(v, "=")
+		if key == "" {
+			return nil, fmt.Errorf("invalid --%s %q, expected key=value or key", name, v)
+		}
+		conditions = append(conditions, metadataCondition{key: key, value: value, any: !ok})
+	}
+	return conditions, nil
+}
+
+func (f metadataFilter) enabled() bool {
+	return len(f.Annotations) > 0 || len(f.Labels) > 0
+}
+
+func (f metadataFilter) matches(annotations, labels map[string]string) bool {
+	return conditionsMatch(f.Annotations, annotations) && conditionsMatch(f.Labels, labels)
+}
+
+func conditionsMatch(conditions []metadataCondition, values map[string]string) bool {
+	for _, c := range conditions {
+		if v, ok := values[c.key]; !ok || (!c.any && v != c.value) {
+			return false
+		}
+	}
+	return true
+}
+
+// filterMetadata returns the tags whose annotations and labels match the
+// metadata filter. Tags whose metadata can't be read aren't copied.
+func (r *syncRun) filterMetadata(ctx context.Context, srcRepository types.ImageReference, tags []string) []string {
+	selected := r.selectConcurrently(tags, func(tag string) bool {
+		annotations, labels, err := r.imageMetadata(ctx, srcRepository, tag)
+		if err != nil {
+			logrus.Warnf("skipping tag %s, failed reading its annotations and labels: %s", tag, err)
+			return false
+		}
+		if !r.job.Metadata.matches(annotations, labels) {
+			logrus.Debugf("skipping tag %s, its annotations and labels don't match", tag)
+			return false
+		}
+		return true
+	})
+	logrus.Infof("%d of %d tags match the annotation and label filters", len(selected), len(tags))
+	return selected
+}
+
+// imageMetadata returns the annotations of the manifest of a tag and the
+// labels of its image config. For a manifest list the annotations of the
+// list and of its first instance after --platforms are merged, the labels
+// are those of the first instance. Artifacts have no labels.
+func (r *syncRun) imageMetadata(ctx context.Context, srcRepository types.ImageReference, tag string) (map[string]string, map[string]string, error) {
+	srcRef, err := docker.ParseReference(fmt.Sprintf("//%s:%s", srcRepository.DockerReference().Name(), tag))
+	if err != nil {
+		return nil, nil, err
+	}
+	src, err := r.job.Platforms.wrap(srcRef).NewImageSource(ctx, r.opts.SourceCtx)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer src.Close()
+
+	data, mimeType, err := src.GetManifest(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	annotations := manifestAnnotations(data, mimeType)
+	var instance *digest.Digest
+	if manifest.MIMETypeIsMultiImage(mimeType) {
+		list, err := manifest.ListFromBlob(data, mimeType)
+		if err != nil {
+			return nil, nil, err
+		}
+		instances := list.Instances()
+		if len(instances) == 0 {
+			return annotations, nil, nil
+		}
+		instance = &instances[0]
+	}
+	if len(r.job.Metadata.Labels) == 0 && instance == nil {
+		return annotations, nil, nil
+	}
+
+	img, err := image.FromUnparsedImage(ctx, r.opts.SourceCtx, image.UnparsedInstance(src, instance))
+	if err != nil {
+		return nil, nil, err
+	}
+	if instance != nil {
+		if data, mimeType, err = img.Manifest(ctx); err == nil {
+			annotations = mergeAnnotations(annotations, manifestAnnotations(data, mimeType))
+		}
+	}
+	if len(r.job.Metadata.Labels) == 0 {
+		return annotations, nil, nil
+	}
+	info, err := img.Inspect(ctx)
+	if isNonImageArtifact(err) {
+		return annotations, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return annotations, info.Labels, nil
+}
+
+// manifestAnnotations returns the annotations of an OCI manifest or index,
+// Docker manifests have none.
+func manifestAnnotations(data []byte, mimeType string) map[string]string {
+	switch mimeType {
+	case imgspecv1.MediaTypeImageIndex:
+		if index, err := manifest.OCI1IndexFromManifest(data); err == nil {
+			return index.Annotations
+		}
+	case imgspecv1.MediaTypeImageManifest:
+		if m, err := manifest.OCI1FromManifest(data); err == nil {
+			return m.Annotations
+		}
+	}
+	return nil
+}
+
+// mergeAnnotations returns the annotations of the list with those of its
+// instance, the list wins.
+func mergeAnnotations(list, instance map[string]string) map[string]string {
+	merged := maps.Clone(instance)
+	if merged == nil {
+		merged = map[string]string{}
+	}
+	maps.Copy(merged, list)
+	return merged
+}
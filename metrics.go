@@ -0,0 +1,101 @@
+package imagesync
+
+import (
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/types"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/urfave/cli/v2"
+)
+
+// syncMetrics are the Prometheus metrics of all sync runs of the process,
+// a nil syncMetrics records nothing.
+type syncMetrics struct {
+	tags        *prometheus.CounterVec
+	bytes       *prometheus.CounterVec
+	duration    prometheus.Histogram
+	failures    *prometheus.CounterVec
+	lastSuccess *prometheus.GaugeVec
+}
+
+// startMetrics serves the metrics on --metrics-addr and returns a function
+// stopping the listener. Without --metrics-addr nothing is recorded.
+func startMetrics(c *cli.Context) (*syncMetrics, func()) {
+	addr := c.String("metrics-addr")
+	if addr == "" {
+		return nil, func() {}
+	}
+
+	m := &syncMetrics{
+		tags: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "imagesync_tags_total",
+			Help: "Number of tags by outcome.",
+		}, []string{"status"}),
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "imagesync_transferred_bytes_total",
+			Help: "Number of blob bytes copied, blobs which already exist in the destination aren't counted.",
+		}, []string{"source_registry", "destination_registry"}),
+		duration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "imagesync_copy_duration_seconds",
+			Help:    "Duration of copying a single tag including retries.",
+			Buckets: prometheus.ExponentialBuckets(0.5, 2, 12),
+		}),
+		failures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "imagesync_copy_failures_total",
+			Help: "Number of tags which failed copying.",
+		}, []string{"source_registry", "destination_registry"}),
+		lastSuccess: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "imagesync_last_success_timestamp_seconds",
+			Help: "Unix time of the last sync of a destination without failures.",
+		}, []string{"repository"}),
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.tags, m.bytes, m.duration, m.failures, m.lastSuccess,
+	)
+
+	stop := serveHTTP("metrics", addr, "/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	if stop == nil {
+		return nil, func() {}
+	}
+	return m, stop
+}
+
+func (m *syncMetrics) recordTag(status TagStatus) {
+	if m == nil {
+		return
+	}
+	m.tags.WithLabelValues(string(status)).Inc()
+}
+
+func (m *syncMetrics) recordCopy(destRef, srcRef types.ImageReference, t transferred, err error) {
+	if m == nil {
+		return
+	}
+	m.duration.Observe(t.duration.Seconds())
+	m.bytes.WithLabelValues(registryName(srcRef), registryName(destRef)).Add(float64(t.bytes))
+	if err != nil {
+		m.failures.WithLabelValues(registryName(srcRef), registryName(destRef)).Inc()
+	}
+}
+
+func (m *syncMetrics) recordSuccess(destination string) {
+	if m == nil {
+		return
+	}
+	m.lastSuccess.WithLabelValues(destination).SetToCurrentTime()
+}
+
+// registryName returns the registry host of docker references and the
+// transport name of all others.
+func registryName(ref types.ImageReference) string {
+	if ref.Transport().Name() == docker.Transport.Name() {
+		return reference.Domain(ref.DockerReference())
+	}
+	return ref.Transport().Name()
+}
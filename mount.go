@@ -0,0 +1,169 @@
+package imagesync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/types"
+	"github.com/samber/lo"
+	"github.com/sirupsen/logrus"
+)
+
+// blobMounter mounts the blobs a registry destination lacks from other
+// repositories of the same registry instead of uploading them, e.g. from a
+// repository of shared base images. A repository without registry is on the
+// registry of each destination.
+type blobMounter struct {
+	repositories []string
+}
+
+func newBlobMounter(opts Options) (*blobMounter, error) {
+	if len(opts.MountFrom) == 0 {
+		return nil, nil
+	}
+	m := &blobMounter{}
+	for _, repository := range opts.MountFrom {
+		name := repository
+		if isShortName(repository) {
+			// only the syntax is checked, the registry is the destination's
+			name = "localhost/" + repository
+		}
+		named, err := reference.ParseNormalizedNamed(name)
+		if err != nil || !reference.IsNameOnly(named) {
+			return nil, fmt.Errorf("invalid --mount-from %q, expected a repository", repository)
+		}
+		m.repositories = append(m.repositories, repository)
+	}
+	return m, nil
+}
+
+// wrap returns the registry destination ref mounting the blobs it lacks
+// from the --mount-from repositories of its registry, plainHTTP is the
+// --dest-plain-http of the job.
+func (m *blobMounter) wrap(ref types.ImageReference, plainHTTP bool) types.ImageReference {
+	if m == nil || ref.Transport() != docker.Transport || ref.DockerReference() == nil {
+		return ref
+	}
+	destRepo := reference.TrimNamed(ref.DockerReference())
+	domain := reference.Domain(destRepo)
+	var from []reference.Named
+	for _, repository := range m.repositories {
+		name := repository
+		if isShortName(repository) {
+			name = domain + "/" + repository
+		}
+		named, err := reference.ParseNormalizedNamed(name)
+		if err != nil || reference.Domain(named) != domain || named.Name() == destRepo.Name() {
+			continue
+		}
+		if !lo.ContainsBy(from, func(other reference.Named) bool { return other.Name() == named.Name() }) {
+			from = append(from, named)
+		}
+	}
+	if len(from) == 0 {
+		return ref
+	}
+	return &mountReference{ImageReference: ref, repo: destRepo, from: from, plainHTTP: plainHTTP}
+}
+
+type mountReference struct {
+	types.ImageReference
+	repo      reference.Named
+	from      []reference.Named
+	plainHTTP bool
+}
+
+func (r *mountReference) NewImageDestination(ctx context.Context, sys *types.SystemContext) (types.ImageDestination, error) {
+	dest, err := r.ImageReference.NewImageDestination(ctx, sys)
+	if err != nil {
+		return nil, err
+	}
+	host := reference.Domain(r.repo)
+	client := &registryClient{host: host, sys: sys, http: registryHTTPClient(sys), plainHTTP: r.plainHTTP}
+	// Docker Hub is reached through its registry host
+	if host == "docker.io" {
+		client.host = hubRegistry
+	}
+	return &mountDestination{ImageDestination: dest, ref: r, client: client}, nil
+}
+
+type mountDestination struct {
+	types.ImageDestination
+	ref *mountReference
+
+	// the client keeps the token of the last request, the blobs of an
+	// image are checked in parallel
+	mu     sync.Mutex
+	client *registryClient
+}
+
+func (d *mountDestination) Reference() types.ImageReference {
+	return d.ref
+}
+
+// TryReusingBlob mounts a blob the destination repository lacks from the
+// first --mount-from repository having it. A failing mount only logs, the
+// blob is uploaded then.
+func (d *mountDestination) TryReusingBlob(ctx context.Context, info types.BlobInfo, cache types.BlobInfoCache, canSubstitute bool) (bool, types.BlobInfo, error) {
+	reused, blob, err := d.ImageDestination.TryReusingBlob(ctx, info, cache, canSubstitute)
+	if err != nil || reused || info.Digest == "" {
+		return reused, blob, err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, from := range d.ref.from {
+		size, err := d.mount(ctx, from, info)
+		if err != nil {
+			logrus.Debugf("failed mounting %s from %s: %s", info.Digest, from.Name(), err)
+			continue
+		}
+		if size < 0 {
+			continue
+		}
+		logrus.WithFields(logrus.Fields{"repository": d.ref.repo.Name(), "from": from.Name(), "digest": info.Digest}).Debug("Mounted blob")
+		return true, types.BlobInfo{Digest: info.Digest, Size: size}, nil
+	}
+	return false, types.BlobInfo{}, nil
+}
+
+// mount mounts the blob of info from the repository from and returns its
+// size, -1 if from doesn't have it. Like containers/image, the blob is
+// checked first, a mount of a missing blob starts an upload instead.
+func (d *mountDestination) mount(ctx context.Context, from reference.Named, info types.BlobInfo) (int64, error) {
+	repo, fromRepo := reference.Path(d.ref.repo), reference.Path(from)
+	scope := fmt.Sprintf("repository:%s:pull,push repository:%s:pull", repo, fromRepo)
+	resp, err := d.client.request(ctx, http.MethodHead, "/v2/"+fromRepo+"/blobs/"+info.Digest.String(), scope)
+	var statusErr *registryStatusError
+	if errors.As(err, &statusErr) && statusErr.code == http.StatusNotFound {
+		return -1, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	size := resp.ContentLength
+
+	query := url.Values{"mount": {info.Digest.String()}, "from": {fromRepo}}
+	if resp, err = d.client.request(ctx, http.MethodPost, "/v2/"+repo+"/blobs/uploads/?"+query.Encode(), scope); err != nil {
+		return 0, err
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusCreated {
+		return size, nil
+	}
+	// the registry started an upload instead
+	if location, err := resp.Location(); err == nil {
+		if cancel, err := d.client.request(ctx, http.MethodDelete, location.RequestURI(), scope); err == nil {
+			cancel.Body.Close()
+		}
+	}
+	return 0, fmt.Errorf("the registry answered the mount with %s", resp.Status)
+}
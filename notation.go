@@ -0,0 +1,96 @@
+package imagesync
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/types"
+	"github.com/sirupsen/logrus"
+)
+
+// notationSigner signs the copied images with Notary v2 signatures of the
+// notation CLI, a nil notationSigner doesn't sign.
+type notationSigner struct {
+	binary string
+	// key is the name of a key of the notation configuration, which may be
+	// a key of a plugin like a KMS.
+	key string
+
+	mu sync.Mutex
+	// signed are the digests signed by the process, tags of the same
+	// image get a single signature.
+	signed map[string]bool
+}
+
+func newNotationSigner(opts Options) (*notationSigner, error) {
+	if opts.NotationKey == "" {
+		return nil, nil
+	}
+	binary, err := exec.LookPath("notation")
+	if err != nil {
+		return nil, fmt.Errorf("--notation-key needs the notation CLI: %w", err)
+	}
+	return &notationSigner{binary: binary, key: opts.NotationKey, signed: map[string]bool{}}, nil
+}
+
+// signCopies signs the registry destinations of a copy by the digest of
+// the written manifestBlob. The signatures are pushed as referrers of the
+// copied image.
+func (r *syncRun) signCopies(ctx context.Context, destRefs []types.ImageReference, manifestBlob []byte) error {
+	if r.notation == nil || r.options.DryRun || r.export != nil {
+		return nil
+	}
+	dgst, err := manifest.Digest(manifestBlob)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, destRef := range destRefs {
+		if destRef.Transport().Name() != docker.Transport.Name() {
+			continue
+		}
+		ref := fmt.Sprintf("%s@%s", destRef.DockerReference().Name(), dgst)
+		if err := r.notation.sign(ctx, ref, r.opts.DestinationCtx); err != nil {
+			errs = append(errs, fmt.Errorf("signing %s with notation: %w", refName(destRef), err))
+			continue
+		}
+		logrus.Debugf("Signed %s with notation", ref)
+	}
+	return errors.Join(errs...)
+}
+
+// sign runs notation sign for ref unless it was signed before. The
+// credentials of sys are passed on, otherwise notation reads the docker
+// credential store.
+func (n *notationSigner) sign(ctx context.Context, ref string, sys *types.SystemContext) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.signed[ref] {
+		return nil
+	}
+	args := []string{"sign", "--key", n.key}
+	if sys.DockerInsecureSkipTLSVerify == types.OptionalBoolTrue {
+		args = append(args, "--insecure-registry")
+	}
+	cmd := exec.CommandContext(ctx, n.binary, append(args, ref)...)
+	cmd.Env = os.Environ()
+	if auth := sys.DockerAuthConfig; auth != nil && auth.Username != "" {
+		cmd.Env = append(cmd.Env, "NOTATION_USERNAME="+auth.Username, "NOTATION_PASSWORD="+auth.Password)
+	}
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(output.String()))
+	}
+	n.signed[ref] = true
+	return nil
+}
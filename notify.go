@@ -0,0 +1,174 @@
+package imagesync
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/samber/lo"
+	"github.com/sirupsen/logrus"
+)
+
+// defaultNotifyTemplate is the message of a notification without
+// --notify-template.
+const defaultNotifyTemplate = `imagesync {{.Status}}: {{.Summary.Copied}} copied, {{.Summary.Failed}} failed, {{.Summary.Skipped}} skipped in {{printf "%.0f" .DurationSeconds}}s
+{{- if .Source}} ({{.Source}} to {{.Destination}}){{end}}
+{{- if .Error}}
+{{.Error}}{{end}}
+{{- range .FailedTags}}
+- {{.Destination}}: {{.Error}}{{end}}`
+
+// notifyMaxFailedTags bounds the failed tags of a notification, a run
+// against a broken registry fails every tag.
+const notifyMaxFailedTags = 20
+
+// Notification is the document posted to --notify-webhook when a run
+// finishes.
+type Notification struct {
+	// Status is succeeded or failed.
+	Status      string    `json:"status"`
+	Source      string    `json:"source,omitempty"`
+	Destination string    `json:"destination,omitempty"`
+	Config      string    `json:"config,omitempty"`
+	StartedAt   time.Time `json:"startedAt"`
+	FinishedAt  time.Time `json:"finishedAt"`
+	// Summary is the totals of the Result document of the run.
+	Summary         ResultTotals `json:"summary"`
+	DurationSeconds float64      `json:"durationSeconds"`
+	FailedTags      []TagResult  `json:"failedTags,omitempty"`
+	Error           string       `json:"error,omitempty"`
+	// Message is the text of --notify-template.
+	Message string `json:"message"`
+}
+
+// notifier posts a notification to webhooks and Slack when a run finishes,
+// a nil notifier doesn't notify.
+type notifier struct {
+	webhooks []string
+	slack    []string
+	// onFailure only notifies about failed runs.
+	onFailure bool
+	// custom is set if the template of --notify-template replaces the
+	// webhook body.
+	custom   bool
+	template *template.Template
+	client   *http.Client
+}
+
+func newNotifier(opts Options) (*notifier, error) {
+	if len(opts.NotifyWebhooks) == 0 && len(opts.NotifySlack) == 0 {
+		return nil, nil
+	}
+	n := &notifier{webhooks: opts.NotifyWebhooks, slack: opts.NotifySlack, client: &http.Client{Timeout: 30 * time.Second}}
+	switch opts.NotifyOn {
+	case "", "always":
+	case "failure":
+		n.onFailure = true
+	default:
+		return nil, fmt.Errorf("unsupported --notify-on %q, expected always or failure", opts.NotifyOn)
+	}
+	text := defaultNotifyTemplate
+	if opts.NotifyTemplate != "" {
+		text, n.custom = opts.NotifyTemplate, true
+	}
+	var err error
+	if n.template, err = template.New("notify").Parse(text); err != nil {
+		return nil, fmt.Errorf("--notify-template: %w", err)
+	}
+	return n, nil
+}
+
+// notify posts the notification of a finished run. Failed notifications
+// are logged, they don't fail the run.
+func (n *notifier) notify(ctx context.Context, opts Options, result *Result, err error) {
+	if n == nil {
+		return
+	}
+	notification := newNotification(opts, result, err)
+	if n.onFailure && notification.Status != "failed" {
+		return
+	}
+	var message bytes.Buffer
+	if terr := n.template.Execute(&message, notification); terr != nil {
+		logrus.Warnf("failed rendering the notification: %s", terr)
+		return
+	}
+	notification.Message = strings.TrimSpace(message.String())
+
+	// a sync cancelled by its timeout is still notified
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Minute)
+	defer cancel()
+	webhookBody, contentType := []byte(notification.Message), "text/plain; charset=utf-8"
+	if !n.custom {
+		webhookBody, _ = json.Marshal(notification)
+	}
+	if json.Valid(webhookBody) {
+		contentType = "application/json"
+	}
+	for _, endpoint := range n.webhooks {
+		if perr := n.post(ctx, endpoint, contentType, webhookBody); perr != nil {
+			logrus.Warnf("failed notifying webhook: %s", perr)
+		}
+	}
+	slackBody, _ := json.Marshal(map[string]string{"text": notification.Message})
+	for _, endpoint := range n.slack {
+		if perr := n.post(ctx, endpoint, "application/json", slackBody); perr != nil {
+			logrus.Warnf("failed notifying Slack: %s", perr)
+		}
+	}
+}
+
+func newNotification(opts Options, result *Result, err error) Notification {
+	tags, _ := result.progress()
+	failed := lo.Filter(tags, func(tag TagResult, _ int) bool { return tag.Status == TagFailed })
+	notification := Notification{
+		Status:          "succeeded",
+		Source:          opts.Source,
+		Destination:     opts.Destination,
+		Config:          opts.Config,
+		StartedAt:       result.StartedAt,
+		FinishedAt:      result.FinishedAt,
+		Summary:         result.totals(),
+		DurationSeconds: result.durationSeconds(),
+		FailedTags:      failed[:min(len(failed), notifyMaxFailedTags)],
+	}
+	if err != nil || len(failed) > 0 {
+		notification.Status = "failed"
+	}
+	if err != nil {
+		notification.Error = err.Error()
+	}
+	return notification
+}
+
+// post sends body to endpoint, the URLs of webhooks often contain their
+// secret and aren't logged.
+func (n *notifier) post(ctx context.Context, endpoint, contentType string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return errors.New("invalid URL")
+	}
+	req.Header.Set("Content-Type", contentType)
+	resp, err := n.client.Do(req)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	return nil
+}
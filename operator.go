@@ -0,0 +1,250 @@
+package imagesync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	imageSyncGroup   = "imagesync.trim21.github.io"
+	imageSyncVersion = "v1alpha1"
+	// maxStatusTags bounds the tags written into the status, etcd rejects
+	// objects above 1.5MiB.
+	maxStatusTags = 500
+)
+
+// imageSyncPhase is the state of the last sync of an ImageSync.
+type imageSyncPhase string
+
+const (
+	phaseRunning   imageSyncPhase = "Running"
+	phaseSucceeded imageSyncPhase = "Succeeded"
+	phaseFailed    imageSyncPhase = "Failed"
+)
+
+// imageSync is the ImageSync custom resource, its spec has the keys of a
+// POST /syncs request.
+type imageSync struct {
+	Metadata struct {
+		Name       string `json:"name"`
+		Namespace  string `json:"namespace"`
+		Generation int64  `json:"generation"`
+	} `json:"metadata"`
+	Spec   imageSyncSpec   `json:"spec"`
+	Status imageSyncStatus `json:"status"`
+}
+
+type imageSyncSpec struct {
+	syncRequest
+	// Interval is the time between the syncs, --interval if empty.
+	Interval string `json:"interval"`
+	Suspend  bool   `json:"suspend"`
+}
+
+type imageSyncStatus struct {
+	ObservedGeneration int64          `json:"observedGeneration,omitempty"`
+	Phase              imageSyncPhase `json:"phase,omitempty"`
+	LastSyncTime       *time.Time     `json:"lastSyncTime,omitempty"`
+	NextSyncTime       *time.Time     `json:"nextSyncTime,omitempty"`
+	Totals             *ResultTotals  `json:"totals,omitempty"`
+	Tags               []TagResult    `json:"tags,omitempty"`
+	Message            string         `json:"message"`
+}
+
+// operator reconciles the ImageSync resources of the cluster one after
+// another.
+type operator struct {
+	c         *cli.Context
+	syncer    *Syncer
+	client    *kubernetesClient
+	namespace string
+	interval  time.Duration
+}
+
+// operateSyncs syncs the ImageSync resources until SIGINT or SIGTERM. They
+// are listed every --resync-interval, a resource is synced when its spec
+// changed or its interval passed since its last sync.
+func operateSyncs(c *cli.Context, syncer *Syncer) error {
+	resync := c.Duration("resync-interval")
+	if resync <= 0 {
+		return errors.New("--resync-interval must be positive")
+	}
+	client, err := newKubernetesClient()
+	if err != nil {
+		return fmt.Errorf("operator: %w", err)
+	}
+	o := &operator{
+		c:         c,
+		syncer:    syncer,
+		client:    client,
+		namespace: c.String("namespace"),
+		interval:  c.Duration("interval"),
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	logrus.Infof("Watching ImageSync resources every %s", resync)
+	for {
+		if err := o.reconcile(ctx); err != nil && ctx.Err() == nil {
+			logrus.Errorf("listing ImageSync resources failed: %s", err)
+		}
+		select {
+		case <-ctx.Done():
+			logrus.Info("Received shutdown signal, stopped operating.")
+			return nil
+		case <-time.After(resync):
+		}
+	}
+}
+
+// reconcile syncs the resources which are due.
+func (o *operator) reconcile(ctx context.Context) error {
+	path := "/apis/" + imageSyncGroup + "/" + imageSyncVersion + "/imagesyncs"
+	if o.namespace != "" {
+		path = "/apis/" + imageSyncGroup + "/" + imageSyncVersion + "/namespaces/" + url.PathEscape(o.namespace) + "/imagesyncs"
+	}
+	var list struct {
+		Items []imageSync `json:"items"`
+	}
+	if err := o.client.do(ctx, http.MethodGet, path, "", nil, &list); err != nil {
+		return err
+	}
+	for _, item := range list.Items {
+		if ctx.Err() != nil {
+			return nil
+		}
+		interval, err := o.syncInterval(item.Spec)
+		if err != nil {
+			if item.Status.ObservedGeneration != item.Metadata.Generation {
+				o.fail(ctx, item, err)
+			}
+			continue
+		}
+		if !item.due(interval, time.Now()) {
+			continue
+		}
+		o.sync(ctx, item, interval)
+	}
+	return nil
+}
+
+func (o *operator) syncInterval(spec imageSyncSpec) (time.Duration, error) {
+	if spec.Interval == "" {
+		return o.interval, nil
+	}
+	interval, err := time.ParseDuration(spec.Interval)
+	if err != nil || interval <= 0 {
+		return 0, fmt.Errorf("invalid interval %q", spec.Interval)
+	}
+	return interval, nil
+}
+
+// due reports whether s has to be synced at now.
+func (s imageSync) due(interval time.Duration, now time.Time) bool {
+	switch {
+	case s.Spec.Suspend:
+		return false
+	case s.Status.ObservedGeneration != s.Metadata.Generation, s.Status.LastSyncTime == nil:
+		return true
+	default:
+		return !now.Before(s.Status.LastSyncTime.Add(interval))
+	}
+}
+
+// sync syncs s and writes the outcome into its status.
+func (o *operator) sync(ctx context.Context, s imageSync, interval time.Duration) {
+	name := s.Metadata.Namespace + "/" + s.Metadata.Name
+	opts, err := syncOptions(o.c)
+	if err == nil {
+		err = s.Spec.apply(&opts)
+	}
+	if err == nil {
+		// invalid filters fail the resource instead of the run
+		_, err = jobFromOptions(opts)
+	}
+	if err != nil {
+		o.fail(ctx, s, err)
+		return
+	}
+
+	o.patchStatus(ctx, s, imageSyncStatus{Phase: phaseRunning, Message: "syncing"})
+	logrus.Infof("Starting sync of ImageSync %s", name)
+	result, err := o.syncer.Sync(ctx, opts)
+	if ctx.Err() != nil {
+		// the generation isn't observed, the next start syncs it again
+		o.patchStatus(context.WithoutCancel(ctx), s, imageSyncStatus{Phase: phaseFailed, Message: "interrupted by shutdown"})
+		return
+	}
+	err = reportResult(o.c, opts, result, err)
+
+	now := time.Now().UTC()
+	next := now.Add(interval)
+	tags, totals := result.progress()
+	status := imageSyncStatus{
+		ObservedGeneration: s.Metadata.Generation,
+		Phase:              phaseSucceeded,
+		LastSyncTime:       &now,
+		NextSyncTime:       &next,
+		Totals:             &totals,
+		Tags:               tags[:min(len(tags), maxStatusTags)],
+		Message:            fmt.Sprintf("%d copied, %d skipped, %d failed", totals.Copied, totals.Skipped, totals.Failed),
+	}
+	if len(tags) > maxStatusTags {
+		status.Message += fmt.Sprintf(", %d of %d tags listed", maxStatusTags, len(tags))
+	}
+	if err != nil {
+		logrus.Errorf("sync of ImageSync %s failed: %s", name, err)
+		status.Phase, status.Message = phaseFailed, err.Error()
+	}
+	o.patchStatus(ctx, s, status)
+}
+
+// fail marks the spec of s as invalid, it isn't synced again before it
+// changes or its interval passed.
+func (o *operator) fail(ctx context.Context, s imageSync, err error) {
+	logrus.Errorf("ImageSync %s/%s is invalid: %s", s.Metadata.Namespace, s.Metadata.Name, err)
+	now := time.Now().UTC()
+	o.patchStatus(ctx, s, imageSyncStatus{
+		ObservedGeneration: s.Metadata.Generation,
+		Phase:              phaseFailed,
+		LastSyncTime:       &now,
+		Message:            err.Error(),
+	})
+}
+
+// patchStatus writes status into s, without ObservedGeneration only its
+// phase and message. Resources deleted during their sync are ignored.
+func (o *operator) patchStatus(ctx context.Context, s imageSync, status imageSyncStatus) {
+	path := "/apis/" + imageSyncGroup + "/" + imageSyncVersion + "/namespaces/" + url.PathEscape(s.Metadata.Namespace) +
+		"/imagesyncs/" + url.PathEscape(s.Metadata.Name) + "/status"
+	fields := map[string]any{"phase": status.Phase, "message": status.Message}
+	if status.ObservedGeneration != 0 {
+		// the merge patch keeps the fields it doesn't set, null removes
+		// those of the previous sync
+		fields["observedGeneration"] = status.ObservedGeneration
+		fields["lastSyncTime"] = status.LastSyncTime
+		fields["nextSyncTime"] = status.NextSyncTime
+		fields["totals"] = status.Totals
+		fields["tags"] = status.Tags
+	}
+	patch := map[string]any{"status": fields}
+	err := o.client.do(ctx, http.MethodPatch, path, "application/merge-patch+json", patch, nil)
+	var kerr *kubernetesError
+	switch {
+	case errors.As(err, &kerr) && kerr.status == http.StatusNotFound:
+		logrus.Debugf("ImageSync %s/%s was deleted", s.Metadata.Namespace, s.Metadata.Name)
+	case err != nil:
+		logrus.Warnf("failed writing the status of ImageSync %s/%s: %s", s.Metadata.Namespace, s.Metadata.Name, err)
+	}
+}
@@ -0,0 +1,168 @@
+package imagesync
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// platformFilter selects the instances of manifest lists to copy,
+// a nil filter copies all platforms.
+type platformFilter []imgspecv1.Platform
+
+// parsePlatforms parses a comma separated list of os/arch[/variant].
+func parsePlatforms(value string) (platformFilter, error) {
+	if value == "" {
+		return nil, nil
+	}
+	var filter platformFilter
+	for _, p := range strings.Split(value, ",") {
+		parts := strings.Split(strings.TrimSpace(p), "/")
+		if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid platform %q, expected os/arch[/variant]", p)
+		}
+		platform := imgspecv1.Platform{OS: parts[0], Architecture: parts[1]}
+		if len(parts) == 3 {
+			platform.Variant = parts[2]
+		}
+		filter = append(filter, platform)
+	}
+	return filter, nil
+}
+
+// matches reports whether p is selected, a filter without variant matches
+// every variant of the architecture.
+func (f platformFilter) matches(p *imgspecv1.Platform) bool {
+	if p == nil {
+		return false
+	}
+	for _, want := range f {
+		if want.OS == p.OS && want.Architecture == p.Architecture && (want.Variant == "" || want.Variant == p.Variant) {
+			return true
+		}
+	}
+	return false
+}
+
+// wrap returns ref with manifest lists reduced to the selected platforms, so
+// neither the other instances nor their blobs are copied. The destination gets
+// a manifest list referring to the selected instances only: the unchanged list
+// copied by copy.CopySpecificImages refers to missing instances, which
+// registries reject. The reduced list is deterministic, sourceDigest compares
+// it with the destination.
+func (f platformFilter) wrap(ref types.ImageReference) types.ImageReference {
+	if f == nil {
+		return ref
+	}
+	return &platformReference{ImageReference: ref, filter: f}
+}
+
+type platformReference struct {
+	types.ImageReference
+	filter platformFilter
+}
+
+func (r *platformReference) NewImageSource(ctx context.Context, sys *types.SystemContext) (types.ImageSource, error) {
+	src, err := r.ImageReference.NewImageSource(ctx, sys)
+	if err != nil {
+		return nil, err
+	}
+	return &platformSource{ImageSource: src, ref: r}, nil
+}
+
+type platformSource struct {
+	types.ImageSource
+	ref *platformReference
+}
+
+func (s *platformSource) Reference() types.ImageReference {
+	return s.ref
+}
+
+func (s *platformSource) GetManifest(ctx context.Context, instanceDigest *digest.Digest) ([]byte, string, error) {
+	manifestBlob, mimeType, err := s.ImageSource.GetManifest(ctx, instanceDigest)
+	if err != nil || instanceDigest != nil || !manifest.MIMETypeIsMultiImage(mimeType) {
+		return manifestBlob, mimeType, err
+	}
+	// the manifests of an artifact index have no platforms
+	if isArtifactType(artifactType(manifestBlob, mimeType)) {
+		return manifestBlob, mimeType, nil
+	}
+	filtered, err := s.ref.filter.filterList(manifestBlob, mimeType)
+	if err != nil {
+		return nil, "", fmt.Errorf("selecting platforms of %s: %w", refName(s.ref), err)
+	}
+	return filtered, mimeType, nil
+}
+
+// GetSignatures drops the signatures of the manifest list, they don't match
+// the reduced list.
+func (s *platformSource) GetSignatures(ctx context.Context, instanceDigest *digest.Digest) ([][]byte, error) {
+	if instanceDigest == nil {
+		_, mimeType, err := s.ImageSource.GetManifest(ctx, nil)
+		if err != nil {
+			return nil, err
+		}
+		if manifest.MIMETypeIsMultiImage(mimeType) {
+			return nil, nil
+		}
+	}
+	return s.ImageSource.GetSignatures(ctx, instanceDigest)
+}
+
+// filterList removes the instances not matching f from a docker manifest
+// list or OCI index, all other fields are kept. Instances without platform
+// aren't images for a platform and are kept.
+func (f platformFilter) filterList(manifestBlob []byte, mimeType string) ([]byte, error) {
+	list, err := manifest.ListFromBlob(manifestBlob, mimeType)
+	if err != nil {
+		return nil, fmt.Errorf("parsing manifest list: %w", err)
+	}
+	keep := map[digest.Digest]bool{}
+	platformless := map[digest.Digest]bool{}
+	for _, instance := range list.Instances() {
+		info, err := list.Instance(instance)
+		if err != nil {
+			return nil, fmt.Errorf("reading manifest list instance: %w", err)
+		}
+		if info.ReadOnly.Platform == nil {
+			platformless[instance] = true
+		} else if f.matches(info.ReadOnly.Platform) {
+			keep[instance] = true
+		}
+	}
+	if len(keep) == 0 && len(platformless) < len(list.Instances()) {
+		return nil, fmt.Errorf("no instance matches the selected platforms")
+	}
+
+	var doc map[string]json.RawMessage
+	if err = json.Unmarshal(manifestBlob, &doc); err != nil {
+		return nil, fmt.Errorf("parsing manifest list: %w", err)
+	}
+	var entries []json.RawMessage
+	if err = json.Unmarshal(doc["manifests"], &entries); err != nil {
+		return nil, fmt.Errorf("parsing manifest list entries: %w", err)
+	}
+	kept := make([]json.RawMessage, 0, len(keep))
+	for _, entry := range entries {
+		var descriptor struct {
+			Digest digest.Digest `json:"digest"`
+		}
+		if err = json.Unmarshal(entry, &descriptor); err != nil {
+			return nil, fmt.Errorf("parsing manifest list entry: %w", err)
+		}
+		if keep[descriptor.Digest] || platformless[descriptor.Digest] {
+			kept = append(kept, entry)
+		}
+	}
+	if doc["manifests"], err = json.Marshal(kept); err != nil {
+		return nil, err
+	}
+	return json.Marshal(doc)
+}
@@ -0,0 +1,107 @@
+package imagesync
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"runtime"
+	runtimepprof "runtime/pprof"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+// startProfiling starts the pprof listener and the CPU profile when they are
+// requested and returns a function that stops them and writes the heap profile.
+// Profiling problems are only logged so they never block the sync itself.
+func startProfiling(c *cli.Context) func() {
+	var stops []func()
+
+	if addr := c.String("pprof-addr"); addr != "" {
+		if stop := servePprof(addr); stop != nil {
+			stops = append(stops, stop)
+		}
+	}
+
+	if path := c.String("cpuprofile"); path != "" {
+		f, err := os.Create(path)
+		if err != nil {
+			logrus.Warnf("failed creating cpu profile: %s", err)
+		} else if err = runtimepprof.StartCPUProfile(f); err != nil {
+			logrus.Warnf("failed starting cpu profile: %s", err)
+			_ = f.Close()
+		} else {
+			stops = append(stops, func() {
+				runtimepprof.StopCPUProfile()
+				if err := f.Close(); err != nil {
+					logrus.Warnf("failed writing cpu profile: %s", err)
+				}
+			})
+		}
+	}
+
+	if path := c.String("memprofile"); path != "" {
+		stops = append(stops, func() { writeHeapProfile(path) })
+	}
+
+	return func() {
+		for i := len(stops) - 1; i >= 0; i-- {
+			stops[i]()
+		}
+	}
+}
+
+func servePprof(addr string) func() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return serveHTTP("pprof", addr, "/debug/pprof/", mux)
+}
+
+// serveHTTP serves handler on addr until the returned function is called,
+// a failing listener is only logged and returns nil.
+func serveHTTP(name, addr, path string, handler http.Handler) func() {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		logrus.Warnf("failed starting %s listener, continuing without it: %s", name, err)
+		return nil
+	}
+
+	srv := &http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logrus.Warnf("%s listener stopped: %s", name, err)
+		}
+	}()
+	logrus.Infof("Serving %s on http://%s%s", name, ln.Addr(), path)
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			logrus.Warnf("failed stopping %s listener: %s", name, err)
+		}
+	}
+}
+
+func writeHeapProfile(path string) {
+	f, err := os.Create(path)
+	if err != nil {
+		logrus.Warnf("failed creating memory profile: %s", err)
+		return
+	}
+	defer f.Close()
+
+	// get up-to-date statistics
+	runtime.GC()
+	if err = runtimepprof.WriteHeapProfile(f); err != nil {
+		logrus.Warnf("failed writing memory profile: %s", err)
+	}
+}
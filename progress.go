@@ -0,0 +1,175 @@
+package imagesync
+
+import (
+	"io"
+	"os"
+	"sync"
+
+	"github.com/containers/image/v5/types"
+	"github.com/sirupsen/logrus"
+	"github.com/vbauerster/mpb/v8"
+	"github.com/vbauerster/mpb/v8/decor"
+	"golang.org/x/term"
+)
+
+// isTerminal reports whether w is a terminal.
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	return ok && term.IsTerminal(int(f.Fd()))
+}
+
+// tagBarPriorities is the range of bar priorities of a tag, its blobs are
+// drawn below it in the order they were started.
+const tagBarPriorities = 1 << 10
+
+// progressBars draws the progress of a sync on a terminal: a bar of the
+// copied tags, a bar with the rate and ETA of each tag being copied and
+// below it a bar of each of its blobs in flight. A nil *progressBars draws
+// nothing.
+type progressBars struct {
+	progress *mpb.Progress
+	tags     *mpb.Bar
+	// logs is the output of the logs while the bars are drawn, nil if it
+	// isn't redirected.
+	logs io.Writer
+
+	mu      sync.Mutex
+	planned int64
+	started int64
+}
+
+// newProgressBars returns the bars of a sync with opts, nil unless
+// opts.ProgressBars is set. Logs written to a terminal are printed above
+// the bars until wait is called.
+func newProgressBars(opts Options) *progressBars {
+	if !opts.ProgressBars || opts.ReportWriter == nil || opts.DryRun {
+		return nil
+	}
+	p := &progressBars{progress: mpb.New(mpb.WithOutput(opts.ReportWriter), mpb.WithAutoRefresh())}
+	p.tags = p.progress.AddBar(0,
+		mpb.BarPriority(-1),
+		mpb.PrependDecorators(decor.Name("tags", decor.WCSyncSpaceR), decor.CountersNoUnit("%d / %d", decor.WCSyncSpaceR)),
+		mpb.AppendDecorators(decor.Percentage(decor.WCSyncSpace), decor.Elapsed(decor.ET_STYLE_GO, decor.WCSyncSpace)),
+	)
+	if logs := logrus.StandardLogger().Out; isTerminal(logs) {
+		p.logs = logs
+		logrus.SetOutput(p.progress)
+	}
+	return p
+}
+
+// plan adds n tags to the total of the tags bar.
+func (p *progressBars) plan(n int) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.planned += int64(n)
+	p.tags.SetTotal(max(p.planned, p.started), false)
+}
+
+// startTag adds the bar of copying the tag name, the bars of its blobs are
+// fed by observe. Tags which weren't planned are added to the total.
+func (p *progressBars) startTag(name string) *tagBar {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	p.started++
+	p.tags.SetTotal(max(p.planned, p.started), false)
+	priority := int(p.started) * tagBarPriorities
+	p.mu.Unlock()
+	return &tagBar{
+		progress: p,
+		priority: priority,
+		bar: p.progress.AddBar(0,
+			mpb.BarPriority(priority),
+			mpb.BarRemoveOnComplete(),
+			mpb.PrependDecorators(decor.Name(name, decor.WCSyncSpaceR), decor.Counters(decor.SizeB1024(0), "% .1f / % .1f", decor.WCSyncSpaceR)),
+			mpb.AppendDecorators(decor.AverageSpeed(decor.SizeB1024(0), "% .1f", decor.WCSyncSpace), decor.AverageETA(decor.ET_STYLE_GO, decor.WCSyncSpace)),
+		),
+		blobs: map[string]*mpb.Bar{},
+	}
+}
+
+// wait completes the tags bar, stops drawing and restores the log output.
+func (p *progressBars) wait() {
+	if p == nil {
+		return
+	}
+	p.tags.SetTotal(-1, true)
+	p.progress.Wait()
+	if p.logs != nil {
+		logrus.SetOutput(p.logs)
+	}
+}
+
+// tagBar is the bar of a tag being copied. The total grows with the blobs
+// the copy starts, layers which exist in the destination aren't shown.
+type tagBar struct {
+	progress *progressBars
+	bar      *mpb.Bar
+	priority int
+	total    int64
+	blobs    map[string]*mpb.Bar
+}
+
+// observe updates the bars with an event of the copy, it is called by a
+// single goroutine.
+func (t *tagBar) observe(p types.ProgressProperties) {
+	if t == nil {
+		return
+	}
+	key := p.Artifact.Digest.String()
+	switch p.Event {
+	case types.ProgressEventNewArtifact:
+		if p.Artifact.Size > 0 {
+			t.total += p.Artifact.Size
+			t.bar.SetTotal(t.total, false)
+		}
+		blob := t.progress.progress.AddBar(0,
+			mpb.BarPriority(t.priority+1+len(t.blobs)%(tagBarPriorities-1)),
+			mpb.BarRemoveOnComplete(),
+			mpb.PrependDecorators(decor.Name("  "+blobName(p.Artifact), decor.WCSyncSpaceR), decor.Counters(decor.SizeB1024(0), "% .1f / % .1f", decor.WCSyncSpaceR)),
+			mpb.AppendDecorators(decor.AverageSpeed(decor.SizeB1024(0), "% .1f", decor.WCSyncSpace)),
+		)
+		blob.SetTotal(max(p.Artifact.Size, 0), false)
+		// the bar of a blob of a failed attempt which is retried
+		if old, ok := t.blobs[key]; ok {
+			old.Abort(true)
+		}
+		t.blobs[key] = blob
+	case types.ProgressEventRead, types.ProgressEventDone:
+		t.bar.IncrInt64(int64(p.OffsetUpdate))
+		if blob, ok := t.blobs[key]; ok {
+			blob.IncrInt64(int64(p.OffsetUpdate))
+			if p.Event == types.ProgressEventDone {
+				blob.SetTotal(-1, true)
+				delete(t.blobs, key)
+			}
+		}
+	}
+}
+
+// done removes the bar of the tag and its remaining blobs and counts the
+// tag as copied or failed.
+func (t *tagBar) done() {
+	if t == nil {
+		return
+	}
+	for _, blob := range t.blobs {
+		blob.Abort(true)
+	}
+	t.bar.SetTotal(-1, true)
+	t.progress.tags.Increment()
+}
+
+// blobName returns the abbreviated digest of a blob like docker pull.
+func blobName(blob types.BlobInfo) string {
+	if blob.Digest.Validate() != nil {
+		return "blob"
+	}
+	encoded := blob.Digest.Encoded()
+	return encoded[:min(12, len(encoded))]
+}
@@ -0,0 +1,156 @@
+package imagesync
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/samber/lo"
+)
+
+// dockerHubHosts are contacted for docker.io references.
+var dockerHubHosts = []string{"docker.io", "index.docker.io", "registry-1.docker.io", "auth.docker.io"}
+
+// parseProxy validates a --src-proxy or --dest-proxy URL.
+func parseProxy(value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	u, err := url.Parse(value)
+	if err != nil {
+		return "", err
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return "", fmt.Errorf("unsupported proxy %q, expected an http://, https:// or socks5:// URL", value)
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("proxy %q has no host", value)
+	}
+	return u.String(), nil
+}
+
+// setupProxies routes the connections of one side through --src-proxy or
+// --dest-proxy while the other side is contacted directly. containers/image
+// reads the proxy from the environment once on the first request of the
+// process, so the proxy is set as HTTPS_PROXY and HTTP_PROXY and the
+// registries of the other side are added to NO_PROXY before any request.
+// Hosts not known beforehand, like blob storage redirects, use the proxy.
+func setupProxies(options Options, jobs []syncJob) error {
+	srcProxy, err := parseProxy(options.SrcProxy)
+	if err != nil {
+		return fmt.Errorf("--src-proxy: %w", err)
+	}
+	destProxy, err := parseProxy(options.DestProxy)
+	if err != nil {
+		return fmt.Errorf("--dest-proxy: %w", err)
+	}
+	resolver, err := parseResolves(options.Resolve)
+	if err != nil {
+		return err
+	}
+	if resolver != nil {
+		// the environment names the proxy of --resolve after the first sync
+		// of the process
+		if srcProxy != "" || destProxy != "" || getEnvAny("HTTPS_PROXY", "https_proxy", "HTTP_PROXY", "http_proxy") != resolveProxy.url {
+			return errors.New("--resolve can't be used with a proxy, it connects through a proxy itself")
+		}
+		if err = setupResolve(resolver); err != nil {
+			return err
+		}
+		for _, key := range []string{"HTTPS_PROXY", "HTTP_PROXY"} {
+			if err = os.Setenv(key, resolveProxy.url); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if srcProxy == "" && destProxy == "" {
+		return nil
+	}
+	if srcProxy != "" && destProxy != "" && srcProxy != destProxy {
+		return errors.New("--src-proxy and --dest-proxy must be the same proxy if both are given, connections can't use different proxies")
+	}
+
+	srcHosts, destHosts := proxyHosts(options, jobs)
+	proxy, direct := srcProxy, destHosts
+	switch {
+	case srcProxy == destProxy:
+		direct = nil
+	case srcProxy == "":
+		proxy, direct = destProxy, srcHosts
+	}
+	if overlap := lo.Intersect(srcHosts, destHosts); len(direct) > 0 && len(overlap) > 0 {
+		return fmt.Errorf("%s is both source and destination, it can't be reached with and without proxy", overlap[0])
+	}
+
+	for _, key := range []string{"HTTPS_PROXY", "HTTP_PROXY"} {
+		if err = os.Setenv(key, proxy); err != nil {
+			return err
+		}
+	}
+	if len(direct) > 0 {
+		noProxy := lo.Compact(append(strings.Split(getEnvAny("NO_PROXY", "no_proxy"), ","), direct...))
+		if err = os.Setenv("NO_PROXY", strings.Join(lo.Uniq(noProxy), ",")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// proxyHosts returns the registry hosts of the sources and destinations. The
+// jobs of a --src-namespace aren't listed yet, its hosts come from options.
+func proxyHosts(options Options, jobs []syncJob) (src, dest []string) {
+	if options.SrcNamespace != "" {
+		if ns, err := parseNamespace(options.SrcNamespace); err == nil {
+			src = registryHosts(ns.host)
+		}
+		for _, prefix := range strings.Split(options.DestNamespace, ",") {
+			host, _, _ := strings.Cut(strings.TrimPrefix(strings.TrimSpace(prefix), "docker://"), "/")
+			dest = append(dest, registryHosts(host)...)
+		}
+		return lo.Uniq(src), lo.Uniq(dest)
+	}
+
+	for _, job := range jobs {
+		if s, err := detectSource(job.Source, job.SrcFormat, options.LegacySourceDetection); err == nil && s.kind == sourceRegistry {
+			if named, err := reference.ParseNormalizedNamed(s.value); err == nil {
+				src = append(src, registryHosts(reference.Domain(named))...)
+			}
+		}
+		dests, err := detectDestinations(job.Destination, job.DestType)
+		if err != nil {
+			continue
+		}
+		for _, d := range dests {
+			if d.kind != destinationRegistry {
+				continue
+			}
+			if named, err := reference.ParseNormalizedNamed(d.value); err == nil {
+				dest = append(dest, registryHosts(reference.Domain(named))...)
+			}
+		}
+	}
+	return lo.Uniq(src), lo.Uniq(dest)
+}
+
+// registryHosts returns the hosts contacted for a registry.
+func registryHosts(host string) []string {
+	if lo.Contains(dockerHubHosts, host) {
+		return dockerHubHosts
+	}
+	return []string{host}
+}
+
+func getEnvAny(names ...string) string {
+	for _, name := range names {
+		if v := os.Getenv(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,130 @@
+package imagesync
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+	"github.com/samber/lo"
+	"github.com/sirupsen/logrus"
+)
+
+// pruneTags deletes the destination tags which don't exist in the source
+// anymore. Without --confirm-prune, or in dry-run mode, the tags are only
+// listed. Registries delete manifests rather than tags, so a tag whose
+// manifest is shared with a kept tag is never deleted.
+func (r *syncRun) pruneTags(ctx context.Context, dest destination, destRepository types.ImageReference, srcTags []string) error {
+	// list again to also see the tags copied by this run
+	destTags, err := dest.tags(ctx, r.opts.DestinationCtx, destRepository)
+	if err != nil {
+		return fmt.Errorf("getting destination tags: %w", err)
+	}
+	// signatures created by --sign-cosign-* only exist in the destination
+	stale := lo.Filter(subtract(destTags, srcTags), func(tag string, _ int) bool { return !referrerTagPattern.MatchString(tag) })
+	if len(stale) == 0 {
+		return nil
+	}
+
+	kept := subtract(destTags, stale)
+	keptDigests, err := r.keptDigests(ctx, dest, kept)
+	if err != nil {
+		return fmt.Errorf("not pruning %s: %w", destRepository.DockerReference().Name(), err)
+	}
+	staleDigests := r.destDigests(ctx, dest, stale)
+
+	confirmed := r.options.ConfirmPrune && !r.options.DryRun
+	deleted := map[digest.Digest]bool{}
+	for _, tag := range stale {
+		ref, err := dest.tagReference(tag)
+		if err != nil {
+			return fmt.Errorf("parsing dest ref: %w", err)
+		}
+		name := refName(ref)
+		dgst, ok := staleDigests[tag]
+		if !ok {
+			logrus.Warnf("not pruning %s, its digest couldn't be read", name)
+			continue
+		}
+		if keptTag, ok := keptDigests[dgst]; ok {
+			logrus.Warnf("not pruning %s, its manifest is shared with tag %s", name, keptTag)
+			continue
+		}
+		if !confirmed {
+			logrus.WithFields(logrus.Fields{"destination": name, "digest": dgst}).Info("Would prune tag, use --confirm-prune to delete it")
+			continue
+		}
+
+		result := TagResult{Destination: name, Status: TagPruned, Digest: dgst.String()}
+		if deleted[dgst] {
+			// already gone together with another stale tag of the same manifest
+			logrus.WithFields(tagFields(result)).Info("Pruned tag")
+			r.addTag(result)
+			continue
+		}
+		if err = ref.DeleteImage(ctx, r.opts.DestinationCtx); err != nil {
+			logrus.Warnf("failed pruning %s: %s", name, err)
+			result.Status = TagFailed
+			result.Error = fmt.Sprintf("pruning: %s", err)
+		} else {
+			deleted[dgst] = true
+			logrus.WithFields(tagFields(result)).Info("Pruned tag")
+		}
+		r.addTag(result)
+	}
+	return nil
+}
+
+// keptDigests returns the kept tags by their manifest digests in dest. A
+// kept tag whose digest can't be read fails it, deleting a tag sharing its
+// manifest would delete the kept tag too.
+func (r *syncRun) keptDigests(ctx context.Context, dest destination, kept []string) (map[digest.Digest]string, error) {
+	digests := r.destDigests(ctx, dest, kept)
+	if unread, ok := lo.Find(kept, func(tag string) bool { _, ok := digests[tag]; return !ok }); ok {
+		return nil, fmt.Errorf("tag %s's digest couldn't be read, refusing to delete shared manifests", unread)
+	}
+	keptDigests := make(map[digest.Digest]string, len(digests))
+	for tag, dgst := range digests {
+		keptDigests[dgst] = tag
+	}
+	return keptDigests, nil
+}
+
+// destDigests returns the manifest digests of tags in dest, tags whose
+// digest can't be read are missing from the result.
+func (r *syncRun) destDigests(ctx context.Context, dest destination, tags []string) map[string]digest.Digest {
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		digests = make(map[string]digest.Digest, len(tags))
+	)
+	ch := make(chan string)
+	for i := 0; i < max(min(r.job.MaxConcurrentTags, len(tags)), 1); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for tag := range ch {
+				ref, err := dest.tagReference(tag)
+				if err != nil {
+					logrus.Debugf("failed parsing dest ref: %s", err)
+					continue
+				}
+				dgst, err := referenceDigest(ctx, r.opts.DestinationCtx, ref)
+				if err != nil {
+					logrus.Debugf("failed getting digest of tag %s: %s", tag, err)
+					continue
+				}
+				mu.Lock()
+				digests[tag] = dgst
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, tag := range tags {
+		ch <- tag
+	}
+	close(ch)
+	wg.Wait()
+	return digests
+}
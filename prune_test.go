@@ -0,0 +1,123 @@
+package imagesync
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// pushTestTag tags the image of host/repo:tag as alias.
+func pushTestTag(t *testing.T, host, repo, tag, alias string) {
+	t.Helper()
+	ref, err := name.ParseReference(host+"/"+repo+":"+tag, name.Insecure)
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc, err := remote.Get(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = remote.Tag(ref.Context().Tag(alias), desc); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// deletes records the manifests deleted from a registry.
+type deletes struct {
+	mu    sync.Mutex
+	paths []string
+}
+
+func (d *deletes) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodDelete {
+			d.mu.Lock()
+			d.paths = append(d.paths, r.URL.Path)
+			d.mu.Unlock()
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func TestPrune(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		confirm bool
+		pruned  int
+	}{
+		{"listed only", false, 0},
+		{"confirmed", true, 1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var deleted deletes
+			src := newTestRegistry(t, nil)
+			dest := newTestRegistry(t, deleted.wrap)
+			pushTestImage(t, src, "app", "1", 1)
+			pushTestImage(t, src, "app", "2", 1)
+			old := pushTestImage(t, dest, "app", "old", 1)
+			// a stale tag of a kept manifest, deleting it would delete 1
+			pushTestImage(t, dest, "app", "1", 1)
+			pushTestTag(t, dest, "app", "1", "alias")
+
+			opts := testOptions(src+"/app", dest+"/app")
+			opts.Prune = true
+			opts.ConfirmPrune = tt.confirm
+			result, err := (&Syncer{}).Sync(context.Background(), opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var want []string
+			if tt.confirm {
+				dgst, err := old.Digest()
+				if err != nil {
+					t.Fatal(err)
+				}
+				want = []string{"/v2/app/manifests/" + dgst.String()}
+			}
+			if !slices.Equal(deleted.paths, want) {
+				t.Errorf("deleted %q, want %q", deleted.paths, want)
+			}
+			if got := result.totals().Pruned; got != tt.pruned {
+				t.Errorf("pruned %d tags, want %d", got, tt.pruned)
+			}
+		})
+	}
+}
+
+// TestPruneUnreadableKeptTag checks that nothing is pruned if the digest of a
+// kept tag can't be read, a stale tag might share its manifest.
+func TestPruneUnreadableKeptTag(t *testing.T) {
+	var deleted deletes
+	var failing atomic.Bool
+	src := newTestRegistry(t, nil)
+	dest := newTestRegistry(t, func(next http.Handler) http.Handler {
+		fail := failTag("1", http.StatusInternalServerError)(next)
+		return deleted.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if failing.Load() {
+				fail.ServeHTTP(w, r)
+				return
+			}
+			next.ServeHTTP(w, r)
+		}))
+	})
+	pushTestImage(t, src, "app", "1", 1)
+	pushTestImage(t, dest, "app", "1", 1)
+	pushTestImage(t, dest, "app", "old", 1)
+	failing.Store(true)
+
+	opts := testOptions(src+"/app", dest+"/app")
+	opts.Prune = true
+	opts.ConfirmPrune = true
+	if _, err := (&Syncer{}).Sync(context.Background(), opts); err == nil {
+		t.Error("Sync() = nil, want the error of the kept tag")
+	}
+	if len(deleted.paths) > 0 {
+		t.Errorf("deleted %q, want nothing", deleted.paths)
+	}
+}
@@ -0,0 +1,164 @@
+package imagesync
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/pkg/docker/config"
+	"github.com/containers/image/v5/pkg/tlsclientconfig"
+	"github.com/containers/image/v5/types"
+	"github.com/docker/go-units"
+	"github.com/sirupsen/logrus"
+)
+
+var ErrQuotaExceeded = errors.New("destination quota exceeded")
+
+// destinationQuota is the remaining storage quota of a destination
+// repository in bytes.
+type destinationQuota struct {
+	remaining int64
+}
+
+// checkDestinationQuota compares the estimated transfer of srcRefs against the
+// remaining quota of destRef and warns or fails depending on action.
+// Destinations other than Harbor projects with a quota are skipped with a
+// warning, plainHTTP is the --dest-plain-http of the job.
+func checkDestinationQuota(ctx context.Context, action string, destRef types.ImageReference, destSys, srcSys *types.SystemContext, srcRefs []types.ImageReference, plainHTTP bool) error {
+	if action == "" || len(srcRefs) == 0 {
+		return nil
+	}
+	if action != "warn" && action != "fail" {
+		return fmt.Errorf("unsupported quota action %q", action)
+	}
+
+	quota, err := lookupDestinationQuota(ctx, destRef, destSys, plainHTTP)
+	if err != nil {
+		logrus.Debugf("failed reading destination quota, skipping quota check: %s", err)
+		return nil
+	}
+	if quota == nil {
+		logrus.Warnf("quota of %s isn't checked, only Harbor project quotas are", refName(destRef))
+		return nil
+	}
+
+	var total int64
+	for _, ref := range srcRefs {
+		size, err := imageSize(ctx, ref, srcSys)
+		if err != nil {
+			logrus.Warnf("failed estimating size of %s, skipping quota check: %s", refName(ref), err)
+			return nil
+		}
+		total += size
+	}
+	if total <= quota.remaining {
+		return nil
+	}
+	msg := fmt.Sprintf("syncing an estimated %s exceeds the remaining quota of %s", units.HumanSize(float64(total)), units.HumanSize(float64(quota.remaining)))
+
+	if action == "fail" {
+		return fmt.Errorf("%s: %w", msg, ErrQuotaExceeded)
+	}
+	logrus.Warn(msg)
+	return nil
+}
+
+// lookupDestinationQuota reads the quota of Harbor destinations. ECR limits
+// the images per repository, but the limit is an account setting of Service
+// Quotas which isn't read, so ECR isn't checked.
+func lookupDestinationQuota(ctx context.Context, destRef types.ImageReference, sys *types.SystemContext, plainHTTP bool) (*destinationQuota, error) {
+	if destRef.Transport().Name() != docker.Transport.Name() {
+		return nil, nil
+	}
+	named := destRef.DockerReference()
+	if ecrHostPattern.MatchString(reference.Domain(named)) {
+		return nil, nil
+	}
+	scheme := "https"
+	if plainHTTP {
+		scheme = "http"
+	}
+	return harborQuota(ctx, scheme, reference.Domain(named), reference.Path(named), sys)
+}
+
+// harborQuota reads the storage quota of the Harbor project of repoPath,
+// registries which aren't Harbor or have no quota return nil.
+func harborQuota(ctx context.Context, scheme, host, repoPath string, sys *types.SystemContext) (*destinationQuota, error) {
+	project, _, _ := strings.Cut(repoPath, "/")
+	u := url.URL{Scheme: scheme, Host: host, Path: "/api/v2.0/projects/" + project + "/summary"}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Is-Resource-Name", "true")
+	if auth, err := config.GetCredentials(sys, host); err == nil && auth.Username != "" {
+		req.SetBasicAuth(auth.Username, auth.Password)
+	}
+
+	resp, err := registryHTTPClient(sys).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		// not a Harbor registry or the project summary isn't accessible
+		return nil, nil
+	}
+
+	var summary struct {
+		Quota *struct {
+			Hard struct {
+				Storage int64 `json:"storage"`
+			} `json:"hard"`
+			Used struct {
+				Storage int64 `json:"storage"`
+			} `json:"used"`
+		} `json:"quota"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&summary); err != nil {
+		return nil, nil
+	}
+	if summary.Quota == nil || summary.Quota.Hard.Storage < 0 {
+		return nil, nil
+	}
+	return &destinationQuota{remaining: max(summary.Quota.Hard.Storage-summary.Quota.Used.Storage, 0)}, nil
+}
+
+// registryHTTPClient returns a client for registry APIs not covered by
+// containers/image, honoring the TLS setting of sys.
+func registryHTTPClient(sys *types.SystemContext) *http.Client {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.TLSClientConfig = &tls.Config{}
+	if sys != nil && sys.DockerInsecureSkipTLSVerify == types.OptionalBoolTrue {
+		tr.TLSClientConfig.InsecureSkipVerify = true //nolint:gosec // mirrors the registry TLS setting
+	}
+	if sys != nil && sys.DockerCertPath != "" {
+		if err := tlsclientconfig.SetupCertificates(sys.DockerCertPath, tr.TLSClientConfig); err != nil {
+			logrus.Warnf("failed loading certificates of %s: %s", sys.DockerCertPath, err)
+		}
+	}
+	return &http.Client{Transport: tr, Timeout: 30 * time.Second}
+}
+
+// isQuotaExceeded reports whether err is a registry rejecting a push because
+// of an exhausted quota, retrying or copying more tags won't succeed.
+func isQuotaExceeded(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, ErrQuotaExceeded) {
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	return (strings.Contains(msg, "quota") && strings.Contains(msg, "exceed")) ||
+		strings.Contains(msg, "exceed the configured upper limit")
+}
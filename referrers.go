@@ -0,0 +1,346 @@
+package imagesync
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"time"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/image"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/pkg/blobinfocache"
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+)
+
+// referrerTagPattern matches the tags cosign stores signatures, attestations
+// and SBOMs of a manifest digest in, and the referrers tag of the OCI tag
+// schema fallback used by registries without the referrers API.
+var referrerTagPattern = regexp.MustCompile(`^sha256-[0-9a-f]{64}(\.(sig|att|sbom))?$`)
+
+// referrerTagSuffixes are appended to the referrers tag of a digest to get
+// the tags of its referrers.
+var referrerTagSuffixes = []string{"", ".sig", ".att", ".sbom"}
+
+// referrers copies the artifacts referring to the copied images, see
+// --include-referrers. A nil referrers doesn't copy anything.
+type referrers struct {
+	dests   []destination
+	srcRepo string
+	// srcTags lists the tags of the source repository, the referrer tags are
+	// looked up in them instead of probing every possible tag.
+	srcTags func() ([]string, error)
+}
+
+// ociReferrer is a descriptor of the index returned by the OCI referrers
+// API.
+type ociReferrer struct {
+	Digest       digest.Digest `json:"digest"`
+	ArtifactType string        `json:"artifactType"`
+}
+
+func referrerTag(dgst digest.Digest, suffix string) string {
+	return fmt.Sprintf("%s-%s%s", dgst.Algorithm(), dgst.Encoded(), suffix)
+}
+
+// referredDigests returns the digests whose referrers are valid in the
+// destination: the top-level manifest if it was copied unchanged and the
+// instances of a manifest list.
+func referredDigests(t transferred) []digest.Digest {
+	var digests []digest.Digest
+	if dgst, err := manifest.Digest(t.manifest); err == nil && dgst == t.sourceDigest {
+		digests = append(digests, dgst)
+	}
+	mimeType := manifest.GuessMIMEType(t.manifest)
+	if manifest.MIMETypeIsMultiImage(mimeType) {
+		if list, err := manifest.ListFromBlob(t.manifest, mimeType); err == nil {
+			digests = append(digests, list.Instances()...)
+		}
+	}
+	return digests
+}
+
+// copyReferrers copies the referrer tags of the image copied as t.
+func (r *syncRun) copyReferrers(ctx context.Context, t transferred) {
+	if r.referrers == nil {
+		return
+	}
+	srcTags, err := r.referrers.srcTags()
+	if err != nil {
+		logrus.Warnf("failed getting source tags to find referrers: %s", err)
+		return
+	}
+	available := make(map[string]bool, len(srcTags))
+	for _, tag := range srcTags {
+		available[tag] = true
+	}
+	digests := referredDigests(t)
+	for _, dgst := range digests {
+		for _, suffix := range referrerTagSuffixes {
+			tag := referrerTag(dgst, suffix)
+			if !available[tag] {
+				continue
+			}
+			srcRef, err := docker.ParseReference(fmt.Sprintf("//%s:%s", r.referrers.srcRepo, tag))
+			if err != nil {
+				logrus.Warnf("failed parsing src ref: %s", err)
+				continue
+			}
+			for _, dest := range r.referrers.dests {
+				destRef, err := dest.tagReference(tag)
+				if err != nil {
+					logrus.Warnf("failed parsing dest ref: %s", err)
+					continue
+				}
+				r.copyReferrer(ctx, srcRef, destRef)
+			}
+		}
+	}
+	r.copyAPIReferrers(ctx, digests)
+}
+
+// copyAPIReferrers copies the artifacts the OCI referrers API of the source
+// lists for digests, and the artifacts referring to those, by digest to
+// the registry destinations. Their manifests are copied unchanged, keeping
+// their subject, artifactType and annotations. Registries without the API
+// are skipped.
+func (r *syncRun) copyAPIReferrers(ctx context.Context, digests []digest.Digest) {
+	named, err := reference.ParseNormalizedNamed(r.referrers.srcRepo)
+	if err != nil {
+		logrus.Warnf("failed parsing src repository: %s", err)
+		return
+	}
+	host := reference.Domain(named)
+	if host == "docker.io" {
+		host = hubRegistry
+	}
+	client := &registryClient{host: host, sys: r.opts.SourceCtx, http: registryHTTPClient(r.opts.SourceCtx), plainHTTP: r.job.SrcPlainHTTP}
+	seen := map[digest.Digest]bool{}
+	for len(digests) > 0 {
+		dgst := digests[0]
+		digests = digests[1:]
+		found, err := listReferrers(ctx, client, reference.Path(named), dgst)
+		if err != nil {
+			logrus.Warnf("failed listing the referrers of %s@%s: %s", r.referrers.srcRepo, dgst, err)
+			continue
+		}
+		for _, referrer := range found {
+			if seen[referrer.Digest] || !r.wantsReferrer(referrer) {
+				continue
+			}
+			seen[referrer.Digest] = true
+			digests = append(digests, referrer.Digest)
+			srcRef, err := docker.ParseReference(fmt.Sprintf("//%s@%s", r.referrers.srcRepo, referrer.Digest))
+			if err != nil {
+				logrus.Warnf("failed parsing src ref: %s", err)
+				continue
+			}
+			for _, dest := range r.referrers.dests {
+				if dest.kind != destinationRegistry {
+					continue
+				}
+				destRef, err := docker.ParseReference(fmt.Sprintf("//%s@%s", dest.value, referrer.Digest))
+				if err != nil {
+					logrus.Warnf("failed parsing dest ref: %s", err)
+					continue
+				}
+				r.copyReferrer(ctx, srcRef, destRef)
+			}
+		}
+	}
+}
+
+// wantsReferrer reports whether the artifact type of referrer is selected
+// by --referrer-types, without it all referrers are copied.
+func (r *syncRun) wantsReferrer(referrer ociReferrer) bool {
+	return len(r.options.ReferrerTypes) == 0 || slices.Contains(r.options.ReferrerTypes, referrer.ArtifactType)
+}
+
+// listReferrers reads all pages of the OCI referrers API for dgst in repo,
+// nil if the registry doesn't support the API.
+func listReferrers(ctx context.Context, client *registryClient, repo string, dgst digest.Digest) ([]ociReferrer, error) {
+	next := fmt.Sprintf("/v2/%s/referrers/%s", repo, dgst)
+	var found []ociReferrer
+	for next != "" {
+		resp, err := client.get(ctx, next, fmt.Sprintf("repository:%s:pull", repo))
+		var statusErr *registryStatusError
+		if errors.As(err, &statusErr) && statusErr.code == http.StatusNotFound {
+			logrus.Debugf("%s doesn't support the referrers API: %s", client.host, err)
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		var index struct {
+			Manifests []ociReferrer `json:"manifests"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&index)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("parsing referrers: %w", err)
+		}
+		found = append(found, index.Manifests...)
+		next = nextLink(resp)
+	}
+	return found, nil
+}
+
+// copyReferrer copies a single referrer and records the outcome.
+func (r *syncRun) copyReferrer(ctx context.Context, srcRef, destRef types.ImageReference) {
+
+	var (
+		t        transferred
+		upToDate bool
+	)
+	err := withRetry(ctx, r.options.MaxRetries, r.options.RetryDelay, refName(srcRef), func() error {
+		var err error
+		t, upToDate, err = r.transferRaw(ctx, destRef, srcRef)
+		return err
+	})
+	result := TagResult{
+		Source:          refName(srcRef),
+		Destination:     refName(destRef),
+		Status:          TagCopied,
+		Digest:          t.sourceDigest.String(),
+		SourceDigest:    t.sourceDigest.String(),
+		Bytes:           t.bytes,
+		DurationSeconds: t.duration.Seconds(),
+	}
+	switch {
+	case err != nil:
+		logrus.Warnf("failed copying referrer %s: %s", result.Source, err)
+		result.Status = TagFailed
+		result.Error = err.Error()
+		result.Digest = ""
+	case upToDate:
+		result.Status = TagSkipped
+	case r.options.DryRun:
+		result.Status = TagPlanned
+		logrus.WithFields(tagFields(result)).Info("Would copy referrer")
+	default:
+		logrus.WithFields(tagFields(result)).Info("Copied referrer")
+		r.index.recordCopied(ctx, destRef, r.opts.DestinationCtx, t.manifest, r.job.DestPlainHTTP)
+	}
+	r.addTag(result)
+}
+
+// transferRaw copies the manifest of srcRef and its blobs to destRef byte
+// for byte, so the digest referrers are addressed by stays the same. It
+// reports whether destRef already has the manifest; in dry-run mode nothing
+// is copied.
+func (r *syncRun) transferRaw(ctx context.Context, destRef, srcRef types.ImageReference) (transferred, bool, error) {
+	started := time.Now()
+	srcRef = throttle(srcRef, r.bandwidth, newBandwidthLimiter(r.bandwidthPerTag))
+	src, err := r.limits.src.wrap(srcRef).NewImageSource(ctx, r.opts.SourceCtx)
+	if err != nil {
+		return transferred{}, false, fmt.Errorf("opening source image: %w", err)
+	}
+	defer src.Close()
+	manifestBlob, mimeType, err := src.GetManifest(ctx, nil)
+	if err != nil {
+		return transferred{}, false, fmt.Errorf("reading source manifest: %w", err)
+	}
+	dgst, err := manifest.Digest(manifestBlob)
+	if err != nil {
+		return transferred{}, false, fmt.Errorf("computing source digest: %w", err)
+	}
+	t := transferred{manifest: manifestBlob, sourceDigest: dgst}
+	if destDigest, err := referenceDigest(ctx, r.opts.DestinationCtx, destRef); err == nil && destDigest == dgst {
+		t.duration = time.Since(started)
+		return t, true, nil
+	}
+	if r.options.DryRun {
+		t.duration = time.Since(started)
+		return t, false, nil
+	}
+
+	dest, err := r.limits.dest.wrap(destRef).NewImageDestination(ctx, r.opts.DestinationCtx)
+	if err != nil {
+		return transferred{}, false, fmt.Errorf("opening destination: %w", err)
+	}
+	defer dest.Close()
+	cache := blobinfocache.DefaultCache(r.opts.DestinationCtx)
+	if manifest.MIMETypeIsMultiImage(mimeType) {
+		list, err := manifest.ListFromBlob(manifestBlob, mimeType)
+		if err != nil {
+			return transferred{}, false, fmt.Errorf("parsing manifest list: %w", err)
+		}
+		for _, instance := range list.Instances() {
+			instanceBlob, instanceType, err := src.GetManifest(ctx, &instance)
+			if err != nil {
+				return transferred{}, false, fmt.Errorf("reading manifest %s: %w", instance, err)
+			}
+			n, err := copyBlobs(ctx, src, dest, cache, instanceBlob, instanceType)
+			t.bytes += n
+			if err != nil {
+				return transferred{}, false, err
+			}
+			if err = dest.PutManifest(ctx, instanceBlob, &instance); err != nil {
+				return transferred{}, false, fmt.Errorf("writing manifest %s: %w", instance, err)
+			}
+		}
+	} else {
+		n, err := copyBlobs(ctx, src, dest, cache, manifestBlob, mimeType)
+		t.bytes += n
+		if err != nil {
+			return transferred{}, false, err
+		}
+	}
+	if err = dest.PutManifest(ctx, manifestBlob, nil); err != nil {
+		return transferred{}, false, fmt.Errorf("writing manifest: %w", err)
+	}
+	if err = dest.Commit(ctx, image.UnparsedInstance(src, nil)); err != nil {
+		return transferred{}, false, fmt.Errorf("committing destination: %w", err)
+	}
+	t.duration = time.Since(started)
+	return t, false, nil
+}
+
+// copyBlobs copies the config and layers of a single manifest from src to
+// dest unmodified and returns the copied bytes, blobs which exist in the
+// destination aren't copied.
+func copyBlobs(ctx context.Context, src types.ImageSource, dest types.ImageDestination, cache types.BlobInfoCache, manifestBlob []byte, mimeType string) (int64, error) {
+	m, err := manifest.FromBlob(manifestBlob, mimeType)
+	if err != nil {
+		return 0, fmt.Errorf("parsing manifest: %w", err)
+	}
+	blobs := []types.BlobInfo{m.ConfigInfo()}
+	for _, layer := range m.LayerInfos() {
+		blobs = append(blobs, layer.BlobInfo)
+	}
+
+	var copied int64
+	for i, info := range blobs {
+		if info.Digest == "" {
+			continue
+		}
+		reused, _, err := dest.TryReusingBlob(ctx, info, cache, false)
+		if err != nil {
+			return copied, fmt.Errorf("checking blob %s: %w", info.Digest, err)
+		}
+		if reused {
+			continue
+		}
+		stream, size, err := src.GetBlob(ctx, info, cache)
+		if err != nil {
+			return copied, fmt.Errorf("reading blob %s: %w", info.Digest, err)
+		}
+		_, err = dest.PutBlob(ctx, stream, info, cache, i == 0)
+		stream.Close()
+		if err != nil {
+			return copied, fmt.Errorf("writing blob %s: %w", info.Digest, err)
+		}
+		if size < 0 {
+			size = info.Size
+		}
+		copied += size
+	}
+	return copied, nil
+}
@@ -0,0 +1,120 @@
+package imagesync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/pkg/sysregistriesv2"
+	"github.com/containers/image/v5/types"
+	"github.com/sirupsen/logrus"
+)
+
+// checkRegistriesConf fails early for a missing or invalid --registries-conf
+// file, containers/image would ignore a missing file.
+func checkRegistriesConf(path string) error {
+	if path == "" {
+		return nil
+	}
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("--registries-conf: %w", err)
+	}
+	if _, err := sysregistriesv2.GetRegistries(&types.SystemContext{SystemRegistriesConfPath: path}); err != nil {
+		return fmt.Errorf("--registries-conf: %w", err)
+	}
+	return nil
+}
+
+// isShortName reports whether the registry source value has no registry,
+// like alpine or library/alpine:3.
+func isShortName(value string) bool {
+	first, _, ok := strings.Cut(value, "/")
+	return !ok || (!strings.ContainsAny(first, ".:") && first != "localhost")
+}
+
+// splitShortName splits value into its repository and the :tag or @digest
+// suffix.
+func splitShortName(value string) (repository, suffix string) {
+	if i := strings.Index(value, "@"); i >= 0 {
+		return value[:i], value[i:]
+	}
+	if i := strings.LastIndex(value, ":"); i > strings.LastIndex(value, "/") {
+		return value[:i], value[i:]
+	}
+	return value, ""
+}
+
+// resolveShortName resolves a source without registry with the
+// --registries-conf file like Podman does without a terminal: an alias is
+// used as is, otherwise the unqualified-search registries are tried in
+// order and the first one having the image or repository wins. Qualified
+// sources and runs without --registries-conf keep the source.
+func (r *syncRun) resolveShortName(ctx context.Context, value string) (string, error) {
+	if r.options.RegistriesConf == "" || !isShortName(value) {
+		return value, nil
+	}
+	sys := r.opts.SourceCtx
+	repository, suffix := splitShortName(value)
+	alias, origin, err := sysregistriesv2.ResolveShortNameAlias(sys, repository)
+	if err != nil {
+		return "", fmt.Errorf("resolving short name %s: %w", value, err)
+	}
+	if alias != nil {
+		logrus.Infof("Resolved %s as an alias (%s)", repository, origin)
+		return alias.Name() + suffix, nil
+	}
+
+	registries, origin, err := sysregistriesv2.UnqualifiedSearchRegistriesWithOrigin(sys)
+	if err != nil {
+		return "", fmt.Errorf("resolving short name %s: %w", value, err)
+	}
+	if len(registries) == 0 {
+		return "", fmt.Errorf("short name %s has no alias and %s has no unqualified-search registries", value, r.options.RegistriesConf)
+	}
+	if len(registries) > 1 {
+		mode, err := sysregistriesv2.GetShortNameMode(sys)
+		if err != nil {
+			return "", err
+		}
+		if mode == types.ShortNameModeEnforcing {
+			return "", fmt.Errorf("short name %s is ambiguous with short-name-mode enforcing, add an alias or use a fully qualified name", value)
+		}
+	}
+	logrus.Infof("Resolving %s using unqualified-search registries (%s)", value, origin)
+	var errs []error
+	for _, registry := range registries {
+		candidate := registry + "/" + value
+		if err := sourceExists(ctx, sys, candidate); err != nil {
+			logrus.Debugf("short name candidate %s: %s", candidate, err)
+			errs = append(errs, fmt.Errorf("%s: %w", candidate, err))
+			continue
+		}
+		logrus.Infof("Resolved %s to %s", value, candidate)
+		return candidate, nil
+	}
+	return "", fmt.Errorf("resolving short name %s: %w", value, errors.Join(errs...))
+}
+
+// sourceExists checks the registry has the image of a tagged source or the
+// repository of a repository source. Images are read through the mirrors of
+// their registry.
+func sourceExists(ctx context.Context, sys *types.SystemContext, value string) error {
+	ref, err := docker.ParseReference("//" + value)
+	if err != nil {
+		return err
+	}
+	if !hasTag(value) {
+		_, err = docker.GetRepositoryTags(ctx, sys, ref)
+		return err
+	}
+	src, err := ref.NewImageSource(ctx, sys)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	_, _, err = src.GetManifest(ctx, nil)
+	return err
+}
@@ -0,0 +1,74 @@
+package imagesync
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/sirupsen/logrus"
+)
+
+// newTestRegistry starts an in-memory registry and returns its host. wrap,
+// if not nil, wraps the registry handler, e.g. to count or fail requests.
+func newTestRegistry(t *testing.T, wrap func(http.Handler) http.Handler) string {
+	t.Helper()
+	var handler http.Handler = registry.New(registry.Logger(log.New(io.Discard, "", 0)))
+	if wrap != nil {
+		handler = wrap(handler)
+	}
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return strings.TrimPrefix(server.URL, "http://")
+}
+
+// pushTestImage pushes a random image with layers layers to host/repo:tag.
+func pushTestImage(t *testing.T, host, repo, tag string, layers int64) v1.Image {
+	t.Helper()
+	img, err := random.Image(1024, layers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := name.ParseReference(host+"/"+repo+":"+tag, name.Insecure)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = remote.Write(ref, img); err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+// testOptions returns the Options of a sync between test registries.
+func testOptions(src, dest string) Options {
+	return Options{
+		Source:        src,
+		Destination:   dest,
+		SrcPlainHTTP:  true,
+		DestPlainHTTP: true,
+	}
+}
+
+// failTag answers the manifest reads of tag with status, pushing it works.
+func failTag(tag string, status int) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPut && strings.Contains(r.URL.Path, "/manifests/") && strings.HasSuffix(r.URL.Path, "/"+tag) {
+				http.Error(w, http.StatusText(status), status)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func init() {
+	logrus.SetLevel(logrus.WarnLevel)
+}
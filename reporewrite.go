@@ -0,0 +1,63 @@
+package imagesync
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/containers/image/v5/docker/reference"
+)
+
+// repoRewrite is a single pattern=replacement rule of --repo-rewrite, the
+// pattern has to match the whole source repository.
+type repoRewrite struct {
+	re          *regexp.Regexp
+	replacement string
+}
+
+// repoRewriter maps source repositories to destination repositories, the
+// first matching rule wins.
+type repoRewriter []repoRewrite
+
+func parseRepoRewrites(rules []string) (repoRewriter, error) {
+	var rewriter repoRewriter
+	for _, rule := range rules {
+		i := strings.LastIndex(rule, "=")
+		if i <= 0 || i == len(rule)-1 {
+			return nil, fmt.Errorf("invalid repo rewrite %q, expected pattern=replacement", rule)
+		}
+		re, err := regexp.Compile("^(?:" + rule[:i] + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid repo rewrite %q: %w", rule, err)
+		}
+		rewriter = append(rewriter, repoRewrite{re: re, replacement: rule[i+1:]})
+	}
+	return rewriter, nil
+}
+
+// rewrite returns the destination repository of the source repository
+// repo, false if no rule matches. The repository is matched with its
+// registry, library/alpine as docker.io/library/alpine.
+func (r repoRewriter) rewrite(repo string) (string, bool) {
+	if len(r) == 0 {
+		return "", false
+	}
+	if named, err := reference.ParseNormalizedNamed(repo); err == nil {
+		repo = reference.TrimNamed(named).Name()
+	}
+	for _, rule := range r {
+		if match := rule.re.FindStringSubmatchIndex(repo); match != nil {
+			return string(rule.re.ExpandString(nil, rule.replacement, repo, match)), true
+		}
+	}
+	return "", false
+}
+
+// destinationOf returns the destinations of the source repository repo,
+// the --repo-rewrite of it or name below each of the prefixes otherwise.
+func (r repoRewriter) destinationOf(repo, prefixes, name string) string {
+	if dest, ok := r.rewrite(repo); ok {
+		return dest
+	}
+	return destinationsBelow(prefixes, name)
+}
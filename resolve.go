@@ -0,0 +1,151 @@
+package imagesync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// resolver connects to the addresses of --resolve instead of the resolved
+// addresses of their hosts.
+type resolver struct {
+	// overrides are the addresses by host:port, or by host for every port.
+	overrides map[string]string
+	dialer    net.Dialer
+}
+
+// parseResolves parses host[:port]=address[:port] overrides, an address
+// without port keeps the port of the connection.
+func parseResolves(values []string) (*resolver, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	r := &resolver{overrides: map[string]string{}, dialer: net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}}
+	for _, v := range values {
+		host, address, ok := strings.Cut(v, "=")
+		if !ok || host == "" || address == "" || strings.Contains(host, "/") || strings.Contains(address, "/") {
+			return nil, fmt.Errorf("invalid --resolve %q, expected host[:port]=address[:port]", v)
+		}
+		r.overrides[strings.ToLower(host)] = address
+	}
+	return r, nil
+}
+
+// address returns the address to connect to for hostport.
+func (r *resolver) address(hostport string) string {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return hostport
+	}
+	host = strings.ToLower(host)
+	address, ok := r.overrides[net.JoinHostPort(host, port)]
+	if !ok {
+		if address, ok = r.overrides[host]; !ok {
+			return hostport
+		}
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, port)
+	}
+	logrus.Debugf("connecting to %s for %s", address, hostport)
+	return address
+}
+
+func (r *resolver) dial(ctx context.Context, network, hostport string) (net.Conn, error) {
+	return r.dialer.DialContext(ctx, network, r.address(hostport))
+}
+
+// resolveProxy is the proxy of the process, containers/image reads the
+// proxy from the environment once.
+var resolveProxy struct {
+	once sync.Once
+	url  string
+	err  error
+}
+
+// setupResolve routes all connections through a proxy on the loopback
+// interface which connects to the addresses of --resolve. TLS connections
+// are tunneled, so the certificates are still verified for the hosts. The
+// proxy is started by the first sync, later syncs of the process use its
+// overrides.
+func setupResolve(r *resolver) error {
+	resolveProxy.once.Do(func() {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			resolveProxy.err = fmt.Errorf("starting the --resolve proxy: %w", err)
+			return
+		}
+		transport := &http.Transport{DialContext: r.dial, IdleConnTimeout: 90 * time.Second}
+		server := &http.Server{Handler: &resolveHandler{resolver: r, transport: transport}, ReadHeaderTimeout: 30 * time.Second}
+		go func() {
+			if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logrus.Errorf("the --resolve proxy failed: %s", err)
+			}
+		}()
+		resolveProxy.url = "http://" + listener.Addr().String()
+	})
+	return resolveProxy.err
+}
+
+type resolveHandler struct {
+	resolver  *resolver
+	transport *http.Transport
+}
+
+func (h *resolveHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodConnect {
+		h.forward(w, req)
+		return
+	}
+	upstream, err := h.resolver.dial(req.Context(), "tcp", req.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	conn, buffered, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		upstream.Close()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		conn.Close()
+		upstream.Close()
+		return
+	}
+	go func() {
+		// the reader holds the bytes the client sent after the request
+		_, _ = io.Copy(upstream, buffered.Reader)
+		upstream.Close()
+	}()
+	_, _ = io.Copy(conn, upstream)
+	conn.Close()
+}
+
+// forward sends a plain HTTP request to its host.
+func (h *resolveHandler) forward(w http.ResponseWriter, req *http.Request) {
+	out := req.Clone(req.Context())
+	out.RequestURI = ""
+	out.Header.Del("Proxy-Connection")
+	resp, err := h.transport.RoundTrip(out)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	for key, values := range resp.Header {
+		for _, v := range values {
+			w.Header().Add(key, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	_, _ = io.Copy(w, resp.Body)
+}
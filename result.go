@@ -0,0 +1,191 @@
+package imagesync
+
+import (
+	"encoding/json"
+	"io"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ResultSchemaVersion is the version of the Result JSON document. It is
+// increased on every change which isn't backwards compatible.
+const ResultSchemaVersion = 1
+
+// TagStatus is the outcome of a single tag.
+type TagStatus string
+
+const (
+	TagCopied  TagStatus = "copied"
+	TagSkipped TagStatus = "skipped"
+	TagFailed  TagStatus = "failed"
+	// TagPlanned is a tag which would be copied by a dry-run.
+	TagPlanned TagStatus = "planned"
+	// TagPruned is a destination tag deleted by --prune.
+	TagPruned TagStatus = "pruned"
+)
+
+// FailureClass groups the errors of failed tags.
+type FailureClass string
+
+const (
+	// FailureQuotaExceeded is a push the destination rejected because its
+	// quota is exhausted, the run stops dispatching tags.
+	FailureQuotaExceeded FailureClass = "quotaExceeded"
+	// FailureTransient is a rate limit, server error or network failure
+	// which outlasted the retries.
+	FailureTransient FailureClass = "transient"
+)
+
+// Result is the machine-readable result of a sync run.
+type Result struct {
+	mu sync.Mutex
+
+	SchemaVersion int              `json:"schemaVersion"`
+	Parameters    ResultParameters `json:"parameters"`
+	StartedAt     time.Time        `json:"startedAt"`
+	FinishedAt    time.Time        `json:"finishedAt"`
+	Tags          []TagResult      `json:"tags"`
+	Totals        ResultTotals     `json:"totals"`
+	// Error is the error which aborted the run, failures of single tags are
+	// reported in Tags.
+	Error string `json:"error,omitempty"`
+}
+
+// ResultParameters are the parameters of a sync run.
+type ResultParameters struct {
+	Source             string   `json:"source,omitempty"`
+	Destination        string   `json:"destination,omitempty"`
+	Config             string   `json:"config,omitempty"`
+	TagsPattern        string   `json:"tagsPattern,omitempty"`
+	SkipTagsPattern    string   `json:"skipTagsPattern,omitempty"`
+	SkipTags           []string `json:"skipTags,omitempty"`
+	Tags               []string `json:"tags,omitempty"`
+	Semver             string   `json:"semver,omitempty"`
+	KeepLatestN        int      `json:"keepLatestN,omitempty"`
+	Overwrite          bool     `json:"overwrite"`
+	MaxConcurrentTags  int      `json:"maxConcurrentTags"`
+	MaxConcurrentRepos int      `json:"maxConcurrentRepos,omitempty"`
+	DryRun             bool     `json:"dryRun,omitempty"`
+	Check              bool     `json:"check,omitempty"`
+}
+
+// TagResult is the outcome of copying a single image.
+type TagResult struct {
+	Source      string    `json:"source,omitempty"`
+	Destination string    `json:"destination"`
+	Status      TagStatus `json:"status"`
+	// Digest is the digest of the manifest in the destination, it differs
+	// from SourceDigest if the manifest was converted or platforms selected.
+	Digest       string `json:"digest,omitempty"`
+	SourceDigest string `json:"sourceDigest,omitempty"`
+	// Bytes are the copied blob bytes, blobs which already existed in the
+	// destination aren't counted. Their size is ReusedBytes.
+	Bytes           int64   `json:"bytes,omitempty"`
+	ReusedBytes     int64   `json:"reusedBytes,omitempty"`
+	DurationSeconds float64 `json:"durationSeconds,omitempty"`
+	Error           string  `json:"error,omitempty"`
+	// FailureClass classifies the Error of a failed tag, it is empty for
+	// other errors.
+	FailureClass FailureClass `json:"failureClass,omitempty"`
+	// Reason is why a tag was skipped, empty for tags the destination has.
+	Reason string `json:"reason,omitempty"`
+}
+
+// ResultTotals counts the tags of a run by status.
+type ResultTotals struct {
+	Copied  int `json:"copied"`
+	Skipped int `json:"skipped"`
+	Failed  int `json:"failed"`
+	Planned int `json:"planned,omitempty"`
+	Pruned  int `json:"pruned,omitempty"`
+	// Bytes is the sum of the copied bytes of all tags.
+	Bytes       int64 `json:"bytes"`
+	ReusedBytes int64 `json:"reusedBytes,omitempty"`
+}
+
+func newResult(options Options) *Result {
+	return &Result{
+		SchemaVersion: ResultSchemaVersion,
+		Parameters: ResultParameters{
+			Source:             options.Source,
+			Destination:        options.Destination,
+			Config:             options.Config,
+			TagsPattern:        options.TagsPattern,
+			SkipTagsPattern:    options.SkipTagsPattern,
+			SkipTags:           options.SkipTags,
+			Tags:               options.Tags,
+			Semver:             options.Semver,
+			KeepLatestN:        options.KeepLatestN,
+			Overwrite:          options.Overwrite,
+			MaxConcurrentTags:  options.MaxConcurrentTags,
+			MaxConcurrentRepos: options.MaxConcurrentRepos,
+			DryRun:             options.DryRun,
+			Check:              options.Check,
+		},
+		StartedAt: time.Now().UTC(),
+		Tags:      []TagResult{},
+	}
+}
+
+func (r *Result) addTag(tag TagResult) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Tags = append(r.Tags, tag)
+	r.Totals.Bytes += tag.Bytes
+	r.Totals.ReusedBytes += tag.ReusedBytes
+	switch tag.Status {
+	case TagCopied:
+		r.Totals.Copied++
+	case TagSkipped:
+		r.Totals.Skipped++
+	case TagFailed:
+		r.Totals.Failed++
+	case TagPlanned:
+		r.Totals.Planned++
+	case TagPruned:
+		r.Totals.Pruned++
+	}
+}
+
+func (r *Result) failed() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.Totals.Failed
+}
+
+func (r *Result) planned() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.Totals.Planned
+}
+
+// progress returns a copy of the tags and totals reported so far.
+func (r *Result) progress() ([]TagResult, ResultTotals) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.Tags), r.Totals
+}
+
+// finish sorts the tags for a stable output and records err.
+func (r *Result) finish(err error) {
+	r.FinishedAt = time.Now().UTC()
+	r.sortTags()
+	if err != nil {
+		r.Error = err.Error()
+	}
+}
+
+func (r *Result) sortTags() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sort.SliceStable(r.Tags, func(i, j int) bool { return r.Tags[i].Destination < r.Tags[j].Destination })
+}
+
+// WriteJSON writes r as a single indented JSON document.
+func (r *Result) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
@@ -0,0 +1,118 @@
+package imagesync
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var updateGolden = flag.Bool("update", false, "update the golden files")
+
+// TestResultGolden locks the JSON schema of Result, a change of the golden
+// file which isn't backwards compatible needs a new ResultSchemaVersion.
+func TestResultGolden(t *testing.T) {
+	started := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	result := &Result{
+		SchemaVersion: ResultSchemaVersion,
+		Parameters: ResultParameters{
+			Source:             "docker.io/library/alpine",
+			Destination:        "registry.internal/library/alpine",
+			TagsPattern:        `^3\.`,
+			SkipTagsPattern:    "-rc",
+			SkipTags:           []string{"edge"},
+			Tags:               []string{"3.19", "3.20"},
+			Semver:             ">=3.18",
+			KeepLatestN:        5,
+			Overwrite:          true,
+			MaxConcurrentTags:  4,
+			MaxConcurrentRepos: 2,
+			DryRun:             true,
+			Check:              true,
+		},
+		StartedAt:  started,
+		FinishedAt: started.Add(90 * time.Second),
+		Tags:       []TagResult{},
+	}
+	for _, tag := range []TagResult{
+		{
+			Source:          "docker.io/library/alpine:3.20",
+			Destination:     "registry.internal/library/alpine:3.20",
+			Status:          TagCopied,
+			Digest:          "sha256:1111111111111111111111111111111111111111111111111111111111111111",
+			SourceDigest:    "sha256:2222222222222222222222222222222222222222222222222222222222222222",
+			Bytes:           3623807,
+			ReusedBytes:     1024,
+			DurationSeconds: 2.5,
+		},
+		{
+			Source:      "docker.io/library/alpine:3.19",
+			Destination: "registry.internal/library/alpine:3.19",
+			Status:      TagSkipped,
+		},
+		{
+			Source:      "docker.io/library/alpine:3.18",
+			Destination: "registry.internal/library/alpine:3.18",
+			Status:      TagSkipped,
+			Reason:      "max-image-size",
+		},
+		{
+			Source:          "docker.io/library/alpine:3.17",
+			Destination:     "registry.internal/library/alpine:3.17",
+			Status:          TagFailed,
+			DurationSeconds: 1,
+			Error:           "writing blob: denied: quota exceeded",
+			FailureClass:    FailureQuotaExceeded,
+		},
+		{
+			Source:       "docker.io/library/alpine:3.16",
+			Destination:  "registry.internal/library/alpine:3.16",
+			Status:       TagFailed,
+			Error:        "reading manifest: received unexpected HTTP status: 503 Service Unavailable",
+			FailureClass: FailureTransient,
+		},
+		{
+			Source:      "docker.io/library/alpine:3.15",
+			Destination: "registry.internal/library/alpine:3.15",
+			Status:      TagFailed,
+			Error:       "manifest unknown",
+		},
+		{
+			Source:       "docker.io/library/alpine:3.21",
+			Destination:  "registry.internal/library/alpine:3.21",
+			Status:       TagPlanned,
+			Digest:       "sha256:3333333333333333333333333333333333333333333333333333333333333333",
+			SourceDigest: "sha256:3333333333333333333333333333333333333333333333333333333333333333",
+		},
+		{
+			Destination: "registry.internal/library/alpine:3.14",
+			Status:      TagPruned,
+			Digest:      "sha256:4444444444444444444444444444444444444444444444444444444444444444",
+			Reason:      "retention",
+		},
+	} {
+		result.addTag(tag)
+	}
+	result.sortTags()
+	result.Error = "some tags failed"
+
+	var buf bytes.Buffer
+	if err := result.WriteJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+	golden := filepath.Join("testdata", "result.golden.json")
+	if *updateGolden {
+		if err := os.WriteFile(golden, buf.Bytes(), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("the Result document differs from %s, run go test -update if the change is intended:\n%s", golden, buf.String())
+	}
+}
@@ -0,0 +1,145 @@
+package imagesync
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/containers/image/v5/image"
+	"github.com/containers/image/v5/types"
+	"github.com/samber/lo"
+	"github.com/sirupsen/logrus"
+)
+
+// retagRule points a floating destination tag like latest at the highest
+// version among the destination tags after each sync, optionally only the
+// versions matching constraint.
+type retagRule struct {
+	tag        string
+	constraint string
+}
+
+// retagRules are the --retag rules of a job, a floating tag of the source
+// isn't copied since the rule owns it.
+type retagRules []retagRule
+
+// parseRetags parses tag=highest-semver or tag=highest-semver:<constraint>
+// rules, e.g. stable=highest-semver:<2.0.
+func parseRetags(values []string) (retagRules, error) {
+	var rules retagRules
+	for _, v := range values {
+		tag, policy, ok := strings.Cut(v, "=")
+		if !ok || !validTag.MatchString(tag) {
+			return nil, fmt.Errorf("invalid --retag %q, expected tag=highest-semver", v)
+		}
+		var constraint string
+		if policy != "highest-semver" {
+			if constraint, ok = strings.CutPrefix(policy, "highest-semver:"); !ok || constraint == "" {
+				return nil, fmt.Errorf("invalid --retag %q, the policy is highest-semver or highest-semver:<constraint>", v)
+			}
+			if _, err := semver.NewConstraint(constraint); err != nil {
+				return nil, fmt.Errorf("invalid --retag %q: %w", v, err)
+			}
+		}
+		if rules.has(tag) {
+			return nil, fmt.Errorf("--retag %s is given twice", tag)
+		}
+		rules = append(rules, retagRule{tag: tag, constraint: constraint})
+	}
+	return rules, nil
+}
+
+func (rules retagRules) has(tag string) bool {
+	return lo.SomeBy(rules, func(rule retagRule) bool { return rule.tag == tag })
+}
+
+func (rules retagRules) tags() []string {
+	return lo.Map(rules, func(rule retagRule, _ int) string { return rule.tag })
+}
+
+// retag points the floating tags of the rules at their version in dest.
+// Only the manifest is pushed, the destination has the blobs of the version
+// already. A floating tag already having the digest is left alone.
+func (r *syncRun) retag(ctx context.Context, dest destination, destRepository types.ImageReference) error {
+	if dest.kind != destinationRegistry && dest.kind != destinationOCILayout {
+		logrus.Warnf("--retag only applies to registry and oci destinations, skipping %s", dest.value)
+		return nil
+	}
+	sys := r.opts.DestinationCtx
+	destTags, err := dest.tags(ctx, sys, destRepository)
+	if err != nil {
+		return fmt.Errorf("getting destination tags: %w", err)
+	}
+	destTags = slices.DeleteFunc(destTags, func(tag string) bool {
+		return referrerTagPattern.MatchString(tag) || r.job.Retag.has(tag)
+	})
+	for _, rule := range r.job.Retag {
+		versions, err := filterSemver(destTags, rule.constraint, 1)
+		if err != nil {
+			return err
+		}
+		floatRef, err := dest.tagReference(rule.tag)
+		if err != nil {
+			return fmt.Errorf("parsing dest ref: %w", err)
+		}
+		if len(versions) == 0 {
+			logrus.Warnf("not pointing %s, no tag is a matching version", refName(floatRef))
+			continue
+		}
+		targetRef, err := dest.tagReference(versions[0])
+		if err != nil {
+			return fmt.Errorf("parsing dest ref: %w", err)
+		}
+		result := TagResult{Source: refName(targetRef), Destination: refName(floatRef), Status: TagCopied, Reason: "retag"}
+		dgst, err := referenceDigest(ctx, sys, targetRef)
+		if err != nil {
+			logrus.Warnf("failed pointing %s at %s: %s", refName(floatRef), versions[0], err)
+			result.Status, result.Error = TagFailed, fmt.Sprintf("retag: %s", err)
+			r.addTag(result)
+			continue
+		}
+		result.Digest = dgst.String()
+		if current, err := referenceDigest(ctx, sys, floatRef); err == nil && current == dgst {
+			logrus.Debugf("%s already points at %s", refName(floatRef), versions[0])
+			continue
+		}
+		fields := logrus.Fields{"destination": refName(floatRef), "tag": versions[0], "digest": dgst}
+		if r.options.DryRun {
+			logrus.WithFields(fields).Info("Would point tag")
+			continue
+		}
+		if err = pointTag(ctx, sys, targetRef, floatRef); err != nil {
+			logrus.Warnf("failed pointing %s at %s: %s", refName(floatRef), versions[0], err)
+			result.Status, result.Error = TagFailed, fmt.Sprintf("retag: %s", err)
+		} else {
+			logrus.WithFields(fields).Info("Pointed tag")
+		}
+		r.addTag(result)
+	}
+	return nil
+}
+
+// pointTag pushes the manifest of targetRef as floatRef in the same
+// repository.
+func pointTag(ctx context.Context, sys *types.SystemContext, targetRef, floatRef types.ImageReference) error {
+	src, err := targetRef.NewImageSource(ctx, sys)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	manifestBlob, _, err := src.GetManifest(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("reading manifest: %w", err)
+	}
+	dest, err := floatRef.NewImageDestination(ctx, sys)
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+	if err = dest.PutManifest(ctx, manifestBlob, nil); err != nil {
+		return fmt.Errorf("writing manifest: %w", err)
+	}
+	return dest.Commit(ctx, image.UnparsedInstance(src, nil))
+}
@@ -0,0 +1,204 @@
+package imagesync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/types"
+	"github.com/samber/lo"
+	"github.com/sirupsen/logrus"
+)
+
+// configRetention is the retention key of a config file repository.
+type configRetention struct {
+	KeepLatestPerMinor      int      `yaml:"keep-latest-per-minor"`
+	KeepPattern             []string `yaml:"keep-pattern"`
+	DeleteUntaggedOlderThan string   `yaml:"delete-untagged-older-than"`
+}
+
+// retentionPolicy is applied to the registry destinations of a repository
+// after each sync. With a keep rule the destination tags none of the rules
+// keeps are deleted, untagged manifests are deleted once they are older
+// than untaggedAge.
+type retentionPolicy struct {
+	keepLatestPerMinor int
+	keepPatterns       []*regexp.Regexp
+	untaggedAge        time.Duration
+}
+
+func parseRetention(c configRetention) (*retentionPolicy, error) {
+	if c.KeepLatestPerMinor < 0 {
+		return nil, fmt.Errorf("invalid retention keep-latest-per-minor %d", c.KeepLatestPerMinor)
+	}
+	p := &retentionPolicy{keepLatestPerMinor: c.KeepLatestPerMinor}
+	for _, pattern := range c.KeepPattern {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid retention keep-pattern %q: %w", pattern, err)
+		}
+		p.keepPatterns = append(p.keepPatterns, re)
+	}
+	var err error
+	if p.untaggedAge, err = parseAge("retention delete-untagged-older-than", c.DeleteUntaggedOlderThan); err != nil {
+		return nil, err
+	}
+	if !p.hasTagRules() && p.untaggedAge == 0 {
+		return nil, errors.New("retention needs keep-latest-per-minor, keep-pattern or delete-untagged-older-than")
+	}
+	return p, nil
+}
+
+func (p *retentionPolicy) hasTagRules() bool {
+	return p.keepLatestPerMinor > 0 || len(p.keepPatterns) > 0
+}
+
+// retained returns the tags a rule keeps: those matching a keep pattern and
+// the newest keepLatestPerMinor versions of every major.minor. Pre-releases
+// and tags which aren't versions are only kept by a pattern.
+func (p *retentionPolicy) retained(tags []string) []string {
+	keep := map[string]bool{}
+	for _, tag := range tags {
+		keep[tag] = lo.SomeBy(p.keepPatterns, func(re *regexp.Regexp) bool { return re.MatchString(tag) })
+	}
+	if p.keepLatestPerMinor > 0 {
+		type versionTag struct {
+			tag     string
+			version *semver.Version
+		}
+		minors := map[string][]versionTag{}
+		for _, tag := range tags {
+			v, err := semver.NewVersion(tag)
+			if err != nil || v.Prerelease() != "" {
+				continue
+			}
+			minor := fmt.Sprintf("%d.%d", v.Major(), v.Minor())
+			minors[minor] = append(minors[minor], versionTag{tag: tag, version: v})
+		}
+		for _, versions := range minors {
+			sort.SliceStable(versions, func(i, j int) bool { return versions[j].version.LessThan(versions[i].version) })
+			for _, v := range versions[:min(p.keepLatestPerMinor, len(versions))] {
+				keep[v.tag] = true
+			}
+		}
+	}
+	return lo.Filter(tags, func(tag string, _ int) bool { return keep[tag] })
+}
+
+// applyRetention enforces the retention policy of the job on the registry
+// destination dest, in dry-run mode the tags and manifests are only listed.
+// It fails without deleting tags if the digest of a kept tag can't be read.
+func (r *syncRun) applyRetention(ctx context.Context, dest destination, destRepository types.ImageReference) error {
+	policy := r.job.Retention
+	if dest.kind != destinationRegistry {
+		logrus.Warnf("retention only applies to registry destinations, skipping %s", dest.value)
+		return nil
+	}
+	name := destRepository.DockerReference().Name()
+	if policy.hasTagRules() {
+		destTags, err := dest.tags(ctx, r.opts.DestinationCtx, destRepository)
+		if err != nil {
+			return fmt.Errorf("getting destination tags: %w", err)
+		}
+		// signatures created by --sign-cosign-* only exist in the destination
+		destTags = slices.DeleteFunc(destTags, referrerTagPattern.MatchString)
+		kept := policy.retained(destTags)
+		expired := subtract(destTags, kept)
+		logrus.Infof("Retention keeps %d of %d tags of %s", len(kept), len(destTags), name)
+		deletions, err := r.deleteTags(ctx, dest, expired, kept)
+		if err != nil {
+			return fmt.Errorf("retention of %s: %w", name, err)
+		}
+		for _, d := range deletions {
+			destTagRef, err := dest.tagReference(d.Tag)
+			if err != nil {
+				continue
+			}
+			switch d.Status {
+			case deletionDeleted:
+				r.addTag(TagResult{Destination: refName(destTagRef), Status: TagPruned, Digest: d.Digest, Reason: "retention"})
+			case deletionFailed:
+				r.addTag(TagResult{Destination: refName(destTagRef), Status: TagFailed, Digest: d.Digest, Error: fmt.Sprintf("retention: %s", d.Error)})
+			}
+		}
+	}
+	if policy.untaggedAge > 0 {
+		return r.deleteUntagged(ctx, destRepository.DockerReference())
+	}
+	return nil
+}
+
+// harborArtifact is the part of a Harbor artifact the retention reads.
+type harborArtifact struct {
+	Digest   string    `json:"digest"`
+	PushTime time.Time `json:"push_time"`
+	Tags     []struct {
+		Name string `json:"name"`
+	} `json:"tags"`
+}
+
+// deleteUntagged deletes the untagged manifests of the repository which were
+// pushed longer than the untagged age of the retention ago. The registry API
+// can't list untagged manifests, only Harbor's API can.
+func (r *syncRun) deleteUntagged(ctx context.Context, named reference.Named) error {
+	host := reference.Domain(named)
+	project, repository, ok := strings.Cut(reference.Path(named), "/")
+	api := newHarborAPI(host, r.opts.DestinationCtx)
+	session := r.harbor
+	if session == nil {
+		session = &harborSession{hosts: map[string]bool{}, projects: map[string]bool{}}
+	}
+	if !ok || !session.isHarbor(ctx, api) {
+		logrus.Warnf("skipping delete-untagged-older-than for %s, only Harbor registries list untagged manifests", named.Name())
+		return nil
+	}
+
+	path := "/projects/" + url.PathEscape(project) + "/repositories/" + url.PathEscape(url.PathEscape(repository)) + "/artifacts"
+	cutoff := time.Now().Add(-r.job.Retention.untaggedAge)
+	const pageSize = 100
+	var expired []string
+	for page := 1; ; page++ {
+		var artifacts []harborArtifact
+		status, err := api.do(ctx, http.MethodGet, fmt.Sprintf("%s?with_tag=true&page=%d&page_size=%d", path, page, pageSize), nil, &artifacts, http.StatusOK, http.StatusNotFound)
+		if err != nil {
+			return fmt.Errorf("listing the artifacts of %s: %w", named.Name(), err)
+		}
+		if status == http.StatusNotFound {
+			return nil
+		}
+		for _, a := range artifacts {
+			if len(a.Tags) == 0 && !a.PushTime.IsZero() && a.PushTime.Before(cutoff) {
+				expired = append(expired, a.Digest)
+			}
+		}
+		if len(artifacts) < pageSize {
+			break
+		}
+	}
+
+	for _, dgst := range expired {
+		fields := logrus.Fields{"repository": named.Name(), "digest": dgst}
+		if r.options.DryRun {
+			logrus.WithFields(fields).Info("Would delete untagged manifest")
+			continue
+		}
+		result := TagResult{Destination: named.Name() + "@" + dgst, Status: TagPruned, Digest: dgst, Reason: "retention"}
+		if _, err := api.do(ctx, http.MethodDelete, path+"/"+url.PathEscape(dgst), nil, nil, http.StatusOK, http.StatusNotFound); err != nil {
+			logrus.WithFields(fields).Warnf("failed deleting untagged manifest: %s", err)
+			result.Status, result.Error = TagFailed, fmt.Sprintf("retention: %s", err)
+		} else {
+			logrus.WithFields(fields).Info("Deleted untagged manifest")
+		}
+		r.addTag(result)
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package imagesync
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"regexp"
+	"syscall"
+	"time"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/docker/distribution/registry/api/errcode"
+	"github.com/sirupsen/logrus"
+)
+
+// maxRetryDelay caps the exponential backoff between two attempts.
+const maxRetryDelay = 5 * time.Minute
+
+var (
+	serverErrorStatus = regexp.MustCompile(`(status code from registry|unexpected HTTP status:) 5\d\d`)
+	throttledStatus   = regexp.MustCompile(`(status code from registry|unexpected HTTP status:) (429|503)`)
+)
+
+// withRetry calls fn until it succeeds, returns an error which isn't
+// transient or maxRetries retries are used up. The delay between attempts
+// doubles starting with delay and is jittered to spread concurrent retries.
+//
+// 429 responses are already retried by the registry client honoring
+// Retry-After, a tag failing with one anyway waits for the maximum delay.
+func withRetry(ctx context.Context, maxRetries int, delay time.Duration, what string, fn func() error) error {
+	// doubled after every attempt, stops growing at the cap so it can't
+	// overflow, a negative delay retries at once
+	next := max(min(delay, maxRetryDelay), 0)
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= maxRetries || !isTransient(err) {
+			return err
+		}
+
+		backoff := next
+		next = min(next*2, maxRetryDelay)
+		if errors.Is(err, docker.ErrTooManyRequests) {
+			backoff = maxRetryDelay
+		}
+		// jitter within [backoff/2, backoff]
+		backoff = backoff/2 + rand.N(backoff/2+1)
+		logrus.Warnf("attempt %d of %d for %s failed, retrying in %s: %s", attempt+1, maxRetries+1, what, backoff.Round(time.Millisecond), err)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// isTransient reports whether err is worth retrying: rate limits, server
+// errors and network failures.
+func isTransient(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || isQuotaExceeded(err) {
+		return false
+	}
+	if errors.Is(err, docker.ErrTooManyRequests) {
+		return true
+	}
+
+	var ec errcode.Error
+	if errors.As(err, &ec) {
+		switch ec.Code {
+		case errcode.ErrorCodeTooManyRequests, errcode.ErrorCodeUnavailable:
+			return true
+		}
+	}
+	var ecs errcode.Errors
+	if errors.As(err, &ecs) {
+		for _, e := range ecs {
+			if isTransient(e) {
+				return true
+			}
+		}
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+
+	return serverErrorStatus.MatchString(err.Error())
+}
+
+// isThrottled reports whether err is a 429 or 503 response of a registry,
+// the registry asks for fewer requests.
+func isThrottled(err error) bool {
+	if errors.Is(err, docker.ErrTooManyRequests) {
+		return true
+	}
+	var ec errcode.Error
+	if errors.As(err, &ec) {
+		return ec.Code == errcode.ErrorCodeTooManyRequests || ec.Code == errcode.ErrorCodeUnavailable
+	}
+	var ecs errcode.Errors
+	if errors.As(err, &ecs) {
+		for _, e := range ecs {
+			if isThrottled(e) {
+				return true
+			}
+		}
+	}
+	return throttledStatus.MatchString(err.Error())
+}
@@ -0,0 +1,116 @@
+package imagesync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWithRetry(t *testing.T) {
+	transient := &net.OpError{Op: "dial", Err: errors.New("connection refused")}
+	permanent := errors.New("manifest unknown")
+	for _, tt := range []struct {
+		name       string
+		maxRetries int
+		// errs are returned by the attempts in order, nil afterwards
+		errs      []error
+		wantCalls int
+		wantErr   error
+	}{
+		{"success", 3, nil, 1, nil},
+		{"transient", 3, []error{transient, transient}, 3, nil},
+		{"retries used up", 2, []error{transient, transient, transient, transient}, 3, transient},
+		{"permanent", 3, []error{permanent}, 1, permanent},
+		{"no retries", 0, []error{transient}, 1, transient},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			err := withRetry(context.Background(), tt.maxRetries, time.Millisecond, "test", func() error {
+				calls++
+				if calls <= len(tt.errs) {
+					return tt.errs[calls-1]
+				}
+				return nil
+			})
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("withRetry() = %v, want %v", err, tt.wantErr)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("fn called %d times, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	for _, tt := range []struct {
+		err  error
+		want bool
+	}{
+		{errors.New("reading manifest 1 in registry.internal/app: received unexpected HTTP status: 503 Service Unavailable"), true},
+		{errors.New("fetching blob: received unexpected HTTP status: 502 Bad Gateway"), true},
+		{errors.New("writing blob: invalid status code from registry 500 (Internal Server Error)"), true},
+		{errors.New("reading manifest 1 in registry.internal/app: manifest unknown"), false},
+		{errors.New("received unexpected HTTP status: 404 Not Found"), false},
+		{fmt.Errorf("copying: %w", context.Canceled), false},
+	} {
+		if got := isTransient(tt.err); got != tt.want {
+			t.Errorf("isTransient(%q) = %t, want %t", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestWithRetryCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	err := withRetry(ctx, 5, time.Hour, "test", func() error {
+		calls++
+		cancel()
+		return &net.OpError{Op: "dial", Err: errors.New("connection refused")}
+	})
+	if err == nil || calls != 1 {
+		t.Errorf("withRetry() = %v after %d calls, want the error of the only call", err, calls)
+	}
+}
+
+// TestSyncRetriesServerErrors syncs from a registry answering the first
+// manifest reads of a tag with 503.
+func TestSyncRetriesServerErrors(t *testing.T) {
+	for _, tt := range []struct {
+		failures   int32
+		maxRetries int
+		want       ResultTotals
+	}{
+		{2, 2, ResultTotals{Copied: 1}},
+		{2, 1, ResultTotals{Failed: 1}},
+	} {
+		t.Run(fmt.Sprintf("%d failures %d retries", tt.failures, tt.maxRetries), func(t *testing.T) {
+			var served atomic.Int32
+			src := newTestRegistry(t, func(next http.Handler) http.Handler {
+				return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					if r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/manifests/1") && served.Add(1) <= tt.failures {
+						http.Error(w, "unavailable", http.StatusServiceUnavailable)
+						return
+					}
+					next.ServeHTTP(w, r)
+				})
+			})
+			dest := newTestRegistry(t, nil)
+			pushTestImage(t, src, "app", "1", 1)
+
+			opts := testOptions(src+"/app:1", dest+"/app:1")
+			opts.MaxRetries = tt.maxRetries
+			opts.RetryDelay = time.Millisecond
+			result, _ := (&Syncer{}).Sync(context.Background(), opts)
+			if got := result.totals(); got.Copied != tt.want.Copied || got.Failed != tt.want.Failed {
+				t.Errorf("copied %d and failed %d tags, want %d and %d", got.Copied, got.Failed, tt.want.Copied, tt.want.Failed)
+			}
+		})
+	}
+}
@@ -0,0 +1,180 @@
+package imagesync
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+
+	"github.com/containers/image/v5/types"
+	"github.com/samber/lo"
+	"github.com/sirupsen/logrus"
+)
+
+// scanSeverities are the vulnerability severities of --severity-threshold
+// from lowest to highest.
+var scanSeverities = []string{"low", "medium", "high", "critical"}
+
+// scanGate scans the source images with trivy or grype before they are
+// copied, images with vulnerabilities of the threshold severity or higher
+// aren't copied. A nil scanGate copies every image.
+type scanGate struct {
+	scanner string
+	binary  string
+	// severities are the severities at or above the threshold.
+	severities []string
+}
+
+// vulnerability is a vulnerability found by a scanner.
+type vulnerability struct {
+	ID       string
+	Severity string
+}
+
+func newScanGate(opts Options) (*scanGate, error) {
+	if !opts.ScanBeforePush {
+		return nil, nil
+	}
+	threshold := strings.ToLower(opts.SeverityThreshold)
+	i := slices.Index(scanSeverities, threshold)
+	if i < 0 {
+		return nil, fmt.Errorf("unsupported --severity-threshold %q, expected %s", opts.SeverityThreshold, strings.Join(scanSeverities, ", "))
+	}
+	switch opts.Scanner {
+	case "trivy", "grype":
+	default:
+		return nil, fmt.Errorf("unsupported --scanner %q, expected trivy or grype", opts.Scanner)
+	}
+	binary, err := exec.LookPath(opts.Scanner)
+	if err != nil {
+		return nil, fmt.Errorf("--scan-before-push needs %s: %w", opts.Scanner, err)
+	}
+	return &scanGate{scanner: opts.Scanner, binary: binary, severities: scanSeverities[i:]}, nil
+}
+
+// scanSource scans srcRef and records it as skipped for destRefs if the
+// scanner found vulnerabilities at or above the threshold. A failing scan
+// fails the tag, an image which wasn't scanned isn't copied either.
+func (r *syncRun) scanSource(ctx context.Context, destRefs []types.ImageReference, srcRef types.ImageReference) (bool, error) {
+	if r.scan == nil {
+		return true, nil
+	}
+	found, err := r.scan.scan(ctx, refName(srcRef), r.opts.SourceCtx, r.job.Platforms)
+	if err != nil {
+		err = fmt.Errorf("scanning %s with %s: %w", refName(srcRef), r.scan.scanner, err)
+		r.recordCopies(ctx, destRefs, srcRef, transferred{}, err)
+		return false, err
+	}
+	if len(found) == 0 {
+		return true, nil
+	}
+	ids := lo.Map(found[:min(len(found), 5)], func(v vulnerability, _ int) string { return v.ID })
+	if len(found) > len(ids) {
+		ids = append(ids, "...")
+	}
+	reason := fmt.Sprintf("%s found %d vulnerabilities of severity %s or higher: %s", r.scan.scanner, len(found), r.scan.severities[0], strings.Join(ids, ", "))
+	logrus.Warnf("Skipping %s, %s", refName(srcRef), reason)
+	for _, destRef := range destRefs {
+		r.addTag(TagResult{Source: refName(srcRef), Destination: refName(destRef), Status: TagSkipped, Reason: reason})
+	}
+	return false, nil
+}
+
+// scan runs the scanner for the registry image ref and returns the
+// vulnerabilities at or above the threshold. Manifest lists are scanned
+// for the first selected platform, by default for the platform of the
+// host. The source credentials are passed on.
+func (g *scanGate) scan(ctx context.Context, ref string, sys *types.SystemContext, platforms platformFilter) ([]vulnerability, error) {
+	insecure := sys.DockerInsecureSkipTLSVerify == types.OptionalBoolTrue
+	cmd := exec.CommandContext(ctx, g.binary)
+	cmd.Env = os.Environ()
+	auth := sys.DockerAuthConfig
+	if auth != nil && auth.Username == "" {
+		auth = nil
+	}
+	switch g.scanner {
+	case "trivy":
+		cmd.Args = append(cmd.Args, "image", "--quiet", "--format", "json", "--scanners", "vuln")
+		if insecure {
+			cmd.Args = append(cmd.Args, "--insecure")
+		}
+		if auth != nil {
+			cmd.Env = append(cmd.Env, "TRIVY_USERNAME="+auth.Username, "TRIVY_PASSWORD="+auth.Password)
+		}
+	case "grype":
+		cmd.Args = append(cmd.Args, "--quiet", "--output", "json")
+		ref = "registry:" + ref
+		if insecure {
+			cmd.Env = append(cmd.Env, "GRYPE_REGISTRY_INSECURE_SKIP_TLS_VERIFY=true", "GRYPE_REGISTRY_INSECURE_USE_HTTP=true")
+		}
+		if auth != nil {
+			cmd.Env = append(cmd.Env, "GRYPE_REGISTRY_AUTH_USERNAME="+auth.Username, "GRYPE_REGISTRY_AUTH_PASSWORD="+auth.Password)
+		}
+	}
+	if len(platforms) > 0 {
+		p := platforms[0]
+		platform := p.OS + "/" + p.Architecture
+		if p.Variant != "" {
+			platform += "/" + p.Variant
+		}
+		cmd.Args = append(cmd.Args, "--platform", platform)
+	}
+	cmd.Args = append(cmd.Args, ref)
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	vulns, err := g.parseReport(stdout.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("parsing report: %w", err)
+	}
+	return lo.Filter(vulns, func(v vulnerability, _ int) bool { return slices.Contains(g.severities, strings.ToLower(v.Severity)) }), nil
+}
+
+// parseReport returns the vulnerabilities of a JSON report of the scanner,
+// each vulnerability once.
+func (g *scanGate) parseReport(report []byte) ([]vulnerability, error) {
+	var vulns []vulnerability
+	switch g.scanner {
+	case "trivy":
+		var r struct {
+			Results []struct {
+				Vulnerabilities []struct {
+					VulnerabilityID string
+					Severity        string
+				}
+			}
+		}
+		if err := json.Unmarshal(report, &r); err != nil {
+			return nil, err
+		}
+		for _, result := range r.Results {
+			for _, v := range result.Vulnerabilities {
+				vulns = append(vulns, vulnerability{ID: v.VulnerabilityID, Severity: v.Severity})
+			}
+		}
+	case "grype":
+		var r struct {
+			Matches []struct {
+				Vulnerability struct {
+					ID       string `json:"id"`
+					Severity string `json:"severity"`
+				} `json:"vulnerability"`
+			} `json:"matches"`
+		}
+		if err := json.Unmarshal(report, &r); err != nil {
+			return nil, err
+		}
+		for _, m := range r.Matches {
+			vulns = append(vulns, vulnerability{ID: m.Vulnerability.ID, Severity: m.Vulnerability.Severity})
+		}
+	}
+	return lo.Uniq(vulns), nil
+}
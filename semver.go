@@ -0,0 +1,48 @@
+package imagesync
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/Masterminds/semver/v3"
+)
+
+// filterSemver keeps the tags which are semantic versions matching
+// constraint, sorted by version. With keepLatest > 0 only the newest
+// keepLatest versions are kept. Tags which aren't versions are dropped, like
+// the constraints do pre-releases are dropped unless constraint includes them.
+func filterSemver(tags []string, constraint string, keepLatest int) ([]string, error) {
+	var c *semver.Constraints
+	if constraint != "" {
+		var err error
+		if c, err = semver.NewConstraint(constraint); err != nil {
+			return nil, fmt.Errorf("%q is not a valid semver constraint: %w", constraint, err)
+		}
+	}
+
+	type versionTag struct {
+		tag     string
+		version *semver.Version
+	}
+	var versions []versionTag
+	for _, tag := range tags {
+		v, err := semver.NewVersion(tag)
+		if err != nil {
+			continue
+		}
+		if (c == nil && v.Prerelease() != "") || (c != nil && !c.Check(v)) {
+			continue
+		}
+		versions = append(versions, versionTag{tag: tag, version: v})
+	}
+	sort.SliceStable(versions, func(i, j int) bool { return versions[i].version.LessThan(versions[j].version) })
+	if keepLatest > 0 && len(versions) > keepLatest {
+		versions = versions[len(versions)-keepLatest:]
+	}
+
+	filtered := make([]string, 0, len(versions))
+	for _, v := range versions {
+		filtered = append(filtered, v.tag)
+	}
+	return filtered, nil
+}
@@ -0,0 +1,266 @@
+package imagesync
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	// syncQueueSize is the number of syncs waiting to run, further webhooks
+	// and API requests are rejected until the queue drains.
+	syncQueueSize  = 100
+	maxWebhookSize = 1 << 20
+	// maxServerRuns is the number of runs kept for /history.
+	maxServerRuns = 200
+)
+
+// runStatus is the state of a sync run by the server.
+type runStatus string
+
+const (
+	runQueued    runStatus = "queued"
+	runRunning   runStatus = "running"
+	runSucceeded runStatus = "succeeded"
+	runFailed    runStatus = "failed"
+)
+
+// syncServer runs the syncs triggered by webhooks, the API and --watch one
+// after another in the order they were queued.
+type syncServer struct {
+	c            *cli.Context
+	syncer       *Syncer
+	webhookToken string
+	apiToken     string
+	queue        chan *serverRun
+
+	mu sync.Mutex
+	// runs are the recent runs, the oldest first.
+	runs []*serverRun
+}
+
+// serverRun is a sync queued by the server. The status and times are
+// guarded by the mutex of the server.
+type serverRun struct {
+	id      string
+	trigger string
+	opts    Options
+	result  *Result
+
+	status     runStatus
+	queuedAt   time.Time
+	startedAt  time.Time
+	finishedAt time.Time
+	err        error
+}
+
+// serveSyncs serves the webhooks and the API until SIGINT or SIGTERM, with
+// --watch a full sync runs at start and every --interval in between.
+func serveSyncs(c *cli.Context, syncer *Syncer) error {
+	var interval time.Duration
+	if c.Bool("watch") {
+		if interval = c.Duration("interval"); interval <= 0 {
+			return errors.New("--interval must be positive")
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	ln, err := net.Listen("tcp", c.String("listen"))
+	if err != nil {
+		return fmt.Errorf("listening for webhooks: %w", err)
+	}
+	s := &syncServer{
+		c:            c,
+		syncer:       syncer,
+		webhookToken: c.String("webhook-token"),
+		apiToken:     c.String("api-token"),
+		queue:        make(chan *serverRun, syncQueueSize),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/webhook", s.serveWebhook)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) { _, _ = io.WriteString(w, "ok\n") })
+	if s.apiToken != "" {
+		s.registerAPI(mux)
+	}
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logrus.Errorf("listener stopped: %s", err)
+			stop()
+		}
+	}()
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			logrus.Warnf("failed stopping listener: %s", err)
+		}
+	}()
+	logrus.Infof("Serving webhooks on http://%s/webhook", ln.Addr())
+
+	// a nil channel never fires without --watch
+	var fullSync <-chan time.Time
+	if interval > 0 {
+		fullSync = time.After(0)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			logrus.Info("Received shutdown signal, stopped serving.")
+			return nil
+		case <-fullSync:
+			if opts, err := syncOptions(c); err != nil {
+				logrus.Errorf("full sync failed: %s", err)
+			} else {
+				run := s.newRun("schedule", opts)
+				s.add(run)
+				s.execute(ctx, run)
+			}
+			fullSync = time.After(interval)
+		case run := <-s.queue:
+			s.execute(ctx, run)
+		}
+	}
+}
+
+func (s *syncServer) newRun(trigger string, opts Options) *serverRun {
+	opts = opts.withDefaults()
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	return &serverRun{
+		id:       hex.EncodeToString(id),
+		trigger:  trigger,
+		opts:     opts,
+		result:   newResult(opts),
+		status:   runQueued,
+		queuedAt: time.Now().UTC(),
+	}
+}
+
+// enqueue queues run, it reports false if the queue is full.
+func (s *syncServer) enqueue(run *serverRun) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case s.queue <- run:
+		s.addLocked(run)
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *syncServer) add(run *serverRun) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.addLocked(run)
+}
+
+// addLocked records run, dropping the oldest finished runs beyond
+// maxServerRuns.
+func (s *syncServer) addLocked(run *serverRun) {
+	s.runs = append(s.runs, run)
+	for len(s.runs) > maxServerRuns && s.runs[0].finished() {
+		s.runs = s.runs[1:]
+	}
+}
+
+func (r *serverRun) finished() bool {
+	return r.status == runSucceeded || r.status == runFailed
+}
+
+func (s *syncServer) execute(ctx context.Context, run *serverRun) {
+	s.mu.Lock()
+	run.status, run.startedAt = runRunning, time.Now().UTC()
+	s.mu.Unlock()
+
+	logrus.Infof("Starting %s sync %s", run.trigger, run.id)
+	err := reportResult(s.c, run.opts, run.result, s.syncer.syncInto(ctx, run.opts, run.result))
+	if err != nil && ctx.Err() == nil {
+		logrus.Errorf("%s sync %s failed: %s", run.trigger, run.id, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	run.status, run.finishedAt, run.err = runSucceeded, time.Now().UTC(), err
+	if err != nil {
+		run.status = runFailed
+	}
+}
+
+// serveWebhook queues a sync for every push of the webhook.
+func (s *syncServer) serveWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !webhookAuthorized(r, s.webhookToken) {
+		http.Error(w, "invalid webhook token", http.StatusUnauthorized)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	pushes, err := parseWebhook(body)
+	if err != nil {
+		logrus.Warnf("rejected webhook: %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(pushes) == 0 {
+		logrus.Debug("ignored webhook without pushed tags")
+		w.WriteHeader(http.StatusOK)
+		_, _ = io.WriteString(w, "ignored\n")
+		return
+	}
+	for _, push := range pushes {
+		opts, err := syncOptions(s.c)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		opts.PushedRepository = push.Repository
+		opts.PushedTags = push.Tags
+		if !s.enqueue(s.newRun("webhook", opts)) {
+			http.Error(w, "too many pending syncs", http.StatusServiceUnavailable)
+			return
+		}
+		logrus.Infof("Received push of %s to %s", strings.Join(push.Tags, ", "), push.Repository)
+	}
+	w.WriteHeader(http.StatusAccepted)
+	_, _ = io.WriteString(w, "accepted\n")
+}
+
+// webhookAuthorized reports whether r has the token as token query
+// parameter or in the Authorization header, either plain like Harbor sends
+// it or as a bearer token. An empty token accepts every request.
+func webhookAuthorized(r *http.Request, token string) bool {
+	if token == "" {
+		return true
+	}
+	given := r.URL.Query().Get("token")
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		given, _ = strings.CutPrefix(auth, "Bearer ")
+	}
+	return subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
@@ -0,0 +1,156 @@
+package imagesync
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containers/image/v5/copy"
+	"github.com/containers/image/v5/signature"
+	"github.com/containers/image/v5/signature/signer"
+	"github.com/containers/image/v5/signature/sigstore"
+	"github.com/containers/image/v5/signature/sigstore/fulcio"
+	"github.com/containers/image/v5/signature/sigstore/rekor"
+	"github.com/samber/lo"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultFulcioURL = "https://fulcio.sigstore.dev"
+	defaultRekorURL  = "https://rekor.sigstore.dev"
+)
+
+// registriesDConfig enables writing sigstore signatures as cosign compatible
+// sha256-<digest>.sig tags to every registry.
+const registriesDConfig = "default-docker:\n  use-sigstore-attachments: true\n"
+
+// signing signs copied images with sigstore signatures or GPG simple
+// signing signatures, a nil signing doesn't sign.
+type signing struct {
+	// signer is the sigstore signer, nil for simple signing.
+	signer *signer.Signer
+	// registriesDir is a registries.d directory enabling sigstore attachments.
+	registriesDir string
+	// signBy is the fingerprint of the GPG key of simple signing.
+	signBy     string
+	passphrase string
+}
+
+func newSigning(opts Options) (*signing, error) {
+	if opts.SignBy != "" {
+		return newSimpleSigning(opts)
+	}
+	if opts.SignCosignKey == "" && opts.SignCosignIdentityToken == "" {
+		return nil, nil
+	}
+	if opts.SignCosignKey != "" && opts.SignCosignIdentityToken != "" {
+		return nil, errors.New("--sign-cosign-key and --sign-cosign-identity can't be used together")
+	}
+
+	var signerOpts []sigstore.Option
+	rekorURL := opts.SignRekorURL
+	if opts.SignCosignKey != "" {
+		signerOpts = append(signerOpts, sigstore.WithPrivateKeyFile(opts.SignCosignKey, []byte(opts.SignCosignPassphrase)))
+	} else {
+		fulcioURL, err := url.Parse(lo.CoalesceOrEmpty(opts.SignFulcioURL, defaultFulcioURL))
+		if err != nil {
+			return nil, fmt.Errorf("parsing fulcio url: %w", err)
+		}
+		signerOpts = append(signerOpts, fulcio.WithFulcioAndPreexistingOIDCIDToken(fulcioURL, opts.SignCosignIdentityToken))
+		rekorURL = lo.CoalesceOrEmpty(rekorURL, defaultRekorURL)
+	}
+	if rekorURL != "" {
+		u, err := url.Parse(rekorURL)
+		if err != nil {
+			return nil, fmt.Errorf("parsing rekor url: %w", err)
+		}
+		signerOpts = append(signerOpts, rekor.WithRekor(u))
+	}
+
+	s, err := sigstore.NewSigner(signerOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("creating signer: %w", err)
+	}
+
+	dir, err := newSigstoreRegistriesDir()
+	if err != nil {
+		_ = s.Close()
+		return nil, err
+	}
+	return &signing{signer: s, registriesDir: dir}, nil
+}
+
+// newSimpleSigning signs with the GPG key of opts.SignBy from the keyring of
+// GNUPGHOME. The signatures are stored where registries.d configures it for
+// the destination, or with the signature API of the registry.
+func newSimpleSigning(opts Options) (*signing, error) {
+	if opts.SignCosignKey != "" || opts.SignCosignIdentityToken != "" {
+		return nil, errors.New("--sign-by can't be used together with --sign-cosign-key or --sign-cosign-identity")
+	}
+	mech, err := signature.NewGPGSigningMechanism()
+	if err != nil {
+		return nil, fmt.Errorf("initializing GPG: %w", err)
+	}
+	defer mech.Close()
+	if err = mech.SupportsSigning(); err != nil {
+		return nil, fmt.Errorf("--sign-by: %w", err)
+	}
+	s := &signing{signBy: opts.SignBy}
+	if opts.SignPassphraseFile != "" {
+		passphrase, err := os.ReadFile(opts.SignPassphraseFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading sign passphrase: %w", err)
+		}
+		s.passphrase = strings.TrimRight(string(passphrase), "\r\n")
+	}
+	return s, nil
+}
+
+// newSigstoreRegistriesDir creates a registries.d directory which enables
+// sigstore attachments, the caller must remove it.
+func newSigstoreRegistriesDir() (string, error) {
+	dir, err := os.MkdirTemp("", "imagesync-registries.d-")
+	if err != nil {
+		return "", fmt.Errorf("creating registries.d: %w", err)
+	}
+	if err = os.WriteFile(filepath.Join(dir, "imagesync.yaml"), []byte(registriesDConfig), 0o600); err != nil {
+		_ = os.RemoveAll(dir)
+		return "", fmt.Errorf("creating registries.d: %w", err)
+	}
+	return dir, nil
+}
+
+// apply makes opts sign the copied images.
+func (s *signing) apply(opts *copy.Options) {
+	if s == nil {
+		return
+	}
+	if s.signer == nil {
+		opts.SignBy = s.signBy
+		opts.SignPassphrase = s.passphrase
+		return
+	}
+	opts.Signers = []*signer.Signer{s.signer}
+	opts.DestinationCtx.RegistriesDirPath = s.registriesDir
+}
+
+// sigstore reports whether s writes sigstore signatures, which are stored
+// as tags next to the image.
+func (s *signing) sigstore() bool {
+	return s != nil && s.signer != nil
+}
+
+func (s *signing) close() {
+	if !s.sigstore() {
+		return
+	}
+	if err := s.signer.Close(); err != nil {
+		logrus.Warnf("failed closing signer: %s", err)
+	}
+	if err := os.RemoveAll(s.registriesDir); err != nil {
+		logrus.Warnf("failed removing %s: %s", s.registriesDir, err)
+	}
+}
@@ -0,0 +1,123 @@
+package imagesync
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/types"
+	"github.com/docker/go-units"
+	"github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+)
+
+// imageSizes are the sizes the manifests of an image report.
+type imageSizes struct {
+	// total is the sum of the config and layer sizes.
+	total int64
+	// largestLayer is the size of the largest layer.
+	largestLayer int64
+}
+
+// parseSize parses a size like 5GB of the flag name, empty is unlimited.
+func parseSize(name, value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	size, err := units.FromHumanSize(strings.TrimSpace(value))
+	if err != nil || size <= 0 {
+		return 0, fmt.Errorf("invalid --%s %q, expected e.g. 5GB", name, value)
+	}
+	return size, nil
+}
+
+// imageSize sums the config and layer sizes reported by the manifests of ref,
+// for manifest lists the sizes of all instances are summed.
+func imageSize(ctx context.Context, ref types.ImageReference, sys *types.SystemContext) (int64, error) {
+	sizes, err := readImageSizes(ctx, ref, sys)
+	return sizes.total, err
+}
+
+// readImageSizes reads the sizes of the manifests of ref, for manifest
+// lists those of all instances.
+func readImageSizes(ctx context.Context, ref types.ImageReference, sys *types.SystemContext) (imageSizes, error) {
+	src, err := ref.NewImageSource(ctx, sys)
+	if err != nil {
+		return imageSizes{}, fmt.Errorf("opening image: %w", err)
+	}
+	defer src.Close()
+
+	manifestBlob, mimeType, err := src.GetManifest(ctx, nil)
+	if err != nil {
+		return imageSizes{}, fmt.Errorf("reading manifest: %w", err)
+	}
+	if !manifest.MIMETypeIsMultiImage(mimeType) {
+		return manifestSize(manifestBlob, mimeType)
+	}
+
+	list, err := manifest.ListFromBlob(manifestBlob, mimeType)
+	if err != nil {
+		return imageSizes{}, fmt.Errorf("parsing manifest list: %w", err)
+	}
+	var sizes imageSizes
+	for _, instance := range list.Instances() {
+		size, err := instanceSize(ctx, src, instance)
+		if err != nil {
+			return imageSizes{}, err
+		}
+		sizes.total += size.total
+		sizes.largestLayer = max(sizes.largestLayer, size.largestLayer)
+	}
+	return sizes, nil
+}
+
+func instanceSize(ctx context.Context, src types.ImageSource, instance digest.Digest) (imageSizes, error) {
+	manifestBlob, mimeType, err := src.GetManifest(ctx, &instance)
+	if err != nil {
+		return imageSizes{}, fmt.Errorf("reading manifest %s: %w", instance, err)
+	}
+	return manifestSize(manifestBlob, mimeType)
+}
+
+func manifestSize(manifestBlob []byte, mimeType string) (imageSizes, error) {
+	m, err := manifest.FromBlob(manifestBlob, mimeType)
+	if err != nil {
+		return imageSizes{}, fmt.Errorf("parsing manifest: %w", err)
+	}
+	sizes := imageSizes{total: max(m.ConfigInfo().Size, 0)}
+	for _, layer := range m.LayerInfos() {
+		sizes.total += max(layer.Size, 0)
+		sizes.largestLayer = max(sizes.largestLayer, layer.Size)
+	}
+	return sizes, nil
+}
+
+// selectSize reads the manifest sizes of srcRef for --max-image-size and
+// --max-layer-size and records srcRef as skipped for destRefs if it is
+// larger. Only the selected platforms of a manifest list are counted.
+// Images whose size can't be read are copied, the copy reports the error.
+func (r *syncRun) selectSize(ctx context.Context, destRefs []types.ImageReference, srcRef types.ImageReference) bool {
+	if r.maxImageSize <= 0 && r.maxLayerSize <= 0 {
+		return true
+	}
+	sizes, err := readImageSizes(ctx, r.limits.src.wrap(r.job.Platforms.wrap(srcRef)), r.opts.SourceCtx)
+	if err != nil {
+		logrus.Debugf("failed reading the size of %s: %s", refName(srcRef), err)
+		return true
+	}
+	var reason string
+	switch {
+	case r.maxImageSize > 0 && sizes.total > r.maxImageSize:
+		reason = fmt.Sprintf("its size of %s exceeds --max-image-size %s", units.HumanSize(float64(sizes.total)), units.HumanSize(float64(r.maxImageSize)))
+	case r.maxLayerSize > 0 && sizes.largestLayer > r.maxLayerSize:
+		reason = fmt.Sprintf("its layer of %s exceeds --max-layer-size %s", units.HumanSize(float64(sizes.largestLayer)), units.HumanSize(float64(r.maxLayerSize)))
+	default:
+		return true
+	}
+	logrus.Warnf("Skipping %s, %s", refName(srcRef), reason)
+	for _, destRef := range destRefs {
+		r.addTag(TagResult{Source: refName(srcRef), Destination: refName(destRef), Status: TagSkipped, Reason: reason})
+	}
+	return false
+}
@@ -0,0 +1,121 @@
+package imagesync
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/containers/image/v5/types"
+	"gopkg.in/yaml.v3"
+)
+
+// skopeoRegistry is a registry of a `skopeo sync` YAML file, the file maps
+// registry hosts to their images.
+type skopeoRegistry struct {
+	// Images maps repositories to the tags to copy, no tags copies all.
+	Images           map[string][]string `yaml:"images"`
+	ImagesByTagRegex map[string]string   `yaml:"images-by-tag-regex"`
+	ImagesBySemver   map[string]string   `yaml:"images-by-semver"`
+	Credentials      *struct {
+		Username string `yaml:"username"`
+		Password string `yaml:"password"`
+	} `yaml:"credentials"`
+	TLSVerify *bool  `yaml:"tls-verify"`
+	CertDir   string `yaml:"cert-dir"`
+}
+
+// skopeoJobs returns a repository sync job for every image of the
+// --skopeo-sync-config file. Like `skopeo sync` without --scoped, an image
+// is copied to its last path element below each --dest.
+func skopeoJobs(options Options, defaults syncJob) ([]syncJob, error) {
+	if options.Source != "" || options.Config != "" {
+		return nil, errors.New("--skopeo-sync-config can't be used together with --src or --config")
+	}
+	if options.Destination == "" && options.ExportBundle == "" && len(defaults.RepoRewrite) == 0 {
+		return nil, errors.New("--dest or --repo-rewrite is required with --skopeo-sync-config")
+	}
+	path := options.SkopeoSyncConfig
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading skopeo sync config: %w", err)
+	}
+	defer f.Close()
+
+	var registries map[string]skopeoRegistry
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err = dec.Decode(&registries); err != nil {
+		return nil, fmt.Errorf("parsing skopeo sync config %s: %w", path, err)
+	}
+
+	var jobs []syncJob
+	destRepos := map[string]string{}
+	for _, host := range slices.Sorted(maps.Keys(registries)) {
+		registry := registries[host]
+		base := defaults
+		base.TagsPattern, base.Semver, base.Tags = "", "", nil
+		setIfNotNil(&base.SrcStrictTLS, registry.TLSVerify)
+		if registry.CertDir != "" {
+			base.SrcCertDir = registry.CertDir
+		}
+		if c := registry.Credentials; c != nil {
+			base.SrcCredentials = &types.DockerAuthConfig{Username: c.Username, Password: c.Password}
+		}
+
+		add := func(repo string, set func(*syncJob) error) error {
+			repo = strings.Trim(repo, "/")
+			name := repo[strings.LastIndex(repo, "/")+1:]
+			job := base
+			job.Source = strings.TrimSuffix(host, "/") + "/" + repo
+			job.Destination = base.RepoRewrite.destinationOf(job.Source, options.Destination, name)
+			if job.Destination == "" && options.ExportBundle == "" {
+				return fmt.Errorf("skopeo sync config %s: no --repo-rewrite matches %s and --dest isn't set", path, job.Source)
+			}
+			if other, ok := destRepos[job.Destination]; ok && other != job.Source {
+				return fmt.Errorf("skopeo sync config %s: %s and %s are both copied to %s", path, other, job.Source, job.Destination)
+			}
+			destRepos[job.Destination] = job.Source
+			if err := set(&job); err != nil {
+				return fmt.Errorf("skopeo sync config %s: %s: %w", path, job.Source, err)
+			}
+			jobs = append(jobs, job)
+			return nil
+		}
+		for _, repo := range slices.Sorted(maps.Keys(registry.Images)) {
+			tags := registry.Images[repo]
+			err := add(repo, func(job *syncJob) error {
+				for _, tag := range tags {
+					if strings.Contains(tag, ":") {
+						return fmt.Errorf("digest %s isn't supported, only tags can be listed", tag)
+					}
+				}
+				if len(tags) > 0 {
+					job.Tags = tags
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+		for _, repo := range slices.Sorted(maps.Keys(registry.ImagesByTagRegex)) {
+			pattern := registry.ImagesByTagRegex[repo]
+			if err := add(repo, func(job *syncJob) error { job.TagsPattern = pattern; return nil }); err != nil {
+				return nil, err
+			}
+		}
+		for _, repo := range slices.Sorted(maps.Keys(registry.ImagesBySemver)) {
+			constraint := registry.ImagesBySemver[repo]
+			if err := add(repo, func(job *syncJob) error { job.Semver = constraint; return nil }); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(jobs) == 0 {
+		return nil, fmt.Errorf("skopeo sync config %s has no images", path)
+	}
+	return jobs, nil
+}
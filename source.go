@@ -0,0 +1,192 @@
+package imagesync
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/pkg/compression"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var ErrAmbiguousSource = errors.New("ambiguous source")
+
+type sourceKind int
+
+const (
+	sourceRegistry sourceKind = iota
+	sourceOCILayout
+	sourceOCIArchive
+	sourceDockerArchive
+	sourceDockerDaemon
+	sourceContainersStorage
+	sourceDir
+)
+
+// source is a detected source reference, value has the transport prefix
+// stripped and local paths are absolute with symlinks resolved.
+type source struct {
+	kind  sourceKind
+	value string
+}
+
+var sourcePrefixes = []struct {
+	name   string
+	prefix string
+	kind   sourceKind
+}{
+	{"registry", "docker://", sourceRegistry},
+	{"oci", "oci:", sourceOCILayout},
+	{"oci-archive", "oci-archive:", sourceOCIArchive},
+	{"docker-archive", "docker-archive:", sourceDockerArchive},
+	{"docker-daemon", "docker-daemon:", sourceDockerDaemon},
+	{"containers-storage", "containers-storage:", sourceContainersStorage},
+	{"dir", "dir:", sourceDir},
+}
+
+// detectSource decides whether src is a local path or a registry reference.
+// A source is local if it has an explicit transport prefix or is an absolute
+// or ./ and ../ prefixed path, a bare value is a registry reference.
+// A bare value which also exists locally is rejected as ambiguous. The
+// format of a local archive is detected by its content. An explicit
+// srcFormat wins.
+//
+// With legacy detection every value which exists locally is a local path.
+func detectSource(src, srcFormat string, legacy bool) (source, error) {
+	if srcFormat != "" {
+		return forcedSource(src, srcFormat)
+	}
+	for _, p := range sourcePrefixes {
+		if value, ok := strings.CutPrefix(src, p.prefix); ok {
+			return source{kind: p.kind, value: value}, nil
+		}
+	}
+
+	if legacy || isPathLike(src) {
+		s, err := detectLocalSource(src)
+		if err == nil || !legacy || !errors.Is(err, os.ErrNotExist) {
+			return s, err
+		}
+		return source{kind: sourceRegistry, value: src}, nil
+	}
+
+	if _, err := os.Lstat(src); err == nil {
+		if _, err := reference.ParseNormalizedNamed(src); err == nil {
+			return source{}, fmt.Errorf(
+				"%q is both a local path and a registry reference, use ./%s for the local path or docker://%s for the registry: %w",
+				src, src, src, ErrAmbiguousSource)
+		}
+		return detectLocalSource(src)
+	}
+
+	return source{kind: sourceRegistry, value: src}, nil
+}
+
+// forcedSource returns src as source of the transport srcFormat, a transport
+// prefix of src has to match it.
+func forcedSource(src, srcFormat string) (source, error) {
+	for _, p := range sourcePrefixes {
+		if p.name != srcFormat {
+			continue
+		}
+		for _, other := range sourcePrefixes {
+			if value, ok := strings.CutPrefix(src, other.prefix); ok {
+				if other.kind != p.kind {
+					return source{}, fmt.Errorf("source %q doesn't match --src-format %s", src, srcFormat)
+				}
+				src = value
+				break
+			}
+		}
+		if p.kind != sourceRegistry && isPathLike(src) {
+			abs, err := filepath.Abs(src)
+			if err != nil {
+				return source{}, fmt.Errorf("resolving source path: %w", err)
+			}
+			src = abs
+		}
+		return source{kind: p.kind, value: src}, nil
+	}
+	return source{}, fmt.Errorf("unsupported --src-format %q, expected registry, oci, oci-archive, docker-archive, docker-daemon, containers-storage or dir", srcFormat)
+}
+
+func isPathLike(src string) bool {
+	return filepath.IsAbs(src) || src == "." || src == ".." ||
+		strings.HasPrefix(src, "./") || strings.HasPrefix(src, "../")
+}
+
+func detectLocalSource(path string) (source, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return source{}, fmt.Errorf("resolving source path: %w", err)
+	}
+	resolved, err := filepath.EvalSymlinks(abs)
+	if err != nil {
+		return source{}, fmt.Errorf("resolving source path: %w", err)
+	}
+	info, err := os.Stat(resolved)
+	if err != nil {
+		return source{}, fmt.Errorf("reading source path: %w", err)
+	}
+	if info.IsDir() {
+		return source{kind: sourceOCILayout, value: resolved}, nil
+	}
+	kind, err := sniffArchive(resolved)
+	if err != nil {
+		return source{}, err
+	}
+	return source{kind: kind, value: resolved}, nil
+}
+
+// sniffArchive detects the format of the archive at path by its entries, an
+// oci-archive has an oci-layout file and a docker-archive a manifest.json. A
+// compressed docker-archive is read entirely, the entries of an uncompressed
+// archive are skipped.
+func sniffArchive(path string) (sourceKind, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("reading source archive: %w", err)
+	}
+	defer f.Close()
+	_, decompress, stream, err := compression.DetectCompressionFormat(f)
+	if err != nil {
+		return 0, fmt.Errorf("reading source archive %s: %w", path, err)
+	}
+	var r io.Reader = f
+	if decompress != nil {
+		decompressed, err := decompress(stream)
+		if err != nil {
+			return 0, fmt.Errorf("reading source archive %s: %w", path, err)
+		}
+		defer decompressed.Close()
+		r = decompressed
+	} else if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return 0, fmt.Errorf("reading source archive %s: %w", path, err)
+	}
+	tr := tar.NewReader(r)
+	docker := false
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return 0, fmt.Errorf("%s is neither an oci-archive nor a docker-archive, use --src-format to choose the transport: %w", path, err)
+		}
+		switch strings.TrimPrefix(hdr.Name, "./") {
+		case imgspecv1.ImageLayoutFile:
+			return sourceOCIArchive, nil
+		case "manifest.json":
+			docker = true
+		}
+	}
+	if !docker {
+		return 0, fmt.Errorf("%s is neither an oci-archive nor a docker-archive, it has no oci-layout or manifest.json", path)
+	}
+	return sourceDockerArchive, nil
+}
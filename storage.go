@@ -0,0 +1,78 @@
+package imagesync
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/containers/image/v5/storage"
+	cstorage "github.com/containers/storage"
+	"github.com/containers/storage/pkg/unshare"
+	"github.com/sirupsen/logrus"
+)
+
+// openStorage opens the containers-storage store of containers-storage:
+// sources and destinations and makes it the store of the transport. The
+// paths default to storage.conf, which has per user paths for rootless
+// setups. It returns nil if no job uses the transport.
+func openStorage(options Options, jobs []syncJob) (cstorage.Store, error) {
+	if !usesStorage(options, jobs) {
+		return nil, nil
+	}
+	storeOptions, err := cstorage.DefaultStoreOptions()
+	if err != nil {
+		return nil, fmt.Errorf("reading storage.conf: %w", err)
+	}
+	if options.StorageRoot != "" {
+		storeOptions.GraphRoot = options.StorageRoot
+	}
+	if options.StorageRunRoot != "" {
+		storeOptions.RunRoot = options.StorageRunRoot
+	}
+	store, err := cstorage.GetStore(storeOptions)
+	if err != nil {
+		return nil, fmt.Errorf("opening containers-storage %s: %w", storeOptions.GraphRoot, err)
+	}
+	storage.Transport.SetStore(store)
+	return store, nil
+}
+
+func closeStorage(store cstorage.Store) {
+	if store == nil {
+		return
+	}
+	if _, err := store.Shutdown(false); err != nil {
+		logrus.Warnf("failed closing containers-storage: %s", err)
+	}
+}
+
+// usesStorage reports whether a source or destination of jobs is a
+// containers-storage image.
+func usesStorage(options Options, jobs []syncJob) bool {
+	for _, job := range jobs {
+		if s, err := detectSource(job.Source, job.SrcFormat, options.LegacySourceDetection); err == nil && s.kind == sourceContainersStorage {
+			return true
+		}
+		dests, err := detectDestinations(job.Destination, job.DestType)
+		if err != nil {
+			continue
+		}
+		for _, d := range dests {
+			if d.kind == destinationContainersStorage {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// reexecForStorage runs the CLI again in a user namespace if a rootless user
+// syncs containers-storage images, like podman the layers are stored with
+// the ids of the namespace. The re-executed process replaces this one.
+func reexecForStorage(options Options) {
+	if options.SrcNamespace != "" || !unshare.IsRootless() {
+		return
+	}
+	if jobs, err := syncJobs(context.Background(), options); err == nil && usesStorage(options, jobs) {
+		unshare.MaybeReexecUsingUserNamespace(false)
+	}
+}
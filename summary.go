@@ -0,0 +1,79 @@
+package imagesync
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/docker/go-units"
+	"github.com/sirupsen/logrus"
+)
+
+// totals returns the totals of the tags reported so far.
+func (r *Result) totals() ResultTotals {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.Totals
+}
+
+// durationSeconds is the wall time of a finished run.
+func (r *Result) durationSeconds() float64 {
+	return r.FinishedAt.Sub(r.StartedAt).Seconds()
+}
+
+// writeSummary prints the totals of result as a table, or as a single log
+// entry with --log-format json. Attempted are the tags which were copied,
+// failed or planned, skipped tags already existed in the destination.
+func writeSummary(w io.Writer, result *Result) error {
+	t := result.totals()
+	attempted := t.Copied + t.Failed + t.Planned
+	duration := result.durationSeconds()
+	var bytesPerSecond float64
+	if duration > 0 {
+		bytesPerSecond = float64(t.Bytes) / duration
+	}
+	if jsonLogs() {
+		logrus.WithFields(logrus.Fields{
+			"attempted":       attempted,
+			"copied":          t.Copied,
+			"failed":          t.Failed,
+			"skipped":         t.Skipped,
+			"planned":         t.Planned,
+			"pruned":          t.Pruned,
+			"bytes":           t.Bytes,
+			"reusedBytes":     t.ReusedBytes,
+			"durationSeconds": duration,
+			"bytesPerSecond":  bytesPerSecond,
+		}).Info("Summary")
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "\nSummary:")
+	fmt.Fprintf(tw, "  Tags attempted\t%d\n", attempted)
+	fmt.Fprintf(tw, "  Copied\t%d\n", t.Copied)
+	if t.Planned > 0 {
+		fmt.Fprintf(tw, "  Planned\t%d\n", t.Planned)
+	}
+	fmt.Fprintf(tw, "  Failed\t%d\n", t.Failed)
+	fmt.Fprintf(tw, "  Skipped\t%d\n", t.Skipped)
+	if t.Pruned > 0 {
+		fmt.Fprintf(tw, "  Pruned\t%d\n", t.Pruned)
+	}
+	fmt.Fprintf(tw, "  Uploaded\t%s\n", units.HumanSize(float64(t.Bytes)))
+	fmt.Fprintf(tw, "  Reused\t%s\n", units.HumanSize(float64(t.ReusedBytes)))
+	fmt.Fprintf(tw, "  Duration\t%.1fs\n", duration)
+	fmt.Fprintf(tw, "  Throughput\t%s/s\n", units.HumanSize(bytesPerSecond))
+	return tw.Flush()
+}
+
+// writeReportFile writes the Result document of a run to path, the same
+// document as --output json.
+func writeReportFile(path string, result *Result) error {
+	var buf bytes.Buffer
+	if err := result.WriteJSON(&buf); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, buf.Bytes())
+}
@@ -0,0 +1,777 @@
+package imagesync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/samber/lo"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Options configures a sync, the fields correspond to the command line flags.
+// Either Source and Destination or Config must be set.
+type Options struct {
+	Source string
+	// SrcFormat forces the source transport, named like DestType. Empty
+	// detects it from Source and the content of local archives.
+	SrcFormat string
+	// Destination is a comma separated list to copy to several destinations
+	// at once, the source is read only once.
+	Destination string
+	// DestType forces the destination transport: registry, oci, oci-archive,
+	// docker-archive, docker-daemon, containers-storage or dir. Empty
+	// detects it from Destination.
+	DestType string
+	// FallbackSources are registries, e.g. mirror.gcr.io, hosting the same
+	// repository as Source, or other repositories, tried in order when the
+	// tags of Source can't be listed or a tag can't be copied from it.
+	FallbackSources []string
+	// DestTag names a single source image, e.g. one referenced by digest, in
+	// destinations without a tag.
+	DestTag               string
+	Config                string
+	LegacySourceDetection bool
+	// ImagesFile lists single images to copy, one per line with an optional
+	// destination, - reads stdin. The jobs run concurrently, at most
+	// MaxConcurrentTags at once.
+	ImagesFile string
+	// Manifests are the files and directories of Kubernetes manifests,
+	// kustomizations and Helm charts whose images are copied like those of
+	// ImagesFile.
+	Manifests []string
+	// SkopeoSyncConfig reads the jobs from a `skopeo sync` YAML file, the
+	// images are copied below Destination.
+	SkopeoSyncConfig string
+	// SrcNamespace syncs every repository below a registry path, e.g.
+	// registry.example.com/team/, matching ReposPattern to the same path
+	// below DestNamespace. It replaces Source and Destination.
+	SrcNamespace  string
+	DestNamespace string
+	ReposPattern  string
+	// VerifyAfterCopy reads the manifests of the copied images back from
+	// the registry destinations and fails tags whose digest or media type
+	// differs. VerifyLayers is the fraction of their layers downloaded and
+	// checked against their digests too, between 0 and 1.
+	VerifyAfterCopy bool
+	VerifyLayers    float64
+	// RepoRewrite maps the source repositories of the namespace, skopeo
+	// sync config, images file and manifest jobs to their destination with
+	// pattern=replacement rules, the first matching rule wins. Repositories
+	// without match are copied below the destination.
+	RepoRewrite []string
+
+	SrcStrictTLS bool
+	// SrcPlainHTTP and DestPlainHTTP connect to the registries of one side
+	// over http:// instead of https://, for registries without TLS.
+	SrcPlainHTTP  bool
+	DestPlainHTTP bool
+	// SrcProxy and DestProxy are http(s):// or socks5:// proxy URLs for the
+	// connections of one side, the other side is contacted directly. Both
+	// sides can only use the same proxy. The proxy is set in the environment
+	// of the process, it has to be set before the first request.
+	SrcProxy  string
+	DestProxy string
+	// Resolve connects to other addresses for registries, given as
+	// host[:port]=address[:port], e.g. registry.example.com=10.0.0.5:5000.
+	// It can't be used with proxies.
+	Resolve       []string
+	DestStrictTLS bool
+	AuthFile      string
+	SrcAuthFile   string
+	DestAuthFile  string
+	// SrcCertDir and DestCertDir contain the ca.crt, client.cert and
+	// client.key of the registries of one side, replacing the per host
+	// directories below /etc/docker/certs.d.
+	SrcCertDir  string
+	DestCertDir string
+	// RegistriesConf is a containers registries.conf file, its mirrors,
+	// blocked registries and location rewrites replace the system
+	// registries.conf and its aliases and unqualified-search registries
+	// resolve registry sources without registry.
+	RegistriesConf string
+	// ECRRepositoryTags are the key=value tags, ECRImmutableTags and
+	// ECRScanOnPush the settings of the Amazon ECR repositories created
+	// for missing destinations.
+	ECRRepositoryTags []string
+	ECRImmutableTags  bool
+	ECRScanOnPush     bool
+	// GoogleCredentials is a service-account JSON file for gcr.io and
+	// pkg.dev registries, empty uses the Application Default Credentials.
+	GoogleCredentials string
+	// CredentialHelpers are docker credential helpers like ecr-login, for
+	// all registries or a single one with registry=helper. They log in to
+	// the registries without credentials in the config file.
+	CredentialHelpers []string
+	// SrcCreds and DestCreds are the credentials of the registries of one
+	// side, user:password or vault:<path>[#field] read from Vault. The
+	// jobs of a skopeo sync config keep their own source credentials.
+	SrcCreds  string
+	DestCreds string
+	// VaultRoleID and VaultSecretIDFile log in to Vault with AppRole,
+	// otherwise VAULT_TOKEN or ~/.vault-token is used.
+	VaultRoleID       string
+	VaultSecretIDFile string
+	// DockerSocket is the socket path or host URL of the docker daemon of
+	// docker-daemon: sources and destinations.
+	DockerSocket string
+	// StorageRoot and StorageRunRoot override the graph root and run root
+	// of storage.conf for containers-storage: sources and destinations.
+	StorageRoot    string
+	StorageRunRoot string
+	// BlobCacheDir is the directory of the blob info cache, which remembers
+	// the blobs known to exist in registries across runs. Empty uses the
+	// containers/image default.
+	BlobCacheDir string
+	// MountFrom are repositories of the destination registries, e.g. a
+	// repository of shared base images, whose blobs are mounted instead of
+	// uploaded. A repository without registry is on the registry of each
+	// destination.
+	MountFrom []string
+
+	TagsPattern     string
+	SkipTagsPattern string
+	SkipTags        []string
+	// Tags are copied without listing the source repository.
+	Tags []string
+	// TagRewrite renames the destination tags with sed style
+	// s/pattern/replacement/[g] rules, applied in order.
+	TagRewrite []string
+	// Retag points floating destination tags at a version after each
+	// repository sync, e.g. latest=highest-semver.
+	Retag       []string
+	Semver      string
+	KeepLatestN int
+	// MinAge and MaxAge are durations like 12h or 90d, NewerThan is a date
+	// like 2024-01-01. They select the tags of a repository by the creation
+	// time of their image.
+	MinAge    string
+	MaxAge    string
+	NewerThan string
+	// FilterAnnotations and FilterLabels are key=value or key conditions
+	// the manifest annotations or the config labels of an image have to
+	// match for its tag to be synced.
+	FilterAnnotations []string
+	FilterLabels      []string
+	// Platforms is a comma separated list of os/arch[/variant], empty copies all platforms.
+	Platforms string
+	// IncludeReferrers copies the cosign and OCI referrer tags of the copied
+	// images together with them, and the artifacts the OCI referrers API
+	// lists for them.
+	IncludeReferrers bool
+	// ReferrerTypes restricts the artifacts of the referrers API to these
+	// artifact types, empty copies all.
+	ReferrerTypes []string
+	// ArtifactTypes and SkipArtifactTypes select the tags to copy by their
+	// artifact type, the artifactType of their manifest or the media type
+	// of its config. Empty ArtifactTypes copies all types.
+	ArtifactTypes     []string
+	SkipArtifactTypes []string
+	// MaxImageSize and MaxLayerSize skip the images larger than this, or
+	// with a larger layer, by the sizes of their manifests, e.g. 5GB. Empty
+	// is unlimited.
+	MaxImageSize string
+	MaxLayerSize string
+	// Format converts the manifests to oci or v2s2 (Docker schema 2), which
+	// changes their digests. Empty keeps the source format.
+	Format string
+	// PreserveDigests copies the manifests unchanged, a copy which would
+	// convert or recompress them fails instead.
+	PreserveDigests bool
+	// Compression recompresses the layers with gzip, zstd or zstd:chunked at
+	// CompressionLevel, 0 is the default level. zstd converts Docker
+	// manifests to OCI. Empty keeps the compression of the source.
+	Compression      string
+	CompressionLevel int
+	// EncryptLayers encrypts all layers of the copied images for the
+	// recipients of EncryptionKeys, e.g. jwe:pubkey.pem, which converts
+	// them to OCI. DecryptionKeys decrypt the encrypted layers of the
+	// sources, e.g. privkey.pem or privkey.pem:password.
+	EncryptLayers  bool
+	EncryptionKeys []string
+	DecryptionKeys []string
+	// AddAnnotations are key=value annotations added to the top-level OCI
+	// manifests of the copied images. ${source}, ${digest} and ${date} in a
+	// value are replaced by the source image, its digest and the copy time.
+	AddAnnotations []string
+
+	Overwrite      bool
+	CompareDigests bool
+	Prune          bool
+	ConfirmPrune   bool
+	DryRun         bool
+	// Check is a DryRun which fails with ErrOutOfSync if any tag would be
+	// copied.
+	Check bool
+
+	// MaxConcurrentTags defaults to 1.
+	MaxConcurrentTags int
+	// MaxConcurrentRepos is the number of repositories of a config file or
+	// namespace synced in parallel, each with its own tags in parallel. All
+	// repositories share a budget of MaxConcurrentTags times
+	// MaxConcurrentRepos tags. It defaults to 1.
+	MaxConcurrentRepos int
+	// MaxParallelBlobs is the number of layers of a single image copied at
+	// once, every layer is streamed from the source to the destinations. 0
+	// uses the containers/image default of 6.
+	MaxParallelBlobs int
+	// Timeout bounds the whole sync, TagTimeout every single image copy
+	// including its retries. Zero doesn't time out.
+	Timeout     time.Duration
+	TagTimeout  time.Duration
+	KeepGoing   bool
+	MaxRetries  int
+	RetryDelay  time.Duration
+	QuotaAction string
+	// Harbor creates missing projects in Harbor destinations, public with
+	// HarborPublicProjects, logs their retention rules and checks their
+	// quota unless QuotaAction is set.
+	Harbor                    bool
+	HarborPublicProjects      bool
+	MaxConnectionsPerRegistry int
+	// MaxConcurrentPerRegistry bounds the tags copied at once from each
+	// source registry, every value is the limit of all registries or
+	// registry=limit, e.g. ghcr.io=2.
+	MaxConcurrentPerRegistry []string
+	// AdaptiveConcurrency halves the tags copied at once when a registry
+	// throttles with 429 or 503 and raises it again while it doesn't.
+	AdaptiveConcurrency bool
+	// MaxBandwidth limits the blob transfer of all copies together,
+	// MaxBandwidthPerTag of every single copy, e.g. 50MB/s. Empty is
+	// unlimited.
+	MaxBandwidth       string
+	MaxBandwidthPerTag string
+	// HubRateLimitBuffer is the number of Docker Hub pulls left in the rate
+	// limit window at which copies from Docker Hub pause, negative doesn't
+	// pace them.
+	HubRateLimitBuffer int
+
+	// VerifyPolicy is a containers-policy.json file source images must
+	// satisfy, VerifyCosignPubkey requires a cosign signature of this key.
+	VerifyPolicy       string
+	VerifyCosignPubkey string
+
+	// SignCosignKey signs every copied image with this cosign private key,
+	// SignCosignIdentityToken signs keyless with a Fulcio certificate issued
+	// for this OIDC identity token instead.
+	SignCosignKey           string
+	SignCosignPassphrase    string
+	SignCosignIdentityToken string
+	// SignFulcioURL and SignRekorURL default to the public sigstore
+	// instances for keyless signing, key signatures are only uploaded to
+	// Rekor if SignRekorURL is set.
+	SignFulcioURL string
+	SignRekorURL  string
+	// SignBy signs every copied image with a simple signing signature of
+	// the GPG key with this fingerprint, unlocked with the passphrase in
+	// SignPassphraseFile.
+	SignBy             string
+	SignPassphraseFile string
+	// NotationKey signs every copied image with a Notary v2 signature of
+	// this key of the notation CLI configuration.
+	NotationKey string
+
+	// ScanBeforePush scans every source image with Scanner, trivy or grype,
+	// and skips the images with vulnerabilities of SeverityThreshold (low,
+	// medium, high or critical) or higher.
+	ScanBeforePush    bool
+	Scanner           string
+	SeverityThreshold string
+
+	// StateFile records the completed copies, a restarted sync skips them
+	// even with Overwrite. It is removed once a sync finishes without failures.
+	StateFile string
+	// StateDB is a SQLite database every run and the outcome of its tags
+	// are added to, for the history command.
+	StateDB string
+
+	IndexFile     string
+	IndexFormat   string
+	IndexExisting bool
+	IndexMaxSize  int64
+	// NotifyWebhooks are posted a Notification when a run finishes,
+	// NotifySlack are Slack incoming webhooks posted its message.
+	// NotifyTemplate is a text/template of the Notification replacing the
+	// default message and the webhook body, NotifyOn always or failure.
+	NotifyWebhooks []string
+	NotifySlack    []string
+	NotifyTemplate string
+	NotifyOn       string
+
+	// PreTagHook, PostTagHook and PostRunHook are shell commands run before
+	// and after every copied tag and after the run, with IMAGESYNC_
+	// environment variables describing the tag or the run. A failing
+	// PreTagHook fails its tag.
+	PreTagHook  string
+	PostTagHook string
+	PostRunHook string
+
+	// DigestMapFile is written with the destination digest of every synced
+	// source tag, as the images list of a kustomization.
+	DigestMapFile string
+
+	// ExportBundle packs the images of the sources into this .tar, .tar.gz
+	// or .tar.zst bundle instead of copying them to destinations, every
+	// repository is stored by its path without registry. ImportBundle
+	// copies the images of a bundle to the same paths below Destination.
+	ExportBundle string
+	ImportBundle string
+	// BundleInventory lists the images and blobs of the air-gapped
+	// registry. An import adds its images to it and an export leaves out
+	// what it has, so the bundle is incremental.
+	BundleInventory string
+
+	// PushedRepository restricts the sync to the jobs of this source
+	// repository, e.g. docker.io/library/alpine, which copy only PushedTags
+	// of it. The serve command sets them for every pushed repository.
+	PushedRepository string
+	PushedTags       []string
+
+	// ReportWriter receives the progress of the copies, nil discards it.
+	ReportWriter io.Writer
+	// ProgressBars draws progress bars of the tags and their blobs on
+	// ReportWriter instead of the output of the copies, ReportWriter has to
+	// be a terminal.
+	ProgressBars bool
+}
+
+func (o Options) sideAuthFile(side string) string {
+	if side == "src" {
+		return o.SrcAuthFile
+	}
+	return o.DestAuthFile
+}
+
+func (o Options) sideCertDir(side string) string {
+	if side == "src" {
+		return o.SrcCertDir
+	}
+	return o.DestCertDir
+}
+
+// Syncer syncs images between registries and archives, the zero value is
+// ready to use. A Syncer never exits the process, all outcomes are reported
+// by the returned Result and error.
+type Syncer struct {
+	metrics *syncMetrics
+	events  *progressEvents
+
+	// vault is kept across syncs, its token is renewed in the background.
+	vaultOnce sync.Once
+	vault     *vaultSession
+}
+
+func (s *Syncer) vaultSession(opts Options) *vaultSession {
+	s.vaultOnce.Do(func() { s.vault = newVaultSession(opts) })
+	return s.vault
+}
+
+// Sync runs the sync described by opts. The Result is returned even if the
+// sync fails, failing tags are reported in it. A sync in which tags failed
+// returns an error, with KeepGoing one wrapping ErrPartialFailure.
+func (s *Syncer) Sync(ctx context.Context, opts Options) (*Result, error) {
+	opts = opts.withDefaults()
+	result := newResult(opts)
+	return result, s.syncInto(ctx, opts, result)
+}
+
+func (o Options) withDefaults() Options {
+	if o.Check {
+		o.DryRun = true
+	}
+	if o.MaxConcurrentTags < 1 {
+		o.MaxConcurrentTags = 1
+	}
+	if o.MaxConcurrentRepos < 1 {
+		o.MaxConcurrentRepos = 1
+	}
+	if o.Harbor && o.QuotaAction == "" {
+		o.QuotaAction = "warn"
+	}
+	return o
+}
+
+// syncInto runs the sync of opts, which has its defaults applied, and
+// reports it in result while it runs.
+func (s *Syncer) syncInto(ctx context.Context, opts Options, result *Result) error {
+	history, err := openHistory(opts.StateDB)
+	if err != nil {
+		result.finish(err)
+		return err
+	}
+	defer history.close()
+	notifier, err := newNotifier(opts)
+	if err != nil {
+		result.finish(err)
+		return err
+	}
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+	ctx, span := tracer.Start(ctx, "sync", trace.WithAttributes(
+		attribute.String("imagesync.source", opts.Source),
+		attribute.String("imagesync.destination", opts.Destination),
+		attribute.String("imagesync.config", opts.Config),
+		attribute.Bool("imagesync.dry_run", opts.DryRun),
+	))
+	err = s.sync(ctx, opts, result)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) && opts.Timeout > 0 {
+		err = fmt.Errorf("sync exceeded the timeout of %s: %w", opts.Timeout, err)
+	}
+	result.finish(err)
+	span.SetAttributes(
+		attribute.Int("imagesync.tags.copied", result.Totals.Copied),
+		attribute.Int("imagesync.tags.failed", result.Totals.Failed),
+	)
+	endSpan(span, err)
+	if herr := history.record(result); herr != nil {
+		err = errors.Join(err, fmt.Errorf("recording the run in the state db: %w", herr))
+	}
+	notifier.notify(ctx, opts, result, err)
+	if !opts.DryRun {
+		newHooks(opts).runPostRun(ctx, result, err)
+	}
+	return err
+}
+
+func (s *Syncer) sync(ctx context.Context, opts Options, result *Result) error {
+	// the proxies have to be set before the first request, which for a
+	// namespace is listing its repositories
+	var (
+		jobs   []syncJob
+		bundle *bundleImport
+		err    error
+	)
+	if err = checkRegistriesConf(opts.RegistriesConf); err != nil {
+		return err
+	}
+	removeAuthFiles, err := kubernetesAuthFiles(ctx, &opts)
+	if err != nil {
+		return err
+	}
+	defer removeAuthFiles()
+	switch {
+	case opts.ImportBundle != "":
+		if bundle, jobs, err = openBundle(opts); err != nil {
+			return err
+		}
+		defer bundle.remove()
+	case opts.SrcNamespace == "":
+		if jobs, err = syncJobs(ctx, opts); err != nil {
+			return err
+		}
+	}
+	if err = setupProxies(opts, jobs); err != nil {
+		return err
+	}
+	if opts.SrcNamespace != "" {
+		if jobs, err = syncJobs(ctx, opts); err != nil {
+			return err
+		}
+	}
+	if opts.PushedRepository != "" {
+		if jobs = pushedJobs(opts, jobs); len(jobs) == 0 {
+			logrus.Infof("No repository syncs the pushed tags of %s", opts.PushedRepository)
+			return nil
+		}
+	}
+	if err = s.setCredentials(ctx, opts, jobs); err != nil {
+		return err
+	}
+	var export *bundleExport
+	if opts.ExportBundle != "" {
+		if export, err = newBundleExport(opts, jobs); err != nil {
+			return err
+		}
+		defer export.remove()
+	}
+
+	store, err := openStorage(opts, jobs)
+	if err != nil {
+		return err
+	}
+	defer closeStorage(store)
+
+	// containers/image ignores a missing certificate directory
+	for _, dir := range []struct{ flag, path string }{{"--src-cert-dir", opts.SrcCertDir}, {"--dest-cert-dir", opts.DestCertDir}} {
+		if dir.path == "" {
+			continue
+		}
+		if _, err = os.Stat(dir.path); err != nil {
+			return fmt.Errorf("%s: %w", dir.flag, err)
+		}
+	}
+	if opts.BlobCacheDir != "" {
+		// containers/image silently falls back to a memory cache
+		if err = os.MkdirAll(opts.BlobCacheDir, 0o700); err != nil {
+			return fmt.Errorf("creating blob cache dir: %w", err)
+		}
+	}
+	checkpoint, err := loadCheckpoint(opts.StateFile)
+	if err != nil {
+		return err
+	}
+	index, err := newTagIndex(opts.IndexFile, opts.IndexFormat, opts.IndexMaxSize, opts.IndexExisting)
+	if err != nil {
+		return err
+	}
+	verification, err := newVerification(opts)
+	if err != nil {
+		return err
+	}
+	defer verification.close()
+	signing, err := newSigning(opts)
+	if err != nil {
+		return err
+	}
+	defer signing.close()
+	notation, err := newNotationSigner(opts)
+	if err != nil {
+		return err
+	}
+	scan, err := newScanGate(opts)
+	if err != nil {
+		return err
+	}
+	manifestType, err := parseFormat(opts.Format)
+	if err != nil {
+		return fmt.Errorf("--format: %w", err)
+	}
+	// the jobs of single images and archives are cheap, they bound their
+	// parallelism together
+	concurrentJobs := opts.ImagesFile != "" || len(opts.Manifests) > 0 || lo.SomeBy(jobs, func(job syncJob) bool { return job.ArchiveTags })
+	tagSlots, err := newTagSlots(opts, concurrentJobs)
+	if err != nil {
+		return err
+	}
+	// the adaptive limit starts at the parallelism of the most parallel job
+	adaptive := newAdaptiveLimit(opts.AdaptiveConcurrency, lo.Max(append(lo.Map(jobs, func(job syncJob, _ int) int { return job.MaxConcurrentTags }), opts.MaxConcurrentTags)))
+	if manifestType != "" && opts.PreserveDigests {
+		return errors.New("--format can't be used with --preserve-digests")
+	}
+	compression, compressionLevel, err := parseCompression(opts.Compression, opts.CompressionLevel)
+	if err != nil {
+		return err
+	}
+	encryption, err := newEncryption(opts, manifestType)
+	if err != nil {
+		return err
+	}
+	annotator, err := newAnnotator(opts)
+	if err != nil {
+		return err
+	}
+	mounter, err := newBlobMounter(opts)
+	if err != nil {
+		return err
+	}
+	if compression != nil && opts.PreserveDigests {
+		return errors.New("--compression can't be used with --preserve-digests")
+	}
+	if opts.VerifyLayers < 0 || opts.VerifyLayers > 1 {
+		return errors.New("--verify-layers has to be between 0 and 1")
+	}
+	ecr, err := newECRSession(opts)
+	if err != nil {
+		return err
+	}
+	google, err := newGoogleSession(opts)
+	if err != nil {
+		return err
+	}
+	maxBandwidth, err := parseBandwidth(opts.MaxBandwidth)
+	if err != nil {
+		return fmt.Errorf("--max-bandwidth: %w", err)
+	}
+	maxBandwidthPerTag, err := parseBandwidth(opts.MaxBandwidthPerTag)
+	if err != nil {
+		return fmt.Errorf("--max-bandwidth-per-tag: %w", err)
+	}
+	maxImageSize, err := parseSize("max-image-size", opts.MaxImageSize)
+	if err != nil {
+		return err
+	}
+	maxLayerSize, err := parseSize("max-layer-size", opts.MaxLayerSize)
+	if err != nil {
+		return err
+	}
+	state := &syncState{
+		limits:           newConnLimits(opts.MaxConnectionsPerRegistry),
+		bandwidth:        newBandwidthLimiter(maxBandwidth),
+		bandwidthPerTag:  maxBandwidthPerTag,
+		maxImageSize:     maxImageSize,
+		maxLayerSize:     maxLayerSize,
+		index:            index,
+		digests:          newDigestMap(opts.DigestMapFile),
+		hooks:            newHooks(opts),
+		checkpoint:       checkpoint,
+		result:           result,
+		metrics:          s.metrics,
+		signing:          signing,
+		notation:         notation,
+		scan:             scan,
+		verification:     verification,
+		export:           export,
+		manifestType:     manifestType,
+		compression:      compression,
+		compressionLevel: compressionLevel,
+		encryption:       encryption,
+		annotator:        annotator,
+		mounter:          mounter,
+		ecr:              ecr,
+		google:           google,
+		acr:              newACRSession(),
+		harbor:           newHarborSession(opts),
+		hub:              newHubPacer(opts.HubRateLimitBuffer),
+		credentials:      newCredentialStore(),
+		tagSlots:         tagSlots,
+		adaptive:         adaptive,
+		progress:         newProgressBars(opts),
+		events:           s.events,
+	}
+	defer state.progress.wait()
+	if err = bundle.checkBlobs(ctx, opts); err != nil {
+		return err
+	}
+
+	// with a config file a failing repository doesn't stop the others
+	var (
+		errs []error
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+	)
+	// the single images of an images file or manifests are copied
+	// concurrently, with registry limits enough jobs are started for every
+	// registry to use its slots while others wait. Repositories are synced
+	// one after another unless --max-concurrent-repos is set.
+	workers := 1
+	switch {
+	case concurrentJobs:
+		workers = opts.MaxConcurrentTags
+		if state.tagSlots.registries != nil {
+			workers = min(workers*len(lo.Uniq(lo.Map(jobs, func(job syncJob, _ int) string { return jobRegistry(job) }))), len(jobs))
+		}
+	case opts.MaxConcurrentRepos > 1:
+		workers = opts.MaxConcurrentRepos
+	}
+	sem := make(chan struct{}, workers)
+	for _, job := range jobs {
+		sem <- struct{}{}
+		if ctx.Err() != nil {
+			mu.Lock()
+			errs = append(errs, ctx.Err())
+			mu.Unlock()
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			run := newSyncRun(opts, job, state)
+			jobCtx, span := tracer.Start(ctx, "sync repository", trace.WithAttributes(
+				attribute.String("imagesync.source", job.Source),
+				attribute.String("imagesync.destination", job.Destination),
+			))
+			err := run.copyImages(jobCtx)
+			endSpan(span, err)
+			if err != nil {
+				if len(jobs) > 1 {
+					logrus.Errorf("failed syncing %s to %s: %s", job.Source, job.Destination, err)
+					err = fmt.Errorf("%s: %w", job.Source, err)
+				}
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+				return
+			}
+			if !opts.DryRun && run.failed.Load() == 0 {
+				s.metrics.recordSuccess(job.Destination)
+			}
+		}()
+	}
+	wg.Wait()
+	if len(jobs) == 1 && len(errs) > 0 {
+		return errs[0]
+	}
+
+	if !opts.DryRun {
+		if err = index.write(); err != nil {
+			errs = append(errs, fmt.Errorf("writing index file: %w", err))
+		}
+		if err = state.digests.write(); err != nil {
+			errs = append(errs, fmt.Errorf("writing digest map file: %w", err))
+		}
+	}
+	if export != nil && !opts.DryRun && len(errs) == 0 && result.failed() == 0 {
+		if err = export.write(); err != nil {
+			errs = append(errs, fmt.Errorf("writing bundle: %w", err))
+		}
+	}
+	if !opts.DryRun && len(errs) == 0 && result.failed() == 0 {
+		if err = bundle.writeInventory(opts.BundleInventory); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if !opts.DryRun && len(errs) == 0 && result.failed() == 0 {
+		if err = checkpoint.remove(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	switch {
+	case result.failed() == 0:
+	case opts.KeepGoing:
+		errs = append(errs, fmt.Errorf("%d of %d tags failed: %w", result.failed(), len(result.Tags), ErrPartialFailure))
+	case !opts.Check:
+		// the failed tags didn't stop the others, the run still fails
+		errs = append(errs, fmt.Errorf("%d of %d tags failed", result.failed(), len(result.Tags)))
+	}
+	if opts.Check {
+		// a tag which couldn't be compared mustn't pass the check
+		if !opts.KeepGoing && result.failed() > 0 {
+			errs = append(errs, fmt.Errorf("%d of %d tags couldn't be checked", result.failed(), len(result.Tags)))
+		}
+		if planned := result.planned(); planned > 0 {
+			errs = append(errs, fmt.Errorf("%d tags are missing in the destination: %w", planned, ErrOutOfSync))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// setCredentials sets the --src-creds and --dest-creds of the jobs, which
+// are read again for every sync.
+func (s *Syncer) setCredentials(ctx context.Context, opts Options, jobs []syncJob) error {
+	srcCreds, err := parseCredentials(ctx, "src-creds", opts.SrcCreds, s.vaultSession(opts))
+	if err != nil {
+		return err
+	}
+	destCreds, err := parseCredentials(ctx, "dest-creds", opts.DestCreds, s.vaultSession(opts))
+	if err != nil {
+		return err
+	}
+	for i := range jobs {
+		if jobs[i].SrcCredentials == nil {
+			jobs[i].SrcCredentials = srcCreds
+		}
+		jobs[i].DestCredentials = destCreds
+	}
+	return nil
+}
+
+// jobRegistry returns the registry of the source of job, empty for other
+// sources.
+func jobRegistry(job syncJob) string {
+	named, err := reference.ParseNormalizedNamed(strings.TrimPrefix(job.Source, "docker://"))
+	if err != nil {
+		return ""
+	}
+	return reference.Domain(named)
+}
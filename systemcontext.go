@@ -0,0 +1,47 @@
+package imagesync
+
+import (
+	"os"
+	"strings"
+
+	"github.com/containers/image/v5/types"
+)
+
+// newSystemContext builds the SystemContext of one copy side from the
+// side specific options, side is either "src" or "dest".
+func newSystemContext(options Options, side string, strictTLS, plainHTTP bool) *types.SystemContext {
+	sys := &types.SystemContext{BlobInfoCacheDir: options.BlobCacheDir}
+	// containers/image only falls back to http:// for registries without TLS
+	// verification, the https:// attempt fails at the TLS handshake of a
+	// plain HTTP registry
+	if !strictTLS || plainHTTP {
+		sys.DockerInsecureSkipTLSVerify = types.NewOptionalBool(true)
+	}
+
+	// credentials, a side specific auth file takes precedence
+	sys.AuthFilePath = options.AuthFile
+	if path := options.sideAuthFile(side); path != "" {
+		sys.AuthFilePath = path
+	}
+
+	// private CAs and client certificates
+	sys.DockerCertPath = options.sideCertDir(side)
+
+	// mirrors, aliases and search registries
+	sys.SystemRegistriesConfPath = options.RegistriesConf
+
+	// the docker-daemon transport of both sides, containers/image ignores
+	// DOCKER_HOST
+	socket := options.DockerSocket
+	if socket == "" {
+		socket = os.Getenv("DOCKER_HOST")
+	}
+	if socket != "" {
+		if !strings.Contains(socket, "://") {
+			socket = "unix://" + socket
+		}
+		sys.DockerDaemonHost = socket
+	}
+
+	return sys
+}
@@ -0,0 +1,116 @@
+package imagesync
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// validTag is the format of a tag in the OCI distribution spec.
+var validTag = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9._-]{0,127}$`)
+
+// tagRewrite is a single s/pattern/replacement/[g] rule, the replacement
+// refers to capture groups as $1 or ${name}.
+type tagRewrite struct {
+	re          *regexp.Regexp
+	replacement string
+	global      bool
+}
+
+// tagRewriter renames destination tags, the rules are applied in order to
+// every tag. Tags not matching any rule keep their name.
+type tagRewriter []tagRewrite
+
+func parseTagRewrites(rules []string) (tagRewriter, error) {
+	var rewriter tagRewriter
+	for _, rule := range rules {
+		rewrite, err := parseTagRewrite(rule)
+		if err != nil {
+			return nil, err
+		}
+		rewriter = append(rewriter, rewrite)
+	}
+	return rewriter, nil
+}
+
+// parseTagRewrite parses a sed style substitution, any character following
+// the s is the delimiter and can be escaped with a backslash.
+func parseTagRewrite(rule string) (tagRewrite, error) {
+	if len(rule) < 2 || rule[0] != 's' {
+		return tagRewrite{}, fmt.Errorf("invalid tag rewrite %q, expected s/pattern/replacement/", rule)
+	}
+	delim := rule[1]
+	var (
+		parts []string
+		part  strings.Builder
+	)
+	for i := 2; i < len(rule); i++ {
+		switch {
+		case rule[i] == '\\' && i+1 < len(rule) && rule[i+1] == delim:
+			part.WriteByte(delim)
+			i++
+		case rule[i] == delim:
+			parts = append(parts, part.String())
+			part.Reset()
+		default:
+			part.WriteByte(rule[i])
+		}
+	}
+	parts = append(parts, part.String())
+	if len(parts) != 3 || (parts[2] != "" && parts[2] != "g") {
+		return tagRewrite{}, fmt.Errorf("invalid tag rewrite %q, expected s/pattern/replacement/ with optional g flag", rule)
+	}
+	re, err := regexp.Compile(parts[0])
+	if err != nil {
+		return tagRewrite{}, fmt.Errorf("invalid tag rewrite %q: %w", rule, err)
+	}
+	return tagRewrite{re: re, replacement: parts[1], global: parts[2] == "g"}, nil
+}
+
+// rewrite returns the destination tag of tag.
+func (t tagRewriter) rewrite(tag string) string {
+	for _, rule := range t {
+		if rule.global {
+			tag = rule.re.ReplaceAllString(tag, rule.replacement)
+			continue
+		}
+		match := rule.re.FindStringSubmatchIndex(tag)
+		if match == nil {
+			continue
+		}
+		expanded := rule.re.ExpandString(nil, rule.replacement, tag, match)
+		tag = tag[:match[0]] + string(expanded) + tag[match[1]:]
+	}
+	return tag
+}
+
+// check verifies that tags are rewritten to valid and distinct tags.
+func (t tagRewriter) check(tags []string) error {
+	if t == nil {
+		return nil
+	}
+	seen := make(map[string]string, len(tags))
+	for _, tag := range tags {
+		rewritten := t.rewrite(tag)
+		if !validTag.MatchString(rewritten) {
+			return fmt.Errorf("tag %s is rewritten to the invalid tag %q", tag, rewritten)
+		}
+		if other, ok := seen[rewritten]; ok {
+			return fmt.Errorf("tags %s and %s are both rewritten to %s", other, tag, rewritten)
+		}
+		seen[rewritten] = tag
+	}
+	return nil
+}
+
+// rewriteAll returns the destination tags of tags.
+func (t tagRewriter) rewriteAll(tags []string) []string {
+	if t == nil {
+		return tags
+	}
+	rewritten := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		rewritten = append(rewritten, t.rewrite(tag))
+	}
+	return rewritten
+}
@@ -0,0 +1,133 @@
+package imagesync
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/containers/image/v5/types"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates the spans of the syncs with the global tracer provider,
+// programs using the library install their own. Without one spans aren't
+// recorded.
+var tracer = otel.Tracer("github.com/trim21/imagesync")
+
+// startTracing exports the spans to the OTLP/HTTP collector at
+// --otel-endpoint and returns a function flushing them.
+func startTracing(c *cli.Context) (func(), error) {
+	endpoint := c.String("otel-endpoint")
+	if endpoint == "" {
+		return func() {}, nil
+	}
+	// the exporter ignores an invalid URL
+	if u, err := url.Parse(endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("--otel-endpoint %q isn't an http(s):// URL", endpoint)
+	}
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, fmt.Errorf("--otel-endpoint: %w", err)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "imagesync"))),
+	)
+	otel.SetTracerProvider(provider)
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := provider.Shutdown(ctx); err != nil {
+			logrus.Warnf("failed exporting traces: %s", err)
+		}
+	}, nil
+}
+
+// endSpan ends span with the outcome err.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// traceBlobs records a span for every blob read from the source of ref if
+// ctx is traced. The wrapper hides the optional interfaces of the source,
+// it isn't used otherwise.
+func traceBlobs(ctx context.Context, ref types.ImageReference) types.ImageReference {
+	if !trace.SpanFromContext(ctx).IsRecording() {
+		return ref
+	}
+	return &tracedReference{ImageReference: ref}
+}
+
+type tracedReference struct {
+	types.ImageReference
+}
+
+func (r *tracedReference) NewImageSource(ctx context.Context, sys *types.SystemContext) (types.ImageSource, error) {
+	src, err := r.ImageReference.NewImageSource(ctx, sys)
+	if err != nil {
+		return nil, err
+	}
+	return &tracedSource{ImageSource: src, ref: r}, nil
+}
+
+type tracedSource struct {
+	types.ImageSource
+	ref *tracedReference
+}
+
+func (s *tracedSource) Reference() types.ImageReference {
+	return s.ref
+}
+
+// GetBlob starts a span which ends when the blob is closed, it covers the
+// transfer of the blob to the destinations.
+func (s *tracedSource) GetBlob(ctx context.Context, info types.BlobInfo, cache types.BlobInfoCache) (io.ReadCloser, int64, error) {
+	ctx, span := tracer.Start(ctx, "blob", trace.WithAttributes(
+		attribute.String("imagesync.blob.digest", info.Digest.String()),
+		attribute.String("imagesync.blob.media_type", info.MediaType),
+	))
+	rc, size, err := s.ImageSource.GetBlob(ctx, info, cache)
+	if err != nil {
+		endSpan(span, err)
+		return nil, 0, err
+	}
+	span.SetAttributes(attribute.Int64("imagesync.blob.size", size))
+	return &tracedReadCloser{ReadCloser: rc, span: span}, size, nil
+}
+
+type tracedReadCloser struct {
+	io.ReadCloser
+	span  trace.Span
+	read  int64
+	close sync.Once
+}
+
+func (r *tracedReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.read += int64(n)
+	return n, err
+}
+
+func (r *tracedReadCloser) Close() error {
+	err := r.ReadCloser.Close()
+	r.close.Do(func() {
+		r.span.SetAttributes(attribute.Int64("imagesync.blob.read_bytes", r.read))
+		r.span.End()
+	})
+	return err
+}
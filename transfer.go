@@ -0,0 +1,139 @@
+package imagesync
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+)
+
+// transferred is the outcome of copying a single image.
+type transferred struct {
+	// manifest is the manifest written to the destination, in dry-run mode
+	// the manifest of the source.
+	manifest     []byte
+	sourceDigest digest.Digest
+	// bytes is the number of blob bytes copied, blobs which exist in the
+	// destination aren't counted but their size is added to reusedBytes.
+	bytes       int64
+	reusedBytes int64
+	duration    time.Duration
+}
+
+// countBytes returns a progress channel for copy.Options and a function
+// which must be called once the copy is done and returns the copied bytes
+// and the size of the layers which already existed in the destination.
+// Every event is passed on to observe as well.
+func countBytes(observe func(types.ProgressProperties)) (chan types.ProgressProperties, func() (int64, int64)) {
+	progress := make(chan types.ProgressProperties)
+	var (
+		wg             sync.WaitGroup
+		copied, reused int64
+	)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for p := range progress {
+			observe(p)
+			switch p.Event {
+			case types.ProgressEventRead, types.ProgressEventDone:
+				copied += int64(p.OffsetUpdate)
+			case types.ProgressEventSkipped:
+				reused += max(p.Artifact.Size, 0)
+			}
+		}
+	}()
+	return progress, func() (int64, int64) {
+		close(progress)
+		wg.Wait()
+		return copied, reused
+	}
+}
+
+// recordSourceDigest returns the reference to copy instead of ref and a
+// function returning the digest of the top-level source manifest once it was
+// read. The digest of registry images is requested up front, wrapping their
+// source would hide sigstore signatures from the copy. The request takes a
+// connection slot of limiter.
+func recordSourceDigest(ctx context.Context, sys *types.SystemContext, ref types.ImageReference, limiter *connLimiter) (types.ImageReference, func() digest.Digest) {
+	if ref.Transport().Name() == docker.Transport.Name() {
+		var dgst digest.Digest
+		release, err := limiter.acquireFor(ctx, ref)
+		if err == nil {
+			dgst, err = docker.GetDigest(ctx, sys, ref)
+			release()
+		}
+		if err != nil {
+			logrus.Debugf("failed getting digest of %s: %s", refName(ref), err)
+		}
+		return ref, func() digest.Digest { return dgst }
+	}
+	recorder := &digestReference{ImageReference: ref}
+	return recorder, recorder.manifestDigest
+}
+
+// checkPreservedDigest fails if the copied manifest doesn't have the source
+// digest. Unknown source digests aren't checked.
+func checkPreservedDigest(manifestBlob []byte, sourceDigest digest.Digest) error {
+	if sourceDigest == "" {
+		return nil
+	}
+	dgst, err := manifest.Digest(manifestBlob)
+	if err != nil {
+		return err
+	}
+	if dgst != sourceDigest {
+		return fmt.Errorf("the copied manifest has the digest %s instead of the source digest %s", dgst, sourceDigest)
+	}
+	return nil
+}
+
+// digestReference records the digest of the top-level manifest read from
+// the source, before it is modified by e.g. platform selection.
+type digestReference struct {
+	types.ImageReference
+
+	mu     sync.Mutex
+	digest digest.Digest
+}
+
+func (r *digestReference) NewImageSource(ctx context.Context, sys *types.SystemContext) (types.ImageSource, error) {
+	src, err := r.ImageReference.NewImageSource(ctx, sys)
+	if err != nil {
+		return nil, err
+	}
+	return &digestSource{ImageSource: src, ref: r}, nil
+}
+
+func (r *digestReference) manifestDigest() digest.Digest {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.digest
+}
+
+type digestSource struct {
+	types.ImageSource
+	ref *digestReference
+}
+
+func (s *digestSource) Reference() types.ImageReference {
+	return s.ref
+}
+
+func (s *digestSource) GetManifest(ctx context.Context, instanceDigest *digest.Digest) ([]byte, string, error) {
+	manifestBlob, mimeType, err := s.ImageSource.GetManifest(ctx, instanceDigest)
+	if err == nil && instanceDigest == nil {
+		if dgst, err := manifest.Digest(manifestBlob); err == nil {
+			s.ref.mu.Lock()
+			s.ref.digest = dgst
+			s.ref.mu.Unlock()
+		}
+	}
+	return manifestBlob, mimeType, err
+}
@@ -0,0 +1,191 @@
+package imagesync
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/containers/image/v5/types"
+	vault "github.com/hashicorp/vault/api"
+	"github.com/sirupsen/logrus"
+)
+
+// parseCredentials parses --src-creds and --dest-creds, user:password or
+// vault:<path>[#field] read from Vault. Empty returns nil.
+func parseCredentials(ctx context.Context, flag, value string, v *vaultSession) (*types.DockerAuthConfig, error) {
+	if value == "" {
+		return nil, nil
+	}
+	if ref, ok := strings.CutPrefix(value, "vault:"); ok {
+		auth, err := v.credentials(ctx, ref)
+		if err != nil {
+			return nil, fmt.Errorf("--%s: %w", flag, err)
+		}
+		return auth, nil
+	}
+	user, password, ok := strings.Cut(value, ":")
+	if !ok || user == "" {
+		return nil, fmt.Errorf("--%s: expected user:password or vault:<path>#<field>", flag)
+	}
+	return &types.DockerAuthConfig{Username: user, Password: password}, nil
+}
+
+// vaultSession reads registry credentials from HashiCorp Vault. It logs in
+// with the token of VAULT_TOKEN or ~/.vault-token, or with the AppRole of
+// --vault-role-id, and renews its token in the background so long running
+// watch and serve processes keep their login.
+type vaultSession struct {
+	roleID       string
+	secretIDFile string
+
+	mu     sync.Mutex
+	client *vault.Client
+}
+
+func newVaultSession(options Options) *vaultSession {
+	return &vaultSession{roleID: options.VaultRoleID, secretIDFile: options.VaultSecretIDFile}
+}
+
+// login returns the logged in client, it logs in again once the token
+// couldn't be renewed anymore.
+func (v *vaultSession) login(ctx context.Context) (*vault.Client, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.client != nil {
+		return v.client, nil
+	}
+	// VAULT_ADDR, VAULT_CACERT and the other variables of the vault CLI
+	client, err := vault.NewClient(vault.DefaultConfig())
+	if err != nil {
+		return nil, fmt.Errorf("creating Vault client: %w", err)
+	}
+
+	var login *vault.Secret
+	switch {
+	case v.roleID != "":
+		if v.secretIDFile == "" {
+			return nil, errors.New("--vault-role-id needs --vault-secret-id-file")
+		}
+		secretID, err := os.ReadFile(v.secretIDFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading Vault secret id: %w", err)
+		}
+		login, err = client.Logical().WriteWithContext(ctx, "auth/approle/login", map[string]any{
+			"role_id":   v.roleID,
+			"secret_id": strings.TrimSpace(string(secretID)),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("logging in to Vault with AppRole: %w", err)
+		}
+		if login == nil || login.Auth == nil {
+			return nil, errors.New("logging in to Vault with AppRole: no token returned")
+		}
+		client.SetToken(login.Auth.ClientToken)
+	default:
+		if client.Token() == "" {
+			// the token stored by vault login
+			if home, err := os.UserHomeDir(); err == nil {
+				if token, err := os.ReadFile(filepath.Join(home, ".vault-token")); err == nil {
+					client.SetToken(strings.TrimSpace(string(token)))
+				}
+			}
+		}
+		if client.Token() == "" {
+			return nil, errors.New("no Vault token, set VAULT_TOKEN, log in with vault login or use --vault-role-id")
+		}
+		// root and other tokens without TTL can't be renewed
+		if login, err = client.Auth().Token().RenewSelfWithContext(ctx, 0); err != nil {
+			logrus.Debugf("not renewing the Vault token: %s", err)
+		}
+	}
+	if login != nil && login.Auth != nil && login.Auth.Renewable {
+		v.renew(client, login)
+	}
+	v.client = client
+	return client, nil
+}
+
+// renew keeps the token of login alive, once it expires the next read logs
+// in again.
+func (v *vaultSession) renew(client *vault.Client, login *vault.Secret) {
+	watcher, err := client.NewLifetimeWatcher(&vault.LifetimeWatcherInput{Secret: login})
+	if err != nil {
+		logrus.Warnf("not renewing the Vault token: %s", err)
+		return
+	}
+	go watcher.Start()
+	go func() {
+		defer watcher.Stop()
+		for {
+			select {
+			case err := <-watcher.DoneCh():
+				if err != nil {
+					logrus.Warnf("failed renewing the Vault token: %s", err)
+				} else {
+					logrus.Debug("the Vault token reached its maximum TTL")
+				}
+				v.mu.Lock()
+				if v.client == client {
+					v.client = nil
+				}
+				v.mu.Unlock()
+				return
+			case <-watcher.RenewCh():
+				logrus.Debug("renewed the Vault token")
+			}
+		}
+	}()
+}
+
+// credentials reads the credentials of ref, the path of a KV secret with
+// the field holding user:password or the base64 auth of an auth file.
+// Without field the secret has a username and a password.
+func (v *vaultSession) credentials(ctx context.Context, ref string) (*types.DockerAuthConfig, error) {
+	path, field, _ := strings.Cut(ref, "#")
+	client, err := v.login(ctx)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := client.Logical().ReadWithContext(ctx, path)
+	if err != nil {
+		return nil, fmt.Errorf("reading Vault secret %s: %w", path, err)
+	}
+	if secret == nil || secret.Data == nil {
+		return nil, fmt.Errorf("secret %s doesn't exist in Vault", path)
+	}
+	data := secret.Data
+	// KV version 2 nests the fields
+	if nested, ok := data["data"].(map[string]any); ok && data["metadata"] != nil {
+		data = nested
+	}
+
+	if field == "" {
+		user, _ := data["username"].(string)
+		password, _ := data["password"].(string)
+		if user == "" {
+			return nil, fmt.Errorf("secret %s has no username, select a field with #", path)
+		}
+		return &types.DockerAuthConfig{Username: user, Password: password}, nil
+	}
+	value, ok := data[field].(string)
+	if !ok {
+		return nil, fmt.Errorf("secret %s has no field %s", path, field)
+	}
+	if !strings.Contains(value, ":") {
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("field %s of secret %s is neither user:password nor base64", field, path)
+		}
+		value = string(decoded)
+	}
+	user, password, ok := strings.Cut(value, ":")
+	if !ok || user == "" {
+		return nil, fmt.Errorf("field %s of secret %s isn't user:password", field, path)
+	}
+	return &types.DockerAuthConfig{Username: user, Password: password}, nil
+}
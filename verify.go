@@ -0,0 +1,84 @@
+package imagesync
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/containers/image/v5/copy"
+	"github.com/containers/image/v5/signature"
+	"github.com/sirupsen/logrus"
+)
+
+// verification is the signature policy source images must satisfy, a nil
+// verification accepts every image.
+type verification struct {
+	policy *signature.Policy
+	// registriesDir is a registries.d directory enabling sigstore
+	// attachments, set to read cosign signatures.
+	registriesDir string
+}
+
+func newVerification(opts Options) (*verification, error) {
+	switch {
+	case opts.VerifyPolicy != "" && opts.VerifyCosignPubkey != "":
+		return nil, errors.New("--verify-policy and --verify-cosign-pubkey can't be used together")
+	case opts.VerifyPolicy != "":
+		policy, err := signature.NewPolicyFromFile(opts.VerifyPolicy)
+		if err != nil {
+			return nil, fmt.Errorf("reading verify policy: %w", err)
+		}
+		return &verification{policy: policy}, nil
+	case opts.VerifyCosignPubkey != "":
+		// the wrapped sources of these options only pass simple signing signatures
+		if opts.Platforms != "" || opts.MaxConnectionsPerRegistry > 0 || opts.MaxBandwidth != "" || opts.MaxBandwidthPerTag != "" {
+			return nil, errors.New("--verify-cosign-pubkey can't be used together with --platforms, --max-connections-per-registry or --max-bandwidth*")
+		}
+		if _, err := os.Stat(opts.VerifyCosignPubkey); err != nil {
+			return nil, fmt.Errorf("reading cosign public key: %w", err)
+		}
+		req, err := signature.NewPRSigstoreSignedKeyPath(opts.VerifyCosignPubkey, signature.NewPRMMatchRepoDigestOrExact())
+		if err != nil {
+			return nil, fmt.Errorf("creating verify policy: %w", err)
+		}
+		dir, err := newSigstoreRegistriesDir()
+		if err != nil {
+			return nil, err
+		}
+		return &verification{
+			policy:        &signature.Policy{Default: []signature.PolicyRequirement{req}},
+			registriesDir: dir,
+		}, nil
+	}
+	return nil, nil
+}
+
+// apply makes opts read the cosign signatures of the source, which are then
+// also copied to the destination.
+func (v *verification) apply(opts *copy.Options) {
+	if v == nil || v.registriesDir == "" {
+		return
+	}
+	opts.SourceCtx.RegistriesDirPath = v.registriesDir
+	opts.DestinationCtx.RegistriesDirPath = v.registriesDir
+}
+
+// newPolicyContext returns a new policy context, they can't be used by
+// concurrent copies.
+func (v *verification) newPolicyContext() (*signature.PolicyContext, error) {
+	if v == nil {
+		return signature.NewPolicyContext(&signature.Policy{
+			Default: []signature.PolicyRequirement{signature.NewPRInsecureAcceptAnything()},
+		})
+	}
+	return signature.NewPolicyContext(v.policy)
+}
+
+func (v *verification) close() {
+	if v == nil || v.registriesDir == "" {
+		return
+	}
+	if err := os.RemoveAll(v.registriesDir); err != nil {
+		logrus.Warnf("failed removing %s: %s", v.registriesDir, err)
+	}
+}
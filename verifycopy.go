@@ -0,0 +1,151 @@
+package imagesync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand/v2"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/pkg/blobinfocache/none"
+	"github.com/containers/image/v5/types"
+	"github.com/sirupsen/logrus"
+)
+
+// verifyCopies reads the manifests of the registry destinations of a copy
+// back and compares them with the written manifestBlob, with
+// --verify-layers a sample of their layers is downloaded and checked
+// against the layer digests as well. Proxies and caches in front of a
+// registry have been seen rewriting manifests.
+func (r *syncRun) verifyCopies(ctx context.Context, destRefs []types.ImageReference, manifestBlob []byte) error {
+	if !r.options.VerifyAfterCopy || r.options.DryRun || r.export != nil {
+		return nil
+	}
+	opts := r.opts
+	if err := r.refreshGoogle(&opts); err != nil {
+		return err
+	}
+	var errs []error
+	for _, destRef := range destRefs {
+		// other destinations are written locally
+		if destRef.Transport().Name() != docker.Transport.Name() {
+			continue
+		}
+		if err := r.verifyCopy(ctx, destRef, opts.DestinationCtx, manifestBlob); err != nil {
+			errs = append(errs, fmt.Errorf("verifying %s: %w", refName(destRef), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (r *syncRun) verifyCopy(ctx context.Context, destRef types.ImageReference, sys *types.SystemContext, manifestBlob []byte) error {
+	src, err := r.limits.dest.wrap(destRef).NewImageSource(ctx, sys)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	blob, mimeType, err := src.GetManifest(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("reading manifest: %w", err)
+	}
+	want, err := manifest.Digest(manifestBlob)
+	if err != nil {
+		return err
+	}
+	got, err := manifest.Digest(blob)
+	if err != nil {
+		return err
+	}
+	if got != want {
+		return fmt.Errorf("the destination returned manifest %s instead of the copied %s", got, want)
+	}
+	wantType := manifest.NormalizedMIMEType(manifest.GuessMIMEType(manifestBlob))
+	if mimeType = manifest.NormalizedMIMEType(mimeType); mimeType != wantType {
+		return fmt.Errorf("the destination returned media type %s instead of %s", mimeType, wantType)
+	}
+	if r.options.VerifyLayers <= 0 {
+		return nil
+	}
+
+	layers, err := manifestLayers(ctx, src, blob, mimeType)
+	if err != nil {
+		return err
+	}
+	n := int(math.Ceil(r.options.VerifyLayers * float64(len(layers))))
+	for _, i := range rand.Perm(len(layers))[:n] {
+		if err = verifyBlob(ctx, src, layers[i]); err != nil {
+			return fmt.Errorf("layer %s: %w", layers[i].Digest, err)
+		}
+	}
+	logrus.Debugf("Verified %s and %d of its %d layers", refName(destRef), n, len(layers))
+	return nil
+}
+
+// manifestLayers returns the layers of the manifest, for an index those of
+// its instances copied to src.
+func manifestLayers(ctx context.Context, src types.ImageSource, blob []byte, mimeType string) ([]types.BlobInfo, error) {
+	if !manifest.MIMETypeIsMultiImage(mimeType) {
+		m, err := manifest.FromBlob(blob, mimeType)
+		if err != nil {
+			return nil, fmt.Errorf("parsing manifest: %w", err)
+		}
+		return layerBlobs(m), nil
+	}
+	list, err := manifest.ListFromBlob(blob, mimeType)
+	if err != nil {
+		return nil, fmt.Errorf("parsing index: %w", err)
+	}
+	var layers []types.BlobInfo
+	for _, instance := range list.Instances() {
+		instanceBlob, instanceType, err := src.GetManifest(ctx, &instance)
+		if err != nil {
+			// the instances of platforms which weren't copied
+			logrus.Debugf("not verifying instance %s: %s", instance, err)
+			continue
+		}
+		if manifest.MIMETypeIsMultiImage(instanceType) {
+			continue
+		}
+		m, err := manifest.FromBlob(instanceBlob, instanceType)
+		if err != nil {
+			return nil, fmt.Errorf("parsing manifest %s: %w", instance, err)
+		}
+		layers = append(layers, layerBlobs(m)...)
+	}
+	return layers, nil
+}
+
+func layerBlobs(m manifest.Manifest) []types.BlobInfo {
+	var blobs []types.BlobInfo
+	for _, layer := range m.LayerInfos() {
+		blobs = append(blobs, layer.BlobInfo)
+	}
+	return blobs
+}
+
+// verifyBlob downloads a blob and checks its digest and size.
+func verifyBlob(ctx context.Context, src types.ImageSource, info types.BlobInfo) error {
+	if err := info.Digest.Validate(); err != nil {
+		return err
+	}
+	rc, _, err := src.GetBlob(ctx, info, none.NoCache)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	digester := info.Digest.Algorithm().Digester()
+	size, err := io.Copy(digester.Hash(), rc)
+	if err != nil {
+		return err
+	}
+	if got := digester.Digest(); got != info.Digest {
+		return fmt.Errorf("the destination returned a blob with digest %s", got)
+	}
+	if info.Size > 0 && size != info.Size {
+		return fmt.Errorf("the destination returned %d bytes instead of %d", size, info.Size)
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package imagesync
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+// watchImages repeats the sync every --interval until SIGINT or SIGTERM.
+// Failing iterations are logged and retried with the next one. A signal
+// cancels the running sync and stops watching without an error.
+func watchImages(c *cli.Context, syncer *Syncer) error {
+	interval := c.Duration("interval")
+	if interval <= 0 {
+		return errors.New("--interval must be positive")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	for iteration := 1; ; iteration++ {
+		logrus.Infof("Starting sync iteration %d", iteration)
+		started := time.Now()
+		err := syncOnce(ctx, c, syncer)
+		if ctx.Err() != nil {
+			break
+		}
+		if err != nil {
+			logrus.Errorf("sync iteration %d failed: %s", iteration, err)
+		}
+		logrus.Infof("Sync iteration %d finished in %s, next sync in %s", iteration, time.Since(started).Round(time.Second), interval)
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(interval):
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	logrus.Info("Received shutdown signal, stopped watching.")
+	return nil
+}
@@ -0,0 +1,155 @@
+package imagesync
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/containers/image/v5/docker/reference"
+)
+
+// pushEvent is a push of tags to a registry repository, Repository is the
+// normalized name like docker.io/library/alpine.
+type pushEvent struct {
+	Repository string
+	Tags       []string
+}
+
+// webhookPayload has the fields of the Harbor, Docker Hub and Quay push
+// webhooks. The repository of Docker Hub is an object, that of Quay a
+// string.
+type webhookPayload struct {
+	// Harbor
+	Type      string `json:"type"`
+	EventData *struct {
+		Resources []struct {
+			Tag         string `json:"tag"`
+			ResourceURL string `json:"resource_url"`
+		} `json:"resources"`
+	} `json:"event_data"`
+	// Docker Hub
+	PushData *struct {
+		Tag string `json:"tag"`
+	} `json:"push_data"`
+	Repository json.RawMessage `json:"repository"`
+	// Quay
+	DockerURL   string   `json:"docker_url"`
+	UpdatedTags []string `json:"updated_tags"`
+}
+
+var errUnsupportedWebhook = errors.New("unsupported webhook payload, expected a Harbor, Docker Hub or Quay push")
+
+// parseWebhook returns the pushes of a webhook body. Events which aren't
+// pushes of tags, like Harbor scans or pushes by digest, return none.
+func parseWebhook(body []byte) ([]pushEvent, error) {
+	var p webhookPayload
+	if err := json.Unmarshal(body, &p); err != nil {
+		return nil, fmt.Errorf("parsing webhook: %w", err)
+	}
+	switch {
+	case p.EventData != nil:
+		return harborPushes(p)
+	case p.PushData != nil:
+		var repo struct {
+			RepoName string `json:"repo_name"`
+		}
+		if err := json.Unmarshal(p.Repository, &repo); err != nil || repo.RepoName == "" {
+			return nil, errors.New("docker hub webhook without repository.repo_name")
+		}
+		return newPushEvents(repo.RepoName, []string{p.PushData.Tag})
+	case p.DockerURL != "":
+		return newPushEvents(p.DockerURL, p.UpdatedTags)
+	default:
+		return nil, errUnsupportedWebhook
+	}
+}
+
+// harborPushes groups the pushed artifacts by repository, the resource URL
+// names the registry by the external URL of Harbor.
+func harborPushes(p webhookPayload) ([]pushEvent, error) {
+	if p.Type != "PUSH_ARTIFACT" {
+		return nil, nil
+	}
+	var pushes []pushEvent
+	for _, r := range p.EventData.Resources {
+		named, err := reference.ParseNormalizedNamed(r.ResourceURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid harbor resource_url %q: %w", r.ResourceURL, err)
+		}
+		events, err := newPushEvents(named.Name(), []string{r.Tag})
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range events {
+			i := slices.IndexFunc(pushes, func(p pushEvent) bool { return p.Repository == e.Repository })
+			if i < 0 {
+				pushes = append(pushes, e)
+			} else if !slices.Contains(pushes[i].Tags, e.Tags[0]) {
+				pushes[i].Tags = append(pushes[i].Tags, e.Tags[0])
+			}
+		}
+	}
+	return pushes, nil
+}
+
+// newPushEvents returns the push of the non-empty tags to repository, none
+// if no tag was pushed.
+func newPushEvents(repository string, tags []string) ([]pushEvent, error) {
+	named, err := reference.ParseNormalizedNamed(repository)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pushed repository %q: %w", repository, err)
+	}
+	tags = slices.DeleteFunc(slices.Clone(tags), func(tag string) bool { return tag == "" })
+	if len(tags) == 0 {
+		return nil, nil
+	}
+	return []pushEvent{{Repository: named.Name(), Tags: tags}}, nil
+}
+
+// pushedJobs returns the jobs syncing a tag of Options.PushedTags from the
+// registry repository Options.PushedRepository. Repository jobs copy only
+// the pushed tags their filters select, the tags may have been moved so
+// their digests are compared. Pruning is left to full syncs.
+func pushedJobs(options Options, jobs []syncJob) []syncJob {
+	var pushed []syncJob
+	for _, job := range jobs {
+		src, err := detectSource(job.Source, job.SrcFormat, options.LegacySourceDetection)
+		if err != nil || src.kind != sourceRegistry {
+			continue
+		}
+		named, err := reference.ParseNormalizedNamed(src.value)
+		if err != nil || named.Name() != options.PushedRepository {
+			continue
+		}
+		if _, ok := named.(reference.Digested); ok {
+			continue
+		}
+		if tagged, ok := named.(reference.Tagged); ok {
+			if slices.Contains(options.PushedTags, tagged.Tag()) {
+				pushed = append(pushed, job)
+			}
+			continue
+		}
+		tags := options.PushedTags
+		if job.KeepLatestN > 0 {
+			// the pushed tag may not be one of the newest
+			tags = job.Tags
+		} else if job.Tags != nil {
+			tags = slices.DeleteFunc(slices.Clone(tags), func(tag string) bool { return !slices.Contains(job.Tags, tag) })
+			if len(tags) == 0 {
+				continue
+			}
+		}
+		job.Tags = tags
+		// converted manifests can't be compared with the source
+		if options.Format != "" || options.Compression != "" {
+			job.Overwrite = true
+		} else {
+			job.CompareDigests = true
+		}
+		job.Prune = false
+		pushed = append(pushed, job)
+	}
+	return pushed
+}